@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	getopt "github.com/timtadh/getopt"
+)
+
+const (
+	// agentLabel names the launchd job installed by install-agent.
+	agentLabel = "com.github.rollcat.upmerge"
+	// agentDir is where install-agent puts its property list.
+	agentDir = "/Library/LaunchDaemons"
+	// defaultAgentInterval is how often the agent runs, without --every.
+	defaultAgentInterval = time.Hour
+)
+
+// runEvery merges everything, and then again every so often (give or take a tenth,
+// so that many hosts don't all run at once), until stop is done. A run in progress
+// is finished first.
+func runEvery(stop context.Context, hooks bool) error {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for n := 1; ; n++ {
+		// Each run gets the whole timeout, and isn't interrupted.
+		ctx, cancel := context.Background(), context.CancelFunc(func() {})
+		if timeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+		}
+		actions := runCycle(ctx, nil, hooks)
+		cancel()
+		if stop.Err() != nil {
+			return nil
+		}
+		wait := every - every/10 + time.Duration(rng.Int63n(int64(every/5)+1))
+		logInfo("CYCLE:\t%d (%d changes), next in %s", n, countChanges(actions),
+			wait.Round(time.Second))
+		select {
+		case <-stop.Done():
+			return nil
+		case <-time.After(wait):
+		}
+	}
+}
+
+// agentPath returns the path of the property list installed by install-agent.
+func agentPath() string {
+	return filepath.Join(agentDir, agentLabel+".plist")
+}
+
+// agentArgs returns the command line for the agent: this program, with the flags in
+// opts, except for those that only make sense here.
+func agentArgs(opts []getopt.OptArg) ([]string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	args := []string{exe}
+	for _, opt := range opts {
+		switch opt.Opt() {
+		case "-n", "--dry-run", "-i", "--interactive", "--every", "--bootstrap", "--watch":
+			continue
+		}
+		args = append(args, opt.Opt())
+		if takesArg(opt.Opt()) {
+			args = append(args, opt.Arg())
+		}
+	}
+	return args, nil
+}
+
+// takesArg returns true if the flag named opt takes an argument.
+func takesArg(opt string) bool {
+	if strings.HasPrefix(opt, "--") {
+		for _, name := range longOpts {
+			if name == opt[2:]+"=" {
+				return true
+			}
+		}
+		return false
+	}
+	return strings.Contains(shortOpts, opt[1:]+":")
+}
+
+// writeAgent writes the property list of a launchd job that runs args every interval,
+// from dir.
+func writeAgent(w io.Writer, args []string, dir string, interval time.Duration) {
+	str := func(s string) string {
+		var b strings.Builder
+		xml.EscapeText(&b, []byte(s))
+		return "<string>" + b.String() + "</string>"
+	}
+	fmt.Fprintf(w, "%s", `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+`)
+	fmt.Fprintf(w, "\t<key>Label</key>\n\t%s\n", str(agentLabel))
+	fmt.Fprintf(w, "\t<key>ProgramArguments</key>\n\t<array>\n")
+	for _, arg := range args {
+		fmt.Fprintf(w, "\t\t%s\n", str(arg))
+	}
+	fmt.Fprintf(w, "\t</array>\n")
+	fmt.Fprintf(w, "\t<key>WorkingDirectory</key>\n\t%s\n", str(dir))
+	fmt.Fprintf(w, "\t<key>StartInterval</key>\n\t<integer>%d</integer>\n", int64(interval/time.Second))
+	fmt.Fprintf(w, "\t<key>RunAtLoad</key>\n\t<true/>\n")
+	fmt.Fprintf(w, "</dict>\n</plist>\n")
+}
+
+// installAgent writes the property list of a launchd job that runs upmerge with the
+// flags in opts (every --every), and loads it with bootstrap. In a dry run, the
+// property list is only printed.
+func installAgent(opts []getopt.OptArg, bootstrap bool) error {
+	args, err := agentArgs(opts)
+	if err != nil {
+		return err
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	interval := every
+	if interval == 0 {
+		interval = defaultAgentInterval
+	}
+	if interval < time.Second {
+		return fmt.Errorf("interval too short: %s", interval)
+	}
+	if m.DryRun {
+		writeAgent(os.Stdout, args, dir, interval)
+		return nil
+	}
+	var b strings.Builder
+	writeAgent(&b, args, dir, interval)
+	path := agentPath()
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, []byte(b.String()), 0644); err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	logDebug("AGENT:\t%s", path)
+	if bootstrap {
+		return launchctl("bootstrap", "system", path)
+	}
+	return nil
+}
+
+// uninstallAgent removes the property list written by installAgent, after unloading
+// it with bootstrap.
+func uninstallAgent(bootstrap bool) error {
+	path := agentPath()
+	if m.DryRun {
+		logDebug("REMOVE:\t%s", path)
+		return nil
+	}
+	if bootstrap {
+		if err := launchctl("bootout", "system/"+agentLabel); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	logDebug("REMOVE:\t%s", path)
+	return nil
+}
+
+// launchctl runs launchctl with args.
+func launchctl(args ...string) error {
+	cmd := exec.Command("launchctl", args...)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("launchctl %s: %w", args[0], err)
+	}
+	return nil
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	getopt "github.com/timtadh/getopt"
+)
+
+// The system-wide config file.
+const systemConfigPath = "/etc/upmerge.conf"
+
+// defaultConfigPaths returns the config files read when -c isn't given, in order:
+// the user's settings override the system's.
+func defaultConfigPaths() []string {
+	paths := []string{systemConfigPath}
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			dir = filepath.Join(home, ".config")
+		}
+	}
+	if dir != "" {
+		paths = append(paths, filepath.Join(dir, "upmerge", "config"))
+	}
+	return paths
+}
+
+// configAliases are the settings named after short flags.
+var configAliases = map[string]string{
+	"src":         "-s",
+	"dest":        "-d",
+	"verbose":     "-v",
+	"quiet":       "-q",
+	"dry-run":     "-n",
+	"interactive": "-i",
+	"jobs":        "-P",
+}
+
+// configOpt is a setting from a config file, as if given as a flag.
+type configOpt struct {
+	opt, arg string
+}
+
+func (o configOpt) Opt() string { return o.opt }
+func (o configOpt) Arg() string { return o.arg }
+
+// configFlag returns the flag that sets key, and whether it takes a value.
+func configFlag(key string) (flag string, hasArg bool, ok bool) {
+	if flag, ok := configAliases[key]; ok {
+		return flag, strings.Contains(shortOpts, flag[1:]+":"), true
+	}
+	switch key {
+	case "config", "print-config", "help", "version":
+		// Only meaningful on the command line.
+		return "", false, false
+	}
+	for _, name := range longOpts {
+		if name == key {
+			return "--" + key, false, true
+		} else if name == key+"=" {
+			return "--" + key, true, true
+		}
+	}
+	return "", false, false
+}
+
+// readConfig reads the config file at name, returning its settings as flags. Each
+// line is a setting, "key = value", named after a long flag (or src, dest, verbose,
+// quiet, dry-run, interactive, or jobs); "_" may be used instead of "-". Flags that
+// don't take a value are set with "true" or "false", turning off what an earlier
+// config file turned on. Blank lines, and lines starting with "#", are skipped.
+func readConfig(name string) ([]getopt.OptArg, error) {
+	var opts []getopt.OptArg
+	err := readSettings(name, func(n int, key, value string) error {
+		key = strings.ReplaceAll(strings.ToLower(key), "_", "-")
+		flag, hasArg, ok := configFlag(key)
+		if !ok {
+			return fmt.Errorf("%s:%d: unknown setting %q", name, n, key)
+		}
+		if hasArg {
+			if value == "" {
+				return fmt.Errorf("%s:%d: %s needs a value", name, n, key)
+			}
+			opts = append(opts, configOpt{flag, value})
+			return nil
+		}
+		on, err := parseBool(value)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s must be true or false", name, n, key)
+		}
+		opts = append(opts, configOpt{flag, strconv.FormatBool(on)})
+		return nil
+	})
+	return opts, err
+}
+
+// readVars reads the variables given to templates from the file at name, in the
+// same "key = value" format as a config file. Keys are kept as they are.
+func readVars(name string) (map[string]string, error) {
+	vars := make(map[string]string)
+	err := readSettings(name, func(n int, key, value string) error {
+		vars[key] = value
+		return nil
+	})
+	return vars, err
+}
+
+// readSettings calls fn with the line number, key, and (unquoted) value of every
+// "key = value" line of the file at name, skipping blank lines and comments.
+func readSettings(name string, fn func(n int, key, value string) error) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			return fmt.Errorf("%s:%d: expected key = value", name, n)
+		}
+		value = strings.TrimSpace(value)
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+		if err = fn(n, strings.TrimSpace(key), value); err != nil {
+			return err
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+	return nil
+}
+
+// parseBool is strconv.ParseBool, also accepting yes and no.
+func parseBool(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	}
+	return strconv.ParseBool(s)
+}
+
+// writeConfig prints the effective settings to w, in the format of a config file.
+func writeConfig(w io.Writer) {
+	set := func(key string, value interface{}) {
+		// Leave out what's not set, so that the output can be read back.
+		switch v := value.(type) {
+		case string:
+			if v == "" {
+				fmt.Fprintf(w, "# %s =\n", key)
+				return
+			}
+		case time.Duration:
+			if v == 0 {
+				fmt.Fprintf(w, "# %s =\n", key)
+				return
+			}
+		}
+		fmt.Fprintf(w, "%s = %v\n", key, value)
+	}
+	jobs := m.Workers
+	if jobs < 1 {
+		jobs = 1
+	}
+	set("src", m.SrcDir)
+	for _, dir := range m.Layers {
+		set("src", dir)
+	}
+	set("dest", m.DestDir)
+	set("user", userMode)
+	set("root", rootDir)
+	set("relative-links", m.RelativeLinks)
+	for _, p := range pairs {
+		set("pair", p[0]+":"+p[1])
+	}
+	set("dry-run", dryRun)
+	set("check", check)
+	set("verbose", logLevel.Level() <= slog.LevelDebug)
+	set("quiet", quiet)
+	set("changed-only", changedOnly)
+	set("relative", relative)
+	set("color", colorMode)
+	set("log-format", logFormat)
+	set("log-file", logFile)
+	set("report", reportPath)
+	set("report-required", reportRequired)
+	set("metrics-file", metricsPath)
+	set("syslog", useSyslog)
+	set("json", jsonOut != nil)
+	set("print0", print0)
+	set("interactive", interactive)
+	set("force", m.Force)
+	set("jobs", jobs)
+	set("diff", m.Diff)
+	set("unified", m.DiffContext)
+	for _, pattern := range m.Include {
+		set("include", pattern)
+	}
+	for _, pattern := range m.Once {
+		set("once", pattern)
+	}
+	for _, pattern := range m.ForceFiles {
+		set("force-file", pattern)
+	}
+	for _, pattern := range m.KeyFiles {
+		set("merge-keys", pattern)
+	}
+	for _, pattern := range m.PlistFiles {
+		set("plist-merge", pattern)
+	}
+	for _, v := range m.Validators {
+		set("validate", v.Pattern+" "+strings.Join(v.Command, " "))
+	}
+	for _, h := range m.Hooks {
+		set("on-change", h.Pattern+" "+strings.Join(h.Command, " "))
+	}
+	set("pre-run", preRun)
+	set("post-run", postRun)
+	set("no-hooks", noHooks)
+	set("watch", watch)
+	set("every", every)
+	set("progress", progress)
+	set("clamp-mtime", clampMtime)
+	set("format", mtreeFormat)
+	for _, pattern := range m.Exclude {
+		set("exclude", pattern)
+	}
+	set("backup-suffix", m.BackupSuffix)
+	set("backup-dir", m.BackupDir)
+	if m.BackupRotate > 0 {
+		set("backup-rotate", m.BackupRotate)
+	} else {
+		set("backup-rotate", "")
+	}
+	set("no-backup", m.NoBackup)
+	set("prune-backups", prune)
+	set("clean-identical-backups", m.CleanIdenticalBackups)
+	set("resolve-type-conflicts", m.ResolveTypeConflicts)
+	set("keep-going", m.KeepGoing)
+	set("retries", m.Retries)
+	set("timeout", timeout)
+	set("cache", m.CachePath)
+	set("manifest", m.ManifestPath)
+	set("prune", m.Prune)
+	set("strict-drift", m.StrictDrift)
+	set("merge", m.Merge)
+	set("merge-tool", mergeTool)
+	set("merge-tool-timeout", m.MergeToolTimeout)
+	set("quick", m.Quick)
+	set("ignore-line-endings", m.IgnoreLineEndings)
+	set("ignore-trailing-space", m.IgnoreTrailingSpace)
+	set("copy-links", m.CopyLinks)
+	if m.MaxDepth > 0 {
+		set("max-depth", m.MaxDepth)
+	} else {
+		set("max-depth", "")
+	}
+	set("no-owner", m.NoOwner)
+	set("no-times", m.NoTimes)
+	set("no-clone", m.NoClone)
+	set("unsafe-follow", m.UnsafeFollow)
+	set("no-space-check", m.NoSpaceCheck)
+	set("space-margin", m.SpaceMargin)
+	set("no-dir-perms", m.NoDirPerms)
+	set("case-sensitive-dest", m.CaseSensitiveDest)
+	set("keep-quarantine", m.KeepQuarantine)
+	set("clear-flags", m.ClearFlags)
+	set("protected", m.Protected)
+	set("snapshot", m.Snapshot)
+	set("strict", m.Strict)
+	set("devices", m.Devices)
+	set("create-dest", m.CreateDest)
+	set("host-overlays", hostsDir)
+	set("hostname", hostname)
+	set("templates", m.Templates)
+	set("vars", varsPath)
+	names := make([]string, 0, len(m.CommentLeaders))
+	for name := range m.CommentLeaders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		set("comment-leader", name+"="+m.CommentLeaders[name])
+	}
+	set("lock", lockPath)
+	set("no-lock", noLock)
+	set("journal", journalDir)
+	set("journal-keep", m.JournalKeep)
+	set("no-journal", noJournal)
+	set("wait", waitLock)
+	set("allow-unprivileged", allowUnpriv)
+	set("sudo", useSudo)
+}
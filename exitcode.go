@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/rollcat/upmerge/merge"
+)
+
+// Exit statuses, as listed by help.
+const (
+	exitOK          = 0
+	exitUsage       = 1 // bad flags or settings
+	exitError       = 2 // anything else that failed, such as reading or writing a file
+	exitRefused     = 3 // a backup was in the way, or status, verify or lint found problems
+	exitPending     = 4 // with --check, there are changes to make, or backups differ
+	exitLocked      = 5 // another upmerge is running
+	exitInvalid     = 6 // only validators failed
+	exitTimeout     = 124
+	exitInterrupted = 130
+)
+
+// exitCode returns the exit status for err, the outcome of a run (or of what came
+// before it, such as taking the lock). It's looked for anywhere in a MultiError: an
+// interruption matters most, then a refusal; validators failing only count if that's
+// all that went wrong.
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	var locked errLocked
+	switch {
+	case errors.Is(err, context.Canceled):
+		return exitInterrupted
+	case errors.Is(err, context.DeadlineExceeded):
+		return exitTimeout
+	case errors.As(err, &locked):
+		return exitLocked
+	case errors.Is(err, merge.ErrRefuse):
+		return exitRefused
+	}
+	errs := merge.MultiError{err}
+	if me, ok := err.(merge.MultiError); ok {
+		errs = me
+	}
+	for _, err := range errs {
+		if !errors.Is(err, merge.ErrInvalid) {
+			return exitError
+		}
+	}
+	return exitInvalid
+}
@@ -1,5 +1,10 @@
 module github.com/rollcat/upmerge
 
-go 1.18
+go 1.21
 
-require github.com/timtadh/getopt v1.0.1
+require (
+	github.com/fsnotify/fsnotify v1.7.0
+	github.com/timtadh/getopt v1.0.1
+)
+
+require golang.org/x/sys v0.4.0 // indirect
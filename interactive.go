@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/rollcat/upmerge/merge"
+)
+
+var (
+	// tty is the controlling terminal, opened when running interactively. Prompts go
+	// there rather than to stdout, so redirecting the output doesn't hide them.
+	tty   *os.File
+	ttyIn *bufio.Reader
+)
+
+// openTTY opens the controlling terminal for interactive prompts.
+func openTTY() error {
+	var err error
+	tty, err = os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	ttyIn = bufio.NewReader(tty)
+	return nil
+}
+
+// resolveConflict asks the user what to do about destPath, which differs both from
+// srcPath and from its backup at backupPath. It's used as merge.Merger.Resolve.
+func resolveConflict(srcPath, destPath, backupPath string) (merge.Resolution, error) {
+	fmt.Fprintf(tty, "CONFLICT:\n")
+	fmt.Fprintf(tty, "    source:      %s\n", srcPath)
+	fmt.Fprintf(tty, "    destination: %s\n", destPath)
+	fmt.Fprintf(tty, "    backup:      %s\n", backupPath)
+	for {
+		fmt.Fprintf(tty, "(o)verwrite the backup, (s)kip this file, (d)iff, (q)uit? ")
+		line, err := ttyIn.ReadString('\n')
+		if err != nil {
+			return 0, err
+		}
+		switch strings.TrimSpace(line) {
+		case "o":
+			return merge.ResolveOverwrite, nil
+		case "s":
+			return merge.ResolveSkip, nil
+		case "q":
+			return 0, merge.ErrQuit
+		case "d":
+			for _, pair := range [][2]string{{backupPath, destPath}, {destPath, srcPath}} {
+				if _, err := os.Lstat(pair[0]); os.IsNotExist(err) {
+					// A changed file may not have a backup yet.
+					continue
+				}
+				diff, err := merge.DiffFiles(pair[0], pair[1], m.DiffContext)
+				if err != nil {
+					return 0, err
+				}
+				fmt.Fprint(tty, diff)
+			}
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// defaultLockPath is where the lock is taken when running as root.
+const defaultLockPath = "/var/run/upmerge.lock"
+
+// errLocked is returned by acquireLock when another upmerge holds the lock at path.
+type errLocked struct {
+	path string
+}
+
+func (e errLocked) Error() string {
+	return fmt.Sprintf("another upmerge is running (lock held on %s)", e.path)
+}
+
+// acquireLock takes an exclusive lock on the file at path, for as long as this process
+// runs; the lock is released by the system on exit, however that happens. Unless wait
+// is set, it fails right away with errLocked if another process holds the lock.
+// Otherwise, it waits until the lock is free, or ctx is done.
+func acquireLock(ctx context.Context, path string, wait bool) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	// The file is left open, to keep it locked.
+	for {
+		ok, err := tryLock(f)
+		if ok || err != nil {
+			return err
+		}
+		if !wait {
+			f.Close()
+			return errLocked{path}
+		}
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return fmt.Errorf("gave up waiting for another upmerge (lock held on %s): %w", path, ctx.Err())
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rollcat/upmerge/merge"
+)
+
+var (
+	// sideLogger logs to the --log-file and --syslog only, if either was given.
+	sideLogger *slog.Logger
+	logFiles   []*os.File
+	startTime  = time.Now()
+)
+
+// sideLevel is the level for the --log-file and --syslog: the same as on stderr, but
+// never above slog.LevelInfo, so that the start, end and summary of every run are
+// recorded.
+type sideLevel struct{}
+
+func (sideLevel) Level() slog.Level {
+	if level := logLevel.Level(); level < slog.LevelInfo {
+		return level
+	}
+	return slog.LevelInfo
+}
+
+// multiHandler is a slog.Handler logging every record to each of its handlers that's
+// enabled for it.
+type multiHandler []slog.Handler
+
+func (h multiHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, handler := range h {
+		if handler.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h multiHandler) Handle(ctx context.Context, r slog.Record) error {
+	var firstErr error
+	for _, handler := range h {
+		if !handler.Enabled(ctx, r.Level) {
+			continue
+		}
+		if err := handler.Handle(ctx, r.Clone()); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (h multiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make(multiHandler, len(h))
+	for i, handler := range h {
+		handlers[i] = handler.WithAttrs(attrs)
+	}
+	return handlers
+}
+
+func (h multiHandler) WithGroup(name string) slog.Handler {
+	handlers := make(multiHandler, len(h))
+	for i, handler := range h {
+		handlers[i] = handler.WithGroup(name)
+	}
+	return handlers
+}
+
+// openSideLogs opens the --log-file (appending to it) and the --syslog, and returns
+// their handlers.
+func openSideLogs() ([]slog.Handler, error) {
+	var handlers []slog.Handler
+	if logFile != "" {
+		f, err := os.OpenFile(logFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		logFiles = append(logFiles, f)
+		handlers = append(handlers, merge.NewTextHandler(f,
+			&merge.TextHandlerOptions{Level: sideLevel{}, Time: true}))
+	}
+	if useSyslog {
+		h, err := newSyslogHandler(sideLevel{})
+		if err != nil {
+			return nil, fmt.Errorf("syslog: %w", err)
+		}
+		handlers = append(handlers, h)
+	}
+	return handlers, nil
+}
+
+// logStart records the start of the run in the --log-file and --syslog.
+func logStart() {
+	if sideLogger != nil {
+		sideLogger.Info(fmt.Sprintf("START:\t%s (pid %d)", strings.Join(os.Args, " "), os.Getpid()))
+	}
+}
+
+// exit records the end of the run in the --log-file and --syslog, and exits with code.
+func exit(code int) {
+	code = writeReport(code)
+	writeMetrics(code)
+	if sideLogger != nil {
+		sideLogger.Info(fmt.Sprintf("END:\texit status %d after %s", code,
+			time.Since(startTime).Round(time.Millisecond)))
+		for _, f := range logFiles {
+			f.Close()
+		}
+	}
+	os.Exit(code)
+}
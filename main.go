@@ -3,205 +3,1520 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
-	"io/ioutil"
-	"log"
+	"log/slog"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
+	"unicode"
 
+	"github.com/rollcat/upmerge/merge"
 	getopt "github.com/timtadh/getopt"
 )
 
 var (
-	logInfo   = log.New(ioutil.Discard, "", 0)
-	logError  = log.New(os.Stderr, "", 0)
-	destDir   = "/etc"
-	srcDir    = "/usr/local/upmerge/etc"
-	dryRun    = false
-	errRefuse = errors.New("refusing operation")
-	progName  = path.Base(os.Args[0])
-)
-
-const (
-	backupSuffix = ".upmerge~"
+	logLevel    = new(slog.LevelVar)
+	logFormat   = "text"
+	logFile     = ""
+	useSyslog   = false
+	logger      = slog.New(merge.NewTextHandler(os.Stderr, &merge.TextHandlerOptions{Level: logLevel}))
+	m           = merge.New(merge.DefaultSrcDir, merge.DefaultDestDir)
+	jsonOut     *json.Encoder
+	print0      = false
+	interactive = false
+	prune       = false
+	timeout     time.Duration
+	planOut     = ""
+	lockPath    = ""
+	noLock      = false
+	journalDir  = ""
+	noJournal   = false
+	waitLock    = false
+	allowUnpriv = false
+	useSudo     = false
+	hostsDir    = ""
+	hostname    = ""
+	varsPath    = ""
+	mergeTool   = os.Getenv("UPMERGE_MERGETOOL")
+	preRun      = ""
+	postRun     = ""
+	noHooks     = false
+	watch       = false
+	every       time.Duration
+	bootstrap   = false
+	clampMtime  = os.Getenv("SOURCE_DATE_EPOCH")
+	mtreeFormat = merge.MtreeSpec
+	progress    = false
+	quiet       = false
+	dryRun      = false
+	check       = false
+	changedOnly = false
+	relative    = false
+	colorMode   = "auto"
+	progName    = path.Base(os.Args[0])
+	// version is set when building a release, with -ldflags "-X main.version=...".
+	version = "devel"
 )
 
 func errUsage() {
-	fmt.Printf("Usage: %s [-hnv] [-s src] [-d dest]\n", progName)
-	os.Exit(1)
+	fmt.Printf("Usage: %s [-0fhijnqv] [-c file] [-s src] [-d dest] [-P n] [--diff [-U n]] [command | path...]\n", progName)
+	exit(exitUsage)
 }
 
 func help() {
-	fmt.Printf("Usage: %s [-hnv] [-s src] [-d dest]\n", progName)
+	fmt.Printf("Usage: %s [-0fhijnqv] [-c file] [-s src] [-d dest] [-P n] [--diff [-U n]] [command | path...]\n", progName)
 	fmt.Printf("Maintain local overrides to /etc.\n")
-	fmt.Printf("Flags:\n")
+	fmt.Printf("Commands:\n")
+	fmt.Printf("    status  Show the state of every file in the source, change nothing\n")
+	fmt.Printf("    lint    Check the source for likely mistakes, such as world-writable files,\n")
+	fmt.Printf("            change nothing\n")
+	fmt.Printf("    explain path\n")
+	fmt.Printf("            Show what a merge would do with a single file, and why, change\n")
+	fmt.Printf("            nothing\n")
+	fmt.Printf("    verify  Check the files in the manifest for changes made since they were\n")
+	fmt.Printf("            installed, change nothing (needs --manifest)\n")
+	fmt.Printf("    adopt [-f] path...\n")
+	fmt.Printf("            Copy the given files from the destination back into the source\n")
+	fmt.Printf("    revert [-f] [path...]\n")
+	fmt.Printf("            Restore the given files (default: all) from their backups\n")
+	fmt.Printf("    undo [run]\n")
+	fmt.Printf("            Undo the given run (default: the last one), from its journal\n")
+	fmt.Printf("    plan [-o file]\n")
+	fmt.Printf("            Save the steps a merge would take, as JSON, change nothing\n")
+	fmt.Printf("    apply file\n")
+	fmt.Printf("            Take the steps saved by plan, skipping files changed since\n")
+	fmt.Printf("    bundle [-o file] [--clamp-mtime time]\n")
+	fmt.Printf("            Write a tarball (gzipped, if file ends in .gz or .tgz) of what's\n")
+	fmt.Printf("            merged from the source, to be used as the source elsewhere\n")
+	fmt.Printf("    mtree [-o file] [--format mtree|bom]\n")
+	fmt.Printf("            List what's merged from the source as it should be in the\n")
+	fmt.Printf("            destination, as an mtree spec (or for mkbom -i), change nothing\n")
+	fmt.Printf("    install-agent [--every duration] [--bootstrap]\n")
+	fmt.Printf("            Install a launchd job running upmerge with the same flags\n")
+	fmt.Printf("    uninstall-agent [--bootstrap]\n")
+	fmt.Printf("            Remove the launchd job\n")
+	fmt.Printf("Flags (the short ones also go by -c --config, -d --dest, -f --force, -h --help,\n")
+	fmt.Printf("-i --interactive, -j --json, -n --dry-run, -o --output, -P --jobs, -q --quiet,\n")
+	fmt.Printf("-s --source, -U --unified, -v --verbose and -0 --print0):\n")
+	fmt.Printf("    -f      Overwrite backups that differ from the file being backed up\n")
 	fmt.Printf("    -h      Show this help and exit\n")
+	fmt.Printf("    --version\n")
+	fmt.Printf("            Show the version and exit\n")
+	fmt.Printf("    -i      Ask what to do when a file and its backup both differ\n")
+	fmt.Printf("    -j      Print one JSON object per action on stdout\n")
+	fmt.Printf("    -0      Print the kind, destination and source of each action on stdout,\n")
+	fmt.Printf("            each ending with a NUL, for xargs -0\n")
+	fmt.Printf("    -c file Read settings from file, instead of %s\n", strings.Join(defaultConfigPaths(), " and "))
 	fmt.Printf("    -n      Dry run (don't try making any changes)\n")
+	fmt.Printf("    --check Like -n, but also fail if any backups differ from their files, and list\n")
+	fmt.Printf("            what isn't up to date on stdout\n")
+	fmt.Printf("    -q      Only show warnings and errors, not even a summary at the end\n")
 	fmt.Printf("    -v      Be verbose\n")
-	fmt.Printf("    -s dir  Use dir (default /usr/local/upmerge/etc) as the source\n")
-	fmt.Printf("    -d dir  Use dir (default /etc) as the destination\n")
+	fmt.Printf("    --log-format format\n")
+	fmt.Printf("            Log as text (the default), or as one JSON object per line\n")
+	fmt.Printf("    --log-file file\n")
+	fmt.Printf("            Also log to file, with the start, end and summary of every run\n")
+	fmt.Printf("    --syslog\n")
+	fmt.Printf("            Also log to syslog, the same way\n")
+	fmt.Printf("    --report file\n")
+	fmt.Printf("            At the end, write a JSON record of the run to file\n")
+	fmt.Printf("    --report-required\n")
+	fmt.Printf("            Fail if the report can't be written\n")
+	fmt.Printf("    --metrics-file file\n")
+	fmt.Printf("            At the end, write gauges for Prometheus to file (ending in .prom)\n")
+	fmt.Printf("    --color when\n")
+	fmt.Printf("            Color the actions: auto (the default, on a terminal unless $NO_COLOR\n")
+	fmt.Printf("            is set), always, or never\n")
+	fmt.Printf("    --changed-only\n")
+	fmt.Printf("            With -v or -0, only show the changes\n")
+	fmt.Printf("    --relative\n")
+	fmt.Printf("            Show paths relative to the source and destination directories\n")
+	fmt.Printf("    -s dir  Use dir (default %s) as the source\n", merge.DefaultSrcDir)
+	fmt.Printf("            Given again, layer more sources on top; the last one wins\n")
+	fmt.Printf("    --host-overlays dir\n")
+	fmt.Printf("            Layer dir/<hostname>/<source name> on top of the sources, if it exists\n")
+	fmt.Printf("    --hostname name\n")
+	fmt.Printf("            With --host-overlays, use name rather than this host's name\n")
+	fmt.Printf("    --templates\n")
+	fmt.Printf("            Render source files ending in %s as Go templates\n", merge.TemplateSuffix)
+	fmt.Printf("    --vars file\n")
+	fmt.Printf("            With --templates, read template variables (key = value) from file\n")
+	fmt.Printf("    --comment-leader name=leader\n")
+	fmt.Printf("            Mark blocks from %s fragments with leader in files with that\n", merge.AppendSuffix)
+	fmt.Printf("            name or extension (default %s; repeatable)\n", merge.DefaultCommentLeader)
+	fmt.Printf("    -d dir  Use dir (default %s) as the destination\n", merge.DefaultDestDir)
+	fmt.Printf("    --user  Merge ~/.local/share/upmerge into the home directory by default,\n")
+	fmt.Printf("            keeping the manifest and cache in ~/.local/state/upmerge\n")
+	fmt.Printf("    --pair src:dest\n")
+	fmt.Printf("            Merge src into dest, instead of -s and -d (repeatable)\n")
+	fmt.Printf("    --root dir\n")
+	fmt.Printf("            Merge into the destination within dir, such as a staging volume,\n")
+	fmt.Printf("            keeping the manifest there too; %%root in commands stands for dir\n")
+	fmt.Printf("    --relative-links\n")
+	fmt.Printf("            Make absolute symlink targets relative, to stay within the root\n")
+	fmt.Printf("    -o file With plan, bundle or mtree, write to file instead of stdout\n")
+	fmt.Printf("    --clamp-mtime time\n")
+	fmt.Printf("            With bundle, give nothing a time later than time, in seconds since\n")
+	fmt.Printf("            the epoch or RFC 3339 (default $SOURCE_DATE_EPOCH)\n")
+	fmt.Printf("    -P n    Compare and copy up to n files at the same time\n")
+	fmt.Printf("    --diff  Show a diff for every file that would be overwritten\n")
+	fmt.Printf("    -U n    Show n (default %d) lines of context in diffs\n", merge.DefaultDiffContext)
+	fmt.Printf("    --validate 'pattern command'\n")
+	fmt.Printf("            Check new versions of files matching pattern with command before\n")
+	fmt.Printf("            installing them, with %%f replaced by the file; repeatable\n")
+	fmt.Printf("    --on-change 'pattern command'\n")
+	fmt.Printf("            Run command once files matching pattern were changed; repeatable\n")
+	fmt.Printf("    --pre-run command\n")
+	fmt.Printf("            Run command before changing anything, and stop if it fails\n")
+	fmt.Printf("    --post-run command\n")
+	fmt.Printf("            Run command after changing anything, even if that failed\n")
+	fmt.Printf("    --no-hooks\n")
+	fmt.Printf("            Don't run any hooks\n")
+	fmt.Printf("    --include pattern\n")
+	fmt.Printf("            Only copy files matching pattern (repeatable)\n")
+	fmt.Printf("    --once pattern\n")
+	fmt.Printf("            Only copy files matching pattern if they're missing, and leave them\n")
+	fmt.Printf("            alone once they're there (repeatable)\n")
+	fmt.Printf("    --merge-keys pattern\n")
+	fmt.Printf("            Merge the key = value lines of files matching pattern into dest's,\n")
+	fmt.Printf("            rather than replacing them (repeatable)\n")
+	fmt.Printf("    --plist-merge pattern\n")
+	fmt.Printf("            Merge the dictionaries of plists matching pattern into dest's\n")
+	fmt.Printf("            (repeatable)\n")
+	fmt.Printf("    --force-file pattern\n")
+	fmt.Printf("            Overwrite differing backups of files matching pattern, as with -f\n")
+	fmt.Printf("            (repeatable)\n")
+	fmt.Printf("    --exclude pattern\n")
+	fmt.Printf("            Don't copy files matching pattern, as in %s (repeatable)\n", merge.IgnoreFile)
+	fmt.Printf("    --backup-suffix suffix\n")
+	fmt.Printf("            Name backups by appending suffix (default %s)\n", merge.DefaultBackupSuffix)
+	fmt.Printf("    --backup-dir dir\n")
+	fmt.Printf("            Keep backups under dir, instead of next to each file\n")
+	fmt.Printf("    --backup-rotate n\n")
+	fmt.Printf("            Keep up to n numbered backups of each file, oldest dropped\n")
+	fmt.Printf("    --no-backup\n")
+	fmt.Printf("            Overwrite files without making a backup first\n")
+	fmt.Printf("    --keep-going\n")
+	fmt.Printf("            Report errors at the end, instead of stopping at the first one\n")
+	fmt.Printf("    --retries n\n")
+	fmt.Printf("            Try a file up to n more times after a transient error, such as\n")
+	fmt.Printf("            a timeout on a network mount, waiting longer each time\n")
+	fmt.Printf("    --prune-backups\n")
+	fmt.Printf("            Instead of merging, remove backups identical to their file\n")
+	fmt.Printf("    --clean-identical-backups\n")
+	fmt.Printf("            While merging, remove backups identical to their up-to-date file\n")
+	fmt.Printf("    --resolve-type-conflicts dest|src\n")
+	fmt.Printf("            Leave alone (the default), or back up and replace whatever is a\n")
+	fmt.Printf("            directory in dest but not in src, or the other way around\n")
+	fmt.Printf("    --strict\n")
+	fmt.Printf("            Fail if the source contains special files, such as named pipes,\n")
+	fmt.Printf("            and refuse missing files whose leftover backup differs\n")
+	fmt.Printf("    --devices\n")
+	fmt.Printf("            Recreate devices found in the source, when running as root\n")
+	fmt.Printf("    --clear-flags\n")
+	fmt.Printf("            Replace files marked immutable with chflags, keeping the flags\n")
+	fmt.Printf("    --snapshot[=best-effort]\n")
+	fmt.Printf("            Take a snapshot of the destination before changing it: an APFS\n")
+	fmt.Printf("            one on macOS, or a tarball in %s of what's changed;\n", merge.DefaultSnapshotDir)
+	fmt.Printf("            if that fails, change nothing (or with best-effort, carry on)\n")
+	fmt.Printf("    --protected skip|fail\n")
+	fmt.Printf("            Report files protected by SIP on macOS and carry on (the default),\n")
+	fmt.Printf("            or fail on them\n")
+	fmt.Printf("    --keep-quarantine\n")
+	fmt.Printf("            On macOS, copy the quarantine flag with other extended attributes\n")
+	fmt.Printf("    --no-clone\n")
+	fmt.Printf("            Always copy files, rather than cloning them where possible\n")
+	fmt.Printf("    --unsafe-follow\n")
+	fmt.Printf("            Write to the destination by paths, following symlinks wherever\n")
+	fmt.Printf("    --space-margin n\n")
+	fmt.Printf("            Before changing anything, check that n times (by default, 2) the\n")
+	fmt.Printf("            size of the files to copy is free in the destination\n")
+	fmt.Printf("    --no-space-check\n")
+	fmt.Printf("            Don't check for free space, such as where statfs can't be trusted\n")
+	fmt.Printf("    --no-times\n")
+	fmt.Printf("            Don't give copied files the modification time of their source\n")
+	fmt.Printf("    --no-dir-perms\n")
+	fmt.Printf("            Don't change the permissions of existing directories to the source's\n")
+	fmt.Printf("    --case-sensitive-dest\n")
+	fmt.Printf("            Allow source files whose names only differ by case\n")
+	fmt.Printf("    --no-owner\n")
+	fmt.Printf("            Don't give copied files the owner and group of their source\n")
+	fmt.Printf("    --copy-links\n")
+	fmt.Printf("            Copy what symlinks in the source point to, not the symlinks\n")
+	fmt.Printf("    --max-depth n\n")
+	fmt.Printf("            Don't walk more than n levels of directories into the source\n")
+	fmt.Printf("    --quick Assume files of the same size and modification time match\n")
+	fmt.Printf("    --checksum\n")
+	fmt.Printf("            Compare the contents of every file (the default)\n")
+	fmt.Printf("    --ignore-line-endings\n")
+	fmt.Printf("            Let text files match if they only differ in CRLF or CR line endings\n")
+	fmt.Printf("    --ignore-trailing-space\n")
+	fmt.Printf("            Let text files match if they only differ in blanks at ends of lines\n")
+	fmt.Printf("    --cache file\n")
+	fmt.Printf("            Remember file hashes in file (e.g. %s)\n", merge.DefaultCachePath)
+	fmt.Printf("    --no-cache\n")
+	fmt.Printf("            Compare every file in full, even if --cache was given\n")
+	fmt.Printf("    --manifest file\n")
+	fmt.Printf("            Record the files installed in file (e.g. %s)\n", merge.DefaultManifestPath)
+	fmt.Printf("    --prune Back up and remove installed files that are gone from the source\n")
+	fmt.Printf("            (needs --manifest)\n")
+	fmt.Printf("    --strict-drift\n")
+	fmt.Printf("            Don't replace files changed since they were installed, without -f or -i\n")
+	fmt.Printf("    --merge Merge the source into files changed since they were backed up\n")
+	fmt.Printf("    --merge-tool command\n")
+	fmt.Printf("            Run command on the files --merge can't merge (default $UPMERGE_MERGETOOL),\n")
+	fmt.Printf("            with %%base, %%mine, %%theirs and %%out replaced by their paths\n")
+	fmt.Printf("    --merge-tool-timeout duration\n")
+	fmt.Printf("            Give up on the merge tool after duration (default %s)\n",
+		merge.DefaultMergeToolTimeout)
+	fmt.Printf("    --progress\n")
+	fmt.Printf("            Show how many files were merged so far, and how much was copied\n")
+	fmt.Printf("    --watch Keep merging whatever changes in the source, until interrupted\n")
+	fmt.Printf("    --every duration\n")
+	fmt.Printf("            Merge again after about duration, until interrupted (or for\n")
+	fmt.Printf("            install-agent, how often the agent runs; default %s)\n", defaultAgentInterval)
+	fmt.Printf("    --bootstrap\n")
+	fmt.Printf("            Load (or unload) the agent with launchctl\n")
+	fmt.Printf("    --print-config\n")
+	fmt.Printf("            Show the settings from the config file and flags, and exit\n")
+	fmt.Printf("    --flag=false\n")
+	fmt.Printf("            Turn off a long flag that takes no value, as set in the config file\n")
+	fmt.Printf("    --timeout duration\n")
+	fmt.Printf("            Stop after duration (e.g. 30s), as if interrupted\n")
+	fmt.Printf("    --lock file\n")
+	fmt.Printf("            Lock file, so that only one upmerge runs at a time\n")
+	fmt.Printf("            (default: %s, when running as root)\n", defaultLockPath)
+	fmt.Printf("    --no-lock\n")
+	fmt.Printf("            Don't take the lock\n")
+	fmt.Printf("    --journal dir\n")
+	fmt.Printf("            Keep a journal of every run in dir, to be undone with undo\n")
+	fmt.Printf("            (default: %s, when running as root)\n", merge.DefaultJournalDir)
+	fmt.Printf("    --journal-keep n\n")
+	fmt.Printf("            Keep the journals of the last n runs (default: %d; 0 keeps all)\n",
+		merge.DefaultJournalKeep)
+	fmt.Printf("    --no-journal\n")
+	fmt.Printf("            Don't keep a journal\n")
+	fmt.Printf("    --wait  Wait for another upmerge to finish, instead of failing\n")
+	fmt.Printf("    --create-dest\n")
+	fmt.Printf("            Create the destination directory if it doesn't exist\n")
+	fmt.Printf("    --allow-unprivileged\n")
+	fmt.Printf("            Write to /etc even when not running as root\n")
+	fmt.Printf("    --sudo\n")
+	fmt.Printf("            When not running as root, run again with sudo to write to /etc\n")
+	fmt.Printf("Exit status:\n")
+	fmt.Printf("    %-3d     Success (with -n, whether or not there are changes to make)\n", exitOK)
+	fmt.Printf("    %-3d     Usage or config error\n", exitUsage)
+	fmt.Printf("    %-3d     Error, such as failing to read or write a file\n", exitError)
+	fmt.Printf("    %-3d     Refused to overwrite a differing backup (or to follow a symlink\n", exitRefused)
+	fmt.Printf("            out of the destination); a human is needed\n")
+	fmt.Printf("            status: some files are blocked by a differing backup\n")
+	fmt.Printf("            verify: some files were changed or deleted\n")
+	fmt.Printf("            lint: there are errors in the source\n")
+	fmt.Printf("    %-3d     With --check: changes are pending, or backups differ\n", exitPending)
+	fmt.Printf("    %-3d     Another upmerge is running\n", exitLocked)
+	fmt.Printf("    %-3d     Some files failed validation, and were left alone\n", exitInvalid)
+	fmt.Printf("    %-3d     Timed out\n", exitTimeout)
+	fmt.Printf("    %-3d     Interrupted\n", exitInterrupted)
 }
 
-// fileContentsAreIdentical returns true if the contents of files named by path1 and
-// path2 are identical.
-func fileContentsAreIdentical(path1, path2 string) (bool, error) {
-	// Take a shortcut: if the files have different sizes, they must be different.
-	s1, err := os.Stat(path1)
-	if err != nil {
-		return false, err
+// jsonObserver prints one JSON object per action on stdout. Errors still go to
+// stderr as well.
+type jsonObserver struct {
+	*json.Encoder
+}
+
+func (o jsonObserver) OnAction(a merge.Action) {
+	switch a.Kind {
+	case merge.ActionError, merge.ActionRefuse, merge.ActionWarning:
+		merge.SlogObserver{Logger: logger, Relative: relative}.OnAction(a)
 	}
-	s2, err := os.Stat(path2)
-	if err != nil {
-		return false, err
+	o.Encode(a)
+}
+
+// OnError does nothing: errors are reported once the run is over.
+func (o jsonObserver) OnError(path string, err error) {}
+
+// print0Observer prints the kind, destination and source of each action on stdout,
+// each followed by a NUL, for xargs -0 and the like. Errors still go to stderr as well.
+type print0Observer struct {
+	w           *bufio.Writer
+	changedOnly bool
+}
+
+func (o print0Observer) OnAction(a merge.Action) {
+	switch a.Kind {
+	case merge.ActionError, merge.ActionRefuse, merge.ActionWarning:
+		merge.SlogObserver{Logger: logger, Relative: relative}.OnAction(a)
+	default:
+		if o.changedOnly && !a.IsChange() {
+			return
+		}
 	}
-	if s1.Size() != s2.Size() {
-		return false, nil
+	if relative {
+		a = a.Relative()
 	}
-	// TODO: don't read the whole file at once, compare slice by slice.
-	buf1, err := os.ReadFile(path1)
-	if err != nil {
-		return false, err
+	fmt.Fprintf(o.w, "%s\x00%s\x00%s\x00", a.Kind, a.Dest, a.Src)
+	o.w.Flush()
+}
+
+// OnError does nothing: errors are reported once the run is over.
+func (o print0Observer) OnError(path string, err error) {}
+
+// converged lists the actions of a --check run that mean the destination isn't up to
+// date with the source (changes to make, and differing backups left over), on stdout
+// unless with -j or -0, where they're printed anyway. It returns true if there are none.
+func converged(actions []merge.Action) bool {
+	ok := true
+	for _, a := range actions {
+		if a.IsChange() || a.Kind == merge.ActionCheck {
+			if jsonOut == nil && !print0 && relative {
+				fmt.Println(a.Relative())
+			} else if jsonOut == nil && !print0 {
+				fmt.Println(a)
+			}
+			ok = false
+		}
+	}
+	return ok
+}
+
+// countChanges returns how many of actions are changes.
+func countChanges(actions []merge.Action) int {
+	changes := 0
+	for _, a := range actions {
+		if a.IsChange() {
+			changes++
+		}
+	}
+	return changes
+}
+
+// reportErr prints err, the outcome of a run that made the given number of changes
+// (along with every error in it, if it's a MultiError).
+func reportErr(err error, changes int) {
+	errs := merge.MultiError{err}
+	if me, ok := err.(merge.MultiError); ok {
+		errs = me
+	}
+	how := ""
+	for _, err := range errs {
+		if errors.Is(err, context.Canceled) {
+			how = "interrupted"
+			continue
+		} else if errors.Is(err, context.DeadlineExceeded) {
+			how = "timed out"
+			continue
+		}
+		if jsonOut != nil && !errors.Is(err, merge.ErrRefuse) && !errors.Is(err, merge.ErrChanged) &&
+			!errors.Is(err, merge.ErrSpecial) && !errors.Is(err, merge.ErrInvalid) {
+			jsonOut.Encode(merge.Action{Kind: merge.ActionError, Error: err.Error(), DryRun: m.DryRun})
+		}
+		runErrors = append(runErrors, err.Error())
+		logError("%s: %s", progName, err)
+		if errors.Is(err, merge.ErrImmutable) {
+			logError("%s: run with --clear-flags, or clear them with chflags", progName)
+		}
+		var spaceErr *merge.SpaceError
+		if errors.As(err, &spaceErr) {
+			logError("%s: %s needed, %s free; make room, or run with --no-space-check",
+				progName, formatBytes(spaceErr.Need), formatBytes(spaceErr.Free))
+		}
 	}
-	buf2, err := os.ReadFile(path1)
+	if how != "" {
+		msg := fmt.Sprintf("%s after %d changes", how, changes)
+		if jsonOut != nil {
+			jsonOut.Encode(merge.Action{Kind: merge.ActionError, Error: msg, DryRun: m.DryRun})
+		}
+		logError("%s: %s", progName, msg)
+	}
+}
+
+// logDebug, logInfo and logError log a message, formatted as with fmt.Printf, at their
+// level. What's only shown with -v is logged at slog.LevelDebug.
+func logDebug(format string, args ...interface{}) { logAt(slog.LevelDebug, format, args...) }
+func logInfo(format string, args ...interface{})  { logAt(slog.LevelInfo, format, args...) }
+func logError(format string, args ...interface{}) { logAt(slog.LevelError, format, args...) }
+
+func logAt(level slog.Level, format string, args ...interface{}) {
+	logger.Log(context.Background(), level, fmt.Sprintf(format, args...))
+}
+
+// setupLogger sets up the logger for --log-format and --color, once the flags were
+// applied. The --log-file and --syslog are opened as well; failing that, it exits
+// before anything is changed.
+func setupLogger() {
+	var handler slog.Handler
+	if logFormat == "json" {
+		handler = slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel})
+	} else {
+		handler = merge.NewTextHandler(os.Stderr,
+			&merge.TextHandlerOptions{Level: logLevel, Color: useColor()})
+	}
+	logger = slog.New(handler)
+	side, err := openSideLogs()
 	if err != nil {
-		return false, err
+		logError("%s: %s", progName, err)
+		exit(exitUsage)
+	}
+	if len(side) > 0 {
+		sideLogger = slog.New(multiHandler(side))
+		logger = slog.New(append(multiHandler{handler}, side...))
+		logStart()
 	}
-	return bytes.Equal(buf1, buf2), nil
 }
 
-// copyFile copies named srcPath into destPath, matching permission bits (and applying
-// umask). As a precaution, destPath must not exist.
-func copyFile(srcPath, destPath string) error {
-	st, err := os.Stat(srcPath)
+// useColor returns true if the actions printed on stderr are to be colored: with
+// --color=always, or if it's a terminal that can show them, and NO_COLOR isn't set.
+func useColor() bool {
+	switch colorMode {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+	if _, ok := os.LookupEnv("NO_COLOR"); ok || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	st, err := os.Stderr.Stat()
+	return err == nil && st.Mode()&os.ModeCharDevice != 0
+}
+
+// hostOverlay returns the directory in hostsDir holding the files for this host, or ""
+// if there's none. For a source named etc, that's hostsDir/<hostname>/etc.
+func hostOverlay() (string, error) {
+	name := hostname
+	if name == "" {
+		var err error
+		if name, err = os.Hostname(); err != nil {
+			return "", err
+		}
+		// Only the first part, so that it doesn't change along with the network.
+		name, _, _ = strings.Cut(name, ".")
+	}
+	if name == "" || strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		return "", fmt.Errorf("bad host name: %q", name)
+	}
+	dir := filepath.Join(hostsDir, name, filepath.Base(m.SrcDir))
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// isCommand returns true if name is one of the commands, rather than a path to merge.
+func isCommand(name string) bool {
+	switch name {
+	case "status", "lint", "explain", "verify", "adopt", "revert", "plan", "apply", "bundle",
+		"mtree", "undo", "install-agent", "uninstall-agent":
+		return true
+	}
+	return false
+}
+
+// isSystemDir returns true if dir is the system's /etc (which is /private/etc on
+// macOS), even by way of symlinks.
+func isSystemDir(dir string) bool {
+	if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = resolved
+	}
+	dir, _ = filepath.Abs(dir)
+	return dir == "/etc" || dir == "/private/etc"
+}
+
+// printExplanation prints e on stdout, one tab-separated line for each part of it.
+func printExplanation(e *merge.Explanation) {
+	fmt.Printf("path\t%s\n", e.Path)
+	for _, f := range []struct {
+		name string
+		merge.ExplainedFile
+	}{{"src", e.Src}, {"dest", e.Dest}, {"backup", e.Backup}} {
+		fmt.Printf("%s\t%s\t%s\n", f.name, f.Path, describeFile(f.ExplainedFile))
+	}
+	step := "none"
+	if e.Step != nil {
+		step = e.Step.Kind
+	}
+	fmt.Printf("step\t%s\n", step)
+	fmt.Printf("reason\t%s\n", e.Reason)
+}
+
+// describeFile describes f for printExplanation.
+func describeFile(f merge.ExplainedFile) string {
+	switch {
+	case !f.Exists:
+		return "missing"
+	case f.Mode&fs.ModeSymlink != 0 && strings.HasPrefix(f.Hash, "-> "):
+		return "symlink " + f.Hash
+	case f.Mode&fs.ModeSymlink != 0:
+		return fmt.Sprintf("symlink, copied as what it points to, sha256 %s", f.Hash)
+	case f.Mode.IsDir():
+		return fmt.Sprintf("directory, mode %04o", f.Mode.Perm())
+	case !f.Mode.IsRegular():
+		return fmt.Sprintf("special, mode %s", f.Mode)
+	}
+	return fmt.Sprintf("file, mode %04o, %d bytes, sha256 %s", f.Mode.Perm(), f.Size, f.Hash)
+}
+
+// writePlan saves plan as JSON to the named file, or to stdout if name is empty.
+func writePlan(plan *merge.Plan, name string) error {
+	buf, err := json.MarshalIndent(plan, "", "\t")
 	if err != nil {
 		return err
 	}
-	fr, err := os.Open(srcPath)
+	buf = append(buf, '\n')
+	if name == "" {
+		_, err = os.Stdout.Write(buf)
+		return err
+	}
+	return os.WriteFile(name, buf, 0644)
+}
+
+// buildVersion returns the version of this build: as given with -ldflags, or failing
+// that, the version of the module it was built from, if known.
+func buildVersion() string {
+	if version != "devel" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return version
+}
+
+// parseTime parses s, given either in seconds since the epoch or in RFC 3339 format.
+func parseTime(s string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// writeBundle writes a bundle of the source to the named file (gzipped, if its name
+// says so), or to stdout if name is empty. Nothing is left behind if that fails.
+func writeBundle(ctx context.Context, name string) error {
+	var clamp time.Time
+	if clampMtime != "" {
+		var err error
+		if clamp, err = parseTime(clampMtime); err != nil {
+			return fmt.Errorf("bad time to clamp to: %q", clampMtime)
+		}
+	}
+	info := merge.BundleInfo{Version: buildVersion()}
+	if name == "" {
+		return m.Bundle(ctx, os.Stdout, info, clamp)
+	}
+	if m.DryRun {
+		logDebug("BUNDLE:\t%s", name)
+		return nil
+	}
+	tmp := name + ".tmp"
+	f, err := os.Create(tmp)
 	if err != nil {
 		return err
 	}
-	defer fr.Close()
-	fw, err := os.OpenFile(destPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, st.Mode())
+	var w io.WriteCloser = f
+	if strings.HasSuffix(name, ".gz") || strings.HasSuffix(name, ".tgz") {
+		// With no name or time in its header, so that it's the same every time.
+		w = gzip.NewWriter(f)
+	}
+	err = m.Bundle(ctx, w, info, clamp)
+	if w != f {
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
 	if err != nil {
+		os.Remove(tmp)
 		return err
 	}
-	defer fw.Close()
-	_, err = io.Copy(fw, fr)
-	return err
+	logDebug("BUNDLE:\t%s", name)
+	return nil
 }
 
-func main() {
-	args, opts, err := getopt.GetOpt(os.Args[1:], "hnvs:d:", nil)
-	if err != nil || len(args) != 0 {
+// writeMtree writes the listing made by Merger.Mtree to the named file, or to stdout if
+// name is empty.
+func writeMtree(ctx context.Context, name string) error {
+	if name == "" {
+		return m.Mtree(ctx, os.Stdout, mtreeFormat)
+	}
+	var buf bytes.Buffer
+	if err := m.Mtree(ctx, &buf, mtreeFormat); err != nil {
+		return err
+	}
+	return os.WriteFile(name, buf.Bytes(), 0644)
+}
+
+// readPlan loads a plan saved by writePlan.
+func readPlan(name string) (*merge.Plan, error) {
+	buf, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	plan := &merge.Plan{}
+	if err = json.Unmarshal(buf, plan); err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	return plan, nil
+}
+
+// Options, as given to getopt.
+var (
+	shortOpts = "0c:fhijnqvs:d:o:P:U:"
+	longOpts  = []string{
+		"help", "version", "interactive", "dry-run", "quiet", "verbose", "source=", "dest=",
+		"output=", "jobs=", "config=", "print-config", "json", "diff", "unified=", "force", "prune-backups",
+		"backup-suffix=", "backup-dir=", "backup-rotate=", "no-backup", "keep-going", "retries=", "timeout=",
+		"cache=", "no-cache", "manifest=", "prune", "strict-drift", "quick", "checksum", "copy-links",
+		"no-owner", "no-times", "keep-quarantine", "no-dir-perms", "clear-flags", "strict", "devices",
+		"lock=", "no-lock", "wait", "allow-unprivileged", "sudo", "user", "pair=", "root=",
+		"relative-links", "create-dest", "exclude=", "include=",
+		"host-overlays=", "hostname=", "templates", "vars=", "merge", "merge-tool=",
+		"merge-tool-timeout=", "validate=", "on-change=", "pre-run=", "post-run=", "no-hooks",
+		"watch", "every=", "bootstrap", "clamp-mtime=", "format=", "progress", "changed-only",
+		"color=", "log-format=", "log-file=", "syslog", "check", "case-sensitive-dest",
+		"no-clone", "relative", "print0", "report=", "report-required", "metrics-file=", "once=",
+		"force-file=", "comment-leader=", "merge-keys=", "plist-merge=", "ignore-line-endings",
+		"ignore-trailing-space", "clean-identical-backups", "resolve-type-conflicts=", "max-depth=",
+		"protected=",
+		"unsafe-follow", "no-space-check", "space-margin=", "snapshot=", "journal=",
+		"journal-keep=", "no-journal",
+	}
+)
+
+// parseArgs returns the flags in argv, and any remaining positional arguments.
+func parseArgs(argv []string) ([]string, []getopt.OptArg) {
+	orig := argv
+	argv = append([]string{}, argv...)
+	// The values given to boolean flags, in order, as getopt only takes them bare.
+	values := make(map[string][]bool)
+	for i, arg := range argv {
+		name, value, found := strings.Cut(arg, "=")
+		if arg == "--" {
+			break
+		} else if arg == "--snapshot" {
+			// Its value is optional, which getopt can't tell.
+			argv[i] = "--snapshot=" + merge.SnapshotRequired
+		} else if isBoolFlag(name) {
+			on := true
+			if found {
+				var err error
+				if on, err = parseBool(value); err != nil {
+					logError("%s: %s must be true or false", progName, name)
+					errUsage()
+				}
+				argv[i] = name
+			}
+			values[name] = append(values[name], on)
+		}
+	}
+	args, opts, err := getopt.GetOpt(argv, shortOpts, longOpts)
+	if err == nil {
+		// Positional arguments are left as they were given.
+		args = orig[len(orig)-len(args):]
+		for i, opt := range opts {
+			if v := values[opt.Opt()]; len(v) > 0 {
+				if !v[0] {
+					opts[i] = configOpt{opt.Opt(), "false"}
+				}
+				values[opt.Opt()] = v[1:]
+			}
+		}
+	} else {
+		msg := err.Error()
+		if name, ok := strings.CutPrefix(msg, "couldn't find "); ok {
+			msg = "unknown flag " + strings.Trim(name, "'")
+		} else if strings.HasPrefix(msg, "expected an argument for ") {
+			name := strings.Fields(msg)[4]
+			msg = strings.Trim(name, `"`) + " needs a value"
+		}
+		logError("%s: %s", progName, msg)
 		errUsage()
-		return
 	}
+	return args, opts
+}
+
+// isBoolFlag returns true if flag is the long name of a flag that can be set in a
+// config file and takes no value, so that it can be given "=false" to turn it off.
+func isBoolFlag(flag string) bool {
+	key, ok := strings.CutPrefix(flag, "--")
+	if !ok {
+		return false
+	}
+	_, hasArg, ok := configFlag(key)
+	return ok && !hasArg
+}
+
+// applyOpts applies flags, as returned by parseArgs, to the global settings. A flag
+// that takes no value is turned off if its value is "false", as from --force=false or
+// "force = false" in a config file.
+func applyOpts(opts []getopt.OptArg) {
+	// Sources given here replace any given before, rather than adding layers to them.
+	var srcDirs []string
+	defer func() {
+		if len(srcDirs) > 0 {
+			m.SrcDir, m.Layers = srcDirs[0], srcDirs[1:]
+		}
+	}()
 	for _, opt := range opts {
+		on := opt.Arg() != "false"
 		switch opt.Opt() {
-		case "-h":
+		case "-h", "--help":
 			help()
-			os.Exit(0)
-		case "-n":
-			dryRun = true
-		case "-v":
-			logInfo = log.New(os.Stderr, "", 0)
-		case "-s":
-			srcDir = opt.Arg()
-		case "-d":
-			destDir = opt.Arg()
+			exit(exitOK)
+		case "--version":
+			fmt.Printf("%s %s (%s)\n", progName, buildVersion(), runtime.Version())
+			exit(exitOK)
+		case "-i", "--interactive":
+			interactive = on
+		case "-j", "--json":
+			jsonOut = nil
+			if on {
+				jsonOut = json.NewEncoder(os.Stdout)
+			}
+		case "-0", "--print0":
+			print0 = on
+		case "--report":
+			reportPath = opt.Arg()
+		case "--report-required":
+			reportRequired = on
+		case "--metrics-file":
+			metricsPath = opt.Arg()
+		case "-n", "--dry-run":
+			dryRun = on
+			m.DryRun = dryRun || check
+		case "--check":
+			check = on
+			m.DryRun = dryRun || check
+		case "-v", "--verbose":
+			if on {
+				logLevel.Set(slog.LevelDebug)
+			} else if logLevel.Level() == slog.LevelDebug {
+				logLevel.Set(slog.LevelInfo)
+			}
+		case "-q", "--quiet":
+			if on {
+				logLevel.Set(slog.LevelWarn)
+			} else if quiet {
+				logLevel.Set(slog.LevelInfo)
+			}
+			quiet = on
+		case "--changed-only":
+			changedOnly = on
+		case "--relative":
+			relative = on
+		case "--log-file":
+			logFile = opt.Arg()
+		case "--syslog":
+			useSyslog = on
+		case "--log-format":
+			switch opt.Arg() {
+			case "text", "json":
+				logFormat = opt.Arg()
+			default:
+				errUsage()
+			}
+		case "--color":
+			switch opt.Arg() {
+			case "auto", "always", "never":
+				colorMode = opt.Arg()
+			default:
+				errUsage()
+			}
+		case "-s", "--source":
+			srcDirs = append(srcDirs, opt.Arg())
+		case "-d", "--dest":
+			m.DestDir = opt.Arg()
+		case "-o", "--output":
+			planOut = opt.Arg()
+		case "-P", "--jobs":
+			n, err := strconv.Atoi(opt.Arg())
+			if err != nil || n < 1 {
+				errUsage()
+			}
+			m.Workers = n
+		case "--diff":
+			m.Diff = on
+		case "-f", "--force":
+			m.Force = on
+		case "--keep-going":
+			m.KeepGoing = on
+		case "--retries":
+			n, err := strconv.Atoi(opt.Arg())
+			if err != nil || n < 0 {
+				errUsage()
+			}
+			m.Retries = n
+		case "--prune-backups":
+			prune = on
+		case "--clean-identical-backups":
+			m.CleanIdenticalBackups = on
+		case "--snapshot":
+			switch opt.Arg() {
+			case merge.SnapshotRequired, merge.SnapshotBestEffort:
+				m.Snapshot = opt.Arg()
+			default:
+				errUsage()
+			}
+		case "--protected":
+			switch opt.Arg() {
+			case merge.ProtectedSkip, merge.ProtectedFail:
+				m.Protected = opt.Arg()
+			default:
+				errUsage()
+			}
+		case "--resolve-type-conflicts":
+			switch opt.Arg() {
+			case merge.TypeConflictDest, merge.TypeConflictSrc:
+				m.ResolveTypeConflicts = opt.Arg()
+			default:
+				errUsage()
+			}
+		case "--backup-suffix":
+			m.BackupSuffix = opt.Arg()
+		case "--backup-dir":
+			m.BackupDir = opt.Arg()
+		case "--backup-rotate":
+			n, err := strconv.Atoi(opt.Arg())
+			if err != nil || n < 1 {
+				errUsage()
+			}
+			m.BackupRotate = n
+		case "--no-backup":
+			m.NoBackup = on
+		case "--keep-quarantine":
+			m.KeepQuarantine = on
+		case "--no-clone":
+			m.NoClone = on
+		case "--unsafe-follow":
+			m.UnsafeFollow = on
+		case "--no-space-check":
+			m.NoSpaceCheck = on
+		case "--space-margin":
+			margin, err := strconv.ParseFloat(opt.Arg(), 64)
+			if err != nil || margin < 1 {
+				errUsage()
+			}
+			m.SpaceMargin = margin
+		case "--no-times":
+			m.NoTimes = on
+		case "--strict":
+			m.Strict = on
+		case "--devices":
+			m.Devices = on
+		case "--clear-flags":
+			m.ClearFlags = on
+		case "--no-dir-perms":
+			m.NoDirPerms = on
+		case "--case-sensitive-dest":
+			m.CaseSensitiveDest = on
+		case "--no-owner":
+			m.NoOwner = on
+		case "--copy-links":
+			m.CopyLinks = on
+		case "--max-depth":
+			n, err := strconv.Atoi(opt.Arg())
+			if err != nil || n < 1 {
+				errUsage()
+			}
+			m.MaxDepth = n
+		case "--quick":
+			m.Quick = on
+		case "--checksum":
+			m.Quick = !on
+		case "--ignore-line-endings":
+			m.IgnoreLineEndings = on
+		case "--ignore-trailing-space":
+			m.IgnoreTrailingSpace = on
+		case "--cache":
+			m.CachePath = opt.Arg()
+		case "--no-cache":
+			if on {
+				m.CachePath = ""
+			}
+		case "--manifest":
+			m.ManifestPath = opt.Arg()
+		case "--prune":
+			m.Prune = on
+		case "--strict-drift":
+			m.StrictDrift = on
+		case "--merge":
+			m.Merge = on
+		case "--merge-tool":
+			mergeTool = opt.Arg()
+		case "--merge-tool-timeout":
+			d, err := time.ParseDuration(opt.Arg())
+			if err != nil || d <= 0 {
+				errUsage()
+			}
+			m.MergeToolTimeout = d
+		case "--lock":
+			lockPath = opt.Arg()
+			noLock = false
+		case "--no-lock":
+			noLock = on
+		case "--journal":
+			journalDir = opt.Arg()
+		case "--journal-keep":
+			n, err := strconv.Atoi(opt.Arg())
+			if err != nil || n < 0 {
+				errUsage()
+			}
+			m.JournalKeep = n
+		case "--no-journal":
+			noJournal = on
+		case "--wait":
+			waitLock = on
+		case "--include":
+			m.Include = append(m.Include, opt.Arg())
+		case "--once":
+			m.Once = append(m.Once, opt.Arg())
+		case "--force-file":
+			m.ForceFiles = append(m.ForceFiles, opt.Arg())
+		case "--merge-keys":
+			m.KeyFiles = append(m.KeyFiles, opt.Arg())
+		case "--plist-merge":
+			m.PlistFiles = append(m.PlistFiles, opt.Arg())
+		case "--validate":
+			// Arguments are split on whitespace, and never given to a shell.
+			fields := strings.Fields(opt.Arg())
+			if len(fields) < 2 {
+				errUsage()
+			}
+			m.Validators = append(m.Validators, merge.Validator{Pattern: fields[0], Command: fields[1:]})
+		case "--on-change":
+			fields := strings.Fields(opt.Arg())
+			if len(fields) < 2 {
+				errUsage()
+			}
+			m.Hooks = append(m.Hooks, merge.Hook{Pattern: fields[0], Command: fields[1:]})
+		case "--pre-run":
+			preRun = opt.Arg()
+		case "--post-run":
+			postRun = opt.Arg()
+		case "--no-hooks":
+			noHooks = on
+		case "--watch":
+			watch = on
+		case "--every":
+			d, err := time.ParseDuration(opt.Arg())
+			if err != nil || d <= 0 {
+				errUsage()
+			}
+			every = d
+		case "--progress":
+			progress = on
+		case "--clamp-mtime":
+			clampMtime = opt.Arg()
+		case "--format":
+			switch opt.Arg() {
+			case merge.MtreeSpec, merge.MtreeBOM:
+				mtreeFormat = opt.Arg()
+			default:
+				errUsage()
+			}
+		case "--bootstrap":
+			bootstrap = on
+		case "--exclude":
+			m.Exclude = append(m.Exclude, opt.Arg())
+		case "--host-overlays":
+			hostsDir = opt.Arg()
+		case "--hostname":
+			hostname = opt.Arg()
+		case "--templates":
+			m.Templates = on
+		case "--vars":
+			varsPath = opt.Arg()
+		case "--comment-leader":
+			name, leader, ok := strings.Cut(opt.Arg(), "=")
+			if !ok || name == "" || leader == "" {
+				errUsage()
+			}
+			if m.CommentLeaders == nil {
+				m.CommentLeaders = make(map[string]string)
+			}
+			m.CommentLeaders[name] = leader
+		case "--create-dest":
+			m.CreateDest = on
+		case "--allow-unprivileged":
+			allowUnpriv = on
+		case "--sudo":
+			useSudo = on
+		case "--user":
+			userMode = on
+			if on {
+				userDefaults()
+			}
+		case "--root":
+			rootDir = opt.Arg()
+		case "--relative-links":
+			m.RelativeLinks = on
+		case "--pair":
+			p, ok := parsePair(opt.Arg())
+			if !ok {
+				errUsage()
+			}
+			pairs = append(pairs, p)
+		case "--timeout":
+			d, err := time.ParseDuration(opt.Arg())
+			if err != nil || d <= 0 {
+				errUsage()
+			}
+			timeout = d
+		case "-U", "--unified":
+			n, err := strconv.Atoi(opt.Arg())
+			if err != nil || n < 0 {
+				errUsage()
+			}
+			m.DiffContext = n
+		case "-c", "--config", "--print-config":
+			// Handled by main.
 		default:
 			errUsage()
-			return
 		}
 	}
+}
 
-	err = filepath.WalkDir(srcDir, func(path string, d fs.DirEntry, walkErr error) error {
+func main() {
+	// Flags may be given both before and after the subcommand.
+	args, opts := parseArgs(os.Args[1:])
+	cmd := ""
+	if len(args) > 0 {
+		var more []getopt.OptArg
+		first := args[0]
+		args, more = parseArgs(args[1:])
+		opts = append(opts, more...)
+		if isCommand(first) {
+			cmd = first
+		} else {
+			// Not a command, but the first of the paths to merge.
+			args = append([]string{first}, args...)
+		}
+	}
+	// Settings from the config files come first, so that flags override them.
+	configPaths := defaultConfigPaths()
+	printConfig := false
+	for _, opt := range opts {
+		switch opt.Opt() {
+		case "-c", "--config":
+			configPaths = []string{opt.Arg()}
+		case "--print-config":
+			printConfig = true
+		}
+	}
+	for _, name := range configPaths {
+		configOpts, err := readConfig(name)
+		if os.IsNotExist(err) && len(configPaths) > 1 {
+			// Only a config file that was asked for must exist.
+			continue
+		} else if err != nil {
+			logError("%s: %s", progName, err)
+			exit(exitUsage)
+		}
+		applyOpts(configOpts)
+	}
+	applyOpts(opts)
+	setupLogger()
+	if printConfig {
+		writeConfig(os.Stdout)
+		exit(exitOK)
+	}
+	startReport(cmd)
+	m.Hostname = hostname
+	// Arguments are split on whitespace, and never given to a shell.
+	m.MergeTool = strings.Fields(mergeTool)
+	if varsPath != "" {
+		vars, err := readVars(varsPath)
+		if err != nil {
+			logError("%s: %s", progName, err)
+			exit(exitUsage)
+		}
+		m.Vars = vars
+	}
+	if hostsDir != "" {
+		dir, err := hostOverlay()
+		if err != nil {
+			logError("%s: %s", progName, err)
+			exit(exitUsage)
+		}
+		if dir != "" {
+			logDebug("OVERLAY:\t%s", dir)
+			m.Layers = append(m.Layers, dir)
+		}
+	}
+	if len(pairs) > 0 {
+		// Each pair is a run of its own, of everything in it.
+		if cmd != "" || prune || watch || every > 0 || len(args) != 0 || len(m.Layers) > 0 {
+			errUsage()
+		}
+		m.SrcDir, m.DestDir = pairs[0][0], pairs[0][1]
+	}
+	var plan *merge.Plan
+	if cmd == "apply" && len(args) == 1 {
+		// Where to merge is part of the plan, and it's checked like any other.
 		var err error
-		if walkErr != nil {
-			return walkErr
+		if plan, err = readPlan(args[0]); err != nil {
+			logError("%s: %s", progName, err)
+			exit(exitCode(err))
 		}
-		rel, err := filepath.Rel(srcDir, path)
+		m.SrcDir, m.Layers, m.DestDir = plan.SrcDir, plan.Layers, plan.DestDir
+	}
+	if rootDir != "" {
+		// What's written goes inside the root, never into the live system.
+		root, err := filepath.Abs(rootDir)
 		if err != nil {
-			return err
+			logError("%s: %s", progName, err)
+			exit(exitUsage)
 		}
-		srcPath := filepath.Join(srcDir, rel)
-		destPath := filepath.Join(destDir, rel)
-		if d.IsDir() {
-			// Ensure the directory exists in the destination
-			st, err := d.Info()
-			if err != nil {
-				return err
-			}
-			err = os.Mkdir(destPath, st.Mode())
-			if err == nil {
-				logInfo.Printf("MKDIR:\t%s", destPath)
-				return nil
-			}
-			if os.IsExist(err) {
-				return nil
+		m.Root = root
+		if plan == nil {
+			m.DestDir = filepath.Join(root, m.DestDir)
+		} else if rel, err := filepath.Rel(root, m.DestDir); err != nil || rel == ".." ||
+			strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			// Made with the same --root, it's inside already.
+			logError("%s: the plan is for %s, which is not inside %s", progName, m.DestDir, root)
+			exit(exitUsage)
+		}
+		for i := range pairs {
+			pairs[i][1] = filepath.Join(root, pairs[i][1])
+		}
+		for _, path := range []*string{&m.ManifestPath, &m.CachePath, &m.BackupDir} {
+			if *path != "" {
+				*path = filepath.Join(root, *path)
 			}
-			return err
 		}
-		if strings.HasSuffix(srcPath, "~") {
-			logInfo.Printf("IGNORE:\t%s", srcPath)
-			return nil
+	}
+	if merge.IsArchive(m.SrcDir) {
+		// It's read in full first, so that a broken one changes nothing.
+		fsys, err := merge.OpenArchive(m.SrcDir)
+		if err != nil {
+			logError("%s: %s", progName, err)
+			exit(exitUsage)
 		}
-		if _, err = os.Stat(destPath); os.IsNotExist(err) {
-			if !dryRun {
-				if err = copyFile(srcPath, destPath); err != nil {
-					return err
-				}
+		m.SrcFS = fsys
+	}
+	if len(args) != 0 && (prune || cmd == "verify") {
+		errUsage()
+	}
+	if len(args) == 0 && cmd == "adopt" || len(args) != 1 && (cmd == "apply" || cmd == "explain") ||
+		len(args) > 1 && cmd == "undo" {
+		errUsage()
+	}
+	if planOut != "" && cmd != "plan" && cmd != "bundle" && cmd != "mtree" {
+		errUsage()
+	}
+	if watch && (cmd != "" || prune || len(args) != 0 || every > 0 || m.SrcFS != nil) {
+		errUsage()
+	}
+	agent := cmd == "install-agent" || cmd == "uninstall-agent"
+	if every > 0 && (cmd != "" && cmd != "install-agent" || prune || len(args) != 0) ||
+		bootstrap && !agent || agent && len(args) != 0 {
+		errUsage()
+	}
+	if check && (cmd != "" || prune || watch || every > 0) {
+		errUsage()
+	}
+	if print0 && (jsonOut != nil || colorMode == "always" ||
+		cmd != "" && cmd != "adopt" && cmd != "revert" && cmd != "apply" && cmd != "undo") {
+		// Only actions go on stdout, and nothing else is mixed in.
+		errUsage()
+	}
+	if progress && (cmd != "" || prune || watch || every > 0 || interactive) {
+		errUsage()
+	}
+	if m.Workers > 1 && (cmd != "" || prune) {
+		// Only merging is done in parallel.
+		errUsage()
+	}
+	if prune && cmd != "" || m.Prune && (prune || cmd != "" && cmd != "plan") {
+		errUsage()
+	}
+	if m.NoBackup && m.BackupRotate > 0 {
+		errUsage()
+	}
+	if m.Force && (m.NoBackup || m.BackupRotate > 0 || interactive || prune ||
+		cmd == "status" || cmd == "verify" || cmd == "plan") {
+		// Nothing to force, or conflicting ways of resolving conflicts.
+		errUsage()
+	}
+	if err := m.Validate(); err != nil {
+		logError("%s: %s", progName, err)
+		exit(exitUsage)
+	}
+	srcDir, destDir := m.SrcDir, m.DestDir
+	if err := m.ResolveDirs(); err != nil && len(pairs) == 0 {
+		logError("%s: %s", progName, err)
+		exit(exitUsage)
+	}
+	for _, dir := range [][2]string{{srcDir, m.SrcDir}, {destDir, m.DestDir}} {
+		if dir[0] != dir[1] {
+			logDebug("RESOLVED:\t%s -> %s", dir[0], dir[1])
+		}
+	}
+	switch cmd {
+	case "", "status", "lint", "plan", "bundle", "mtree":
+		// Positional arguments select what to merge.
+		m.Paths = args
+	}
+	// Pruning and undoing only look at the destination. The pairs are checked as they're
+	// merged.
+	if err := m.ValidateDirs(!prune && cmd != "undo"); err != nil && len(pairs) == 0 {
+		logError("%s: %s", progName, err)
+		exit(exitUsage)
+	}
+
+	if agent {
+		var err error
+		if cmd == "install-agent" {
+			err = installAgent(opts, bootstrap)
+		} else {
+			err = uninstallAgent(bootstrap)
+		}
+		if err != nil {
+			logError("%s: %s", progName, err)
+			exit(exitError)
+		}
+		exit(exitOK)
+	}
+	if interactive {
+		if err := openTTY(); err != nil {
+			logError("%s: %s", progName, err)
+			exit(exitUsage)
+		}
+		m.Resolve = resolveConflict
+	}
+	// Only worth the reading if it's shown.
+	m.FirstDiff = jsonOut != nil || logLevel.Level() <= slog.LevelDebug
+	if jsonOut != nil {
+		m.Observer = jsonObserver{jsonOut}
+	} else if print0 {
+		m.Observer = print0Observer{w: bufio.NewWriter(os.Stdout), changedOnly: changedOnly}
+	} else {
+		// Diffs are requested explicitly, so show them even if not verbose.
+		m.Observer = merge.SlogObserver{
+			Logger: logger, Diff: os.Stdout, ChangedOnly: changedOnly, Relative: relative,
+		}
+	}
+	var progressOut *progressObserver
+	if progress {
+		progressOut = newProgressObserver(m.Observer)
+		m.Observer = progressOut
+	}
+	if report != nil || metricsPath != "" {
+		m.Observer = recordObserver{m.Observer}
+	}
+
+	// Stop at the next file (or chunk of one) on a signal; whatever was in progress is
+	// rolled back.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if timeout > 0 && every == 0 {
+		// With --every, it's for each run.
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	writes := !m.DryRun && cmd != "status" && cmd != "lint" && cmd != "explain" && cmd != "verify" && cmd != "plan" &&
+		cmd != "bundle" && cmd != "mtree"
+	systemDest := isSystemDir(m.DestDir)
+	for _, p := range pairs {
+		systemDest = systemDest || isSystemDir(p[1])
+	}
+	if writes && cmd != "adopt" && !allowUnpriv && os.Geteuid() != 0 && systemDest {
+		if useSudo || (interactive && askSudo()) {
+			err := runSudo()
+			logError("%s: can't run with sudo: %s", progName, err)
+			exit(exitUsage)
+		}
+		// Fail before anything is copied, rather than part way through.
+		logError("%s: %s is only writable by root; run with sudo (or --allow-unprivileged)",
+			progName, m.DestDir)
+		exit(exitUsage)
+	}
+
+	// Only one run at a time may change anything.
+	if lockPath == "" && os.Geteuid() == 0 {
+		lockPath = defaultLockPath
+	}
+	if writes && !noLock && lockPath != "" {
+		if userMode {
+			// The state directory may not be there yet; the manifest and cache would
+			// make it anyway.
+			os.MkdirAll(filepath.Dir(lockPath), 0700)
+		}
+		if err := acquireLock(ctx, lockPath, waitLock); err != nil {
+			logError("%s: %s", progName, err)
+			if ctx.Err() != nil {
+				err = ctx.Err()
 			}
-			logInfo.Printf("COPY:\t%s <- %s", destPath, srcPath)
-			// There shouldn't be a need to check for the backup here.
-			return nil
+			exit(exitCode(err))
+		}
+	}
+
+	if !noJournal {
+		if journalDir == "" && os.Geteuid() == 0 {
+			journalDir = merge.DefaultJournalDir
 		}
+		m.JournalDir = journalDir
+	}
 
-		backupPath := fmt.Sprintf("%s%s", destPath, backupSuffix)
-		same, err := fileContentsAreIdentical(srcPath, destPath)
+	hooks := !noHooks && (cmd == "" || cmd == "adopt" || cmd == "revert" || cmd == "apply")
+	if !hooks {
+		m.Hooks = nil
+	} else if preRun != "" && !watch && every == 0 {
+		err := runHook(ctx, preRun, false, nil, false)
+		reportHook("pre-run", preRun, err)
 		if err != nil {
-			return err
+			logError("%s: pre-run hook failed: %s", progName, err)
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			exit(exitCode(err))
+		}
+	}
+
+	var actions []merge.Action
+	var err error
+	blocked := false
+	switch cmd {
+	case "":
+		if prune {
+			actions, err = m.PruneBackups(ctx)
+		} else if watch {
+			err = watchSrc(ctx, hooks)
+		} else if every > 0 {
+			err = runEvery(ctx, hooks)
+		} else if len(pairs) > 0 {
+			actions, err = runPairs(ctx)
+		} else {
+			actions, err = m.Run(ctx)
+		}
+	case "status":
+		if m.ManifestPath != "" {
+			if rev, err := m.Revision(); err == nil && rev != "" {
+				fmt.Printf("revision\t%s\n", rev)
+			}
 		}
-		if same {
-			logInfo.Printf("OK:\t%s <- %s", destPath, srcPath)
-			same, _ = fileContentsAreIdentical(destPath, backupPath)
-			if !same {
-				// destination is up to date with source, but there's still a backup
-				// with contents different from our version.
-				logInfo.Printf("CHECK:\t%s", backupPath)
+		var states []merge.FileStatus
+		states, err = m.Status(ctx)
+		for _, st := range states {
+			if st.State == merge.StateBlocked {
+				blocked = true
 			}
-			return nil
+			fmt.Printf("%s\t%s\n", st.State, st.Dest)
 		}
-		if !dryRun {
-			_, err = os.Stat(backupPath)
-			backupExists := (err == nil || !os.IsNotExist(err))
-			same, _ = fileContentsAreIdentical(destPath, backupPath)
-			if backupExists && !same {
-				logError.Printf("ERROR:\trefusing to overwrite backup: %s\n", backupPath)
-				return errRefuse
+	case "lint":
+		var findings []merge.Finding
+		findings, err = m.Lint(ctx)
+		for _, f := range findings {
+			if f.Severity == merge.SeverityError {
+				blocked = true
 			}
-			if err = os.Rename(destPath, backupPath); err != nil {
-				return err
+			path := f.Path
+			if strings.IndexFunc(path, unicode.IsControl) >= 0 {
+				path = strconv.Quote(path)
 			}
+			fmt.Printf("%s\t%s\t%s\n", f.Severity, path, f.Message)
+		}
+	case "explain":
+		var e *merge.Explanation
+		if e, err = m.Explain(ctx, args[0]); err == nil {
+			printExplanation(e)
 		}
-		logInfo.Printf("MOVE:\t%s <- %s", backupPath, destPath)
-		if !dryRun {
-			if err = copyFile(srcPath, destPath); err != nil {
-				return err
+	case "verify":
+		var states []merge.FileStatus
+		states, err = m.Verify(ctx)
+		for _, st := range states {
+			if st.State == merge.StateDrifted || st.State == merge.StateDeleted {
+				blocked = true
 			}
+			fmt.Printf("%s\t%s\n", st.State, st.Dest)
 		}
-		logInfo.Printf("COPY:\t%s <- %s", destPath, srcPath)
-		return nil
-	})
+	case "adopt":
+		actions, err = m.Adopt(ctx, args)
+	case "revert":
+		actions, err = m.Revert(ctx, args)
+	case "undo":
+		var id string
+		if len(args) > 0 {
+			id = args[0]
+		}
+		actions, err = m.Undo(ctx, id)
+	case "plan":
+		plan, err = m.Plan(ctx)
+		if err == nil {
+			err = writePlan(plan, planOut)
+		}
+	case "bundle":
+		err = writeBundle(ctx, planOut)
+	case "mtree":
+		err = writeMtree(ctx, planOut)
+	case "apply":
+		actions, err = m.Apply(ctx, plan)
+	default:
+		errUsage()
+	}
+	if progressOut != nil {
+		progressOut.clear()
+	}
+	if dir := m.JournalPath(); dir != "" {
+		logDebug("JOURNAL:\t%s", dir)
+	}
 
+	if hooks && postRun != "" && !watch && every == 0 {
+		// Even if the run was interrupted, so that it can be reported.
+		hookErr := runHook(context.Background(), postRun, true, actions, err != nil)
+		reportHook("post-run", postRun, hookErr)
+		if hookErr != nil {
+			hookErr = fmt.Errorf("post-run hook failed: %w", hookErr)
+			if err == nil {
+				err = hookErr
+			} else {
+				logError("%s: %s", progName, hookErr)
+			}
+		}
+	}
+	changes := countChanges(actions)
+	summary := !watch && every == 0 && (cmd == "" || cmd == "adopt" || cmd == "revert" || cmd == "apply" ||
+		cmd == "undo")
 	if err != nil {
-		logError.Printf("%s: %s\n", progName, err)
-		os.Exit(2)
+		reportErr(err, changes)
+		if summary && len(actions) > 0 {
+			// Not if it failed before it got started.
+			printSummary(actions, err)
+		}
+		exit(exitCode(err))
+	}
+	if summary {
+		printSummary(actions, nil)
+	}
+	if check && !converged(actions) {
+		exit(exitPending)
+	}
+	if blocked {
+		exit(exitRefused)
 	}
+	exit(exitOK)
 }
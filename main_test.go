@@ -0,0 +1,762 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rollcat/upmerge/merge"
+)
+
+// TestMain runs main instead of the tests when UPMERGE_TEST_MAIN is set, so that
+// tests can run upmerge as a command, with runMain.
+func TestMain(m *testing.M) {
+	if os.Getenv("UPMERGE_TEST_MAIN") != "" {
+		os.Args = append([]string{"upmerge"}, os.Args[1:]...)
+		progName = "upmerge"
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// result is the outcome of running upmerge.
+type result struct {
+	code           int
+	stdout, stderr string
+}
+
+// mainCommand returns the command running upmerge with args, from dir, without reading
+// any config file, and with neither a lock nor a journal kept outside dir.
+func mainCommand(t *testing.T, dir string, args ...string) *exec.Cmd {
+	t.Helper()
+	config := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(config, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(os.Args[0], append([]string{"-c", config, "--no-lock", "--no-journal"}, args...)...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "UPMERGE_TEST_MAIN=1", "XDG_CONFIG_HOME="+dir, "NO_COLOR=1")
+	return cmd
+}
+
+// runMain runs upmerge with args, as mainCommand does, and returns how it went.
+func runMain(t *testing.T, dir string, args ...string) result {
+	t.Helper()
+	cmd := mainCommand(t, dir, args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		t.Fatal(err)
+	}
+	return result{cmd.ProcessState.ExitCode(), stdout.String(), stderr.String()}
+}
+
+// writeFiles creates the files in dir named by the keys of files (slash-separated, and
+// relative to it), holding their values; a name ending in "/" is a directory. Their
+// modes are 0644 and 0755, whatever the umask.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, contents := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if strings.HasSuffix(name, "/") {
+			if err := os.MkdirAll(path, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chmod(path, 0755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(path, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// fixture makes a directory with src and dest in it, holding the given files, and
+// returns it.
+func fixture(t *testing.T, src, dest map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	writeFiles(t, filepath.Join(dir, "src"), src)
+	writeFiles(t, filepath.Join(dir, "dest"), dest)
+	writeFiles(t, dir, map[string]string{"src/": "", "dest/": ""})
+	return dir
+}
+
+func TestExitStatus(t *testing.T) {
+	tests := []struct {
+		name      string
+		src, dest map[string]string
+		args      []string
+		want      int
+	}{
+		{
+			name: "up to date",
+			src:  map[string]string{"a": "a\n"}, dest: map[string]string{"a": "a\n"},
+			want: exitOK,
+		},
+		{
+			name: "dry run, up to date",
+			src:  map[string]string{"a": "a\n", "d/": ""}, dest: map[string]string{"a": "a\n", "d/": ""},
+			args: []string{"-n"},
+			want: exitOK,
+		},
+		{
+			name: "dry run, file to copy",
+			src:  map[string]string{"a": "a\n", "b": "b\n"}, dest: map[string]string{"a": "a\n"},
+			args: []string{"-n"},
+			want: exitOK,
+		},
+		{
+			name: "dry run, file to replace",
+			src:  map[string]string{"a": "new\n"}, dest: map[string]string{"a": "old\n"},
+			args: []string{"-n"},
+			want: exitOK,
+		},
+		{
+			name: "dry run, directory to make",
+			src:  map[string]string{"d/": ""},
+			args: []string{"-n"},
+			want: exitOK,
+		},
+		// Only with --check does anything to do make it fail.
+		{
+			name: "check, up to date",
+			src:  map[string]string{"a": "a\n", "d/": ""}, dest: map[string]string{"a": "a\n", "d/": ""},
+			args: []string{"--check"},
+			want: exitOK,
+		},
+		{
+			name: "check, file to copy",
+			src:  map[string]string{"a": "a\n", "b": "b\n"}, dest: map[string]string{"a": "a\n"},
+			args: []string{"--check"},
+			want: exitPending,
+		},
+		{
+			name: "check, directory to make",
+			src:  map[string]string{"d/": ""},
+			args: []string{"--check"},
+			want: exitPending,
+		},
+		{
+			name: "check, differing backup left over",
+			src:  map[string]string{"a": "a\n"}, dest: map[string]string{"a": "a\n", "a.upmerge~": "old\n"},
+			args: []string{"--check"},
+			want: exitPending,
+		},
+		{
+			name: "changes made",
+			src:  map[string]string{"a": "new\n"}, dest: map[string]string{"a": "old\n"},
+			want: exitOK,
+		},
+		{
+			name: "differing backup",
+			src:  map[string]string{"a": "new\n"},
+			dest: map[string]string{"a": "old\n", "a.upmerge~": "older\n"},
+			want: exitRefused,
+		},
+		{
+			name: "missing source",
+			args: []string{"-s", "missing"},
+			want: exitUsage,
+		},
+		{
+			name: "destination is a file",
+			src:  map[string]string{"a": "a\n"},
+			args: []string{"-d", "backups/file"},
+			want: exitUsage,
+		},
+		{
+			name: "destination inside source",
+			src:  map[string]string{"sub/": ""},
+			args: []string{"-d", "src/sub"},
+			want: exitUsage,
+		},
+		{
+			name: "unknown flag",
+			args: []string{"--no-such-flag"},
+			want: exitUsage,
+		},
+		{
+			name: "hard error",
+			src:  map[string]string{"a/b": "b\n"}, dest: map[string]string{"a": "a\n"},
+			args: []string{"--resolve-type-conflicts", "src", "--backup-dir", "backups/file"},
+			want: exitError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := fixture(t, tt.src, tt.dest)
+			writeFiles(t, dir, map[string]string{"backups/file": ""})
+			r := runMain(t, dir, append([]string{"-s", "src", "-d", "dest"}, tt.args...)...)
+			if r.code != tt.want {
+				t.Errorf("exit status %d, want %d\nstdout:\n%s\nstderr:\n%s", r.code, tt.want, r.stdout, r.stderr)
+			}
+		})
+	}
+}
+
+func TestHostOverlays(t *testing.T) {
+	dir := fixture(t, map[string]string{"common": "common\n", "both": "common\n"}, nil)
+	writeFiles(t, dir, map[string]string{
+		"hosts/web/src/both":  "web\n",
+		"hosts/web/src/only":  "web\n",
+		"hosts/mail/src/both": "mail\n",
+	})
+	tests := []struct {
+		host string
+		want map[string]string
+	}{
+		{"web", map[string]string{"common": "common\n", "both": "web\n", "only": "web\n"}},
+		{"mail", map[string]string{"common": "common\n", "both": "mail\n"}},
+		// Without an overlay of its own, a host only gets the common files.
+		{"db", map[string]string{"common": "common\n", "both": "common\n"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			dest := filepath.Join(dir, "dest-"+tt.host)
+			r := runMain(t, dir, "-v", "-s", "src", "-d", dest, "--create-dest",
+				"--host-overlays", "hosts", "--hostname", tt.host)
+			if r.code != exitOK {
+				t.Fatalf("exit status %d\n%s", r.code, r.stderr)
+			}
+			for name, want := range tt.want {
+				if got, err := os.ReadFile(filepath.Join(dest, name)); err != nil || string(got) != want {
+					t.Errorf("%s: got %q (%v), want %q", name, got, err, want)
+				}
+			}
+			if _, err := os.Stat(filepath.Join(dest, "only")); tt.host != "web" && !os.IsNotExist(err) {
+				t.Errorf("only: copied from another host's overlay")
+			}
+			// The log tells where overlaid files came from.
+			overlay := filepath.Join("hosts", tt.host, "src", "both")
+			if tt.host != "db" && !strings.Contains(r.stdout+r.stderr, overlay) {
+				t.Errorf("log doesn't mention %s:\n%s%s", overlay, r.stdout, r.stderr)
+			}
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+	dir := fixture(t, map[string]string{"a": "new\n", "b": "new\n"}, map[string]string{"a": "old\n", "b": "old\n"})
+	planPath := filepath.Join(dir, "plan.json")
+	if r := runMain(t, dir, "plan", "-o", planPath, "-s", "src", "-d", "dest"); r.code != exitOK {
+		t.Fatalf("plan: exit status %d: %s", r.code, r.stderr)
+	}
+	buf, err := os.ReadFile(planPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// rewrite saves the plan, with the directories changed by fn.
+	rewrite := func(fn func(p *merge.Plan)) string {
+		t.Helper()
+		var p merge.Plan
+		if err := json.Unmarshal(buf, &p); err != nil {
+			t.Fatal(err)
+		}
+		fn(&p)
+		out, err := json.Marshal(&p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(t.TempDir(), "plan.json")
+		if err := os.WriteFile(path, out, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	if r := runMain(t, dir, "apply", filepath.Join(dir, "missing.json")); r.code != exitError {
+		t.Errorf("missing plan: exit status %d: %s", r.code, r.stderr)
+	}
+
+	// The plan's directories are checked like those given with -s and -d.
+	missing := rewrite(func(p *merge.Plan) { p.DestDir = filepath.Join(dir, "missing") })
+	if r := runMain(t, dir, "apply", missing); r.code != exitUsage || !strings.Contains(r.stderr, "doesn't exist") {
+		t.Errorf("plan for a missing directory: exit status %d: %s", r.code, r.stderr)
+	}
+	if r := runMain(t, dir, "--root", t.TempDir(), "apply", planPath); r.code != exitUsage ||
+		!strings.Contains(r.stderr, "not inside") {
+		t.Errorf("plan outside the root: exit status %d: %s", r.code, r.stderr)
+	}
+	if os.Geteuid() != 0 && isSystemDir("/etc") {
+		etc := rewrite(func(p *merge.Plan) { p.DestDir = "/etc" })
+		if r := runMain(t, dir, "apply", etc); r.code != exitUsage || !strings.Contains(r.stderr, "only writable by root") {
+			t.Errorf("plan for /etc: exit status %d: %s", r.code, r.stderr)
+		}
+	}
+
+	// What changed since the plan was made is skipped, and the rest applied.
+	writeFiles(t, filepath.Join(dir, "dest"), map[string]string{"b": "mine\n"})
+	if r := runMain(t, dir, "apply", planPath); r.code != exitError {
+		t.Errorf("apply: exit status %d: %s", r.code, r.stderr)
+	}
+	if buf, _ := os.ReadFile(filepath.Join(dir, "dest", "a")); string(buf) != "new\n" {
+		t.Errorf("dest/a: got %q, want it applied", buf)
+	}
+	if buf, _ := os.ReadFile(filepath.Join(dir, "dest", "b")); string(buf) != "mine\n" {
+		t.Errorf("dest/b: got %q, want it skipped", buf)
+	}
+}
+
+func TestBoolFlags(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"upmerge.conf": "verbose = true\nno-backup = yes\nmerge = false\n"})
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{"config", nil, []string{"verbose = true", "no-backup = true", "merge = false"}},
+		{"turned off", []string{"--verbose=false", "--no-backup=no"}, []string{"verbose = false", "no-backup = false"}},
+		{"turned on", []string{"--merge=true"}, []string{"merge = true"}},
+		{"last wins", []string{"--merge", "--merge=false", "--no-backup=false", "--no-backup"},
+			[]string{"merge = false", "no-backup = true"}},
+		{"check leaves dry run", []string{"-n", "--check", "--check=false"}, []string{"dry-run = true", "check = false"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := runMain(t, dir, append([]string{"-c", "upmerge.conf", "--print-config"}, tt.args...)...)
+			if r.code != exitOK {
+				t.Fatalf("exit status %d: %s", r.code, r.stderr)
+			}
+			lines := strings.Split(r.stdout, "\n")
+			for _, want := range tt.want {
+				found := false
+				for _, line := range lines {
+					found = found || line == want
+				}
+				if !found {
+					t.Errorf("no %q in:\n%s", want, r.stdout)
+				}
+			}
+		})
+	}
+	r := runMain(t, dir, "--merge=maybe")
+	if r.code != exitUsage || !strings.Contains(r.stderr, "--merge must be true or false") {
+		t.Errorf("--merge=maybe: exit status %d: %s", r.code, r.stderr)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir := fixture(t, map[string]string{"a": "1"}, nil)
+	cmd := mainCommand(t, dir, "-v", "--watch", "-s", "src", "-d", "dest")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	waitFor := func(name, want string) {
+		t.Helper()
+		for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); {
+			if buf, err := os.ReadFile(filepath.Join(dir, "dest", name)); err == nil && string(buf) == want {
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		t.Fatalf("%s never became %q", name, want)
+	}
+	waitFor("a", "1")
+	// A new directory, with a file in it, and a change to what's there.
+	writeFiles(t, filepath.Join(dir, "src"), map[string]string{"sub/b": "2", "a": "3"})
+	waitFor("sub/b", "2")
+	waitFor("a", "3")
+	// A fragment is merged into the file it's named after.
+	writeFiles(t, filepath.Join(dir, "src"), map[string]string{"hosts" + merge.AppendSuffix: "4\n"})
+	waitFor("hosts", "# BEGIN upmerge\n4\n# END upmerge\n")
+	if err := cmd.Process.Signal(os.Interrupt); err != nil {
+		t.Skip(err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("%v: %s", err, stderr.String())
+	}
+	// Each change is only merged by itself, rather than with everything.
+	watched := make(map[string]bool)
+	for _, line := range strings.Split(stderr.String(), "\n") {
+		if paths, ok := strings.CutPrefix(line, "WATCH:\t"); ok {
+			for _, path := range strings.Fields(paths) {
+				watched[path] = true
+			}
+		}
+	}
+	if !watched["a"] || !watched["sub"] || !watched["hosts"] {
+		t.Errorf("no WATCH for a, sub and hosts in:\n%s", stderr.String())
+	}
+}
+
+func TestChangedPaths(t *testing.T) {
+	defer func(templates bool) { m.Templates = templates }(m.Templates)
+	m.Templates = true
+	file := srcEntry{mode: 0644, size: 1}
+	changed := srcEntry{mode: 0644, size: 2}
+	old := map[srcKey]srcEntry{
+		{0, "."}: {mode: fs.ModeDir | 0755}, {0, "etc"}: {mode: fs.ModeDir | 0755},
+		{0, "etc/hosts.upmerge-append"}: file, {0, "etc/motd.upmerge-append.tmpl"}: file,
+		{0, "etc/issue.tmpl"}: file, {0, "etc/plain"}: file,
+	}
+	tests := []struct {
+		name   string
+		change map[srcKey]srcEntry
+		want   []string
+	}{
+		{"plain", map[srcKey]srcEntry{{0, "etc/plain"}: changed}, []string{"etc/plain"}},
+		{"template", map[srcKey]srcEntry{{0, "etc/issue.tmpl"}: changed}, []string{"etc/issue"}},
+		{"fragment", map[srcKey]srcEntry{{0, "etc/hosts.upmerge-append"}: changed}, []string{"etc/hosts"}},
+		{"templated fragment", map[srcKey]srcEntry{{0, "etc/motd.upmerge-append.tmpl"}: changed}, []string{"etc/motd"}},
+		{"new fragment", map[srcKey]srcEntry{{0, "etc/fstab.upmerge-append"}: file}, []string{"etc/fstab"}},
+		{"ignore file", map[srcKey]srcEntry{{0, merge.IgnoreFile}: file}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cur := make(map[srcKey]srcEntry)
+			for k, e := range old {
+				cur[k] = e
+			}
+			for k, e := range tt.change {
+				cur[k] = e
+			}
+			paths, changed := changedPaths(old, cur)
+			if !changed || strings.Join(paths, " ") != strings.Join(tt.want, " ") || (paths == nil) != (tt.want == nil) {
+				t.Errorf("got %q, %v; want %q", paths, changed, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		argv []string
+		opts string
+		args []string
+	}{
+		{name: "none", argv: nil},
+		{name: "short", argv: []string{"-n", "-v", "-s", "src", "-d", "dest"}, opts: "-n -v -s=src -d=dest"},
+		{name: "bundled", argv: []string{"-nv", "-P", "4"}, opts: "-n -v -P=4"},
+		{name: "long", argv: []string{"--dry-run", "--verbose", "--source", "src", "--dest=dest"},
+			opts: "--dry-run --verbose --source=src --dest=dest"},
+		{name: "paths", argv: []string{"-n", "ssh", "pam.d"}, opts: "-n", args: []string{"ssh", "pam.d"}},
+		{name: "after --", argv: []string{"-n", "--", "-v"}, opts: "-n", args: []string{"-v"}},
+		{name: "value", argv: []string{"--dry-run=false", "--verbose=yes"}, opts: "--dry-run=false --verbose"},
+		// Left as it was given, rather than as getopt was given it.
+		{name: "path like a flag", argv: []string{"ssh", "--dry-run=false"}, args: []string{"ssh", "--dry-run=false"}},
+		{name: "snapshot", argv: []string{"--snapshot", "--snapshot=best-effort"},
+			opts: "--snapshot=required --snapshot=best-effort"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args, opts := parseArgs(tt.argv)
+			var got []string
+			for _, opt := range opts {
+				if opt.Arg() != "" {
+					got = append(got, opt.Opt()+"="+opt.Arg())
+				} else {
+					got = append(got, opt.Opt())
+				}
+			}
+			if strings.Join(got, " ") != tt.opts {
+				t.Errorf("flags: got %q, want %q", strings.Join(got, " "), tt.opts)
+			}
+			if strings.Join(args, " ") != strings.Join(tt.args, " ") {
+				t.Errorf("paths: got %q, want %q", args, tt.args)
+			}
+		})
+	}
+}
+
+func TestUsage(t *testing.T) {
+	dir := fixture(t, nil, nil)
+	tests := []struct {
+		name   string
+		args   []string
+		code   int
+		stdout string
+		stderr string
+	}{
+		{name: "unknown flag", args: []string{"--frobnicate"}, code: exitUsage,
+			stdout: "Usage: upmerge ", stderr: "upmerge: unknown flag --frobnicate\n"},
+		{name: "unknown short flag", args: []string{"-nx"}, code: exitUsage,
+			stdout: "Usage: upmerge ", stderr: "upmerge: unknown flag -x\n"},
+		{name: "missing value", args: []string{"-P"}, code: exitUsage, stderr: "upmerge: -P needs a value\n"},
+		{name: "bad value", args: []string{"--jobs", "none"}, code: exitUsage, stdout: "Usage: upmerge "},
+		{name: "help", args: []string{"--help"}, code: exitOK, stdout: "Maintain local overrides to /etc.\n"},
+		{name: "short help", args: []string{"-h"}, code: exitOK, stdout: "Maintain local overrides to /etc.\n"},
+		{name: "version", args: []string{"--version"}, code: exitOK, stdout: "upmerge devel (" + runtime.Version() + ")\n"},
+		{name: "long and short", args: []string{"--source", "src", "-d", "dest", "--dry-run"}, code: exitOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := runMain(t, dir, tt.args...)
+			if r.code != tt.code {
+				t.Errorf("exit status %d, want %d", r.code, tt.code)
+			}
+			if !strings.Contains(r.stdout, tt.stdout) {
+				t.Errorf("stdout %q, want %q in it", r.stdout, tt.stdout)
+			}
+			if tt.stderr != "" && r.stderr != tt.stderr {
+				t.Errorf("stderr %q, want %q", r.stderr, tt.stderr)
+			}
+		})
+	}
+}
+
+// update rewrites the golden files in testdata with what the tests got.
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// checkGolden fails t unless got is the same as the golden file testdata/name, or
+// rewrites it with -update.
+func checkGolden(t *testing.T, name, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", filepath.FromSlash(name))
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Errorf("got:\n%s\nwant (%s):\n%s", got, path, want)
+	}
+}
+
+func TestExplain(t *testing.T) {
+	const old = "old\n"
+	tests := []struct {
+		name      string
+		src, dest map[string]string
+		args      []string
+		path      string
+		setup     func(t *testing.T, dir string)
+	}{
+		{name: "not in source", dest: map[string]string{"f": old}, path: "f"},
+		{name: "excluded directory", src: map[string]string{"d/f": "f\n"}, args: []string{"--exclude", "d"}, path: "d/f"},
+		{name: "excluded", src: map[string]string{"f": "f\n"}, args: []string{"--exclude", "f"}, path: "f"},
+		{name: "not included", src: map[string]string{"f": "f\n", "g": "g\n"}, args: []string{"--include", "g"}, path: "f"},
+		{name: "removed", src: map[string]string{"f.upmerge-remove": ""}, path: "f"},
+		{name: "remove", src: map[string]string{"f.upmerge-remove": ""}, dest: map[string]string{"f": old}, path: "f"},
+		{name: "remove without backup", src: map[string]string{"f.upmerge-remove": ""}, dest: map[string]string{"f": old},
+			args: []string{"--no-backup"}, path: "f"},
+		{name: "like a backup", src: map[string]string{"f.upmerge~": "f\n"}, path: "f.upmerge~"},
+		{name: "once", src: map[string]string{"f": "f\n"}, dest: map[string]string{"f": old}, args: []string{"--once", "f"}, path: "f"},
+		{name: "directory", src: map[string]string{"d/": ""}, dest: map[string]string{"d/": ""}, path: "d"},
+		{name: "mkdir", src: map[string]string{"d/": ""}, path: "d"},
+		{name: "chmod", src: map[string]string{"f": "f\n", ".upmergemeta": "f mode=0600\n"}, dest: map[string]string{"f": "f\n"}, path: "f"},
+		{name: "type conflict", src: map[string]string{"f": "f\n"}, dest: map[string]string{"f/": ""}, path: "f"},
+		{name: "type conflict, src wins", src: map[string]string{"f": "f\n"}, dest: map[string]string{"f/": ""},
+			args: []string{"--resolve-type-conflicts", "src"}, path: "f"},
+		{name: "type conflict, backup", src: map[string]string{"f": "f\n"}, dest: map[string]string{"f/": "", "f.upmerge~": old},
+			args: []string{"--resolve-type-conflicts", "src"}, path: "f"},
+		{name: "copy", src: map[string]string{"f": "f\n"}, path: "f"},
+		{name: "copy symlink", src: map[string]string{"f": "f\n"}, path: "l", setup: func(t *testing.T, dir string) {
+			if err := os.Symlink("f", filepath.Join(dir, "src", "l")); err != nil {
+				t.Skip(err)
+			}
+		}},
+		{name: "copy, backup matches", src: map[string]string{"f": "f\n"}, dest: map[string]string{"f.upmerge~": "f\n"}, path: "f"},
+		{name: "copy, backup matches, clean", src: map[string]string{"f": "f\n"}, dest: map[string]string{"f.upmerge~": "f\n"},
+			args: []string{"--clean-identical-backups"}, path: "f"},
+		{name: "copy, backup differs", src: map[string]string{"f": "f\n"}, dest: map[string]string{"f.upmerge~": old}, path: "f"},
+		{name: "copy, backup differs, strict", src: map[string]string{"f": "f\n"}, dest: map[string]string{"f.upmerge~": old},
+			args: []string{"--strict"}, path: "f"},
+		{name: "same", src: map[string]string{"f": "f\n"}, dest: map[string]string{"f": "f\n"}, path: "f"},
+		{name: "same, quick", src: map[string]string{"f": "f\n"}, dest: map[string]string{"f": "f\n"}, args: []string{"--quick"}, path: "f",
+			setup: func(t *testing.T, dir string) {
+				when := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+				for _, root := range []string{"src", "dest"} {
+					if err := os.Chtimes(filepath.Join(dir, root, "f"), when, when); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}},
+		{name: "same, loose", src: map[string]string{"f": "f\n"}, dest: map[string]string{"f": "f\r\n"},
+			args: []string{"--ignore-line-endings"}, path: "f"},
+		{name: "same, backup differs", src: map[string]string{"f": "f\n"}, dest: map[string]string{"f": "f\n", "f.upmerge~": old}, path: "f"},
+		{name: "same, backup matches", src: map[string]string{"f": "f\n"}, dest: map[string]string{"f": "f\n", "f.upmerge~": "f\n"}, path: "f"},
+		{name: "same, backup matches, clean", src: map[string]string{"f": "f\n"}, dest: map[string]string{"f": "f\n", "f.upmerge~": "f\n"},
+			args: []string{"--clean-identical-backups"}, path: "f"},
+		{name: "replace", src: map[string]string{"f": "f\n"}, dest: map[string]string{"f": old}, path: "f"},
+		{name: "replace without backup", src: map[string]string{"f": "f\n"}, dest: map[string]string{"f": old},
+			args: []string{"--no-backup"}, path: "f"},
+		{name: "replace, backup matches", src: map[string]string{"f": "f\n"}, dest: map[string]string{"f": old, "f.upmerge~": old}, path: "f"},
+		{name: "replace, backup rotated", src: map[string]string{"f": "f\n"}, dest: map[string]string{"f": old, "f.upmerge~1": "older\n"},
+			args: []string{"--backup-rotate", "2"}, path: "f"},
+		{name: "conflict", src: map[string]string{"f": "f\n"}, dest: map[string]string{"f": old, "f.upmerge~": "older\n"}, path: "f"},
+		{name: "conflict, forced", src: map[string]string{"f": "f\n"}, dest: map[string]string{"f": old, "f.upmerge~": "older\n"},
+			args: []string{"-f"}, path: "f"},
+		{name: "conflict, merge", src: map[string]string{"f": "f\n"}, dest: map[string]string{"f": old, "f.upmerge~": "older\n"},
+			args: []string{"--merge"}, path: "f"},
+		{name: "drifted", src: map[string]string{"f": "f\n"}, args: []string{"--manifest", "manifest", "--strict-drift"}, path: "f",
+			setup: func(t *testing.T, dir string) {
+				if r := runMain(t, dir, "-s", "src", "-d", "dest", "--manifest", "manifest"); r.code != exitOK {
+					t.Fatalf("exit status %d: %s", r.code, r.stderr)
+				}
+				writeFiles(t, dir, map[string]string{"src/f": "new\n", "dest/f": "changed\n"})
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := fixture(t, tt.src, tt.dest)
+			if tt.setup != nil {
+				tt.setup(t, dir)
+			}
+			args := append([]string{"-s", "src", "-d", "dest"}, tt.args...)
+			r := runMain(t, dir, append(args, "explain", tt.path)...)
+			if r.code != exitOK {
+				t.Fatalf("exit status %d: %s", r.code, r.stderr)
+			}
+			checkGolden(t, "explain/"+strings.NewReplacer(", ", "-", " ", "-").Replace(tt.name)+".txt", r.stdout)
+		})
+	}
+}
+
+func TestOutput(t *testing.T) {
+	src := map[string]string{
+		"top": "top\n", "a.txt": "a\n", "a/g": "g\n", "a/b/f": "f\n", "a/b/same": "same\n",
+		"a-b/f": "f\n", "c/h": "h\n", "c/d/e/deep": "deep\n", "z/": "",
+	}
+	dest := map[string]string{
+		"a/g": "old\n", "a/b/same": "same\n", "c/h": "old\n", "c/h.upmerge~": "older\n", "extra": "extra\n",
+	}
+	for i := 0; i < 20; i++ {
+		src[fmt.Sprintf("many/%02d", i)] = fmt.Sprintf("%d\n", i)
+	}
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"plain", nil},
+		{"relative", []string{"--relative"}},
+		{"json", []string{"-j"}},
+	}
+	for _, tt := range tests {
+		for _, workers := range []string{"1", "8"} {
+			t.Run(tt.name+"/P"+workers, func(t *testing.T) {
+				dir := fixture(t, src, dest)
+				// A parallel run that stops at an error finishes the files it's working
+				// on, which may be any of them, so this one keeps going past it.
+				args := append([]string{"-s", "src", "-d", "dest", "-v", "--keep-going", "-P", workers}, tt.args...)
+				r := runMain(t, dir, args...)
+				if r.code != exitRefused {
+					t.Fatalf("exit status %d, want %d: %s", r.code, exitRefused, r.stderr)
+				}
+				// Every -P has to get the same output, so there's one golden file for them.
+				checkGolden(t, "output/"+tt.name+".txt", r.stdout+r.stderr)
+			})
+		}
+	}
+}
+
+func TestPrint0(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file names can't have newlines in them")
+	}
+	const name = "a b\nc"
+	dir := fixture(t, map[string]string{name: "new\n", "same": "same\n"}, map[string]string{"same": "same\n"})
+	r := runMain(t, dir, "-s", "src", "-d", "dest", "-0")
+	if r.code != exitOK {
+		t.Fatalf("exit status %d: %s", r.code, r.stderr)
+	}
+	want := "copy\x00dest/" + name + "\x00src/" + name + "\x00" + "ok\x00dest/same\x00src/same\x00"
+	if r.stdout != want {
+		t.Errorf("stdout %q, want %q", r.stdout, want)
+	}
+	// As read by xargs -0, or while read -d ''.
+	fields := strings.Split(strings.TrimSuffix(r.stdout, "\x00"), "\x00")
+	if len(fields)%3 != 0 || fields[1] != "dest/"+name {
+		t.Errorf("fields %q, want three to an action, with %q intact", fields, name)
+	}
+
+	for _, args := range [][]string{{"-j"}, {"--color", "always"}} {
+		if r := runMain(t, dir, append([]string{"-s", "src", "-d", "dest", "-0"}, args...)...); r.code != exitUsage {
+			t.Errorf("-0 %s: exit status %d, want %d", strings.Join(args, " "), r.code, exitUsage)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	// The first two change from run to run.
+	masked := regexp.MustCompile(`(?m)^(upmerge_last_run_(timestamp|duration)_seconds\{.*\}) .*$`)
+	tests := []struct {
+		name      string
+		src, dest map[string]string
+		args      []string
+		code      int
+	}{
+		{name: "success", src: map[string]string{"a": "a\n", "b": "b\n", "c": "c\n"}, dest: map[string]string{"a": "old\n", "c": "c\n"},
+			code: exitOK},
+		{name: "dry run", src: map[string]string{"a": "a\n", "b": "b\n"}, dest: map[string]string{"a": "old\n"},
+			args: []string{"-n"}, code: exitOK},
+		{name: "failed", src: map[string]string{"a": "a\n", "b": "b\n"}, dest: map[string]string{"a": "old\n", "a.upmerge~": "older\n"},
+			args: []string{"--keep-going"}, code: exitRefused},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := fixture(t, tt.src, tt.dest)
+			dest := filepath.Join(dir, "dest")
+			path := filepath.Join(dir, "upmerge.prom")
+			args := append([]string{"-s", "src", "-d", dest, "--metrics-file", path}, tt.args...)
+			if r := runMain(t, dir, args...); r.code != tt.code {
+				t.Fatalf("exit status %d, want %d: %s", r.code, tt.code, r.stderr)
+			}
+			b, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := masked.ReplaceAllString(string(b), "$1 X")
+			got = strings.ReplaceAll(got, labelEscaper.Replace(dest), "DEST")
+			checkGolden(t, "metrics/"+strings.ReplaceAll(tt.name, " ", "-")+".prom", got)
+			if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+				t.Errorf("the temporary file is left over: %v", err)
+			}
+		})
+	}
+}
+
+func TestBundle(t *testing.T) {
+	dir := fixture(t, map[string]string{"a": "a\n", "d/b": "b\n"}, nil)
+	// Gzipped, the bundle has neither a name nor a time to tell the two apart.
+	var bundles [][]byte
+	for _, name := range []string{"one.tgz", "two.tgz"} {
+		path := filepath.Join(dir, name)
+		r := runMain(t, dir, "bundle", "-o", path, "--clamp-mtime", "1577934245", "-s", "src", "-d", "dest")
+		if r.code != exitOK {
+			t.Fatalf("bundle: exit status %d: %s", r.code, r.stderr)
+		}
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bundles = append(bundles, buf)
+	}
+	if !bytes.Equal(bundles[0], bundles[1]) {
+		t.Error("bundled the same source twice, and got different bundles")
+	}
+}
@@ -0,0 +1,208 @@
+package merge
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
+// Kinds of actions.
+const (
+	ActionMkdir        = "mkdir"
+	ActionChmod        = "chmod"
+	ActionCopy         = "copy"
+	ActionSymlink      = "symlink"
+	ActionMknod        = "mknod"
+	ActionRemove       = "remove"
+	ActionMove         = "move"
+	ActionForceMove    = "force-move"
+	ActionOK           = "ok"
+	ActionCheck        = "check"
+	ActionIgnore       = "ignore"
+	ActionAdopt        = "adopt"
+	ActionRevert       = "revert"
+	ActionPrune        = "prune"
+	ActionClean        = "clean"
+	ActionSkip         = "skip"
+	ActionSkipOnce     = "skip-once"
+	ActionCycle        = "cycle"
+	ActionRetry        = "retry"
+	ActionProtected    = "protected"
+	ActionSnapshot     = "snapshot"
+	ActionDiff         = "diff"
+	ActionRefuse       = "refuse"
+	ActionWarning      = "warning"
+	ActionDrift        = "drift"
+	ActionMerged       = "merged"
+	ActionConflict     = "conflict"
+	ActionTypeConflict = "type-conflict"
+	ActionInvalid      = "invalid"
+	ActionHook         = "hook"
+	ActionError        = "error"
+)
+
+// Action describes a single operation performed (or, in a dry run, one that would
+// have been performed).
+type Action struct {
+	Kind   string `json:"action"`
+	Src    string `json:"src,omitempty"`
+	Dest   string `json:"dest,omitempty"`
+	Backup string `json:"backup,omitempty"`
+	Error  string `json:"error,omitempty"`
+	Diff   string `json:"diff,omitempty"`
+	Target string `json:"target,omitempty"`
+	// Command is what an ActionHook runs.
+	Command string `json:"command,omitempty"`
+	// SrcType and DestType are the types of the entries of an ActionTypeConflict, such
+	// as "file", or "directory". Its Backup is set if the destination is backed up and
+	// replaced, rather than left alone.
+	SrcType  string `json:"srcType,omitempty"`
+	DestType string `json:"destType,omitempty"`
+	// Mode is the new mode of an ActionChmod.
+	Mode fs.FileMode `json:"mode,omitempty"`
+	// Hash is the SHA-256 of the file installed by an ActionCopy, if it was hashed
+	// (for the manifest).
+	Hash string `json:"hash,omitempty"`
+	// Quick is set for an ActionOK decided without comparing the contents.
+	Quick bool `json:"quick,omitempty"`
+	// Loose is set for an ActionOK whose files only match with IgnoreLineEndings or
+	// IgnoreTrailingSpace: their bytes differ.
+	Loose bool `json:"loose,omitempty"`
+	// DiffInfo tells where the file replaced by an ActionCopy first differed from its
+	// source, with FirstDiff.
+	DiffInfo *DiffInfo `json:"diffInfo,omitempty"`
+	DryRun   bool      `json:"dryRun"`
+	// SrcRel, DestRel and BackupRel are Src, Dest and Backup relative to their roots:
+	// the source directory (or layer) holding Src, and DestDir (or BackupDir).
+	SrcRel    string `json:"srcRel,omitempty"`
+	DestRel   string `json:"destRel,omitempty"`
+	BackupRel string `json:"backupRel,omitempty"`
+}
+
+// String formats the action the way it's printed in verbose mode.
+func (a Action) String() string {
+	switch a.Kind {
+	case ActionMkdir:
+		return fmt.Sprintf("MKDIR:\t%s", a.Dest)
+	case ActionChmod:
+		return fmt.Sprintf("CHMOD:\t%s (%04o)", a.Dest, a.Mode.Perm())
+	case ActionCopy:
+		if a.DiffInfo != nil {
+			return fmt.Sprintf("COPY:\t%s <- %s (%s)", a.Dest, a.Src, a.DiffInfo)
+		}
+		return fmt.Sprintf("COPY:\t%s <- %s", a.Dest, a.Src)
+	case ActionSymlink:
+		return fmt.Sprintf("SYMLINK:\t%s -> %s", a.Dest, a.Target)
+	case ActionMknod:
+		return fmt.Sprintf("MKNOD:\t%s <- %s", a.Dest, a.Src)
+	case ActionRemove:
+		return fmt.Sprintf("REMOVE:\t%s", a.Dest)
+	case ActionMove:
+		return fmt.Sprintf("MOVE:\t%s <- %s", a.Backup, a.Dest)
+	case ActionForceMove:
+		return fmt.Sprintf("FORCE-MOVE:\t%s <- %s", a.Backup, a.Dest)
+	case ActionOK:
+		if a.Quick {
+			return fmt.Sprintf("OK:\t%s <- %s (quick)", a.Dest, a.Src)
+		} else if a.Loose {
+			return fmt.Sprintf("OK:\t%s <- %s (whitespace differs)", a.Dest, a.Src)
+		}
+		return fmt.Sprintf("OK:\t%s <- %s", a.Dest, a.Src)
+	case ActionCheck:
+		return fmt.Sprintf("CHECK:\t%s", a.Backup)
+	case ActionIgnore:
+		return fmt.Sprintf("IGNORE:\t%s", a.Src)
+	case ActionAdopt:
+		return fmt.Sprintf("ADOPT:\t%s <- %s", a.Src, a.Dest)
+	case ActionRevert:
+		return fmt.Sprintf("REVERT:\t%s <- %s", a.Dest, a.Backup)
+	case ActionPrune:
+		return fmt.Sprintf("PRUNE:\t%s", a.Backup)
+	case ActionClean:
+		return fmt.Sprintf("CLEAN:\t%s", a.Backup)
+	case ActionSkip:
+		if a.Error != "" {
+			return fmt.Sprintf("SKIP:\t%s (%s)", a.Dest, a.Error)
+		}
+		return fmt.Sprintf("SKIP:\t%s", a.Dest)
+	case ActionSkipOnce:
+		return fmt.Sprintf("SKIP-ONCE:\t%s", a.Dest)
+	case ActionCycle:
+		return fmt.Sprintf("CYCLE:\t%s -> %s", a.Src, a.Target)
+	case ActionRetry:
+		return fmt.Sprintf("RETRY:\t%s (%s)", a.Dest, a.Error)
+	case ActionProtected:
+		return fmt.Sprintf("PROTECTED:\t%s (%s)", a.Dest, a.Error)
+	case ActionSnapshot:
+		return fmt.Sprintf("SNAPSHOT:\t%s <- %s", a.Backup, a.Dest)
+	case ActionRefuse:
+		return fmt.Sprintf("REFUSE:\t%s -> %s", a.Dest, a.Target)
+	case ActionWarning:
+		return fmt.Sprintf("WARNING:\t%s", a.Error)
+	case ActionMerged:
+		return fmt.Sprintf("MERGED:\t%s <- %s", a.Src, a.Dest)
+	case ActionConflict:
+		return fmt.Sprintf("CONFLICT:\t%s (%s)", a.Dest, a.Error)
+	case ActionTypeConflict:
+		return fmt.Sprintf("TYPE-CONFLICT:\t%s (%s) <- %s (%s)", a.Dest, a.DestType, a.Src, a.SrcType)
+	case ActionInvalid:
+		return fmt.Sprintf("INVALID:\t%s (%s)", a.Dest, a.Error)
+	case ActionHook:
+		return fmt.Sprintf("HOOK:\t%s", a.Command)
+	case ActionDrift:
+		return fmt.Sprintf("DRIFT:\t%s", a.Dest)
+	case ActionError:
+		return fmt.Sprintf("ERROR:\t%s", a.Error)
+	case ActionDiff:
+		return strings.TrimSuffix(a.Diff, "\n")
+	}
+	return fmt.Sprintf("%s:\t%s", strings.ToUpper(a.Kind), a.Dest)
+}
+
+// Relative returns a copy of a with its paths relative to their roots, where known,
+// such as for printing with String.
+func (a Action) Relative() Action {
+	for _, p := range [][2]*string{{&a.Src, &a.SrcRel}, {&a.Dest, &a.DestRel}, {&a.Backup, &a.BackupRel}} {
+		if *p[1] != "" {
+			*p[0] = *p[1]
+		}
+	}
+	return a
+}
+
+// path returns the path an action is about, relative to the roots, for putting actions
+// in order.
+func (a Action) path() string {
+	switch {
+	case a.DestRel != "":
+		return a.DestRel
+	case a.SrcRel != "":
+		return a.SrcRel
+	}
+	return a.BackupRel
+}
+
+// comparePaths compares relative paths (as strings.Compare does) the way a walk
+// orders them: by each of their parts in turn, so that a directory's contents come
+// right after it.
+func comparePaths(a, b string) int {
+	pa, pb := strings.Split(a, string(filepath.Separator)), strings.Split(b, string(filepath.Separator))
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		if c := strings.Compare(pa[i], pb[i]); c != 0 {
+			return c
+		}
+	}
+	return len(pa) - len(pb)
+}
+
+// IsChange returns true if the action modifies (or, in a dry run, would modify) the
+// file system.
+func (a Action) IsChange() bool {
+	switch a.Kind {
+	case ActionMkdir, ActionChmod, ActionCopy, ActionSymlink, ActionMknod, ActionRemove, ActionMove,
+		ActionForceMove, ActionMerged, ActionAdopt, ActionRevert, ActionPrune, ActionClean:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package merge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// relPath cleans up a path given by the user, making it relative to root. An absolute
+// path is accepted only if it's inside root, once any symlinks in the directories
+// leading to it are resolved, as they are in root (see Merger.ResolveDirs).
+func relPath(root, path string) (string, error) {
+	if filepath.IsAbs(path) {
+		if !isInside(root, path) {
+			if dir, err := filepath.EvalSymlinks(filepath.Dir(path)); err == nil {
+				path = filepath.Join(dir, filepath.Base(path))
+			}
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return "", err
+		}
+		path = rel
+	}
+	path = filepath.Clean(path)
+	if path == "." || path == ".." || strings.HasPrefix(path, "../") {
+		return "", fmt.Errorf("%s: not inside %s", path, root)
+	}
+	return path, nil
+}
+
+// mkdirParents creates the missing parent directories of rel under root, copying the
+// permission bits from the matching directories under like.
+func (m *Merger) mkdirParents(root, like, rel string) error {
+	dir := filepath.Dir(rel)
+	if dir == "." {
+		return nil
+	}
+	// Create from the top down, so that every parent exists before its child.
+	parts := strings.Split(dir, string(filepath.Separator))
+	for i := range parts {
+		sub := filepath.Join(parts[:i+1]...)
+		path := filepath.Join(root, sub)
+		if _, err := os.Stat(path); err == nil {
+			continue
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		st, err := os.Stat(filepath.Join(like, sub))
+		if err != nil {
+			return err
+		}
+		if !m.DryRun {
+			if err = os.Mkdir(path, st.Mode().Perm()); err != nil {
+				return err
+			}
+		}
+		m.log(Action{Kind: ActionMkdir, Dest: path})
+	}
+	return nil
+}
+
+// Adopt copies the named files from DestDir back into SrcDir, so that local edits
+// become the new source of truth. Paths are relative to DestDir. Existing source
+// files are only overwritten with Force.
+func (m *Merger) Adopt(ctx context.Context, paths []string) ([]Action, error) {
+	if err := m.start(true); err != nil {
+		return nil, err
+	}
+	if m.SrcFS != nil {
+		return nil, errors.New("can't adopt into a source that isn't a directory")
+	}
+	for _, path := range paths {
+		if err := ctx.Err(); err != nil {
+			return m.finish(err)
+		}
+		if err := m.adoptFile(ctx, path); err != nil {
+			m.fail(path, err)
+			return m.finish(err)
+		}
+	}
+	return m.finish(nil)
+}
+
+func (m *Merger) adoptFile(ctx context.Context, path string) error {
+	rel, err := relPath(m.DestDir, path)
+	if err != nil {
+		return err
+	}
+	srcPath := m.srcPath(rel)
+	destPath := filepath.Join(m.DestDir, rel)
+	st, err := os.Stat(destPath)
+	if err != nil {
+		return wrapErr(OpAdopt, rel, err)
+	}
+	if st.IsDir() {
+		return wrapErr(OpAdopt, rel, fmt.Errorf("%s: is a directory", destPath))
+	}
+	if m.generated(rel) {
+		return wrapErr(OpAdopt, rel, fmt.Errorf("%s: made from %s, which it would overwrite", destPath, srcPath))
+	}
+	if fileExists(srcPath) && !m.Force {
+		m.log(Action{
+			Kind:  ActionError,
+			Src:   srcPath,
+			Dest:  destPath,
+			Error: fmt.Sprintf("refusing to overwrite source: %s", srcPath),
+		})
+		return wrapErr(OpAdopt, rel, ErrRefuse)
+	}
+	if err = m.mkdirParents(m.SrcDir, m.DestDir, rel); err != nil {
+		return wrapErr(OpMkdir, filepath.Dir(rel), err)
+	}
+	if !m.DryRun {
+		if err = os.Remove(srcPath); err != nil && !os.IsNotExist(err) {
+			return wrapErr(OpAdopt, rel, err)
+		}
+		if err = copyFile(ctx, destPath, srcPath); err != nil {
+			return wrapErr(OpAdopt, rel, err)
+		}
+	}
+	m.log(Action{Kind: ActionAdopt, Src: srcPath, Dest: destPath})
+	return nil
+}
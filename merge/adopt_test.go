@@ -0,0 +1,49 @@
+package merge
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestAdopt(t *testing.T) {
+	m, _ := newTestMerger(t, tree{"f": "ours\n"},
+		tree{"f": "mine\n", "d/e/new": "new\n"})
+	if _, err := m.Adopt(context.Background(), []string{filepath.Join(m.DestDir, "d", "e", "new")}); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, m.SrcDir, tree{"f": "ours\n", "d/": "", "d/e/": "", "d/e/new": "new\n"})
+
+	// What's in the source already is only overwritten with Force.
+	_, err := m.Adopt(context.Background(), []string{"f"})
+	var fe *FileError
+	if !errors.As(err, &fe) || fe.Path != "f" || fe.Op != OpAdopt || !errors.Is(err, ErrRefuse) {
+		t.Fatalf("got %v, want adopting f refused", err)
+	}
+	checkTree(t, m.SrcDir, tree{"f": "ours\n", "d/": "", "d/e/": "", "d/e/new": "new\n"})
+	m.Force = true
+	if _, err := m.Adopt(context.Background(), []string{"f"}); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, m.SrcDir, tree{"f": "mine\n", "d/": "", "d/e/": "", "d/e/new": "new\n"})
+
+	// Adopted, it's in sync.
+	for _, a := range run(t, m) {
+		if a.Kind != ActionOK {
+			t.Errorf("ran after adopting: got %s %s", a.Kind, a.DestRel)
+		}
+	}
+}
+
+func TestAdoptInvalid(t *testing.T) {
+	m, _ := newTestMerger(t, tree{"conf.tmpl": "{{.Hostname}}\n"},
+		tree{"conf": "h\n", "d/": "", "f": "f\n"})
+	m.Templates, m.Force = true, true
+	for _, path := range []string{"d", "missing", "conf", "../f", filepath.Join(filepath.Dir(m.DestDir), "f")} {
+		if _, err := m.Adopt(context.Background(), []string{path}); err == nil {
+			t.Errorf("adopted %s", path)
+		}
+	}
+	checkTree(t, m.SrcDir, tree{"conf.tmpl": "{{.Hostname}}\n"})
+}
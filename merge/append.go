@@ -0,0 +1,231 @@
+package merge
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// AppendSuffix marks a fragment in the source, foo.upmerge-append, holding a block of
+// lines that's kept in foo in the destination, between a pair of marker comments,
+// leaving the rest of foo to whoever else changes it:
+//
+//	# BEGIN upmerge
+//	10.0.0.1	gateway
+//	# END upmerge
+//
+// The block is added at the end of foo (or makes up all of a new one), replaced
+// whenever the fragment changes, and taken out if the fragment is empty, or (with
+// Prune) gone. Otherwise, foo is backed up and replaced like any other file.
+const AppendSuffix = ".upmerge-append"
+
+// DefaultCommentLeader starts the marker comments, unless CommentLeaders gives another.
+const DefaultCommentLeader = "#"
+
+// appendFS shows the fragments in a source file system as the files in the destination
+// they're spliced into. The fragments themselves are hidden.
+type appendFS struct {
+	fs.FS
+	destDir string
+	leaders map[string]string
+
+	mu sync.Mutex
+	// orphans are the files a fragment was spliced into, which is gone: their block is
+	// taken out.
+	orphans map[string]bool
+}
+
+// loadAppends sets up splicing the fragments in the source into the destination.
+func (m *Merger) loadAppends() {
+	inner := m.rawSrc()
+	if m.templates != nil {
+		inner = m.templates
+	}
+	m.appends = &appendFS{FS: inner, destDir: m.DestDir, leaders: m.CommentLeaders,
+		orphans: make(map[string]bool)}
+}
+
+// isAppended returns true if the file at rel is spliced into from a fragment, or was.
+func (m *Merger) isAppended(rel string) bool {
+	return m.appends != nil && (m.appends.isFragment(srcName(rel)+AppendSuffix) ||
+		m.appends.isOrphan(srcName(rel)))
+}
+
+// isFragment returns true if name is a regular file, to be spliced in.
+func (a *appendFS) isFragment(name string) bool {
+	if path.Base(name) == AppendSuffix {
+		return false
+	}
+	st, err := fs.Stat(a.FS, name)
+	return err == nil && st.Mode().IsRegular()
+}
+
+// isOrphan returns true if name is the file of a fragment that's gone.
+func (a *appendFS) isOrphan(name string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.orphans[name]
+}
+
+// orphan takes the block out of name, since its fragment is gone.
+func (a *appendFS) orphan(name string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.orphans[name] = true
+}
+
+// markers returns the lines the block in name starts and ends with.
+func (a *appendFS) markers(name string) (string, string) {
+	leader, ok := a.leaders[path.Base(name)]
+	if !ok {
+		leader, ok = a.leaders[path.Ext(name)]
+	}
+	if !ok {
+		leader = DefaultCommentLeader
+	}
+	// A comment that needs closing, such as "<!-- -->".
+	leader, closer, _ := strings.Cut(leader, " ")
+	if closer != "" {
+		closer = " " + closer
+	}
+	return leader + " BEGIN upmerge" + closer, leader + " END upmerge" + closer
+}
+
+// splice returns the file in the destination at name, with its fragment spliced in.
+func (a *appendFS) splice(name string) ([]byte, fs.FileInfo, error) {
+	var block []byte
+	st, err := fs.Stat(a.FS, name+AppendSuffix)
+	if a.isOrphan(name) {
+		st, err = nil, nil
+	} else if err == nil {
+		block, err = fs.ReadFile(a.FS, name+AppendSuffix)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	destPath := filepath.Join(a.destDir, filepath.FromSlash(name))
+	dest, err := os.ReadFile(destPath)
+	if err == nil {
+		st, err = os.Stat(destPath)
+	} else if os.IsNotExist(err) && st != nil {
+		// A new file, with nothing but the block.
+		err = nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	begin, end := a.markers(name)
+	out, err := spliceBlock(dest, block, begin, end)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", destPath, err)
+	}
+	return out, renderedInfo{st, path.Base(name), int64(len(out))}, nil
+}
+
+// spliceBlock returns text with the lines between begin and end (the markers included)
+// replaced by block between them, or with the block added at the end, if there's none.
+// An empty block is taken out, along with its markers.
+func spliceBlock(text, block []byte, begin, end string) ([]byte, error) {
+	var repl []byte
+	if len(block) > 0 {
+		repl = append(repl, begin+"\n"...)
+		repl = append(repl, block...)
+		if block[len(block)-1] != '\n' {
+			repl = append(repl, '\n')
+		}
+		repl = append(repl, end+"\n"...)
+	}
+	lines := splitLines(text)
+	start := -1
+	for i, line := range lines {
+		line = strings.TrimRight(line, "\r\n")
+		if start < 0 && line == begin {
+			start = i
+		} else if start >= 0 && line == end {
+			var out []byte
+			out = append(out, strings.Join(lines[:start], "")...)
+			out = append(out, repl...)
+			return append(out, strings.Join(lines[i+1:], "")...), nil
+		}
+	}
+	if start >= 0 {
+		return nil, fmt.Errorf("%q on line %d isn't followed by %q", begin, start+1, end)
+	}
+	out := append([]byte{}, text...)
+	if len(out) > 0 && len(repl) > 0 && out[len(out)-1] != '\n' {
+		out = append(out, '\n')
+	}
+	return append(out, repl...), nil
+}
+
+func (a *appendFS) Open(name string) (fs.File, error) {
+	if a.isFragment(name+AppendSuffix) || a.isOrphan(name) {
+		out, st, err := a.splice(name)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return &renderedFile{bytes.NewReader(out), st}, nil
+	}
+	if strings.HasSuffix(name, AppendSuffix) && a.isFragment(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return a.FS.Open(name)
+}
+
+func (a *appendFS) Stat(name string) (fs.FileInfo, error) {
+	if a.isFragment(name+AppendSuffix) || a.isOrphan(name) {
+		_, st, err := a.splice(name)
+		if err != nil {
+			return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+		}
+		return st, nil
+	}
+	if strings.HasSuffix(name, AppendSuffix) && a.isFragment(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return fs.Stat(a.FS, name)
+}
+
+// ReadDir lists the directory name, with each fragment named after the file it's
+// spliced into. A fragment for a file that's in the source as well is an error.
+func (a *appendFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := fs.ReadDir(a.FS, name)
+	if err != nil {
+		return entries, err
+	}
+	seen := make(map[string]bool)
+	for _, e := range entries {
+		seen[e.Name()] = true
+	}
+	for i, e := range entries {
+		base := strings.TrimSuffix(e.Name(), AppendSuffix)
+		if base == e.Name() || base == "" || !a.isFragment(path.Join(name, e.Name())) {
+			continue
+		}
+		if seen[base] {
+			return nil, fmt.Errorf("%s is in the source, but %s is spliced into it",
+				path.Join(name, base), path.Join(name, e.Name()))
+		}
+		entries[i] = appendedEntry{e, a, path.Join(name, base)}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// appendedEntry is a fragment, listed as the file it's spliced into.
+type appendedEntry struct {
+	fs.DirEntry
+	a    *appendFS
+	name string
+}
+
+func (e appendedEntry) Name() string               { return path.Base(e.name) }
+func (e appendedEntry) Type() fs.FileMode          { return 0 }
+func (e appendedEntry) IsDir() bool                { return false }
+func (e appendedEntry) Info() (fs.FileInfo, error) { return e.a.Stat(e.name) }
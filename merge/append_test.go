@@ -0,0 +1,92 @@
+package merge
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+const hostsBlock = "# BEGIN upmerge\n10.0.0.1\tgateway\n# END upmerge\n"
+
+func TestAppend(t *testing.T) {
+	m, _ := newTestMerger(t,
+		tree{"hosts" + AppendSuffix: "10.0.0.1\tgateway\n", "new" + AppendSuffix: "new\n"},
+		tree{"hosts": "127.0.0.1\tlocalhost\n"})
+	run(t, m)
+	checkTree(t, m.DestDir, tree{
+		"hosts":                  "127.0.0.1\tlocalhost\n" + hostsBlock,
+		"hosts" + m.BackupSuffix: "127.0.0.1\tlocalhost\n",
+		"new":                    "# BEGIN upmerge\nnew\n# END upmerge\n",
+	})
+	// Running again changes nothing, and the backup, of the file before the block went
+	// in, is left alone without being reported.
+	for _, a := range run(t, m) {
+		if a.Kind != ActionOK {
+			t.Errorf("ran again: got %s %s", a.Kind, a.DestRel)
+		}
+	}
+}
+
+func TestAppendFragmentChanged(t *testing.T) {
+	m, _ := newTestMerger(t, tree{"hosts" + AppendSuffix: "10.0.0.1\tgateway\n"},
+		tree{"hosts": "127.0.0.1\tlocalhost\n"})
+	run(t, m)
+	// Each time the fragment changes, the block is replaced, although the backup (of
+	// the file with the block before) differs.
+	for _, block := range []string{"10.0.0.2\tgateway\n", "10.0.0.3\tgateway\n"} {
+		writeTree(t, m.SrcDir, tree{"hosts" + AppendSuffix: block})
+		before := readTree(t, m.DestDir)["hosts"]
+		if _, err := m.Run(context.Background()); errors.Is(err, ErrRefuse) {
+			t.Fatalf("fragment changed to %q: %v", block, err)
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		checkTree(t, m.DestDir, tree{
+			"hosts":                  "127.0.0.1\tlocalhost\n# BEGIN upmerge\n" + block + "# END upmerge\n",
+			"hosts" + m.BackupSuffix: before,
+		})
+	}
+	// The rest of the file is still left to whoever else changes it.
+	writeTree(t, m.DestDir, tree{"hosts": "::1\tlocalhost\n"})
+	run(t, m)
+	if got, want := readTree(t, m.DestDir)["hosts"], "::1\tlocalhost\n# BEGIN upmerge\n10.0.0.3\tgateway\n# END upmerge\n"; got != want {
+		t.Errorf("replaced by another: got %q, want %q", got, want)
+	}
+}
+
+func TestAppendEmptied(t *testing.T) {
+	m, _ := newTestMerger(t, tree{"hosts" + AppendSuffix: "10.0.0.1\tgateway\n"},
+		tree{"hosts": "127.0.0.1\tlocalhost\n"})
+	run(t, m)
+	writeTree(t, m.SrcDir, tree{"hosts" + AppendSuffix: ""})
+	run(t, m)
+	if got, want := readTree(t, m.DestDir)["hosts"], "127.0.0.1\tlocalhost\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSpliceBlock(t *testing.T) {
+	tests := []struct {
+		text, block, want string
+		err               bool
+	}{
+		{text: "", block: "a\n", want: "# BEGIN upmerge\na\n# END upmerge\n"},
+		{text: "x", block: "a", want: "x\n# BEGIN upmerge\na\n# END upmerge\n"},
+		{text: "x\n# BEGIN upmerge\nold\n# END upmerge\ny\n", block: "a\n",
+			want: "x\n# BEGIN upmerge\na\n# END upmerge\ny\n"},
+		{text: "x\n# BEGIN upmerge\nold\n# END upmerge\ny\n", block: "", want: "x\ny\n"},
+		{text: "x\n# BEGIN upmerge\nold\n", block: "a\n", err: true},
+	}
+	for _, tt := range tests {
+		got, err := spliceBlock([]byte(tt.text), []byte(tt.block), "# BEGIN upmerge", "# END upmerge")
+		if tt.err {
+			if err == nil {
+				t.Errorf("spliceBlock(%q, %q): got %q, want an error", tt.text, tt.block, got)
+			}
+			continue
+		}
+		if err != nil || string(got) != tt.want {
+			t.Errorf("spliceBlock(%q, %q) = %q, %v; want %q", tt.text, tt.block, got, err, tt.want)
+		}
+	}
+}
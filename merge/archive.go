@@ -0,0 +1,378 @@
+package merge
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// IsArchive returns true if the file at name is a tarball (possibly gzipped) or a zip
+// file, going by its contents, or failing that, its name.
+func IsArchive(name string) bool {
+	st, err := os.Stat(name)
+	if err != nil || !st.Mode().IsRegular() {
+		return false
+	}
+	if kind, err := archiveKind(name); err == nil && kind != "" {
+		return true
+	}
+	for _, ext := range []string{".tar", ".tar.gz", ".tgz", ".zip"} {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// archiveKind returns "tar", "gzip" or "zip" for the file at name, going by its magic
+// numbers, or "" if it's none of them.
+func archiveKind(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	buf = buf[:n]
+	switch {
+	case bytes.HasPrefix(buf, []byte{0x1f, 0x8b}):
+		return "gzip", nil
+	case bytes.HasPrefix(buf, []byte("PK\x03\x04")), bytes.HasPrefix(buf, []byte("PK\x05\x06")):
+		return "zip", nil
+	case len(buf) >= 262 && string(buf[257:262]) == "ustar":
+		return "tar", nil
+	}
+	return "", nil
+}
+
+// OpenArchive reads the whole of the tarball or zip file at name, and returns it as a
+// file system, with the modes, times and symlinks recorded in it (but not BundleFile).
+// Anything wrong with it is found here, before a single file is copied.
+func OpenArchive(name string) (fs.FS, error) {
+	kind, err := archiveKind(name)
+	if err != nil {
+		return nil, err
+	}
+	a := &archiveFS{entries: map[string]*archiveEntry{
+		".": {info: archiveInfo{name: ".", mode: fs.ModeDir}},
+	}}
+	switch kind {
+	case "zip":
+		err = a.readZip(name)
+	case "tar", "gzip":
+		err = a.readTar(name, kind == "gzip")
+	default:
+		err = errors.New("not a tarball or a zip file")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", name, err)
+	}
+	for _, e := range a.entries {
+		if e.info.mode.IsDir() {
+			sort.Strings(e.children)
+		}
+	}
+	return a, nil
+}
+
+// archiveFS is the contents of an archive, read into memory.
+type archiveFS struct {
+	entries map[string]*archiveEntry
+}
+
+// archiveEntry is a file, directory or symlink in an archiveFS.
+type archiveEntry struct {
+	info     archiveInfo
+	data     []byte
+	target   string
+	children []string
+}
+
+// archiveName converts the name of an entry in an archive into its name in the file
+// system. Names that would reach outside of it are an error.
+func archiveName(name string) (string, error) {
+	clean := path.Clean("/" + strings.TrimPrefix(name, "./"))[1:]
+	if clean == "" {
+		clean = "."
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("%s: not inside the archive", name)
+		}
+	}
+	return clean, nil
+}
+
+// add records an entry at name, along with any parent directories the archive left
+// out.
+func (a *archiveFS) add(name string, e *archiveEntry) error {
+	if old, ok := a.entries[name]; ok {
+		if old.info.mode.IsDir() && e.info.mode.IsDir() {
+			// Only the directory's own details are new.
+			old.info = e.info
+			return nil
+		}
+		return fmt.Errorf("%s: appears twice", name)
+	}
+	a.entries[name] = e
+	for child := name; child != "."; child = path.Dir(child) {
+		dir := path.Dir(child)
+		parent, ok := a.entries[dir]
+		if !ok {
+			parent = &archiveEntry{info: archiveInfo{name: path.Base(dir), mode: fs.ModeDir}}
+			a.entries[dir] = parent
+		} else if !parent.info.mode.IsDir() {
+			return fmt.Errorf("%s: %s is not a directory", name, dir)
+		}
+		parent.children = append(parent.children, path.Base(child))
+		if ok {
+			break
+		}
+	}
+	return nil
+}
+
+// readTar reads the tarball at name, gunzipping it first if gzipped.
+func (a *archiveFS) readTar(name string, gzipped bool) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = bufio.NewReader(f)
+	if gzipped {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		entryName, err := archiveName(hdr.Name)
+		if err != nil {
+			return err
+		} else if entryName == BundleFile {
+			continue
+		}
+		e := &archiveEntry{info: archiveInfo{name: path.Base(entryName), modTime: hdr.ModTime}}
+		e.info.mode = hdr.FileInfo().Mode()
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			if e.data, err = io.ReadAll(tr); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			linked, err := archiveName(hdr.Linkname)
+			if err != nil {
+				return err
+			}
+			target, ok := a.entries[linked]
+			if !ok || !target.info.mode.IsRegular() {
+				return fmt.Errorf("%s: hard link to missing %s", hdr.Name, hdr.Linkname)
+			}
+			e.data, e.info.mode = target.data, target.info.mode
+		case tar.TypeSymlink:
+			e.target = hdr.Linkname
+		case tar.TypeDir:
+		case tar.TypeXGlobalHeader:
+			continue
+		}
+		e.info.size = int64(len(e.data))
+		if entryName == "." {
+			a.entries["."].info.mode = e.info.mode
+			continue
+		}
+		if err = a.add(entryName, e); err != nil {
+			return err
+		}
+	}
+}
+
+// readZip reads the zip file at name. Every entry is read in full, so that its
+// checksum is checked.
+func (a *archiveFS) readZip(name string) error {
+	zr, err := zip.OpenReader(name)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	for _, zf := range zr.File {
+		entryName, err := archiveName(strings.TrimSuffix(zf.Name, "/"))
+		if err != nil {
+			return err
+		} else if entryName == BundleFile {
+			continue
+		}
+		st := zf.FileInfo()
+		e := &archiveEntry{info: archiveInfo{name: path.Base(entryName), mode: st.Mode(), modTime: zf.Modified}}
+		if !st.IsDir() {
+			rc, err := zf.Open()
+			if err != nil {
+				return err
+			}
+			buf, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return fmt.Errorf("%s: %w", zf.Name, err)
+			}
+			if st.Mode()&fs.ModeSymlink != 0 {
+				e.target = string(buf)
+			} else {
+				e.data = buf
+			}
+		}
+		e.info.size = int64(len(e.data))
+		if entryName == "." {
+			continue
+		}
+		if err = a.add(entryName, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookup returns the entry at name, following symlinks (inside the archive) if
+// follow is set.
+func (a *archiveFS) lookup(op, name string, follow bool) (*archiveEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	current := name
+	for i := 0; ; i++ {
+		e, ok := a.entries[current]
+		if !ok {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		if !follow || e.target == "" {
+			return e, nil
+		}
+		if i == 40 || path.IsAbs(e.target) {
+			// There's nothing to follow it to.
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		current = path.Join(path.Dir(current), e.target)
+		if !fs.ValidPath(current) {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+	}
+}
+
+func (a *archiveFS) Open(name string) (fs.File, error) {
+	e, err := a.lookup("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return &archiveFile{Reader: bytes.NewReader(e.data), fsys: a, name: name}, nil
+}
+
+func (a *archiveFS) Stat(name string) (fs.FileInfo, error) {
+	e, err := a.lookup("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	info := e.info
+	info.name = path.Base(name)
+	return info, nil
+}
+
+func (a *archiveFS) Lstat(name string) (fs.FileInfo, error) {
+	e, err := a.lookup("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return e.info, nil
+}
+
+func (a *archiveFS) ReadLink(name string) (string, error) {
+	e, err := a.lookup("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if e.target == "" {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return e.target, nil
+}
+
+func (a *archiveFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	e, err := a.lookup("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if !e.info.mode.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	entries := make([]fs.DirEntry, len(e.children))
+	for i, child := range e.children {
+		entries[i] = fs.FileInfoToDirEntry(a.entries[path.Join(name, child)].info)
+	}
+	return entries, nil
+}
+
+// archiveInfo describes an entry in an archiveFS.
+type archiveInfo struct {
+	name    string
+	mode    fs.FileMode
+	size    int64
+	modTime time.Time
+}
+
+func (i archiveInfo) Name() string       { return i.name }
+func (i archiveInfo) Size() int64        { return i.size }
+func (i archiveInfo) Mode() fs.FileMode  { return i.mode }
+func (i archiveInfo) ModTime() time.Time { return i.modTime }
+func (i archiveInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i archiveInfo) Sys() interface{}   { return nil }
+
+// archiveFile is an entry in an archiveFS, opened.
+type archiveFile struct {
+	*bytes.Reader
+	fsys *archiveFS
+	name string
+	// read is how many directory entries were read already.
+	read int
+}
+
+func (f *archiveFile) Stat() (fs.FileInfo, error) { return f.fsys.Stat(f.name) }
+func (f *archiveFile) Close() error               { return nil }
+
+func (f *archiveFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	entries, err := f.fsys.ReadDir(f.name)
+	if err != nil {
+		return nil, err
+	}
+	entries = entries[f.read:]
+	if n > 0 {
+		if len(entries) == 0 {
+			return nil, io.EOF
+		} else if len(entries) > n {
+			entries = entries[:n]
+		}
+	}
+	f.read += len(entries)
+	return entries, nil
+}
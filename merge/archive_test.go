@@ -0,0 +1,175 @@
+package merge
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// tarEntry is an entry to write to a tarball: a directory if its name ends in "/", a
+// symlink if it has a target, and otherwise a file.
+type tarEntry struct {
+	name, data, target string
+	mode               int64
+}
+
+// writeTar writes a tarball of entries to the named file, gzipped if gzipped.
+func writeTar(t *testing.T, name string, gzipped bool, entries []tarEntry) {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: e.mode, ModTime: time.Unix(1e9, 0)}
+		switch {
+		case e.target != "":
+			hdr.Typeflag, hdr.Linkname = tar.TypeSymlink, e.target
+		case e.name[len(e.name)-1] == '/':
+			hdr.Typeflag = tar.TypeDir
+		default:
+			hdr.Typeflag, hdr.Size = tar.TypeReg, int64(len(e.data))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.Bytes()
+	if gzipped {
+		var gz bytes.Buffer
+		zw := gzip.NewWriter(&gz)
+		if _, err := zw.Write(out); err != nil {
+			t.Fatal(err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		out = gz.Bytes()
+	}
+	if err := os.WriteFile(name, out, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+var archiveEntries = []tarEntry{
+	{name: "./", mode: 0755},
+	{name: "./d/", mode: 0700},
+	{name: "./d/f", data: "f\n", mode: 0600},
+	// Its directory is left out.
+	{name: "./e/bin", data: "#!/bin/sh\n", mode: 0755},
+	{name: "./link", target: "d/f", mode: 0777},
+}
+
+func TestArchive(t *testing.T) {
+	dir := t.TempDir()
+	for _, gzipped := range []bool{false, true} {
+		name := filepath.Join(dir, "src.tar")
+		if gzipped {
+			name += ".gz"
+		}
+		writeTar(t, name, gzipped, archiveEntries)
+		if !IsArchive(name) {
+			t.Fatalf("%s: not an archive", name)
+		}
+		fsys, err := OpenArchive(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := fstest.TestFS(fsys, "d/f", "e/bin", "link"); err != nil {
+			t.Fatal(err)
+		}
+		m, _ := newTestMerger(t, nil, nil)
+		m.SrcDir, m.SrcFS = name, fsys
+		run(t, m)
+		checkTree(t, m.DestDir, tree{"d/": "", "d/f": "f\n", "e/": "", "e/bin": "#!/bin/sh\n", "link": "-> d/f"})
+		for rel, want := range map[string]os.FileMode{"d": 0700, "d/f": 0600, "e/bin": 0755} {
+			st, err := os.Stat(filepath.Join(m.DestDir, rel))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if st.Mode().Perm() != want {
+				t.Errorf("%s: got mode %v, want %v", rel, st.Mode().Perm(), want)
+			}
+		}
+		for _, a := range run(t, m) {
+			if a.Kind != ActionOK {
+				t.Errorf("ran again: got %s %s", a.Kind, a.DestRel)
+			}
+		}
+	}
+}
+
+func TestArchiveZip(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, data := range map[string]string{"d/f": "f\n", "g": "g\n"} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// It's told by what's in it, rather than its name.
+	name := filepath.Join(t.TempDir(), "src.bin")
+	if err := os.WriteFile(name, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !IsArchive(name) {
+		t.Fatalf("%s: not an archive", name)
+	}
+	fsys, err := OpenArchive(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, _ := newTestMerger(t, nil, nil)
+	m.SrcDir, m.SrcFS = name, fsys
+	run(t, m)
+	checkTree(t, m.DestDir, tree{"d/": "", "d/f": "f\n", "g": "g\n"})
+}
+
+func TestArchiveInvalid(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		entries []tarEntry
+	}{
+		{"outside", []tarEntry{{name: "../f", data: "f\n", mode: 0644}}},
+		{"twice", []tarEntry{{name: "f", data: "f\n", mode: 0644}, {name: "./f", data: "g\n", mode: 0644}}},
+		{"under a file", []tarEntry{{name: "f", data: "f\n", mode: 0644}, {name: "f/g", data: "g\n", mode: 0644}}},
+	}
+	for _, tt := range tests {
+		name := filepath.Join(dir, "src.tar")
+		writeTar(t, name, false, tt.entries)
+		if _, err := OpenArchive(name); err == nil {
+			t.Errorf("%s: opened", tt.name)
+		}
+	}
+	name := filepath.Join(dir, "src.txt")
+	if err := os.WriteFile(name, []byte("not an archive\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if IsArchive(name) {
+		t.Errorf("%s: taken for an archive", name)
+	}
+	if _, err := OpenArchive(name); err == nil {
+		t.Errorf("%s: opened", name)
+	}
+	if IsArchive(dir) {
+		t.Errorf("%s: a directory taken for an archive", dir)
+	}
+}
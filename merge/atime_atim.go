@@ -0,0 +1,18 @@
+//go:build linux || openbsd || dragonfly || solaris || aix
+
+package merge
+
+import (
+	"io/fs"
+	"syscall"
+	"time"
+)
+
+// fileAtime returns the access time of the file described by st, or its modification
+// time if unknown.
+func fileAtime(st fs.FileInfo) time.Time {
+	if sys, ok := st.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(int64(sys.Atim.Sec), int64(sys.Atim.Nsec))
+	}
+	return st.ModTime()
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !openbsd && !solaris && !aix && !darwin && !freebsd && !netbsd && !dragonfly
+
+package merge
+
+import (
+	"io/fs"
+	"time"
+)
+
+// fileAtime returns the modification time of the file described by st: access times
+// aren't available here.
+func fileAtime(st fs.FileInfo) time.Time {
+	return st.ModTime()
+}
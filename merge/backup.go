@@ -0,0 +1,172 @@
+package merge
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// backupBase returns where the backup of the file at rel (relative to DestDir) is
+// kept: next to the file, or under BackupDir if one is set. With rotation, this is
+// the prefix shared by all the numbered backups.
+func (m *Merger) backupBase(rel string) string {
+	if m.BackupDir != "" {
+		return filepath.Join(m.BackupDir, rel)
+	}
+	return filepath.Join(m.DestDir, rel) + m.BackupSuffix
+}
+
+// rotatedPath returns the name of the i-th rotated backup at base; 1 is the newest.
+func (m *Merger) rotatedPath(base string, i int) string {
+	if m.BackupDir != "" {
+		return fmt.Sprintf("%s.%d", base, i)
+	}
+	return fmt.Sprintf("%s%d", base, i)
+}
+
+// backupPathFor returns the path of the (newest) backup of the file at rel.
+func (m *Merger) backupPathFor(rel string) string {
+	if m.BackupRotate > 0 {
+		return m.rotatedPath(m.backupBase(rel), 1)
+	}
+	return m.backupBase(rel)
+}
+
+// backupOrigin returns the path of the file that the backup at path was made from, or
+// false if path doesn't look like a backup. Only backups kept next to their files can
+// be recognised; under BackupDir, every file is a backup.
+func (m *Merger) backupOrigin(path string) (string, bool) {
+	if m.BackupDir != "" {
+		rel, err := filepath.Rel(m.BackupDir, path)
+		if err != nil {
+			return "", false
+		}
+		if m.BackupRotate > 0 {
+			rel = rotatedSuffix.ReplaceAllString(rel, "")
+		}
+		return filepath.Join(m.DestDir, rel), true
+	}
+	if m.BackupRotate > 0 {
+		path = trailingDigits.ReplaceAllString(path, "")
+	}
+	if !strings.HasSuffix(path, m.BackupSuffix) {
+		return "", false
+	}
+	return strings.TrimSuffix(path, m.BackupSuffix), true
+}
+
+var (
+	rotatedSuffix  = regexp.MustCompile(`\.[0-9]+$`)
+	trailingDigits = regexp.MustCompile(`[0-9]+$`)
+)
+
+// rotateBackups makes room for a new backup at base, by shifting every numbered
+// backup one place down, and dropping the oldest one.
+func (m *Merger) rotateBackups(base string) error {
+	// The oldest backup may be of a directory, replaced by a file since.
+	if err := m.removeAllDest(m.rotatedPath(base, m.BackupRotate)); err != nil {
+		return err
+	}
+	for i := m.BackupRotate - 1; i >= 1; i-- {
+		err := m.renameDest(m.rotatedPath(base, i), m.rotatedPath(base, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// unrotateBackups is the inverse of rotateBackups, after the newest backup at base
+// has been restored.
+func (m *Merger) unrotateBackups(base string) error {
+	for i := 2; i <= m.BackupRotate; i++ {
+		err := m.renameDest(m.rotatedPath(base, i), m.rotatedPath(base, i-1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyTree copies the directory at oldPath to newPath, which must not exist, with
+// everything in it.
+func (m *Merger) copyTree(oldPath, newPath string) error {
+	// Directories are kept writable until they're filled in.
+	var dirs []string
+	var modes []fs.FileMode
+	err := filepath.WalkDir(oldPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(oldPath, path)
+		if err != nil {
+			return err
+		}
+		to := filepath.Join(newPath, rel)
+		switch {
+		case d.IsDir():
+			st, err := d.Info()
+			if err != nil {
+				return err
+			}
+			dirs, modes = append(dirs, to), append(modes, st.Mode()&modeBits)
+			return m.mkdirDest(to, 0700)
+		case d.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return m.symlinkDest(target, to)
+		case d.Type().IsRegular():
+			return m.copyDest(context.Background(), path, to)
+		}
+		return fmt.Errorf("%s: can't move a %s across file systems", path, specialName(d.Type()))
+	})
+	for i := len(dirs) - 1; i >= 0 && err == nil; i-- {
+		err = m.chmodDest(dirs[i], modes[i])
+	}
+	return err
+}
+
+// makeBackup moves destPath (at rel, relative to DestDir) to backupPath, creating its
+// parent directories first if backups are kept in a separate directory.
+func (m *Merger) makeBackup(rel, destPath, backupPath string) error {
+	if m.BackupDir != "" {
+		if err := m.mkdirBackupDir(rel); err != nil {
+			return err
+		}
+	}
+	if m.BackupRotate > 0 {
+		// No need to rotate if the newest backup already has the same contents.
+		if same, _ := fileContentsAreIdentical(destPath, backupPath); !same {
+			if err := m.rotateBackups(m.backupBase(rel)); err != nil {
+				return err
+			}
+		}
+	}
+	return m.moveDest(destPath, backupPath)
+}
+
+// mkdirBackupDir creates BackupDir, and the parents of the backup of rel under it.
+func (m *Merger) mkdirBackupDir(rel string) error {
+	// Files handled at the same time may share parents.
+	m.dirMu.Lock()
+	defer m.dirMu.Unlock()
+	if !fileExists(m.BackupDir) {
+		if err := os.MkdirAll(m.BackupDir, 0700); err != nil {
+			return err
+		}
+		m.log(Action{Kind: ActionMkdir, Dest: m.BackupDir})
+	}
+	return m.mkdirParents(m.BackupDir, m.DestDir, rel)
+}
+
+// restoreBackup puts the backup just made by makeBackup back at destPath, which must
+// not exist. The backup itself is left alone, since it might have been rotated.
+func (m *Merger) restoreBackup(destPath, backupPath string) error {
+	return m.copyDest(context.Background(), backupPath, destPath)
+}
@@ -0,0 +1,116 @@
+package merge
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestBackupRotate(t *testing.T) {
+	tests := []struct {
+		rotate int
+		runs   int
+		want   tree
+	}{
+		{rotate: 3, runs: 1, want: tree{"f": "v1", "f.upmerge~1": "v0"}},
+		{rotate: 3, runs: 2, want: tree{"f": "v2", "f.upmerge~1": "v1", "f.upmerge~2": "v0"}},
+		{rotate: 3, runs: 3, want: tree{"f": "v3", "f.upmerge~1": "v2", "f.upmerge~2": "v1", "f.upmerge~3": "v0"}},
+		// The oldest is dropped.
+		{rotate: 3, runs: 5, want: tree{"f": "v5", "f.upmerge~1": "v4", "f.upmerge~2": "v3", "f.upmerge~3": "v2"}},
+		// With one, it's always replaced by the newest.
+		{rotate: 1, runs: 1, want: tree{"f": "v1", "f.upmerge~1": "v0"}},
+		{rotate: 1, runs: 3, want: tree{"f": "v3", "f.upmerge~1": "v2"}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("rotate %d, %d runs", tt.rotate, tt.runs), func(t *testing.T) {
+			m, _ := newTestMerger(t, nil, tree{"f": "v0"})
+			m.BackupRotate = tt.rotate
+			for i := 1; i <= tt.runs; i++ {
+				writeTree(t, m.SrcDir, tree{"f": fmt.Sprintf("v%d", i)})
+				run(t, m)
+			}
+			checkTree(t, m.DestDir, tt.want)
+		})
+	}
+}
+
+func TestBackupRotateSameContents(t *testing.T) {
+	// A backup that's the same as the newest doesn't push the others along.
+	m, _ := newTestMerger(t, tree{"f": "new"}, tree{"f": "old", "f.upmerge~1": "old", "f.upmerge~2": "older"})
+	m.BackupRotate = 3
+	run(t, m)
+	checkTree(t, m.DestDir, tree{"f": "new", "f.upmerge~1": "old", "f.upmerge~2": "older"})
+}
+
+func TestBackupRotateCheck(t *testing.T) {
+	// Only the newest backup is reported as differing.
+	m, rec := newTestMerger(t, tree{"f": "v2"}, tree{"f": "v2", "f.upmerge~1": "v1", "f.upmerge~2": "v0"})
+	m.BackupRotate = 2
+	run(t, m)
+	var checked []string
+	for _, a := range rec.Actions {
+		if a.Kind == ActionCheck {
+			checked = append(checked, filepath.Base(a.Backup))
+		}
+	}
+	if len(checked) != 1 || checked[0] != "f.upmerge~1" {
+		t.Errorf("CHECK reported for %q, want only f.upmerge~1", checked)
+	}
+}
+
+func TestBackupRotateBackupDir(t *testing.T) {
+	m, _ := newTestMerger(t, nil, tree{"d/f": "v0"})
+	m.BackupRotate = 2
+	m.BackupDir = filepath.Join(filepath.Dir(m.DestDir), "backups")
+	for i := 1; i <= 3; i++ {
+		writeTree(t, m.SrcDir, tree{"d/f": fmt.Sprintf("v%d", i)})
+		run(t, m)
+	}
+	checkTree(t, m.BackupDir, tree{"d/": "", "d/f.1": "v2", "d/f.2": "v1"})
+	if _, err := os.Stat(filepath.Join(m.DestDir, "d", "f.upmerge~1")); !os.IsNotExist(err) {
+		t.Errorf("backup kept next to the file: %v", err)
+	}
+}
+
+func TestCopyLeftoverBackup(t *testing.T) {
+	tests := []struct {
+		name  string
+		dest  tree
+		setup func(m *Merger)
+		err   bool
+		kinds []string
+		want  tree
+	}{
+		{name: "no backup", kinds: []string{"copy f"}, want: tree{"f": "new"}},
+		// Already a copy of what's installed.
+		{name: "backup matches", dest: tree{"f.upmerge~": "new"},
+			kinds: []string{"copy f"}, want: tree{"f": "new", "f.upmerge~": "new"}},
+		{name: "backup matches, clean", dest: tree{"f.upmerge~": "new"}, setup: func(m *Merger) { m.CleanIdenticalBackups = true },
+			kinds: []string{"copy f", "clean f"}, want: tree{"f": "new"}},
+		{name: "backup differs", dest: tree{"f.upmerge~": "old"},
+			kinds: []string{"copy f", "check f"}, want: tree{"f": "new", "f.upmerge~": "old"}},
+		{name: "backup differs, dry run", dest: tree{"f.upmerge~": "old"}, setup: func(m *Merger) { m.DryRun = true },
+			kinds: []string{"copy f", "check f"}, want: tree{"f.upmerge~": "old"}},
+		{name: "backup differs, strict", dest: tree{"f.upmerge~": "old"}, setup: func(m *Merger) { m.Strict = true },
+			err: true, kinds: []string{"error f"}, want: tree{"f.upmerge~": "old"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, rec := newTestMerger(t, tree{"f": "new"}, tt.dest)
+			if tt.setup != nil {
+				tt.setup(m)
+			}
+			_, err := m.Run(context.Background())
+			if (err != nil) != tt.err {
+				t.Fatalf("run: %v, want an error: %v", err, tt.err)
+			}
+			if got := kinds(rec.Actions); !reflect.DeepEqual(got, tt.kinds) {
+				t.Errorf("got %q, want %q", got, tt.kinds)
+			}
+			checkTree(t, m.DestDir, tt.want)
+		})
+	}
+}
@@ -0,0 +1,36 @@
+package merge
+
+import (
+	"io"
+	"sync"
+)
+
+// bufSize is the size of the buffers that files are copied and compared with.
+const bufSize = 64 * 1024
+
+// bufPool holds buffers of bufSize, so that copying and comparing many files doesn't
+// allocate new ones for each.
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, bufSize)
+		return &buf
+	},
+}
+
+// getBuf returns a buffer of bufSize from bufPool, to be given back with putBuf.
+func getBuf() *[]byte {
+	return bufPool.Get().(*[]byte)
+}
+
+// putBuf gives buf, from getBuf, back to bufPool.
+func putBuf(buf *[]byte) {
+	bufPool.Put(buf)
+}
+
+// copyBuffered copies everything from r into w through a buffer from bufPool. Unlike
+// io.Copy, it doesn't let either side bring its own (such as *os.File does).
+func copyBuffered(w io.Writer, r io.Reader) (int64, error) {
+	buf := getBuf()
+	defer putBuf(buf)
+	return io.CopyBuffer(struct{ io.Writer }{w}, struct{ io.Reader }{r}, *buf)
+}
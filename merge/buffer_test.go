@@ -0,0 +1,46 @@
+package merge
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// BenchmarkCopy merges a tree of many small files, and one of a single large file,
+// into an empty destination, and again once it's up to date.
+func BenchmarkCopy(b *testing.B) {
+	trees := []struct {
+		name string
+		src  tree
+	}{
+		{"2000x512B", genTree(2000, 512)},
+		{"1x64MiB", tree{"big": strings.Repeat("0123456789abcdef", 4<<20)}},
+	}
+	for _, tt := range trees {
+		b.Run(tt.name+"/copy", func(b *testing.B) {
+			m, _ := newTestMerger(b, tt.src, nil)
+			m.Observer = nil
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				if err := os.RemoveAll(m.DestDir); err != nil {
+					b.Fatal(err)
+				}
+				if err := os.Mkdir(m.DestDir, 0755); err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+				run(b, m)
+			}
+		})
+		b.Run(tt.name+"/up-to-date", func(b *testing.B) {
+			m, _ := newTestMerger(b, tt.src, tt.src)
+			m.Observer = nil
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				run(b, m)
+			}
+		})
+	}
+}
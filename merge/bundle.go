@@ -0,0 +1,168 @@
+package merge
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// BundleFile is the entry describing a bundle, at the end of it. It's left out when the
+// bundle is merged from.
+const BundleFile = ".upmerge-bundle"
+
+// BundleInfo is what BundleFile records about a bundle.
+type BundleInfo struct {
+	// Version is that of the upmerge that made the bundle.
+	Version string `json:"version,omitempty"`
+	Host    string `json:"host,omitempty"`
+	// Revision is that of the source, as recorded in the manifest.
+	Revision string `json:"revision,omitempty"`
+	// Files has the SHA-256 of every file in the bundle, by relative path.
+	Files map[string]string `json:"files"`
+}
+
+// Bundle writes a tarball of the source to w, leaving out whatever isn't merged from
+// it, with templates as they are. The same source always makes the same tarball:
+// entries are sorted, have no owners, and their times are clamped to clamp, if it's
+// set. The info is completed, and written to BundleFile.
+func (m *Merger) Bundle(ctx context.Context, w io.Writer, info BundleInfo, clamp time.Time) error {
+	if err := m.Validate(); err != nil {
+		return err
+	}
+	if err := m.loadLayers(); err != nil {
+		return err
+	}
+	if err := m.loadIgnore(); err != nil {
+		return err
+	}
+	// MetaFile is bundled as it is, for the users and groups of where it's merged.
+	m.meta = nil
+	if info.Host == "" {
+		info.Host, _ = os.Hostname()
+	}
+	if info.Revision == "" {
+		info.Revision = m.srcRevision(ctx)
+	}
+	info.Files = make(map[string]string)
+	tw := tar.NewWriter(w)
+	err := m.walkSrc(func(rel string, d fs.DirEntry, walkErr error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if walkErr != nil {
+			return wrapErr(OpWalk, rel, walkErr)
+		}
+		if rel == MetaFile {
+			return m.bundleEntry(tw, rel, d, info.Files, clamp)
+		}
+		if skip, err := m.skipExcluded(rel, d); skip {
+			return err
+		}
+		if !d.IsDir() && m.isIgnored(rel) {
+			return nil
+		}
+		return m.bundleEntry(tw, rel, d, info.Files, clamp)
+	})
+	if err != nil {
+		return err
+	}
+	buf, err := json.MarshalIndent(info, "", "\t")
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     "./" + BundleFile,
+		Mode:     int64(DefaultFileMode),
+		Size:     int64(len(buf)),
+		ModTime:  bundleTime(clamp),
+	}
+	if err = tw.WriteHeader(hdr); err == nil {
+		_, err = tw.Write(buf)
+	}
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// bundleTime returns the time to give entries of a bundle that have none: clamp, or
+// failing that, the Unix epoch.
+func bundleTime(clamp time.Time) time.Time {
+	if clamp.IsZero() {
+		return time.Unix(0, 0)
+	}
+	return clamp.Truncate(time.Second)
+}
+
+// bundleEntry writes the source entry at rel, described by d, to tw, recording the
+// hashes of files in hashes.
+func (m *Merger) bundleEntry(tw *tar.Writer, rel string, d fs.DirEntry, hashes map[string]string, clamp time.Time) error {
+	target, err := m.srcLink(rel)
+	if err != nil {
+		return wrapErr(OpWalk, rel, err)
+	}
+	var st fs.FileInfo
+	if target != "" {
+		st, err = d.Info()
+	} else {
+		// Copying what the symlink points to, if it's one.
+		st, err = fs.Stat(m.src(), srcName(rel))
+	}
+	if err != nil {
+		return wrapErr(OpWalk, rel, err)
+	}
+	if st.Mode()&specialModes != 0 {
+		m.log(Action{Kind: ActionSkip, Src: m.srcPath(rel), Error: specialName(st.Mode())})
+		return nil
+	}
+	hdr, err := tar.FileInfoHeader(st, target)
+	if err != nil {
+		return wrapErr(OpCopy, rel, err)
+	}
+	hdr.Name = "./"
+	if rel != "." {
+		hdr.Name += filepath.ToSlash(rel)
+		if st.IsDir() {
+			hdr.Name += "/"
+		}
+	}
+	mode := m.srcMode(st)
+	hdr.Mode = int64(mode.Perm())
+	for bit, tarBit := range map[fs.FileMode]int64{fs.ModeSetuid: 04000, fs.ModeSetgid: 02000, fs.ModeSticky: 01000} {
+		if mode&bit != 0 {
+			hdr.Mode |= tarBit
+		}
+	}
+	hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = 0, 0, "", ""
+	hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+	hdr.ModTime = st.ModTime().Truncate(time.Second)
+	if hdr.ModTime.IsZero() || !clamp.IsZero() && hdr.ModTime.After(clamp) {
+		hdr.ModTime = bundleTime(clamp)
+	}
+	if err = tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		return nil
+	}
+	f, err := m.src().Open(srcName(rel))
+	if err != nil {
+		return wrapErr(OpCopy, rel, err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(tw, h), f); err != nil {
+		return wrapErr(OpCopy, rel, err)
+	}
+	hashes[filepath.ToSlash(rel)] = hex.EncodeToString(h.Sum(nil))
+	return nil
+}
@@ -0,0 +1,77 @@
+package merge
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// bundle returns the bundle m makes, with times clamped to clamp.
+func bundle(t *testing.T, m *Merger, clamp time.Time) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := m.Bundle(context.Background(), &buf, BundleInfo{Version: "test", Host: "h"}, clamp); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestBundleDeterministic(t *testing.T) {
+	src := tree{"b": "b\n", "a/c": "c\n", "a/d/": "", "e" + RemoveSuffix: "", ".upmergeignore": "x\n", "x": "x\n"}
+	m, _ := newTestMerger(t, src, nil)
+	clamp := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	first := bundle(t, m, clamp)
+	if second := bundle(t, m, clamp); !bytes.Equal(first, second) {
+		t.Fatal("bundled the same source twice, and got different bundles")
+	}
+
+	// Written again later, the same files make the same bundle.
+	other, _ := newTestMerger(t, nil, nil)
+	writeTree(t, other.SrcDir, src)
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(other.SrcDir, "b"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	if got := bundle(t, other, clamp); !bytes.Equal(first, got) {
+		t.Error("bundled copies of a source, and got different bundles")
+	}
+
+	var names []string
+	var info BundleInfo
+	tr := tar.NewReader(bytes.NewReader(first))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+		if hdr.Uid != 0 || hdr.Gid != 0 || hdr.Uname != "" || hdr.Gname != "" {
+			t.Errorf("%s: owned by %d:%d (%s:%s)", hdr.Name, hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname)
+		}
+		if hdr.ModTime.After(clamp) {
+			t.Errorf("%s: time %v, after %v", hdr.Name, hdr.ModTime, clamp)
+		}
+		if hdr.Name == "./"+BundleFile {
+			if err := json.NewDecoder(tr).Decode(&info); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// What's ignored is left out, with the file saying so.
+	want := []string{"./", "./a/", "./a/c", "./a/d/", "./b", "./e" + RemoveSuffix, "./" + BundleFile}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("got %q, want %q", names, want)
+	}
+	if _, ok := info.Files["a/c"]; !ok || info.Host != "h" {
+		t.Errorf("got %+v, want the hashes of the files", info)
+	}
+}
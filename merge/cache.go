@@ -0,0 +1,141 @@
+package merge
+
+import (
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// A suggested place to keep the cache, if it's wanted.
+const DefaultCachePath = "/var/db/upmerge/cache"
+
+// cacheEntry records the hash of a file, along with what's needed to tell whether the
+// file changed since.
+type cacheEntry struct {
+	Size  int64  `json:"size"`
+	Mtime int64  `json:"mtime"`
+	Inode uint64 `json:"inode"`
+	Hash  string `json:"hash"`
+}
+
+// hashCache remembers the hashes of the files on either side, by relative path.
+type hashCache struct {
+	SrcDir  string                `json:"srcDir"`
+	Layers  []string              `json:"layers,omitempty"`
+	DestDir string                `json:"destDir"`
+	Src     map[string]cacheEntry `json:"src"`
+	Dest    map[string]cacheEntry `json:"dest"`
+
+	mu    sync.Mutex
+	dirty bool
+}
+
+// loadCache reads the cache from CachePath, if set. A cache that's missing, unreadable,
+// or made for other directories is simply started over.
+func (m *Merger) loadCache() {
+	m.cache = nil
+	if m.CachePath == "" {
+		return
+	}
+	srcDir, _ := filepath.Abs(m.SrcDir)
+	destDir, _ := filepath.Abs(m.DestDir)
+	var layers []string
+	for _, dir := range m.Layers {
+		abs, _ := filepath.Abs(dir)
+		layers = append(layers, abs)
+	}
+	c := &hashCache{}
+	if buf, err := os.ReadFile(m.CachePath); err == nil {
+		if json.Unmarshal(buf, c) != nil || c.SrcDir != srcDir || !sameStrings(c.Layers, layers) ||
+			c.DestDir != destDir {
+			c = &hashCache{}
+		}
+	}
+	c.SrcDir, c.Layers, c.DestDir = srcDir, layers, destDir
+	if c.Src == nil {
+		c.Src = make(map[string]cacheEntry)
+	}
+	if c.Dest == nil {
+		c.Dest = make(map[string]cacheEntry)
+	}
+	m.cache = c
+}
+
+// saveCache writes the cache back to CachePath, if anything changed.
+func (m *Merger) saveCache() error {
+	c := m.cache
+	if c == nil || !c.dirty || m.DryRun {
+		return nil
+	}
+	buf, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(m.CachePath), 0700); err != nil {
+		return err
+	}
+	// Write it whole, or not at all.
+	tmp := m.CachePath + ".tmp"
+	if err = os.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, m.CachePath); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	c.dirty = false
+	return nil
+}
+
+// match returns true if open files src and dest (at rel) have the same contents,
+// going by their cached hashes where those are still fresh.
+func (c *hashCache) match(rel string, src, dest fs.File) (bool, error) {
+	s1, err := src.Stat()
+	if err != nil {
+		return false, err
+	}
+	s2, err := dest.Stat()
+	if err != nil {
+		return false, err
+	}
+	if s1.Size() != s2.Size() {
+		return false, nil
+	}
+	h1, err := c.hash(c.Src, rel, src, s1)
+	if err != nil {
+		return false, err
+	}
+	h2, err := c.hash(c.Dest, rel, dest, s2)
+	if err != nil {
+		return false, err
+	}
+	return h1 == h2, nil
+}
+
+// hash returns the hash of open file f (at rel, described by st), from entries if it's
+// still fresh there. Otherwise, the file is read, and entries updated.
+func (c *hashCache) hash(entries map[string]cacheEntry, rel string, f fs.File, st fs.FileInfo) (string, error) {
+	key := cacheEntry{Size: st.Size(), Mtime: st.ModTime().UnixNano(), Inode: fileInode(st)}
+	// Without a modification time (as in an embed.FS), there's no telling.
+	fresh := !st.ModTime().IsZero()
+	c.mu.Lock()
+	e, ok := entries[rel]
+	c.mu.Unlock()
+	if fresh && ok && e.Size == key.Size && e.Mtime == key.Mtime && e.Inode == key.Inode {
+		return e.Hash, nil
+	}
+	hash, err := hashReader(f)
+	if err != nil {
+		return "", err
+	}
+	if fresh {
+		key.Hash = hash
+		c.mu.Lock()
+		entries[rel] = key
+		c.dirty = true
+		c.mu.Unlock()
+	}
+	return hash, nil
+}
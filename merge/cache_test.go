@@ -0,0 +1,117 @@
+package merge
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// rewrite replaces the contents of the file at path with contents (of the same size),
+// in place, and gives it back its modification time, so that its size, inode and
+// mtime all say it hasn't changed.
+func rewrite(t *testing.T, path, contents string) {
+	t.Helper()
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(contents); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, st.ModTime(), st.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCache(t *testing.T) {
+	m, rec := newTestMerger(t, tree{"a": "aaaa", "b": "bbbb"}, nil)
+	m.CachePath = filepath.Join(t.TempDir(), "cache")
+	run(t, m)
+	run(t, m)
+	if !fileExists(m.CachePath) {
+		t.Fatal("no cache saved")
+	}
+
+	// A change that the cache can't see is taken on trust...
+	dest := filepath.Join(m.DestDir, "a")
+	rewrite(t, dest, "AAAA")
+	rec.Actions = nil
+	run(t, m)
+	if want := []string{"ok a", "ok b"}; !reflect.DeepEqual(kinds(rec.Actions), want) {
+		t.Fatalf("got actions %q, want %q", kinds(rec.Actions), want)
+	}
+
+	// ...until the file's modification time changes.
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(dest, later, later); err != nil {
+		t.Fatal(err)
+	}
+	rec.Actions = nil
+	run(t, m)
+	if want := []string{"move a", "copy a", "ok b"}; !reflect.DeepEqual(kinds(rec.Actions), want) {
+		t.Errorf("got actions %q, want %q", kinds(rec.Actions), want)
+	}
+	checkTree(t, m.DestDir, tree{"a": "aaaa", "a.upmerge~": "AAAA", "b": "bbbb"})
+}
+
+func TestCacheSrc(t *testing.T) {
+	m, rec := newTestMerger(t, tree{"a": "aaaa"}, tree{"a": "aaaa"})
+	m.CachePath = filepath.Join(t.TempDir(), "cache")
+	run(t, m)
+	src := filepath.Join(m.SrcDir, "a")
+	rewrite(t, src, "AAAA")
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(src, later, later); err != nil {
+		t.Fatal(err)
+	}
+	rec.Actions = nil
+	run(t, m)
+	if want := []string{"move a", "copy a"}; !reflect.DeepEqual(kinds(rec.Actions), want) {
+		t.Errorf("got actions %q, want %q", kinds(rec.Actions), want)
+	}
+}
+
+func TestCacheFallback(t *testing.T) {
+	tests := []struct {
+		name  string
+		cache string
+	}{
+		{"corrupt", `{"srcDir": `},
+		{"not json", "\x00\x01\x02"},
+		{"other directories", `{"srcDir": "/nowhere", "destDir": "/nowhere", "src": {"a": {"size": 4, "hash": "x"}}, "dest": {"a": {"size": 4, "hash": "x"}}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, rec := newTestMerger(t, tree{"a": "aaaa"}, tree{"a": "AAAA"})
+			m.CachePath = filepath.Join(t.TempDir(), "cache")
+			if err := os.WriteFile(m.CachePath, []byte(tt.cache), 0600); err != nil {
+				t.Fatal(err)
+			}
+			run(t, m)
+			if want := []string{"move a", "copy a"}; !reflect.DeepEqual(kinds(rec.Actions), want) {
+				t.Errorf("got actions %q, want %q", kinds(rec.Actions), want)
+			}
+		})
+	}
+}
+
+func TestNoCache(t *testing.T) {
+	// Without a cache, a change is always seen.
+	m, rec := newTestMerger(t, tree{"a": "aaaa"}, nil)
+	run(t, m)
+	rewrite(t, filepath.Join(m.DestDir, "a"), "AAAA")
+	rec.Actions = nil
+	run(t, m)
+	if want := []string{"move a", "copy a"}; !reflect.DeepEqual(kinds(rec.Actions), want) {
+		t.Errorf("got actions %q, want %q", kinds(rec.Actions), want)
+	}
+}
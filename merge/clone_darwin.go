@@ -0,0 +1,43 @@
+//go:build darwin
+
+package merge
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// From <sys/syscall.h>, <fcntl.h> and <sys/clonefile.h>.
+const (
+	sysClonefileat   = 462
+	atFDCWD          = -2
+	cloneNoOwnerCopy = 0x0002
+)
+
+// cloneFile makes destPath, which must not exist, a clone of srcPath with
+// clonefile(2): sharing its blocks on an APFS volume, until either is changed. Its
+// owner is left to be set, like that of a copy. It's made in its directory, as opened
+// through m.
+func cloneFile(srcPath, destPath string, m *Merger) error {
+	dir, name, err := m.openDestParent(destPath)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	src, err := syscall.BytePtrFromString(srcPath)
+	if err != nil {
+		return err
+	}
+	dest, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	cwd := atFDCWD
+	_, _, errno := syscall.Syscall6(sysClonefileat, uintptr(cwd), uintptr(unsafe.Pointer(src)),
+		dir.Fd(), uintptr(unsafe.Pointer(dest)), cloneNoOwnerCopy, 0)
+	if errno != 0 {
+		return &os.LinkError{Op: "clonefile", Old: srcPath, New: destPath, Err: errno}
+	}
+	return nil
+}
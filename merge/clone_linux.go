@@ -0,0 +1,46 @@
+package merge
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// ficlone is the FICLONE ioctl, from <linux/fs.h>; the direction bits are placed
+// differently on some architectures.
+func ficlone() uintptr {
+	switch runtime.GOARCH {
+	case "mips", "mipsle", "mips64", "mips64le", "ppc64", "ppc64le":
+		return 0x80049409
+	}
+	return 0x40049409
+}
+
+// cloneFile makes destPath, which must not exist, a clone of srcPath with the FICLONE
+// ioctl: sharing its blocks on a file system with reflinks (such as Btrfs or XFS),
+// until either is changed. It's left with the current time, and private to its owner.
+// It's created (and removed, if that fails) through m.
+func cloneFile(srcPath, destPath string, m *Merger) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dest, err := m.newDestFile(destPath, 0600)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dest.Fd(), ficlone(), src.Fd())
+	if errno != 0 {
+		err = &os.LinkError{Op: "ficlone", Old: srcPath, New: destPath, Err: errno}
+	} else {
+		err = dest.Sync()
+	}
+	if closeErr := dest.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		m.removeDest(destPath)
+	}
+	return err
+}
@@ -0,0 +1,10 @@
+//go:build !darwin && !linux
+
+package merge
+
+import "errors"
+
+// cloneFile fails: there's no way to clone files on this system.
+func cloneFile(srcPath, destPath string, m *Merger) error {
+	return errors.New("cloning files isn't supported on this system")
+}
@@ -0,0 +1,90 @@
+//go:build unix
+
+package merge
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeClone replaces clone, for the rest of t, with one failing with err (or copying
+// the file, if nil, leaving it private and with the current time, as a clone may), and
+// returns how many times it was called.
+func fakeClone(t *testing.T, err error) *int {
+	calls := 0
+	orig := clone
+	clone = func(srcPath, destPath string, m *Merger) error {
+		calls++
+		if err != nil {
+			return err
+		}
+		buf, readErr := os.ReadFile(srcPath)
+		if readErr != nil {
+			return readErr
+		}
+		return os.WriteFile(destPath, buf, 0600)
+	}
+	t.Cleanup(func() { clone = orig })
+	return &calls
+}
+
+func TestClone(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		noClone bool
+		calls   int
+	}{
+		{name: "cloned", calls: 1},
+		// Such as ENOTSUP, or EXDEV across file systems: copied instead.
+		{name: "not supported", err: errors.New("cloning files isn't supported on this system"), calls: 1},
+		{name: "no clone", noClone: true, calls: 0},
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := newTestMerger(t, tree{"f": "contents\n"}, tree{"f": "old\n"})
+			src := filepath.Join(m.SrcDir, "f")
+			if err := os.Chmod(src, 0640); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(src, mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+			m.NoClone = tt.noClone
+			calls := fakeClone(t, tt.err)
+			run(t, m)
+			if *calls != tt.calls {
+				t.Errorf("clone called %d times, want %d", *calls, tt.calls)
+			}
+			checkTree(t, m.DestDir, tree{"f": "contents\n", "f.upmerge~": "old\n"})
+			// Whichever way it got there, it's fixed up the same.
+			st, err := os.Stat(filepath.Join(m.DestDir, "f"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if st.Mode().Perm() != 0640 {
+				t.Errorf("mode %04o, want 0640", st.Mode().Perm())
+			}
+			if !st.ModTime().Equal(mtime) {
+				t.Errorf("modified at %s, want %s", st.ModTime(), mtime)
+			}
+		})
+	}
+}
+
+func TestCloneFile(t *testing.T) {
+	// Only where the file system can; a failure is left to the copy.
+	m, _ := newTestMerger(t, tree{"f": "contents\n"}, nil)
+	dest := filepath.Join(m.DestDir, "f")
+	if err := cloneFile(filepath.Join(m.SrcDir, "f"), dest, m); err != nil {
+		if _, statErr := os.Lstat(dest); !os.IsNotExist(statErr) {
+			t.Errorf("%s left behind by a failed clone", dest)
+		}
+		t.Skip(err)
+	}
+	checkTree(t, m.DestDir, tree{"f": "contents\n"})
+}
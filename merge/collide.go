@@ -0,0 +1,101 @@
+package merge
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
+// foldName returns name the way a case-insensitive file system (such as macOS's, by
+// default) compares it: decomposed, as in NFD, and in lower case.
+func foldName(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		if d, ok := decompositions[r]; ok {
+			b.WriteString(d)
+		} else if r >= 0xac00 && r <= 0xd7a3 {
+			// Hangul syllables decompose into their jamo.
+			s := r - 0xac00
+			b.WriteRune(0x1100 + s/588)
+			b.WriteRune(0x1161 + s%588/28)
+			if s%28 != 0 {
+				b.WriteRune(0x11a7 + s%28)
+			}
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return strings.ToLower(b.String())
+}
+
+// foldedPaths maps paths in the destination, as compared by foldName, to the first
+// source entry seen for each.
+type foldedPaths map[string]foldedPath
+
+type foldedPath struct {
+	name, rel string
+	dir       bool
+}
+
+// add records the source entry at rel, which goes to name in the destination, and
+// returns the source entry seen before that would be the same file on a
+// case-insensitive file system, if there is one. Directories may share a name: their
+// contents simply end up together. The very same name is left for the run to sort out.
+func (f foldedPaths) add(name, rel string, isDir bool) (string, bool) {
+	key := foldName(filepath.ToSlash(name))
+	prev, ok := f[key]
+	if !ok {
+		f[key] = foldedPath{name: name, rel: rel, dir: isDir}
+		return "", false
+	}
+	return prev.rel, prev.name != name && !(prev.dir && isDir)
+}
+
+// checkCollisions refuses to go ahead if any two entries of the source would be the
+// same file in DestDir, on a case-insensitive file system, unless CaseSensitiveDest
+// is set. Each collision is reported, before anything is changed.
+func (m *Merger) checkCollisions(ctx context.Context) error {
+	if m.CaseSensitiveDest {
+		return nil
+	}
+	seen := make(foldedPaths)
+	var errs MultiError
+	err := m.scanSrc(func(rel string, d fs.DirEntry, walkErr error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if walkErr != nil {
+			// Left for the run itself to report.
+			return nil
+		}
+		if skip, err := m.skipExcluded(rel, d); skip {
+			return err
+		}
+		if !d.IsDir() && m.isIgnored(rel) {
+			return nil
+		}
+		name := rel
+		if target, ok := removeTarget(rel); ok {
+			name = target
+		}
+		if other, ok := seen.add(name, rel, d.IsDir()); ok {
+			m.log(Action{
+				Kind: ActionError,
+				Src:  m.srcPath(rel),
+				Dest: filepath.Join(m.DestDir, name),
+				Error: fmt.Sprintf("%s and %s would be the same file on a case-insensitive destination",
+					m.srcPath(other), m.srcPath(rel)),
+			})
+			errs = append(errs, wrapErr(OpWalk, name, ErrRefuse))
+		}
+		return nil
+	})
+	if err != nil || len(errs) == 0 {
+		return err
+	} else if len(errs) == 1 {
+		return errs[0]
+	}
+	return errs
+}
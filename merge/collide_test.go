@@ -0,0 +1,72 @@
+package merge
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFoldName(t *testing.T) {
+	tests := []struct{ a, b string }{
+		{"README", "readme"},
+		{"caf\u00e9", "cafe\u0301"},
+		{"\u00c9t\u00e9", "e\u0301te\u0301"},
+		{"\ud55c", "\u1112\u1161\u11ab"},
+	}
+	for _, tt := range tests {
+		if foldName(tt.a) != foldName(tt.b) {
+			t.Errorf("%q and %q fold to %q and %q", tt.a, tt.b, foldName(tt.a), foldName(tt.b))
+		}
+	}
+	if foldName("a") == foldName("b") {
+		t.Error("a and b fold to the same")
+	}
+}
+
+func TestCollisions(t *testing.T) {
+	m, rec := newTestMerger(t, tree{
+		"README": "one\n", "d/caf\u00e9": "one\n", "D/other": "dirs share\n", "ok": "ok\n",
+	}, nil)
+	writeTree(t, m.SrcDir, tree{"readme": "two\n", "d/cafe\u0301": "two\n"})
+	if len(readTree(t, m.SrcDir)) != 8 {
+		t.Skip("the source is on a case-insensitive file system")
+	}
+	_, err := m.Run(context.Background())
+	if !errors.Is(err, ErrRefuse) {
+		t.Fatalf("got %v, want a refusal", err)
+	}
+	var errs MultiError
+	if !errors.As(err, &errs) || len(errs) != 2 {
+		t.Errorf("got %v, want both collisions", err)
+	}
+	reported := 0
+	for _, a := range rec.Actions {
+		if a.Kind == ActionError {
+			reported++
+		}
+	}
+	if reported != 2 {
+		t.Errorf("got %d collisions reported, want 2", reported)
+	}
+	checkTree(t, m.DestDir, tree{})
+
+	// Merged into a case-sensitive destination, they're all different files.
+	m.CaseSensitiveDest = true
+	run(t, m)
+	if got := len(readTree(t, m.DestDir)); got != 8 {
+		t.Errorf("got %d entries in the destination, want 8", got)
+	}
+}
+
+func TestCollisionsRemoved(t *testing.T) {
+	// A file marked for removal goes by the name of what it removes.
+	m, _ := newTestMerger(t, tree{"Conf": "new\n"}, nil)
+	if err := os.WriteFile(filepath.Join(m.SrcDir, "conf"+RemoveSuffix), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Run(context.Background()); !errors.Is(err, ErrRefuse) {
+		t.Errorf("got %v, want a refusal", err)
+	}
+}
@@ -0,0 +1,169 @@
+package merge
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+)
+
+// fileContentsAreIdentical returns true if the contents of files named by path1 and
+// path2 are identical. Symlinks aren't followed: they're identical only to symlinks
+// with the same target.
+func fileContentsAreIdentical(path1, path2 string) (bool, error) {
+	s1, err := os.Lstat(path1)
+	if err != nil {
+		return false, err
+	}
+	s2, err := os.Lstat(path2)
+	if err != nil {
+		return false, err
+	}
+	if (s1.Mode()|s2.Mode())&fs.ModeSymlink != 0 {
+		if s1.Mode().Type() != s2.Mode().Type() {
+			return false, nil
+		}
+		target, err := os.Readlink(path1)
+		if err != nil {
+			return false, err
+		}
+		return linkMatches(path2, target)
+	}
+	f1, err := os.Open(path1)
+	if err != nil {
+		return false, err
+	}
+	defer f1.Close()
+	f2, err := os.Open(path2)
+	if err != nil {
+		return false, err
+	}
+	defer f2.Close()
+	return filesAreIdentical(f1, f2)
+}
+
+// filesAreIdentical returns true if the contents of open files f1 and f2 are
+// identical.
+func filesAreIdentical(f1, f2 fs.File) (bool, error) {
+	// Take a shortcut: if the files have different sizes, they must be different.
+	s1, err := f1.Stat()
+	if err != nil {
+		return false, err
+	}
+	s2, err := f2.Stat()
+	if err != nil {
+		return false, err
+	}
+	if s1.Size() != s2.Size() {
+		return false, nil
+	}
+	return readersAreIdentical(f1, f2)
+}
+
+// linkMatches returns true if path is a symlink to target.
+func linkMatches(path, target string) (bool, error) {
+	st, err := os.Lstat(path)
+	if err != nil {
+		return false, err
+	}
+	if st.Mode()&fs.ModeSymlink == 0 {
+		return false, nil
+	}
+	dest, err := os.Readlink(path)
+	return dest == target, err
+}
+
+// readersAreIdentical compares r1 and r2 chunk by chunk, stopping at the first
+// mismatch.
+func readersAreIdentical(r1, r2 io.Reader) (bool, error) {
+	b1, b2 := getBuf(), getBuf()
+	defer putBuf(b1)
+	defer putBuf(b2)
+	buf1, buf2 := *b1, *b2
+	for {
+		n1, err1 := io.ReadFull(r1, buf1)
+		if err1 != nil && err1 != io.EOF && err1 != io.ErrUnexpectedEOF {
+			return false, err1
+		}
+		n2, err2 := io.ReadFull(r2, buf2)
+		if err2 != nil && err2 != io.EOF && err2 != io.ErrUnexpectedEOF {
+			return false, err2
+		}
+		if !bytes.Equal(buf1[:n1], buf2[:n2]) {
+			return false, nil
+		}
+		if err1 != nil || err2 != nil {
+			// At least one side is exhausted; both must be for a match.
+			return err1 != nil && err2 != nil, nil
+		}
+	}
+}
+
+// DiffInfo tells where a file about to be replaced first differs from its source.
+type DiffInfo struct {
+	// Offset is that of the first byte that differs, counting from 0.
+	Offset int64 `json:"offset"`
+	// Line is the line that byte is on, counting from 1, or 0 if the files aren't text.
+	Line     int   `json:"line,omitempty"`
+	SrcSize  int64 `json:"srcSize"`
+	DestSize int64 `json:"destSize"`
+	// Tail is set if the files only differ in what one of them has at the end, past
+	// the rest of the other.
+	Tail bool `json:"tail,omitempty"`
+}
+
+// String describes d the way it's printed in verbose mode.
+func (d *DiffInfo) String() string {
+	switch {
+	case d.Tail && d.DestSize > d.SrcSize:
+		return fmt.Sprintf("dest has %d more bytes at the end", d.DestSize-d.SrcSize)
+	case d.Tail:
+		return fmt.Sprintf("src has %d more bytes at the end", d.SrcSize-d.DestSize)
+	case d.Line > 0:
+		return fmt.Sprintf("differs at offset %d, line %d", d.Offset, d.Line)
+	}
+	return fmt.Sprintf("differs at offset %d", d.Offset)
+}
+
+// diffReaders compares src and dest chunk by chunk, like readersAreIdentical, and
+// returns where they first differ, or nil if they don't. The sizes are left to be set.
+func diffReaders(src, dest io.Reader) (*DiffInfo, error) {
+	b1, b2 := getBuf(), getBuf()
+	defer putBuf(b1)
+	defer putBuf(b2)
+	buf1, buf2 := *b1, *b2
+	var d DiffInfo
+	text := true
+	for chunk := 0; ; chunk++ {
+		n1, err1 := io.ReadFull(src, buf1)
+		if err1 != nil && err1 != io.EOF && err1 != io.ErrUnexpectedEOF {
+			return nil, err1
+		}
+		n2, err2 := io.ReadFull(dest, buf2)
+		if err2 != nil && err2 != io.EOF && err2 != io.ErrUnexpectedEOF {
+			return nil, err2
+		}
+		if chunk == 0 {
+			text = !isBinary(buf1[:n1]) && !isBinary(buf2[:n2])
+		}
+		n := min(n1, n2)
+		i := 0
+		for i < n && buf1[i] == buf2[i] {
+			i++
+		}
+		d.Offset += int64(i)
+		d.Line += bytes.Count(buf1[:i], []byte("\n"))
+		if i < n || n1 != n2 {
+			if text {
+				d.Line++
+			} else {
+				d.Line = 0
+			}
+			return &d, nil
+		}
+		if err1 != nil || err2 != nil {
+			return nil, nil
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package merge
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileContentsAreIdentical(t *testing.T) {
+	big := bytes.Repeat([]byte("0123456789abcdef"), 3*bufSize/16+5)
+	lastByte := func(b []byte, c byte) []byte {
+		b = append([]byte(nil), b...)
+		b[len(b)-1] = c
+		return b
+	}
+	tests := []struct {
+		name string
+		a, b []byte
+		same bool
+	}{
+		{name: "empty", a: nil, b: nil, same: true},
+		{name: "equal", a: []byte("hello\n"), b: []byte("hello\n"), same: true},
+		// The second file used to be read from the first's path, so any two files of
+		// the same size matched.
+		{name: "same size", a: []byte("hello\n"), b: []byte("world\n"), same: false},
+		{name: "last byte", a: []byte("hello\n"), b: []byte("hello!"), same: false},
+		{name: "sizes", a: []byte("hello\n"), b: []byte("hello\n\n"), same: false},
+		{name: "larger than buffer", a: big, b: append([]byte(nil), big...), same: true},
+		{name: "larger than buffer, last byte", a: big, b: lastByte(big, '!'), same: false},
+		{name: "larger than buffer, first chunk", a: big, b: append([]byte("!"), big[1:]...), same: false},
+		{name: "buffer size", a: big[:bufSize], b: lastByte(big[:bufSize], '!'), same: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+			if err := os.WriteFile(a, tt.a, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(b, tt.b, 0644); err != nil {
+				t.Fatal(err)
+			}
+			for _, args := range [][2]string{{a, b}, {b, a}} {
+				same, err := fileContentsAreIdentical(args[0], args[1])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if same != tt.same {
+					t.Errorf("fileContentsAreIdentical(%s, %s) = %v, want %v",
+						filepath.Base(args[0]), filepath.Base(args[1]), same, tt.same)
+				}
+			}
+		})
+	}
+}
+
+func TestFileContentsAreIdenticalMissing(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a")
+	if err := os.WriteFile(a, []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if same, err := fileContentsAreIdentical(a, filepath.Join(dir, "missing")); same || !os.IsNotExist(err) {
+		t.Errorf("got %v, %v; want false, and a missing file", same, err)
+	}
+}
+
+func TestFileContentsAreIdenticalSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for name, target := range map[string]string{"a": "file", "b": "file", "c": "other"} {
+		if err := os.Symlink(target, filepath.Join(dir, name)); err != nil {
+			t.Skip(err)
+		}
+	}
+	tests := []struct {
+		a, b string
+		same bool
+	}{
+		{"a", "b", true},
+		{"a", "c", false},
+		// A symlink is only the same as another symlink, not what it points to.
+		{"a", "file", false},
+		{"file", "a", false},
+	}
+	for _, tt := range tests {
+		same, err := fileContentsAreIdentical(filepath.Join(dir, tt.a), filepath.Join(dir, tt.b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if same != tt.same {
+			t.Errorf("fileContentsAreIdentical(%s, %s) = %v, want %v", tt.a, tt.b, same, tt.same)
+		}
+	}
+}
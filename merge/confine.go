@@ -0,0 +1,80 @@
+package merge
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// isInside returns true if path is root, or anywhere below it.
+func isInside(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// mergedIntoItself returns true if src, a source directory inside dest, would be
+// written to by the merge: if any of the sources has something at its place in dest.
+// Otherwise, it's fine where it is, as with dotfiles kept in the home directory.
+func (m *Merger) mergedIntoItself(src, dest string) bool {
+	rel, err := filepath.Rel(dest, src)
+	if err != nil {
+		return true
+	}
+	for _, dir := range m.srcDirs() {
+		if _, err := os.Lstat(filepath.Join(dir, rel)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// checkConfined refuses to write to rel in DestDir if any of its parent directories is
+// a symlink leading out of DestDir. With leaf, the same goes for rel itself: it's about
+// to be written through, rather than replaced.
+func (m *Merger) checkConfined(rel string, leaf bool) error {
+	root, err := filepath.EvalSymlinks(m.DestDir)
+	if err != nil {
+		// Nothing can be in the way of a destination that doesn't exist yet.
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	parts := strings.Split(rel, string(filepath.Separator))
+	if !leaf {
+		parts = parts[:len(parts)-1]
+	}
+	path := m.DestDir
+	for _, part := range parts {
+		path = filepath.Join(path, part)
+		st, err := os.Lstat(path)
+		if isMissing(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if st.Mode()&fs.ModeSymlink == 0 {
+			continue
+		}
+		resolved, err := filepath.EvalSymlinks(path)
+		if os.IsNotExist(err) {
+			// Leads nowhere, so there's nothing to write through; creating
+			// anything there will fail on its own.
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if !isInside(root, resolved) {
+			m.log(Action{
+				Kind:   ActionRefuse,
+				Dest:   path,
+				Target: resolved,
+				Error:  fmt.Sprintf("refusing to write through symlink out of %s: %s", m.DestDir, path),
+			})
+			return wrapErr("", rel, ErrRefuse)
+		}
+	}
+	return nil
+}
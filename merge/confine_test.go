@@ -0,0 +1,61 @@
+package merge
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfined(t *testing.T) {
+	tests := []struct {
+		name string
+		src  tree
+		link string // in the destination, to outside
+		want tree   // outside
+	}{
+		{name: "file", src: tree{"foo": "new"}, link: "foo",
+			want: tree{"secret": "secret", "dir/": ""}},
+		{name: "parent", src: tree{"dir/": "", "dir/foo": "new"}, link: "dir",
+			want: tree{"secret": "secret", "dir/": ""}},
+		{name: "grandparent", src: tree{"dir/": "", "dir/sub/": "", "dir/sub/foo": "new"}, link: "dir",
+			want: tree{"secret": "secret", "dir/": ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, rec := newTestMerger(t, tt.src, nil)
+			outside := filepath.Join(filepath.Dir(m.DestDir), "outside")
+			writeTree(t, outside, tree{"secret": "secret", "dir/": ""})
+			target := filepath.Join(outside, "secret")
+			if tt.link == "dir" {
+				target = filepath.Join(outside, "dir")
+			}
+			if err := os.Symlink(target, filepath.Join(m.DestDir, tt.link)); err != nil {
+				t.Skip(err)
+			}
+			_, err := m.Run(context.Background())
+			if !errors.Is(err, ErrRefuse) {
+				t.Fatalf("got %v, want a refusal", err)
+			}
+			refused := false
+			for _, a := range rec.Actions {
+				refused = refused || a.Kind == ActionRefuse && a.Target == target
+			}
+			if !refused {
+				t.Errorf("got actions %q, want a REFUSE of the symlink to %s", kinds(rec.Actions), target)
+			}
+			checkTree(t, outside, tt.want)
+		})
+	}
+}
+
+func TestConfinedInside(t *testing.T) {
+	// A symlink that stays inside is written through.
+	m, _ := newTestMerger(t, tree{"link/": "", "link/foo": "new"}, tree{"real/": ""})
+	if err := os.Symlink("real", filepath.Join(m.DestDir, "link")); err != nil {
+		t.Skip(err)
+	}
+	run(t, m)
+	checkTree(t, m.DestDir, tree{"real/": "", "real/foo": "new", "link": "-> real"})
+}
@@ -0,0 +1,222 @@
+package merge
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// destRootFor returns DestDir, opened as a destRoot (once per run), or nil with
+// UnsafeFollow.
+func (m *Merger) destRootFor() (*destRoot, error) {
+	if m.UnsafeFollow {
+		return nil, nil
+	}
+	m.destMu.Lock()
+	defer m.destMu.Unlock()
+	if m.dest == nil {
+		var err error
+		if m.dest, err = openDestRoot(m.DestDir); err != nil {
+			return nil, err
+		}
+	}
+	return m.dest, nil
+}
+
+// closeDest closes DestDir, if it was opened by destRootFor.
+func (m *Merger) closeDest() {
+	m.destMu.Lock()
+	defer m.destMu.Unlock()
+	if m.dest != nil {
+		m.dest.Close()
+		m.dest = nil
+	}
+}
+
+// inDest returns the destRoot that the paths, which must all be inside DestDir, are
+// to be worked on through, along with the paths relative to it. It returns nil if
+// they're to be worked on as they are: with UnsafeFollow, or if any is outside.
+func (m *Merger) inDest(paths ...string) (*destRoot, []string, error) {
+	rels := make([]string, len(paths))
+	for i, path := range paths {
+		rel, err := filepath.Rel(m.DestDir, path)
+		if err != nil || rel == "." || !isInside(m.DestDir, path) {
+			return nil, nil, nil
+		}
+		rels[i] = rel
+	}
+	root, err := m.destRootFor()
+	if root == nil {
+		return nil, nil, err
+	}
+	return root, rels, nil
+}
+
+// newDestFile creates a new file at path, which must not exist, for writing.
+func (m *Merger) newDestFile(path string, perm fs.FileMode) (*os.File, error) {
+	const flag = os.O_CREATE | os.O_EXCL | os.O_WRONLY
+	root, rels, err := m.inDest(path)
+	if err != nil {
+		return nil, err
+	} else if root != nil {
+		return root.openFile(rels[0], flag, perm)
+	}
+	return os.OpenFile(path, flag, perm)
+}
+
+// openDest opens the file at path for reading.
+func (m *Merger) openDest(path string) (*os.File, error) {
+	root, rels, err := m.inDest(path)
+	if err != nil {
+		return nil, err
+	} else if root != nil {
+		return root.openFile(rels[0], os.O_RDONLY, 0)
+	}
+	return os.Open(path)
+}
+
+// openDestParent opens the directory holding path, for making a file in it, and
+// returns the name of the file in it.
+func (m *Merger) openDestParent(path string) (*os.File, string, error) {
+	root, rels, err := m.inDest(path)
+	if err != nil {
+		return nil, "", err
+	} else if root != nil {
+		dir, err := root.openDir(filepath.Dir(rels[0]))
+		return dir, filepath.Base(path), err
+	}
+	dir, err := os.Open(filepath.Dir(path))
+	return dir, filepath.Base(path), err
+}
+
+// writeNewDest is writeNewFile, creating destPath with newDestFile.
+func (m *Merger) writeNewDest(ctx context.Context, destPath string, r io.Reader, mode fs.FileMode) error {
+	// Keep it private until it's whole.
+	fw, err := m.newDestFile(destPath, 0600)
+	if err != nil {
+		return err
+	}
+	if err = fillNewFile(ctx, fw, r, mode); err != nil {
+		m.removeDest(destPath)
+	}
+	return err
+}
+
+// symlinkDest creates a symlink to target at path.
+func (m *Merger) symlinkDest(target, path string) error {
+	root, rels, err := m.inDest(path)
+	if err != nil {
+		return err
+	} else if root != nil {
+		return root.symlink(target, rels[0])
+	}
+	return os.Symlink(target, path)
+}
+
+// renameDest renames oldPath to newPath.
+func (m *Merger) renameDest(oldPath, newPath string) error {
+	root, rels, err := m.inDest(oldPath, newPath)
+	if err != nil {
+		return err
+	} else if root != nil {
+		return root.rename(rels[0], rels[1])
+	}
+	return os.Rename(oldPath, newPath)
+}
+
+// moveDest renames oldPath to newPath with renameDest, falling back to copying and
+// unlinking when the two are on different devices (such as a file in DestDir, and its
+// backup in BackupDir). A directory is moved with everything in it.
+func (m *Merger) moveDest(oldPath, newPath string) error {
+	err := m.renameDest(oldPath, newPath)
+	if !isCrossDevice(err) {
+		return err
+	}
+	if err = m.removeDest(newPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if st, statErr := os.Lstat(oldPath); statErr == nil && st.IsDir() {
+		if err = m.copyTree(oldPath, newPath); err != nil {
+			m.removeAllDest(newPath)
+			return err
+		}
+		return m.removeAllDest(oldPath)
+	}
+	if target, linkErr := os.Readlink(oldPath); linkErr == nil {
+		err = m.symlinkDest(target, newPath)
+	} else {
+		// Once started, don't leave the move half done.
+		err = m.copyDest(context.Background(), oldPath, newPath)
+	}
+	if err != nil {
+		return err
+	}
+	return m.removeDest(oldPath)
+}
+
+// copyDest is copyFile, opening srcPath with openDest, and creating destPath with
+// writeNewDest.
+func (m *Merger) copyDest(ctx context.Context, srcPath, destPath string) error {
+	fr, err := m.openDest(srcPath)
+	if err != nil {
+		return err
+	}
+	defer fr.Close()
+	st, err := fr.Stat()
+	if err != nil {
+		return err
+	}
+	if err = m.writeNewDest(ctx, destPath, fr, st.Mode()&modeBits); err != nil {
+		return err
+	}
+	if err = copyTimes(destPath, st); err != nil {
+		return err
+	}
+	return copyOwner(destPath, st)
+}
+
+// mkdirDest creates a directory at path.
+func (m *Merger) mkdirDest(path string, perm fs.FileMode) error {
+	root, rels, err := m.inDest(path)
+	if err != nil {
+		return err
+	} else if root != nil {
+		return root.mkdir(rels[0], perm)
+	}
+	return os.Mkdir(path, perm)
+}
+
+// chmodDest changes the mode of path.
+func (m *Merger) chmodDest(path string, mode fs.FileMode) error {
+	root, rels, err := m.inDest(path)
+	if err != nil {
+		return err
+	} else if root != nil {
+		return root.chmod(rels[0], mode)
+	}
+	return os.Chmod(path, mode)
+}
+
+// removeDest removes the file (or empty directory) at path.
+func (m *Merger) removeDest(path string) error {
+	root, rels, err := m.inDest(path)
+	if err != nil {
+		return err
+	} else if root != nil {
+		return root.remove(rels[0])
+	}
+	return os.Remove(path)
+}
+
+// removeAllDest removes path, with everything in it if it's a directory.
+func (m *Merger) removeAllDest(path string) error {
+	root, rels, err := m.inDest(path)
+	if err != nil {
+		return err
+	} else if root != nil {
+		return root.removeAll(rels[0])
+	}
+	return os.RemoveAll(path)
+}
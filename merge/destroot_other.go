@@ -0,0 +1,119 @@
+//go:build !go1.25
+
+package merge
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// destRoot is DestDir, with every path checked for a symlink leading out of it right
+// before it's used. Without os.Root, in older versions of Go, that leaves a window for
+// a symlink to be swapped in between the check and the use, if only a narrow one.
+type destRoot struct {
+	dir string
+}
+
+// openDestRoot opens dir as a destRoot.
+func openDestRoot(dir string) (*destRoot, error) {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &destRoot{root}, nil
+}
+
+func (d *destRoot) Close() error { return nil }
+
+// path returns the path of rel, once its parents are known to stay inside the root.
+func (d *destRoot) path(rel string) (string, error) {
+	path := d.dir
+	parts := strings.Split(rel, string(filepath.Separator))
+	for _, part := range parts[:len(parts)-1] {
+		path = filepath.Join(path, part)
+		st, err := os.Lstat(path)
+		if err != nil {
+			// Failing the same way it would have anyway.
+			break
+		} else if st.Mode()&fs.ModeSymlink == 0 {
+			continue
+		}
+		if resolved, err := filepath.EvalSymlinks(path); err != nil || !isInside(d.dir, resolved) {
+			return "", &fs.PathError{Op: "open", Path: rel, Err: fmt.Errorf("path escapes from parent")}
+		}
+	}
+	return filepath.Join(d.dir, rel), nil
+}
+
+func (d *destRoot) openFile(rel string, flag int, perm fs.FileMode) (*os.File, error) {
+	path, err := d.path(rel)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(path, flag, perm)
+}
+
+func (d *destRoot) openDir(rel string) (*os.File, error) {
+	// rel is checked as a parent, as well.
+	path, err := d.path(rel + string(filepath.Separator) + ".")
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+func (d *destRoot) symlink(target, rel string) error {
+	path, err := d.path(rel)
+	if err != nil {
+		return err
+	}
+	return os.Symlink(target, path)
+}
+
+func (d *destRoot) rename(oldRel, newRel string) error {
+	oldPath, err := d.path(oldRel)
+	if err != nil {
+		return err
+	}
+	newPath, err := d.path(newRel)
+	if err != nil {
+		return err
+	}
+	return os.Rename(oldPath, newPath)
+}
+
+func (d *destRoot) mkdir(rel string, perm fs.FileMode) error {
+	path, err := d.path(rel)
+	if err != nil {
+		return err
+	}
+	return os.Mkdir(path, perm)
+}
+
+func (d *destRoot) chmod(rel string, mode fs.FileMode) error {
+	path, err := d.path(rel)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(path, mode)
+}
+
+func (d *destRoot) remove(rel string) error {
+	path, err := d.path(rel)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// removeAll doesn't follow a symlink at rel itself, only those leading up to it.
+func (d *destRoot) removeAll(rel string) error {
+	path, err := d.path(rel)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(path)
+}
@@ -0,0 +1,47 @@
+//go:build go1.25
+
+package merge
+
+import (
+	"io/fs"
+	"os"
+)
+
+// destRoot is DestDir, opened so that nothing done in it can be led out of it by a
+// symlink, even one swapped in for a directory after it was checked: every path is
+// looked up from the open directory, one part at a time, and symlinks are only followed
+// while they stay inside.
+type destRoot struct {
+	root *os.Root
+}
+
+// openDestRoot opens dir as a destRoot.
+func openDestRoot(dir string) (*destRoot, error) {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &destRoot{root}, nil
+}
+
+func (d *destRoot) Close() error { return d.root.Close() }
+
+func (d *destRoot) openFile(rel string, flag int, perm fs.FileMode) (*os.File, error) {
+	return d.root.OpenFile(rel, flag, perm)
+}
+
+func (d *destRoot) openDir(rel string) (*os.File, error) { return d.root.Open(rel) }
+
+func (d *destRoot) symlink(target, rel string) error { return d.root.Symlink(target, rel) }
+
+func (d *destRoot) rename(oldRel, newRel string) error { return d.root.Rename(oldRel, newRel) }
+
+// mkdir leaves out the setuid, setgid and sticky bits, which os.Root refuses; they're
+// set by the chmod that follows.
+func (d *destRoot) mkdir(rel string, perm fs.FileMode) error { return d.root.Mkdir(rel, perm.Perm()) }
+
+func (d *destRoot) chmod(rel string, mode fs.FileMode) error { return d.root.Chmod(rel, mode) }
+
+func (d *destRoot) remove(rel string) error { return d.root.Remove(rel) }
+
+func (d *destRoot) removeAll(rel string) error { return d.root.RemoveAll(rel) }
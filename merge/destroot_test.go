@@ -0,0 +1,105 @@
+package merge
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestApplySwappedForSymlink(t *testing.T) {
+	m, _ := newTestMerger(t, tree{"d/new": "new", "d/g": "g"}, tree{"d/g": "old"})
+	plan, err := m.Plan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Between planning and applying, d is swapped for a symlink leading out of the
+	// destination, to a directory that looks just like it.
+	outside := filepath.Join(filepath.Dir(m.DestDir), "outside")
+	writeTree(t, outside, tree{"g": "old"})
+	if err := os.RemoveAll(filepath.Join(m.DestDir, "d")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(m.DestDir, "d")); err != nil {
+		t.Skip(err)
+	}
+	if _, err := m.Apply(context.Background(), plan); !errors.Is(err, ErrRefuse) {
+		t.Errorf("got %v, want a refusal", err)
+	}
+	checkTree(t, outside, tree{"g": "old"})
+}
+
+func TestDestRootSwapped(t *testing.T) {
+	ops := []struct {
+		name string
+		do   func(m *Merger, d string) error
+	}{
+		{"create", func(m *Merger, d string) error {
+			return m.writeNewDest(context.Background(), filepath.Join(d, "new"), strings.NewReader("new"), 0644)
+		}},
+		{"symlink", func(m *Merger, d string) error { return m.symlinkDest("g", filepath.Join(d, "link")) }},
+		{"rename", func(m *Merger, d string) error {
+			return m.renameDest(filepath.Join(d, "g"), filepath.Join(d, "g.upmerge~"))
+		}},
+		{"mkdir", func(m *Merger, d string) error { return m.mkdirDest(filepath.Join(d, "sub"), 0755) }},
+		{"chmod", func(m *Merger, d string) error { return m.chmodDest(filepath.Join(d, "g"), 0600) }},
+		{"remove", func(m *Merger, d string) error { return m.removeDest(filepath.Join(d, "g")) }},
+		{"remove all", func(m *Merger, d string) error { return m.removeAllDest(filepath.Join(d, "g")) }},
+		{"rotate backups", func(m *Merger, d string) error {
+			m.BackupRotate = 2
+			return m.rotateBackups(filepath.Join(d, "g.upmerge~"))
+		}},
+		{"restore backup", func(m *Merger, d string) error {
+			return m.restoreBackup(filepath.Join(d, "new"), filepath.Join(d, "g"))
+		}},
+	}
+	for _, op := range ops {
+		for _, unsafe := range []bool{false, true} {
+			name := op.name
+			if unsafe {
+				name += ", unsafe follow"
+			}
+			t.Run(name, func(t *testing.T) {
+				m, _ := newTestMerger(t, nil, tree{"d/g": "old"})
+				m.UnsafeFollow = unsafe
+				// Opened at the start of the run, before anything is checked.
+				if _, err := m.destRootFor(); err != nil {
+					t.Fatal(err)
+				}
+				defer m.closeDest()
+				// After the checks, d is swapped for a symlink leading out.
+				outside := filepath.Join(filepath.Dir(m.DestDir), "outside")
+				writeTree(t, outside, tree{"g": "old", "g.upmerge~1": "1", "g.upmerge~2": "2"})
+				if err := os.Chmod(filepath.Join(outside, "g"), 0644); err != nil {
+					t.Fatal(err)
+				}
+				d := filepath.Join(m.DestDir, "d")
+				if err := os.RemoveAll(d); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Symlink(outside, d); err != nil {
+					t.Skip(err)
+				}
+				before := readTree(t, outside)
+				err := op.do(m, d)
+				after := readTree(t, outside)
+				st, statErr := os.Lstat(filepath.Join(outside, "g"))
+				changed := !reflect.DeepEqual(before, after) ||
+					statErr == nil && st.Mode().Perm() != 0644
+				if unsafe {
+					// As asked: the symlink is followed.
+					if err != nil || !changed {
+						t.Errorf("got %v, and changed outside: %v; want it followed", err, changed)
+					}
+					return
+				}
+				if err == nil || changed {
+					t.Errorf("got %v, and changed outside: %v; want it to fail, with nothing changed", err, changed)
+				}
+			})
+		}
+	}
+}
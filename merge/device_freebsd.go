@@ -0,0 +1,20 @@
+package merge
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// fileDevice returns the raw mode and device number of the file described by st, if
+// known.
+func fileDevice(st fs.FileInfo) (mode uint32, dev uint64, ok bool) {
+	if sys, ok := st.Sys().(*syscall.Stat_t); ok {
+		return uint32(sys.Mode), uint64(sys.Rdev), true
+	}
+	return 0, 0, false
+}
+
+// mknod creates a device at path, with the raw mode and device number of another.
+func mknod(path string, mode uint32, dev uint64) error {
+	return syscall.Mknod(path, mode, dev)
+}
@@ -0,0 +1,18 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+
+package merge
+
+import (
+	"errors"
+	"io/fs"
+)
+
+// fileDevice returns false: devices can't be recreated here.
+func fileDevice(st fs.FileInfo) (mode uint32, dev uint64, ok bool) {
+	return 0, 0, false
+}
+
+// mknod fails: devices can't be recreated here.
+func mknod(path string, mode uint32, dev uint64) error {
+	return errors.New("creating devices isn't supported")
+}
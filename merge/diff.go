@@ -0,0 +1,211 @@
+package merge
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// diffOp is a single line of an edit script: kept (' '), deleted ('-') or
+// inserted ('+').
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// isBinary guesses whether buf holds binary data, by looking for NUL bytes in its
+// first chunk.
+func isBinary(buf []byte) bool {
+	if len(buf) > bufSize {
+		buf = buf[:bufSize]
+	}
+	return bytes.IndexByte(buf, 0) >= 0
+}
+
+// splitLines splits buf into lines, keeping the line terminators.
+func splitLines(buf []byte) []string {
+	var lines []string
+	for len(buf) > 0 {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			lines = append(lines, string(buf))
+			break
+		}
+		lines = append(lines, string(buf[:i+1]))
+		buf = buf[i+1:]
+	}
+	return lines
+}
+
+// diffLines computes the shortest edit script turning a into b, using Myers'
+// algorithm.
+func diffLines(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	max := n + m
+	off := max + 1
+	v := make([]int, 2*max+3)
+	// trace[d] holds v[-d-1 .. d+1] as it was before round d.
+	var trace [][]int
+	for d := 0; d <= max; d++ {
+		trace = append(trace, append([]int(nil), v[off-d-1:off+d+2]...))
+		done := false
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				done = true
+				break
+			}
+		}
+		if done {
+			break
+		}
+	}
+
+	var ops []diffOp
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		tv := trace[d]
+		get := func(k int) int { return tv[k+d+1] }
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && get(k-1) < get(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := get(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			ops = append(ops, diffOp{' ', a[x-1]})
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prevX {
+				ops = append(ops, diffOp{'+', b[y-1]})
+			} else {
+				ops = append(ops, diffOp{'-', a[x-1]})
+			}
+			x, y = prevX, prevY
+		}
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+// hunkRange formats one side of a hunk header, the way diff -u does.
+func hunkRange(start, length int) string {
+	if length == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if length == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, length)
+}
+
+// unifiedDiff returns a unified diff, with ctx lines of context, turning a (labelled
+// nameA) into b (labelled nameB). It returns an empty string if there are no
+// differences.
+func unifiedDiff(nameA, nameB string, a, b []byte, ctx int) string {
+	ops := diffLines(splitLines(a), splitLines(b))
+	// Line offsets into a and b at the start of each op.
+	ai := make([]int, len(ops)+1)
+	bi := make([]int, len(ops)+1)
+	for i, op := range ops {
+		ai[i+1], bi[i+1] = ai[i], bi[i]
+		if op.kind != '+' {
+			ai[i+1]++
+		}
+		if op.kind != '-' {
+			bi[i+1]++
+		}
+	}
+
+	var out strings.Builder
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+		start := i - ctx
+		if start < 0 {
+			start = 0
+		}
+		// Extend the hunk over any changes separated by at most 2*ctx kept lines.
+		end := i
+		for end < len(ops) {
+			if ops[end].kind != ' ' {
+				end++
+				continue
+			}
+			run := end
+			for run < len(ops) && ops[run].kind == ' ' {
+				run++
+			}
+			if run == len(ops) || run-end > 2*ctx {
+				break
+			}
+			end = run
+		}
+		stop := end + ctx
+		if stop > len(ops) {
+			stop = len(ops)
+		}
+
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %s\n+++ %s\n", nameA, nameB)
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n",
+			hunkRange(ai[start], ai[stop]-ai[start]),
+			hunkRange(bi[start], bi[stop]-bi[start]))
+		for _, op := range ops[start:stop] {
+			out.WriteByte(op.kind)
+			out.WriteString(op.line)
+			if !strings.HasSuffix(op.line, "\n") {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		i = stop
+	}
+	return out.String()
+}
+
+// DiffFiles returns a unified diff turning the file at path1 into the one at path2,
+// or a short note if either of them looks binary.
+func DiffFiles(path1, path2 string, ctx int) (string, error) {
+	buf1, err := os.ReadFile(path1)
+	if err != nil {
+		return "", err
+	}
+	buf2, err := os.ReadFile(path2)
+	if err != nil {
+		return "", err
+	}
+	return diffBytes(path1, path2, buf1, buf2, ctx), nil
+}
+
+// diffBytes is like DiffFiles, for contents that have already been read.
+func diffBytes(name1, name2 string, buf1, buf2 []byte, ctx int) string {
+	if isBinary(buf1) || isBinary(buf2) {
+		if bytes.Equal(buf1, buf2) {
+			return ""
+		}
+		return fmt.Sprintf("Binary files %s and %s differ\n", name1, name2)
+	}
+	return unifiedDiff(name1, name2, buf1, buf2, ctx)
+}
@@ -0,0 +1,139 @@
+package merge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+)
+
+var (
+	// ErrRefuse is returned (wrapped in a FileError) when carrying on would destroy
+	// data that upmerge can't restore, such as a differing backup.
+	ErrRefuse = errors.New("refusing operation")
+	// ErrQuit can be returned by Merger.Resolve to stop the run.
+	ErrQuit = errors.New("quit at user's request")
+	// ErrChanged is returned (wrapped in a FileError) by Merger.Apply for each step
+	// whose files changed since it was planned, and by Merger.Undo for each entry
+	// changed since the run.
+	ErrChanged = errors.New("changed in the meantime")
+	// ErrSpecial is returned (wrapped in a FileError) with Merger.Strict for each
+	// special file in the source, such as a named pipe, as those are never copied.
+	ErrSpecial = errors.New("not a regular file")
+	// ErrImmutable is returned (wrapped in a FileError) when a file in the destination
+	// can't be replaced, because it's marked immutable with chflags.
+	ErrImmutable = errors.New("destination is immutable")
+	// ErrProtected is returned (wrapped in a FileError) with Merger.Protected set to
+	// ProtectedFail, for each file in the destination that System Integrity
+	// Protection keeps from being changed.
+	ErrProtected = errors.New("protected by System Integrity Protection")
+	// ErrInvalid is returned (wrapped in a FileError) for each file whose new version
+	// was rejected by one of Merger.Validators.
+	ErrInvalid = errors.New("failed validation")
+	// ErrHook is returned (in a MultiError) for each of Merger.Hooks that fails. The
+	// changes that triggered it are kept.
+	ErrHook = errors.New("hook failed")
+	// ErrSnapshot is returned before anything is changed, with Merger.Snapshot set to
+	// SnapshotRequired, if the snapshot of the destination can't be taken.
+	ErrSnapshot = errors.New("can't take a snapshot")
+)
+
+// Operations named in a FileError.
+const (
+	OpWalk    = "walk"
+	OpMkdir   = "mkdir"
+	OpChmod   = "chmod"
+	OpCopy    = "copy"
+	OpCompare = "compare"
+	OpBackup  = "backup"
+	OpRemove  = "remove"
+	OpRevert  = "revert"
+	OpAdopt   = "adopt"
+	OpVerify  = "verify"
+	OpMerge   = "merge"
+	OpJournal = "journal"
+	OpUndo    = "undo"
+)
+
+// FileError records an error, and the operation and path (relative to the roots)
+// that caused it.
+type FileError struct {
+	Op   string
+	Path string
+	Err  error
+}
+
+func (e *FileError) Error() string {
+	if e.Op == "" {
+		return fmt.Sprintf("%s: %s", e.Path, e.Err)
+	}
+	return fmt.Sprintf("%s %s: %s", e.Op, e.Path, e.Err)
+}
+
+func (e *FileError) Unwrap() error { return e.Err }
+
+// wrapErr attaches op and rel to err, if it's not nil.
+func wrapErr(op, rel string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &FileError{Op: op, Path: rel, Err: err}
+}
+
+// MultiError is a list of errors that happened during a single run.
+type MultiError []error
+
+func (m MultiError) Error() string {
+	if len(m) == 1 {
+		return m[0].Error()
+	}
+	return fmt.Sprintf("%d errors", len(m))
+}
+
+func (m MultiError) Unwrap() []error { return m }
+
+// isFatal returns true for errors that stop a run even with KeepGoing.
+func isFatal(err error) bool {
+	return errors.Is(err, ErrQuit) ||
+		errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded)
+}
+
+// recordErr passes err, about the entry at rel, on to the Observer. With KeepGoing,
+// it's also recorded, and nil is returned so that the run carries on.
+func (m *Merger) recordErr(rel string, err error) error {
+	if err == nil || err == fs.SkipDir || isFatal(err) {
+		return err
+	}
+	m.fail(rel, err)
+	if !m.KeepGoing {
+		return err
+	}
+	var fe *FileError
+	if !errors.As(err, &fe) {
+		err = &FileError{Path: rel, Err: err}
+	}
+	m.mu.Lock()
+	m.failures = append(m.failures, err)
+	m.mu.Unlock()
+	return nil
+}
+
+// keepGoingFunc wraps fn, which is called with paths relative to the root, so that
+// errors about single entries go through recordErr.
+func (m *Merger) keepGoingFunc(fn fs.WalkDirFunc) fs.WalkDirFunc {
+	return func(rel string, d fs.DirEntry, walkErr error) error {
+		err := fn(rel, d, walkErr)
+		if err == nil {
+			return nil
+		}
+		if err = m.recordErr(rel, err); err != nil {
+			return err
+		}
+		if d != nil && d.IsDir() && walkErr == nil {
+			// Whatever went wrong with the directory will go wrong with its contents.
+			return fs.SkipDir
+		}
+		return nil
+	}
+}
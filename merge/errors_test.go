@@ -0,0 +1,74 @@
+package merge
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileError(t *testing.T) {
+	perm := &fs.PathError{Op: "open", Path: "/etc/a/b", Err: fs.ErrPermission}
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{wrapErr(OpCopy, "a/b", perm), "copy a/b: open /etc/a/b: permission denied"},
+		{wrapErr(OpRemove, "a/b", perm), "remove a/b: open /etc/a/b: permission denied"},
+		{&FileError{Path: "a/b", Err: perm}, "a/b: open /etc/a/b: permission denied"},
+		{MultiError{wrapErr(OpMkdir, "a", perm)}, "mkdir a: open /etc/a/b: permission denied"},
+		{MultiError{wrapErr(OpMkdir, "a", perm), wrapErr(OpCopy, "a/b", ErrRefuse)}, "2 errors"},
+	}
+	for _, tt := range tests {
+		if got := tt.err.Error(); got != tt.want {
+			t.Errorf("got %q, want %q", got, tt.want)
+		}
+		if !errors.Is(tt.err, fs.ErrPermission) {
+			t.Errorf("%q: not a permission error", tt.err)
+		}
+		var fe *FileError
+		if !errors.As(tt.err, &fe) || !strings.HasPrefix(fe.Path, "a") {
+			t.Errorf("%q: no FileError with the path", tt.err)
+		}
+	}
+	if wrapErr(OpCopy, "a", nil) != nil {
+		t.Error("wrapErr wrapped nil")
+	}
+}
+
+func TestRunErrorPath(t *testing.T) {
+	m, rec := newTestMerger(t, tree{"d/": ""}, nil)
+	if err := os.Symlink("nowhere", filepath.Join(m.SrcDir, "d", "link")); err != nil {
+		t.Skip(err)
+	}
+	// What the link points to is copied, and there's nothing there.
+	m.CopyLinks = true
+	_, err := m.Run(context.Background())
+	var fe *FileError
+	if !errors.As(err, &fe) {
+		t.Fatalf("got %v, want a FileError", err)
+	}
+	if want := filepath.Join("d", "link"); fe.Path != want || !strings.Contains(err.Error(), want) {
+		t.Errorf("got %q about %q, want it about %q", err, fe.Path, want)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got %q, lost the cause", err)
+	}
+	if len(rec.Errors) != 1 {
+		t.Errorf("got %d errors for the Observer, want 1", len(rec.Errors))
+	}
+}
+
+func TestKeepGoing(t *testing.T) {
+	m, _ := newTestMerger(t, tree{"a/f": "new", "b/f": "new"}, tree{"a/f": "old", "a/f.upmerge~": "older"})
+	m.KeepGoing = true
+	_, err := m.Run(context.Background())
+	var me MultiError
+	if !errors.As(err, &me) || len(me) != 1 || !errors.Is(err, ErrRefuse) {
+		t.Fatalf("got %v, want a refusal in a MultiError", err)
+	}
+	checkTree(t, m.DestDir, tree{"a/": "", "a/f": "old", "a/f.upmerge~": "older", "b/": "", "b/f": "new"})
+}
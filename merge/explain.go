@@ -0,0 +1,322 @@
+package merge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Explanation describes what a run would do with a single path, and why, as found by
+// Merger.Explain.
+type Explanation struct {
+	Path string
+	// Src, Dest and Backup describe the files involved; Src is the marker for a file
+	// that's removed.
+	Src, Dest, Backup ExplainedFile
+	// Step is what a run would do, or nil if it would leave the path alone.
+	Step *Step
+	// Reason is every comparison that led to Step, and its outcome, separated by "; ".
+	Reason string
+}
+
+// ExplainedFile describes a file involved in an Explanation.
+type ExplainedFile struct {
+	Path   string
+	Exists bool
+	Mode   fs.FileMode
+	Size   int64
+	// Hash is the SHA-256 of a regular file, or "-> target" for a symlink.
+	Hash string
+}
+
+// Explain works out what a run would do with the file (or directory) at path, relative
+// to the roots, without changing anything.
+func (m *Merger) Explain(ctx context.Context, path string) (*Explanation, error) {
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	if err := m.ValidateDirs(true); err != nil {
+		return nil, err
+	}
+	root, _ := filepath.Abs(m.SrcDir)
+	if destDir, _ := filepath.Abs(m.DestDir); filepath.IsAbs(path) {
+		if _, err := relPath(destDir, path); err == nil {
+			root = destDir
+		}
+	}
+	rel, err := relPath(root, path)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.loadLayers(); err != nil {
+		return nil, err
+	}
+	if err := m.loadTemplates(); err != nil {
+		return nil, err
+	}
+	m.loadAppends()
+	m.loadOverlays()
+	if err := m.loadIgnore(); err != nil {
+		return nil, err
+	}
+	if _, err := m.loadMeta(); err != nil {
+		return nil, err
+	}
+	if err := m.loadManifest(); err != nil {
+		return nil, err
+	}
+	m.loadCache()
+	dryRun := m.DryRun
+	m.DryRun = true
+	defer func() { m.DryRun = dryRun }()
+
+	e := &Explanation{Path: rel}
+	srcRel := rel
+	d, err := m.srcEntry(rel)
+	if errors.Is(err, fs.ErrNotExist) {
+		if marker, markerErr := m.srcEntry(rel + RemoveSuffix); markerErr == nil {
+			srcRel, d, err = rel+RemoveSuffix, marker, nil
+		}
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, wrapErr(OpWalk, rel, err)
+	}
+	if e.Src, err = m.describeSrc(srcRel, d); err != nil {
+		return nil, wrapErr(OpCompare, rel, err)
+	}
+	if e.Dest, err = describeFile(filepath.Join(m.DestDir, rel)); err != nil {
+		return nil, wrapErr(OpCompare, rel, err)
+	}
+	if e.Backup, err = describeFile(m.backupPathFor(rel)); err != nil {
+		return nil, wrapErr(OpCompare, rel, err)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	for dir := filepath.Dir(srcRel); dir != "."; dir = filepath.Dir(dir) {
+		if m.isExcluded(dir, true) {
+			e.Reason = fmt.Sprintf("%s is excluded, and so is everything in it; would leave it alone",
+				dir)
+			return e, nil
+		}
+	}
+	switch {
+	case d == nil:
+		e.Reason = "not in the source; would leave it alone"
+		return e, nil
+	case !d.IsDir() && !m.isIncluded(srcRel):
+		e.Reason = "not included; would leave it alone"
+		return e, nil
+	}
+	step, err := m.planEntry(srcRel, d)
+	if err != nil {
+		e.Reason = fmt.Sprintf("would fail: %s", err)
+		return e, nil
+	}
+	e.Step = step
+	e.Reason, err = m.explainStep(e, srcRel)
+	return e, err
+}
+
+// srcEntry returns the entry for rel in the source, the same as a walk would find it.
+func (m *Merger) srcEntry(rel string) (fs.DirEntry, error) {
+	name := srcName(rel)
+	entries, err := fs.ReadDir(m.src(), path.Dir(name))
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range entries {
+		if d.Name() == path.Base(name) {
+			return m.withMeta(name, d), nil
+		}
+	}
+	return nil, &fs.PathError{Op: "stat", Path: m.srcPath(rel), Err: fs.ErrNotExist}
+}
+
+// describeSrc describes the source entry d at rel, which is nil if it's missing.
+func (m *Merger) describeSrc(rel string, d fs.DirEntry) (ExplainedFile, error) {
+	info := ExplainedFile{Path: m.srcPath(rel)}
+	if d == nil {
+		return info, nil
+	}
+	st, err := d.Info()
+	if err != nil {
+		return info, err
+	}
+	info.Exists, info.Mode, info.Size = true, st.Mode(), st.Size()
+	target, err := m.srcLink(rel)
+	if err != nil {
+		return info, err
+	} else if target != "" {
+		info.Hash = linkHash(target)
+		return info, nil
+	}
+	if st.Mode().Type()&^fs.ModeSymlink == 0 && !st.IsDir() {
+		info.Hash, err = hashOpened(m.src().Open(srcName(rel)))
+	}
+	return info, err
+}
+
+// describeFile describes the file at path, without following a symlink.
+func describeFile(path string) (ExplainedFile, error) {
+	info := ExplainedFile{Path: path}
+	st, err := os.Lstat(path)
+	if isMissing(err) {
+		return info, nil
+	} else if err != nil {
+		return info, err
+	}
+	info.Exists, info.Mode, info.Size = true, st.Mode(), st.Size()
+	if st.Mode().IsRegular() || st.Mode()&fs.ModeSymlink != 0 {
+		info.Hash, err = hashPath(path)
+	}
+	return info, err
+}
+
+// explainStep gives the reason for the step of e, planned for the source entry at rel.
+func (m *Merger) explainStep(e *Explanation, rel string) (string, error) {
+	step := e.Step
+	if step == nil {
+		switch {
+		case rel != e.Path:
+			return "marked for removal, and dest is already gone; nothing to do", nil
+		case e.Src.Mode.IsDir():
+			return "dest already exists; nothing to do for the directory itself", nil
+		}
+		return "the same device is already in dest; nothing to do", nil
+	}
+	var reasons []string
+	switch step.Kind {
+	case StepIgnore:
+		if m.isExcluded(rel, step.Mode.IsDir()) {
+			return "excluded; would leave it alone", nil
+		}
+		return "looks like a backup; never copied", nil
+	case StepOnce:
+		return "only copied if it's missing, and dest exists; would leave it alone", nil
+	case StepMkdir:
+		return "dest is missing; would create the directory", nil
+	case StepChmod:
+		return fmt.Sprintf("dest has mode %04o, src has %04o; would change its permissions",
+			e.Dest.Mode&modeBits, step.Mode), nil
+	case StepSpecial:
+		reason := fmt.Sprintf("src is a %s; would skip it", specialName(step.Mode))
+		if m.Strict {
+			reason += ", and fail"
+		}
+		return reason, nil
+	case StepMknod:
+		return "dest is missing; would create the device", nil
+	case StepTypeConflict:
+		srcType, destType := "a file", "a directory"
+		if step.Mode.IsDir() {
+			srcType, destType = destType, "not"
+		}
+		reason := fmt.Sprintf("src is %s, dest is %s", srcType, destType)
+		if m.ResolveTypeConflicts != TypeConflictSrc {
+			return reason + "; would leave it alone", nil
+		} else if e.Backup.Exists && !m.isForced(step.Path) && m.BackupRotate == 0 {
+			return reason + "; backup exists; would refuse", nil
+		}
+		return reason + "; would back dest up whole, and put src in its place", nil
+	case StepCopy:
+		if step.Target != "" {
+			return "dest is missing; would create the symlink", nil
+		}
+		if step.Backup != "" {
+			if !m.leftoverBackup(step) && m.CleanIdenticalBackups {
+				return "dest is missing, but its backup matches src; would copy src, and remove the backup", nil
+			} else if !m.leftoverBackup(step) {
+				return "dest is missing, but its backup matches src; would copy src", nil
+			} else if m.Strict {
+				return "dest is missing, but its backup differs from src; would refuse", nil
+			}
+			return "dest is missing, but its backup differs from src; would copy src and report it", nil
+		}
+		return "dest is missing; would copy src", nil
+	case StepSkip:
+		reasons = append(reasons, "dest matches src")
+		if step.Quick {
+			reasons[0] = "dest has the same size and modification time as src"
+		} else if step.Loose {
+			reasons[0] = "dest matches src, but for line endings or trailing blanks"
+		}
+		if e.Backup.Exists {
+			same, err := fileContentsAreIdentical(step.Dest, step.Backup)
+			if err != nil {
+				return "", wrapErr(OpCompare, step.Path, err)
+			}
+			if !same && m.keepsDest(step.Path) {
+				return strings.Join(append(reasons, "backup differs from dest by what's merged in; would leave it alone"), "; "), nil
+			} else if !same {
+				return strings.Join(append(reasons, "backup differs from dest; would report it"), "; "), nil
+			}
+			reasons = append(reasons, "backup matches dest")
+			if m.CleanIdenticalBackups {
+				return strings.Join(append(reasons, "would remove the backup"), "; "), nil
+			}
+		}
+		return strings.Join(append(reasons, "would leave it alone"), "; "), nil
+	case StepRemove:
+		reasons = append(reasons, "marked for removal")
+	default:
+		reasons = append(reasons, "dest differs from src")
+	}
+
+	conflict := step.Kind == StepConflict
+	switch {
+	case m.NoBackup:
+		reasons = append(reasons, "no backup is kept")
+	case !e.Backup.Exists:
+		reasons = append(reasons, "there's no backup")
+	default:
+		same, err := fileContentsAreIdentical(step.Dest, step.Backup)
+		if err != nil {
+			return "", wrapErr(OpCompare, step.Path, err)
+		}
+		if same {
+			reasons = append(reasons, "backup matches dest")
+		} else if m.keepsDest(step.Path) {
+			reasons = append(reasons, "backup differs from dest by what's merged in")
+		} else {
+			reasons = append(reasons, "backup exists and differs from dest")
+			if step.Kind == StepRemove {
+				conflict = m.BackupRotate == 0
+			}
+		}
+	}
+	drifted, err := m.drifted(step)
+	if err != nil {
+		return "", wrapErr(OpCompare, step.Path, err)
+	}
+	if drifted {
+		reasons = append(reasons, "dest changed since it was last merged")
+	}
+
+	var outcome string
+	switch {
+	case conflict && m.isForced(step.Path):
+		outcome = "would overwrite the backup, since forced"
+	case conflict && m.Merge && step.Kind != StepRemove:
+		outcome = "would try to merge the changes, and refuse if they conflict"
+	case conflict, drifted && m.StrictDrift && !m.isForced(step.Path):
+		outcome = "would refuse"
+	case step.Kind == StepRemove && m.NoBackup:
+		outcome = "would remove it"
+	case step.Kind == StepRemove:
+		outcome = "would back up dest and remove it"
+	case m.NoBackup:
+		outcome = "would copy src over it"
+	case e.Backup.Exists && m.BackupRotate > 0:
+		outcome = "would rotate the backups, back up dest and copy src over it"
+	default:
+		outcome = "would back up dest and copy src over it"
+	}
+	return strings.Join(append(reasons, outcome), "; "), nil
+}
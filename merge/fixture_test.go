@@ -0,0 +1,150 @@
+package merge
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// tree describes the files of a directory, by slash-separated path relative to it: a
+// path ending in "/" is a directory, and anything else a file holding the value.
+type tree map[string]string
+
+// writeTree creates the files of tr in dir.
+func writeTree(t testing.TB, dir string, tr tree) {
+	t.Helper()
+	for name, contents := range tr {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if strings.HasSuffix(name, "/") {
+			if err := os.MkdirAll(path, 0755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readTree describes the files in dir as a tree.
+func readTree(t testing.TB, dir string) tree {
+	t.Helper()
+	tr := tree{}
+	err := filepath.Walk(dir, func(path string, st os.FileInfo, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		name := filepath.ToSlash(rel)
+		switch {
+		case st.IsDir():
+			tr[name+"/"] = ""
+		case st.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			tr[name] = "-> " + target
+		default:
+			buf, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			tr[name] = string(buf)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tr
+}
+
+// checkTree fails t unless dir holds exactly the files of want.
+func checkTree(t testing.TB, dir string, want tree) {
+	t.Helper()
+	got := readTree(t, dir)
+	var names []string
+	for name := range want {
+		names = append(names, name)
+	}
+	for name := range got {
+		if _, ok := want[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		g, inGot := got[name]
+		w, inWant := want[name]
+		switch {
+		case !inWant:
+			t.Errorf("%s: unexpected %q", name, g)
+		case !inGot:
+			t.Errorf("%s: missing, want %q", name, w)
+		case g != w:
+			t.Errorf("%s: got %q, want %q", name, g, w)
+		}
+	}
+}
+
+// newTestMerger returns a Merger from a new source directory holding src to a new
+// destination directory holding dest, which reports to the Recorder it returns.
+func newTestMerger(t testing.TB, src, dest tree) (*Merger, *Recorder) {
+	t.Helper()
+	root := t.TempDir()
+	srcDir, destDir := filepath.Join(root, "src"), filepath.Join(root, "dest")
+	for _, dir := range []string{srcDir, destDir} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTree(t, srcDir, src)
+	writeTree(t, destDir, dest)
+	m := New(srcDir, destDir)
+	rec := &Recorder{}
+	m.Observer = rec
+	return m, rec
+}
+
+// run runs m, failing t on an error.
+func run(t testing.TB, m *Merger) []Action {
+	t.Helper()
+	actions, err := m.Run(context.Background())
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	return actions
+}
+
+// kinds returns the kinds of actions, with their paths relative to the roots, such as
+// "copy a/b".
+func kinds(actions []Action) []string {
+	var out []string
+	for _, a := range actions {
+		out = append(out, a.Kind+" "+filepath.ToSlash(a.path()))
+	}
+	return out
+}
+
+// genTree returns a tree of n files of size bytes each, spread over directories of
+// up to 100 files.
+func genTree(n, size int) tree {
+	tr := tree{}
+	for i := 0; i < n; i++ {
+		contents := make([]byte, size)
+		for j := range contents {
+			contents[j] = byte('a' + (i+j)%26)
+		}
+		tr[fmt.Sprintf("d%03d/f%05d", i/100, i)] = string(contents)
+	}
+	return tr
+}
@@ -0,0 +1,115 @@
+package merge
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+// File flags, as set by chflags(1); these are the same on every BSD.
+const (
+	flagNoDump        = 0x00000001
+	flagUserImmutable = 0x00000002
+	flagUserAppend    = 0x00000004
+	flagOpaque        = 0x00000008
+	flagArchived      = 0x00010000
+	flagSysImmutable  = 0x00020000
+	flagSysAppend     = 0x00040000
+
+	// immutableFlags stop a file from being replaced, renamed, or removed.
+	immutableFlags = flagUserImmutable | flagUserAppend | flagSysImmutable | flagSysAppend
+	// copiedFlags are copied over from the source. The others (such as the one
+	// for compressed files on macOS) are about how a file is stored.
+	copiedFlags = flagNoDump | flagOpaque | flagArchived | immutableFlags
+)
+
+// flagList names the flags the way chflags does, in order.
+var flagList = []struct {
+	flag uint32
+	name string
+}{
+	{flagNoDump, "nodump"},
+	{flagUserImmutable, "uchg"},
+	{flagUserAppend, "uappnd"},
+	{flagOpaque, "opaque"},
+	{flagArchived, "arch"},
+	{flagSysImmutable, "schg"},
+	{flagSysAppend, "sappnd"},
+}
+
+// flagsByName looks up the flags of flagList by name.
+var flagsByName = func() map[string]uint32 {
+	flags := make(map[string]uint32)
+	for _, f := range flagList {
+		flags[f.name] = f.flag
+	}
+	return flags
+}()
+
+// flagNames names flags the way chflags does.
+func flagNames(flags uint32) string {
+	var names []string
+	for _, f := range flagList {
+		if flags&f.flag != 0 {
+			names = append(names, f.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// copySrcFlags gives destPath the flags of the source file described by st. Flags that
+// can't be set (such as schg, unless running as root) are warned about instead.
+func (m *Merger) copySrcFlags(destPath string, st fs.FileInfo) {
+	flags := fileFlags(st) & copiedFlags
+	if flags == 0 {
+		return
+	}
+	if err := setFileFlags(destPath, flags); err != nil {
+		m.log(Action{
+			Kind:  ActionWarning,
+			Dest:  destPath,
+			Error: fmt.Sprintf("can't set flags %s: %s", flagNames(flags), err),
+		})
+	}
+}
+
+// clearImmutable clears the flags that stop the file at path from being replaced,
+// returning the ones it cleared.
+func clearImmutable(path string) (uint32, error) {
+	st, err := os.Lstat(path)
+	if err != nil || !st.Mode().IsRegular() {
+		return 0, nil
+	}
+	flags := fileFlags(st)
+	if flags&immutableFlags == 0 {
+		return 0, nil
+	}
+	return flags & immutableFlags, setFileFlags(path, flags&^immutableFlags)
+}
+
+// addFileFlags sets flags on path, on top of the ones it already has.
+func addFileFlags(path string, flags uint32) error {
+	st, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	return setFileFlags(path, fileFlags(st)|flags)
+}
+
+// explainImmutable returns err, from changing path, pointing out that path is
+// immutable if that's why it failed.
+func explainImmutable(path string, err error) error {
+	if !errors.Is(err, fs.ErrPermission) {
+		return err
+	}
+	st, statErr := os.Lstat(path)
+	if statErr != nil {
+		return err
+	}
+	if flags := fileFlags(st) & immutableFlags; flags != 0 {
+		return fmt.Errorf("%w: %s is marked %s", ErrImmutable, path, flagNames(flags))
+	}
+	return err
+}
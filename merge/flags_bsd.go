@@ -0,0 +1,21 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package merge
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// sysFlags returns the file flags (as set by chflags) of the file described by st.
+func sysFlags(st fs.FileInfo) uint32 {
+	if sys, ok := st.Sys().(*syscall.Stat_t); ok {
+		return uint32(sys.Flags)
+	}
+	return 0
+}
+
+// setFileFlags sets the file flags of path.
+func setFileFlags(path string, flags uint32) error {
+	return syscall.Chflags(path, int(flags))
+}
@@ -0,0 +1,15 @@
+//go:build !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package merge
+
+import "io/fs"
+
+// sysFlags returns 0: file flags are only available on the BSDs.
+func sysFlags(st fs.FileInfo) uint32 {
+	return 0
+}
+
+// setFileFlags does nothing: file flags are only available on the BSDs.
+func setFileFlags(path string, flags uint32) error {
+	return nil
+}
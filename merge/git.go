@@ -0,0 +1,94 @@
+package merge
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// gitTimeout bounds every git command run on the source.
+const gitTimeout = 5 * time.Second
+
+// inGitRepo returns true if dir is in a git working tree.
+func inGitRepo(dir string) bool {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	for {
+		// A file, in a worktree or a submodule.
+		if _, err := os.Lstat(filepath.Join(dir, ".git")); err == nil {
+			return true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return false
+		}
+		dir = parent
+	}
+}
+
+// git runs git with args on SrcDir, and returns what it printed.
+func (m *Merger) git(ctx context.Context, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, gitTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-C", m.SrcDir}, args...)...)
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// srcRevision returns the commit checked out in the git repository that SrcDir is in
+// (with "-dirty" after it, if anything under SrcDir isn't committed, which is warned
+// about), or "" if it's not in one. Without git, it's as if there was no repository.
+func (m *Merger) srcRevision(ctx context.Context) string {
+	if m.SrcFS != nil || !inGitRepo(m.SrcDir) {
+		return ""
+	}
+	if _, err := exec.LookPath("git"); err != nil {
+		return ""
+	}
+	rev, err := m.git(ctx, "rev-parse", "HEAD")
+	if err != nil {
+		// Such as before the first commit.
+		return ""
+	}
+	status, err := m.git(ctx, "status", "--porcelain", "--", ".")
+	if err == nil && status != "" {
+		m.log(Action{
+			Kind:  ActionWarning,
+			Src:   m.SrcDir,
+			Error: fmt.Sprintf("%s has changes that aren't committed", m.SrcDir),
+		})
+		rev += "-dirty"
+	}
+	return rev
+}
+
+// checkSrcRepo records in the manifest the revision of the source being merged, if
+// it's in a git repository (see srcRevision).
+func (m *Merger) checkSrcRepo(ctx context.Context) {
+	rev := m.srcRevision(ctx)
+	mf := m.manifest
+	if mf == nil || m.DryRun || rev == "" {
+		return
+	}
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+	if mf.Revision != rev {
+		mf.Revision = rev
+		mf.dirty = true
+	}
+}
+
+// Revision returns the revision of the source that was last merged, as recorded in
+// the manifest, or "" if it's unknown.
+func (m *Merger) Revision() (string, error) {
+	if err := m.loadManifest(); err != nil || m.manifest == nil {
+		return "", err
+	}
+	return m.manifest.Revision, nil
+}
@@ -0,0 +1,108 @@
+package merge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Hook is a command to run once a run has changed any of the files matching Pattern
+// (in the format of IgnoreFile, relative to DestDir), such as to reload the service
+// that reads them. %root in its arguments is replaced by Merger.Root.
+type Hook struct {
+	Pattern string
+	Command []string
+}
+
+// hookRule is a Hook, with its pattern parsed.
+type hookRule struct {
+	rule    ignoreRule
+	command []string
+}
+
+// parseHooks parses the patterns of hooks.
+func parseHooks(hooks []Hook) ([]hookRule, error) {
+	var rules []hookRule
+	for _, h := range hooks {
+		r, ok, err := parseIgnoreRule(h.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		if !ok || r.negate || len(h.Command) == 0 {
+			return nil, fmt.Errorf("invalid hook: %q", h.Pattern)
+		}
+		rules = append(rules, hookRule{r, h.Command})
+	}
+	return rules, nil
+}
+
+// changedFiles returns the files (relative to DestDir) that the actions so far
+// changed.
+func (m *Merger) changedFiles() [][]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var changed [][]string
+	for _, a := range m.actions {
+		switch a.Kind {
+		case ActionCopy, ActionSymlink, ActionMknod, ActionRemove:
+			if rel, err := filepath.Rel(m.DestDir, a.Dest); err == nil {
+				changed = append(changed, splitRel(rel))
+			}
+		}
+	}
+	return changed
+}
+
+// runHooks runs each of the Hooks (once) that matches any file changed so far, in
+// order. In a dry run, they're only reported. Hooks that fail are recorded as
+// failures of the run, but don't stop the others.
+func (m *Merger) runHooks(ctx context.Context) {
+	rules, err := parseHooks(m.Hooks)
+	if err != nil || len(rules) == 0 {
+		return
+	}
+	changed := m.changedFiles()
+	for _, h := range rules {
+		triggered := false
+		for _, name := range changed {
+			if !h.rule.dirOnly && matchParts(h.rule.parts, name) {
+				triggered = true
+				break
+			}
+		}
+		if !triggered {
+			continue
+		}
+		args := m.rootArgs(h.command)
+		command := strings.Join(args, " ")
+		m.log(Action{Kind: ActionHook, Command: command})
+		if m.DryRun {
+			continue
+		}
+		if ctx.Err() != nil {
+			// Interrupted; what's left is up to whoever stopped it.
+			return
+		}
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		// Keep standard output for the actions.
+		cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+		if err := cmd.Run(); err != nil {
+			m.mu.Lock()
+			m.failures = append(m.failures, fmt.Errorf("%w: %s: %v", ErrHook, command, err))
+			m.mu.Unlock()
+		}
+	}
+}
+
+// finishChanges runs the Hooks for the files changed by the run, then returns its
+// actions and errors like finish.
+func (m *Merger) finishChanges(ctx context.Context, err error) ([]Action, error) {
+	if !errors.Is(err, context.Canceled) {
+		m.runHooks(ctx)
+	}
+	return m.finish(err)
+}
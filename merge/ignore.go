@@ -0,0 +1,164 @@
+package merge
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// IgnoreFile is the name of the file at the root of the source that lists patterns of
+// files not to copy over, like a .gitignore. It's never copied over itself.
+const IgnoreFile = ".upmergeignore"
+
+// ignoreRule is a single pattern from IgnoreFile, or Merger.Exclude.
+type ignoreRule struct {
+	// parts of the pattern between slashes; "**" stands for any number of them.
+	parts   []string
+	negate  bool
+	dirOnly bool
+}
+
+// parseIgnoreRule parses a pattern in the format of a .gitignore: a pattern without a
+// slash matches names at any depth, one with a slash is relative to the root, "**"
+// matches any number of directories, a trailing slash matches only directories, and a
+// leading "!" makes an exception to the patterns before it. It returns false for blank
+// lines and comments.
+func parseIgnoreRule(pattern string) (ignoreRule, bool, error) {
+	var r ignoreRule
+	pattern = strings.TrimSpace(pattern)
+	if pattern == "" || strings.HasPrefix(pattern, "#") {
+		return r, false, nil
+	}
+	if strings.HasPrefix(pattern, "!") {
+		r.negate = true
+		pattern = pattern[1:]
+	}
+	if strings.HasSuffix(pattern, "/") {
+		r.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	anchored := strings.Contains(pattern, "/")
+	r.parts = strings.Split(strings.TrimPrefix(pattern, "/"), "/")
+	if !anchored {
+		r.parts = append([]string{"**"}, r.parts...)
+	}
+	for _, part := range r.parts {
+		if _, err := path.Match(part, ""); err != nil {
+			return r, false, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	return r, true, nil
+}
+
+// matchParts returns true if the parts of a path match the parts of a pattern.
+func matchParts(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			rest := pattern[1:]
+			if len(rest) == 0 {
+				// "dir/**" is everything inside dir, but not dir itself.
+				return len(name) > 0
+			}
+			for i := range name {
+				if matchParts(rest, name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// loadIgnore reads IgnoreFile from the source, if there's one, followed by Exclude.
+// The rules for Include and the other lists of patterns are loaded as well.
+func (m *Merger) loadIgnore() error {
+	m.ignore = nil
+	for _, rules := range []struct {
+		patterns []string
+		rules    *[]ignoreRule
+	}{
+		{m.Include, &m.include},
+		{m.Once, &m.once},
+		{m.ForceFiles, &m.forceFiles},
+		{m.KeyFiles, &m.keyFiles},
+		{m.PlistFiles, &m.plistFiles},
+	} {
+		*rules.rules = nil
+		for _, pattern := range rules.patterns {
+			r, ok, err := parseIgnoreRule(pattern)
+			if err != nil {
+				return err
+			} else if ok {
+				*rules.rules = append(*rules.rules, r)
+			}
+		}
+	}
+	var patterns []string
+	if f, err := m.src().Open(IgnoreFile); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			patterns = append(patterns, scanner.Text())
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", IgnoreFile, err)
+		}
+	}
+	for _, pattern := range append(patterns, m.Exclude...) {
+		r, ok, err := parseIgnoreRule(pattern)
+		if err != nil {
+			return err
+		} else if ok {
+			m.ignore = append(m.ignore, r)
+		}
+	}
+	return nil
+}
+
+// isExcluded returns true if the entry at rel in the source (a directory, if isDir) is
+// excluded by IgnoreFile or Exclude. The last pattern that matches decides.
+func (m *Merger) isExcluded(rel string, isDir bool) bool {
+	if rel == "." {
+		return false
+	}
+	if rel == IgnoreFile || rel == MetaFile {
+		return true
+	}
+	name := splitRel(rel)
+	excluded := false
+	for _, r := range m.ignore {
+		if (!r.dirOnly || isDir) && matchParts(r.parts, name) {
+			excluded = !r.negate
+		}
+	}
+	return excluded
+}
+
+// splitRel splits rel into the names of its parts, as matched by an ignoreRule.
+func splitRel(rel string) []string {
+	return strings.Split(filepath.ToSlash(rel), "/")
+}
+
+// skipExcluded is for walks over the source: it returns true (and the error for the
+// walk to return) if the entry at rel, described by d, is excluded.
+func (m *Merger) skipExcluded(rel string, d fs.DirEntry) (bool, error) {
+	if !m.isExcluded(rel, d.IsDir()) {
+		return false, nil
+	}
+	if d.IsDir() {
+		return true, fs.SkipDir
+	}
+	return true, nil
+}
@@ -0,0 +1,74 @@
+package merge
+
+import (
+	"context"
+	"testing"
+)
+
+func TestIgnore(t *testing.T) {
+	m, _ := newTestMerger(t, tree{
+		IgnoreFile:  "# editors\n*.swp\n\n/top\nbuild/\nlogs/**\n!logs/keep\n",
+		"a":         "a\n",
+		"a.swp":     "a\n",
+		"d/b.swp":   "b\n",
+		"top":       "top\n",
+		"d/top":     "nested\n",
+		"build/x":   "x\n",
+		"d/build":   "a file\n",
+		"logs/old":  "old\n",
+		"logs/keep": "keep\n",
+		"secret":    "s\n",
+	}, nil)
+	m.Exclude = []string{"secret"}
+	run(t, m)
+	checkTree(t, m.DestDir, tree{
+		"a":         "a\n",
+		"d/":        "",
+		"d/top":     "nested\n",
+		"d/build":   "a file\n",
+		"logs/":     "",
+		"logs/keep": "keep\n",
+	})
+}
+
+func TestParseIgnoreRule(t *testing.T) {
+	tests := []struct {
+		pattern string
+		match   []string
+		noMatch []string
+	}{
+		{"*.o", []string{"a.o", "d/a.o", "d/e/a.o"}, []string{"a.c", "a.o/b"}},
+		{"/a", []string{"a"}, []string{"d/a"}},
+		{"d/*.o", []string{"d/a.o"}, []string{"a.o", "e/d/a.o", "d/e/a.o"}},
+		{"d/**/a", []string{"d/a", "d/e/a", "d/e/f/a"}, []string{"a", "e/d/a"}},
+		{"d/**", []string{"d/a", "d/e/a"}, []string{"d"}},
+	}
+	for _, tt := range tests {
+		r, ok, err := parseIgnoreRule(tt.pattern)
+		if !ok || err != nil {
+			t.Fatalf("parseIgnoreRule(%q) = %v, %v", tt.pattern, ok, err)
+		}
+		for _, name := range tt.match {
+			if !matchParts(r.parts, splitRel(name)) {
+				t.Errorf("%q doesn't match %s", tt.pattern, name)
+			}
+		}
+		for _, name := range tt.noMatch {
+			if matchParts(r.parts, splitRel(name)) {
+				t.Errorf("%q matches %s", tt.pattern, name)
+			}
+		}
+	}
+	for _, pattern := range []string{"", "  ", "# comment"} {
+		if _, ok, err := parseIgnoreRule(pattern); ok || err != nil {
+			t.Errorf("parseIgnoreRule(%q) = %v, %v; want it skipped", pattern, ok, err)
+		}
+	}
+	if _, _, err := parseIgnoreRule("a["); err == nil {
+		t.Error("parsed an invalid pattern")
+	}
+	m, _ := newTestMerger(t, tree{IgnoreFile: "a[\n"}, nil)
+	if _, err := m.Run(context.Background()); err == nil {
+		t.Errorf("ran with an invalid pattern in %s", IgnoreFile)
+	}
+}
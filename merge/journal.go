@@ -0,0 +1,583 @@
+package merge
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultJournalDir is where the journals of runs are kept, each in a directory named
+// after its run.
+const DefaultJournalDir = "/var/db/upmerge/journal"
+
+// DefaultJournalKeep is how many journals are kept, unless JournalKeep says otherwise.
+const DefaultJournalKeep = 10
+
+// JournalFile is the journal in the directory of a run: a JSON object per line, for
+// every entry of the destination that the run changed, in order. The contents that it
+// replaced are kept next to it, in "files". Once the run is undone, undoneFile is
+// there as well.
+const JournalFile = "journal"
+
+const undoneFile = "undone"
+
+// journalEntry records what a run did to the entry at Path, in the step numbered Step:
+// the entries of a step (such as a file, and its backup) are undone together.
+type journalEntry struct {
+	Path   string     `json:"path"`
+	Step   int        `json:"step,omitempty"`
+	Before entryState `json:"before"`
+	After  entryState `json:"after"`
+}
+
+// entryState describes an entry of the destination, as it was at some point.
+type entryState struct {
+	Exists  bool        `json:"exists"`
+	Mode    fs.FileMode `json:"mode,omitempty"`
+	UID     int         `json:"uid,omitempty"`
+	GID     int         `json:"gid,omitempty"`
+	ModTime *time.Time  `json:"time,omitempty"`
+	Hash    string      `json:"hash,omitempty"`
+	Target  string      `json:"target,omitempty"`
+	// Saved is the copy of a regular file's contents, relative to the run's directory.
+	Saved string `json:"saved,omitempty"`
+}
+
+// journal records the changes of a run, starting on the first one.
+type journal struct {
+	mu      sync.Mutex
+	base    string
+	dir     string
+	f       *os.File
+	entries int
+	steps   int
+	// written is how many entries are in the journal.
+	written int
+}
+
+// startJournal starts a journal for the run about to start, in a new directory in
+// JournalDir, unless that's "" (or DryRun is set). The directory is only made once
+// something is changed.
+func (m *Merger) startJournal() {
+	m.journal = nil
+	if m.JournalDir != "" && !m.DryRun {
+		m.journal = &journal{base: m.JournalDir}
+	}
+}
+
+// closeJournal closes the journal of the run, if it's open. If nothing was changed after
+// all, it's removed, as there's nothing to undo; otherwise, the oldest journals beyond
+// JournalKeep are.
+func (m *Merger) closeJournal() error {
+	j := m.journal
+	if j == nil || j.f == nil {
+		return nil
+	}
+	err := j.f.Close()
+	j.f = nil
+	if j.written == 0 {
+		if removeErr := os.RemoveAll(j.dir); err == nil {
+			err = removeErr
+		}
+		j.dir = ""
+		return err
+	}
+	if err == nil && m.JournalKeep > 0 {
+		err = pruneJournals(j.base, m.JournalKeep)
+	}
+	return err
+}
+
+// pruneJournals removes the oldest journals in dir, but for the last keep.
+func pruneJournals(dir string, keep int) error {
+	names, err := journalNames(dir)
+	if err != nil || len(names) <= keep {
+		return err
+	}
+	for _, name := range names[:len(names)-keep] {
+		if err := os.RemoveAll(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// JournalPath returns the directory of the journal of the last run, or "" if it didn't
+// change anything (or kept no journal).
+func (m *Merger) JournalPath() string {
+	if m.journal == nil {
+		return ""
+	}
+	return m.journal.dir
+}
+
+// open makes the directory of the journal, named after the time, if it's not there.
+func (j *journal) open() error {
+	if j.f != nil {
+		return nil
+	}
+	if err := os.MkdirAll(j.base, 0700); err != nil {
+		return err
+	}
+	name := time.Now().UTC().Format("20060102T150405Z")
+	dir := filepath.Join(j.base, name)
+	err := os.Mkdir(dir, 0700)
+	for n := 2; os.IsExist(err); n++ {
+		// Another run (such as for another pair) in the same second.
+		dir = filepath.Join(j.base, fmt.Sprintf("%s-%d", name, n))
+		err = os.Mkdir(dir, 0700)
+	}
+	if err == nil {
+		err = os.Mkdir(filepath.Join(dir, "files"), 0700)
+	}
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, JournalFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	j.dir, j.f = dir, f
+	return nil
+}
+
+// journalStep records the state of each entry of the destination that step may change,
+// keeping a copy of the contents of files. The function it returns records what step
+// did to them, once it's done.
+func (m *Merger) journalStep(step *Step) (func(), error) {
+	var paths []string
+	switch step.Kind {
+	case StepIgnore, StepSpecial, StepOnce:
+	case StepSkip:
+		if m.CleanIdenticalBackups && step.Backup != "" {
+			paths = append(paths, step.Backup)
+		}
+	default:
+		paths = append(paths, step.Dest)
+		if step.Backup != "" {
+			paths = append(paths, step.Backup)
+			// Backing up shifts the older backups along, dropping the oldest.
+			for i := 2; i <= m.BackupRotate; i++ {
+				paths = append(paths, m.rotatedPath(m.backupBase(step.Path), i))
+			}
+		}
+		if m.Merge && (step.Kind == StepReplace || step.Kind == StepConflict) {
+			// Written with the conflicts, or removed once they're resolved.
+			paths = append(paths, step.Dest+ConflictSuffix)
+		}
+	}
+	if len(paths) == 0 {
+		return func() {}, nil
+	}
+	j := m.journal
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.open(); err != nil {
+		return nil, fmt.Errorf("can't keep a journal: %w", err)
+	}
+	j.steps++
+	entries := make([]journalEntry, len(paths))
+	for i, path := range paths {
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+		entries[i].Path, entries[i].Step = path, j.steps
+		st, err := describeEntry(path)
+		if err == nil && st.Exists && st.Mode.IsRegular() {
+			j.entries++
+			st.Saved = filepath.Join("files", strconv.Itoa(j.entries))
+			err = copyEntry(path, filepath.Join(j.dir, st.Saved))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("can't keep a journal: %w", err)
+		}
+		entries[i].Before = st
+	}
+	return func() {
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		for _, e := range entries {
+			e.After, _ = describeEntry(e.Path)
+			if e.After.matches(e.Before) {
+				if e.Before.Saved != "" {
+					os.Remove(filepath.Join(j.dir, e.Before.Saved))
+				}
+				continue
+			}
+			buf, err := json.Marshal(e)
+			if err == nil {
+				_, err = j.f.Write(append(buf, '\n'))
+			}
+			if err == nil {
+				j.written++
+			} else {
+				m.log(Action{Kind: ActionWarning, Dest: e.Path,
+					Error: fmt.Sprintf("can't keep a journal of %s: %s", e.Path, err)})
+			}
+		}
+	}, nil
+}
+
+// describeEntry returns the state of the entry at path.
+func describeEntry(path string) (entryState, error) {
+	st, err := os.Lstat(path)
+	if isMissing(err) {
+		return entryState{}, nil
+	} else if err != nil {
+		return entryState{}, err
+	}
+	mtime := st.ModTime()
+	s := entryState{Exists: true, Mode: st.Mode() & (fs.ModeType | modeBits), ModTime: &mtime}
+	s.UID, s.GID, _ = sysOwner(st)
+	switch {
+	case st.Mode()&fs.ModeSymlink != 0:
+		s.Target, err = os.Readlink(path)
+	case st.Mode().IsRegular():
+		s.Hash, err = hashOpened(os.Open(path))
+	}
+	return s, err
+}
+
+// matches returns true if the entry described by s is the same as that described by
+// other: of the same type and mode, with the same contents.
+func (s entryState) matches(other entryState) bool {
+	return s.Exists == other.Exists && s.Mode == other.Mode && s.Hash == other.Hash &&
+		s.Target == other.Target
+}
+
+// copyEntry copies the file at path to dest, which must not exist.
+func copyEntry(path, dest string) error {
+	fr, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fr.Close()
+	fw, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, fr)
+	if closeErr := fw.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Undo reverts the run recorded in the journal named id in JournalDir (or if id is "",
+// the last one that's not undone yet), going through its steps from the last one:
+// replaced files get their contents back, and what was created is removed (directories,
+// if they're empty). A step with an entry that has changed since the run is left alone
+// whole, failing with ErrChanged; the remaining steps are still undone. Only once every
+// step is undone is the run marked as undone. What's in DestDir is changed the way a
+// run changes it, through the opened directory.
+func (m *Merger) Undo(ctx context.Context, id string) ([]Action, error) {
+	m.actions = nil
+	m.failures = nil
+	m.undone = make(map[string]bool)
+	if m.JournalDir == "" {
+		return nil, errors.New("can't undo without a journal")
+	}
+	// The paths in the journal are absolute, so they're told to be in DestDir by its
+	// absolute path.
+	if abs, err := filepath.Abs(m.DestDir); err == nil {
+		m.DestDir = abs
+	}
+	defer m.closeDest()
+	dir, err := m.journalFor(id)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := readJournal(filepath.Join(dir, JournalFile))
+	if err != nil {
+		return nil, err
+	}
+	for end := len(entries); end > 0; {
+		if err := ctx.Err(); err != nil {
+			return m.actions, err
+		}
+		start := end - 1
+		for start > 0 && entries[start].Step != 0 && entries[start-1].Step == entries[start].Step {
+			start--
+		}
+		m.undoStep(dir, entries[start:end])
+		end = start
+	}
+	if len(m.failures) > 0 {
+		return m.actions, m.failures
+	}
+	if !m.DryRun {
+		if err := os.WriteFile(filepath.Join(dir, undoneFile), nil, 0600); err != nil {
+			return m.actions, err
+		}
+	}
+	return m.actions, nil
+}
+
+// journalFor returns the directory of the journal named id in JournalDir, or if id is
+// "", the last one that's not undone yet.
+func (m *Merger) journalFor(id string) (string, error) {
+	if id != "" {
+		if id != filepath.Base(id) || id == "." || id == ".." {
+			return "", fmt.Errorf("not a run: %s", id)
+		}
+		dir := filepath.Join(m.JournalDir, id)
+		if fileExists(filepath.Join(dir, undoneFile)) {
+			return "", fmt.Errorf("run %s is already undone", id)
+		}
+		return dir, nil
+	}
+	names, err := journalNames(m.JournalDir)
+	if err != nil {
+		return "", err
+	}
+	for i := len(names) - 1; i >= 0; i-- {
+		dir := filepath.Join(m.JournalDir, names[i])
+		// One left empty, by a run that was killed, has nothing to undo.
+		st, err := os.Stat(filepath.Join(dir, JournalFile))
+		if err == nil && st.Size() > 0 && !fileExists(filepath.Join(dir, undoneFile)) {
+			return dir, nil
+		}
+	}
+	return "", fmt.Errorf("no run to undo in %s", m.JournalDir)
+}
+
+// journalNames returns the names of the journals in dir, from the oldest.
+func journalNames(dir string) ([]string, error) {
+	d, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var names []string
+	for _, e := range d {
+		if e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		// Named after the time, and then numbered within the second.
+		ti, ni := journalName(names[i])
+		tj, nj := journalName(names[j])
+		if ti != tj {
+			return ti < tj
+		}
+		return ni < nj
+	})
+	return names, nil
+}
+
+// journalName splits the name of a journal into the time it's named after, and its
+// number within that second.
+func journalName(name string) (string, int) {
+	t, suffix, found := strings.Cut(name, "-")
+	n, err := strconv.Atoi(suffix)
+	if !found || err != nil {
+		return name, 1
+	}
+	return t, n
+}
+
+// readJournal reads the entries of the journal at path.
+func readJournal(path string) ([]journalEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []journalEntry
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		var e journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		} else if !filepath.IsAbs(e.Path) {
+			return nil, fmt.Errorf("%s:%d: not an absolute path: %s", path, n, e.Path)
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// undoStep puts the entries of a step back the way they were before the run recorded
+// in dir, from the last one, if they're all still the way the run left them; if any
+// isn't, none of them are.
+func (m *Merger) undoStep(dir string, entries []journalEntry) {
+	changed := false
+	for _, e := range entries {
+		if err := m.checkUndo(e, len(entries)); err != nil {
+			m.undoFailed(e.Path, err)
+			changed = true
+		}
+	}
+	if changed {
+		return
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if err := m.undoEntry(dir, entries[i]); err != nil {
+			m.undoFailed(entries[i].Path, err)
+		}
+	}
+}
+
+// undoFailed records err, from undoing the entry at path.
+func (m *Merger) undoFailed(path string, err error) {
+	err = &FileError{Op: OpUndo, Path: path, Err: err}
+	m.fail(path, err)
+	m.mu.Lock()
+	m.failures = append(m.failures, err)
+	m.mu.Unlock()
+}
+
+// checkUndo returns ErrChanged, once reported, if the entry e of a step of n entries
+// isn't the way the run left it, or is a directory to be removed that isn't empty.
+func (m *Merger) checkUndo(e journalEntry, n int) error {
+	cur, err := describeEntry(e.Path)
+	if err != nil {
+		return err
+	}
+	why := ""
+	if !cur.matches(e.After) {
+		why = "changed since the run"
+	} else if cur.Mode.IsDir() && !cur.matches(e.Before) &&
+		(!e.Before.Exists || e.Before.Mode&fs.ModeType != cur.Mode&fs.ModeType) {
+		if empty, err := m.undoneDir(e.Path); err != nil {
+			return err
+		} else if !empty {
+			why = "not empty"
+		}
+	}
+	if why == "" {
+		return nil
+	}
+	if n > 1 {
+		why += ", leaving the rest of its step alone too"
+	}
+	m.log(Action{Kind: ActionError, Dest: e.Path, Error: fmt.Sprintf("%s: %s", why, e.Path)})
+	return ErrChanged
+}
+
+// undoEntry puts the entry at e.Path back the way it was before the run recorded in
+// dir, once checkUndo found it the way the run left it.
+func (m *Merger) undoEntry(dir string, e journalEntry) error {
+	cur, err := describeEntry(e.Path)
+	if err != nil {
+		return err
+	}
+	if cur.matches(e.Before) {
+		return nil
+	}
+	if !e.Before.Exists || e.Before.Mode&fs.ModeType != cur.Mode&fs.ModeType {
+		if !m.DryRun {
+			if err := m.removeDest(e.Path); err != nil {
+				return err
+			}
+		}
+		m.undone[e.Path] = true
+		if !e.Before.Exists {
+			m.log(Action{Kind: ActionRemove, Dest: e.Path, DryRun: m.DryRun})
+			return nil
+		}
+	}
+	before := e.Before
+	switch {
+	case before.Mode&fs.ModeSymlink != 0:
+		if !m.DryRun {
+			if err := m.removeDest(e.Path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err := m.symlinkDest(before.Target, e.Path); err != nil {
+				return err
+			}
+		}
+		m.log(Action{Kind: ActionSymlink, Dest: e.Path, Target: before.Target, DryRun: m.DryRun})
+	case before.Mode.IsDir():
+		if !m.DryRun {
+			err := m.mkdirDest(e.Path, before.Mode.Perm())
+			if err != nil && !os.IsExist(err) {
+				return err
+			}
+			if err = m.chmodDest(e.Path, before.Mode); err != nil {
+				return err
+			}
+			before.restoreOwner(e.Path)
+		}
+		m.log(Action{Kind: ActionChmod, Dest: e.Path, Mode: before.Mode, DryRun: m.DryRun})
+	default:
+		saved := filepath.Join(dir, before.Saved)
+		if !m.DryRun {
+			if err := m.restoreEntry(before, saved, e.Path); err != nil {
+				return err
+			}
+		}
+		m.log(Action{Kind: ActionRevert, Dest: e.Path, Backup: saved, DryRun: m.DryRun})
+	}
+	return nil
+}
+
+// restoreEntry puts the copy of the file described by s, at saved, in place at path,
+// with s's mode, owner and time.
+func (m *Merger) restoreEntry(s entryState, saved, path string) error {
+	if s.Saved == "" {
+		return errors.New("no copy of the contents was kept")
+	}
+	fr, err := os.Open(saved)
+	if err != nil {
+		return err
+	}
+	defer fr.Close()
+	tmp := path + ".upmerge-undo"
+	m.removeDest(tmp)
+	if err = m.writeNewDest(context.Background(), tmp, fr, s.Mode&modeBits); err == nil {
+		err = m.chmodDest(tmp, s.Mode)
+	}
+	if err == nil {
+		s.restoreOwner(tmp)
+		if s.ModTime != nil {
+			err = os.Chtimes(tmp, *s.ModTime, *s.ModTime)
+		}
+	}
+	if err == nil {
+		err = m.renameDest(tmp, path)
+	}
+	if err != nil {
+		m.removeDest(tmp)
+	}
+	return err
+}
+
+// restoreOwner gives the entry at path the owner described by s, if running as root.
+func (s entryState) restoreOwner(path string) {
+	if os.Geteuid() == 0 {
+		os.Lchown(path, s.UID, s.GID)
+	}
+}
+
+// undoneDir returns true if the directory at path has nothing left in it but what Undo
+// removed.
+func (m *Merger) undoneDir(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return false, err
+	}
+	for _, name := range names {
+		if !m.undone[filepath.Join(path, name)] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,190 @@
+package merge
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// newJournaled returns a Merger as newTestMerger does, keeping journals in a directory
+// of their own.
+func newJournaled(t *testing.T, src, dest tree) (*Merger, *Recorder) {
+	t.Helper()
+	m, rec := newTestMerger(t, src, dest)
+	m.JournalDir = filepath.Join(filepath.Dir(m.DestDir), "journal")
+	return m, rec
+}
+
+// undo undoes the last run of m, and returns the error.
+func undo(m *Merger) error {
+	_, err := m.Undo(context.Background(), "")
+	return err
+}
+
+// journals returns the names of the journals kept by m.
+func journals(t *testing.T, m *Merger) []string {
+	t.Helper()
+	names, err := journalNames(m.JournalDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+var undoDest = tree{"f": "old", "keep": "keep"}
+
+// undoSrc replaces f (backing it up), and creates g, and d with h in it.
+var undoSrc = tree{"f": "new", "g": "g", "d/h": "h", "keep": "keep"}
+
+func TestUndo(t *testing.T) {
+	m, _ := newJournaled(t, undoSrc, undoDest)
+	run(t, m)
+	dir := m.JournalPath()
+	if dir == "" {
+		t.Fatal("no journal kept")
+	}
+	if err := undo(m); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, m.DestDir, undoDest)
+	if !fileExists(filepath.Join(dir, undoneFile)) {
+		t.Errorf("run not marked as undone")
+	}
+	if err := undo(m); err == nil {
+		t.Errorf("undone twice")
+	}
+}
+
+func TestUndoDryRun(t *testing.T) {
+	m, rec := newJournaled(t, undoSrc, undoDest)
+	run(t, m)
+	done := readTree(t, m.DestDir)
+	m.DryRun = true
+	rec.Actions = nil
+	if err := undo(m); err != nil {
+		t.Fatal(err)
+	}
+	// From the last change back: what was created goes, directories included, once
+	// what's in them would.
+	want := []string{"remove g", "remove f.upmerge~", "revert f", "remove d/h", "remove d"}
+	if got := kinds(rec.Actions); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	checkTree(t, m.DestDir, done)
+	if fileExists(filepath.Join(m.JournalPath(), undoneFile)) {
+		t.Errorf("marked as undone by a dry run")
+	}
+}
+
+func TestUndoChanged(t *testing.T) {
+	tests := []struct {
+		name   string
+		change tree
+		want   tree
+	}{
+		// A file and its backup are undone together, or not at all. The rest still is.
+		{name: "file", change: tree{"f": "changed"},
+			want: tree{"f": "changed", "f.upmerge~": "old", "keep": "keep"}},
+		{name: "backup", change: tree{"f.upmerge~": "changed"},
+			want: tree{"f": "new", "f.upmerge~": "changed", "keep": "keep"}},
+		{name: "created", change: tree{"g": "changed"},
+			want: tree{"f": "old", "g": "changed", "keep": "keep"}},
+		// A directory with something else in it is left, but what was made in it isn't.
+		{name: "directory", change: tree{"d/other": "other"},
+			want: tree{"f": "old", "d/": "", "d/other": "other", "keep": "keep"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := newJournaled(t, undoSrc, undoDest)
+			run(t, m)
+			writeTree(t, m.DestDir, tt.change)
+			err := undo(m)
+			if !errors.Is(err, ErrChanged) {
+				t.Errorf("got %v, want ErrChanged", err)
+			}
+			checkTree(t, m.DestDir, tt.want)
+			if fileExists(filepath.Join(m.JournalPath(), undoneFile)) {
+				t.Errorf("marked as undone, with a step left alone")
+			}
+		})
+	}
+}
+
+func TestJournalNothingChanged(t *testing.T) {
+	// The backup is looked at, to be cleaned up, but it differs.
+	m, _ := newJournaled(t, tree{"f": "f"}, tree{"f": "f", "f.upmerge~": "other"})
+	m.CleanIdenticalBackups = true
+	run(t, m)
+	if dir := m.JournalPath(); dir != "" {
+		t.Errorf("journal kept in %s", dir)
+	}
+	if names := journals(t, m); len(names) != 0 {
+		t.Errorf("got journals %q, want none", names)
+	}
+}
+
+func TestJournalForSkipsEmpty(t *testing.T) {
+	m, _ := newJournaled(t, undoSrc, undoDest)
+	run(t, m)
+	// Left by a run that was killed before it changed anything, later than the last.
+	empty := filepath.Join(m.JournalDir, "99991231T235959Z")
+	writeTree(t, empty, tree{"files/": "", JournalFile: ""})
+	dir, err := m.journalFor("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir != m.JournalPath() {
+		t.Errorf("got %s, want %s", dir, m.JournalPath())
+	}
+}
+
+func TestJournalKeep(t *testing.T) {
+	m, _ := newJournaled(t, nil, nil)
+	m.JournalKeep = 2
+	var kept []string
+	for _, contents := range []string{"1", "2", "3"} {
+		writeTree(t, m.SrcDir, tree{"f": contents})
+		m.Force = true
+		run(t, m)
+		kept = append(kept, filepath.Base(m.JournalPath()))
+	}
+	if got := journals(t, m); !reflect.DeepEqual(got, kept[1:]) {
+		t.Errorf("got journals %q, want the last two of %q", got, kept)
+	}
+}
+
+func TestUndoRotated(t *testing.T) {
+	dest := tree{"f": "old", "f.upmerge~1": "older", "f.upmerge~2": "oldest"}
+	m, _ := newJournaled(t, tree{"f": "new"}, dest)
+	m.BackupRotate = 2
+	run(t, m)
+	checkTree(t, m.DestDir, tree{"f": "new", "f.upmerge~1": "old", "f.upmerge~2": "older"})
+	if err := undo(m); err != nil {
+		t.Fatal(err)
+	}
+	// The oldest backup, dropped by the run, is back in its place too.
+	checkTree(t, m.DestDir, dest)
+}
+
+func TestUndoSwappedForSymlink(t *testing.T) {
+	m, _ := newJournaled(t, tree{"d/f": "new"}, tree{"d/f": "old"})
+	run(t, m)
+	// After the run, d is swapped for a symlink leading out of the destination, to a
+	// directory that looks just like it.
+	outside := filepath.Join(filepath.Dir(m.DestDir), "outside")
+	done := tree{"f": "new", "f.upmerge~": "old"}
+	writeTree(t, outside, done)
+	if err := os.RemoveAll(filepath.Join(m.DestDir, "d")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(m.DestDir, "d")); err != nil {
+		t.Skip(err)
+	}
+	if err := undo(m); err == nil {
+		t.Errorf("undone through the symlink")
+	}
+	checkTree(t, outside, done)
+}
@@ -0,0 +1,87 @@
+package merge
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// isKeyed returns true if the keys of the source file at rel are merged into the
+// destination's, as given by KeyFiles.
+func (m *Merger) isKeyed(rel string) bool {
+	return matchFile(m.keyFiles, rel)
+}
+
+// keyLine is a line of a key-value file: a setting, or anything else (with no key).
+type keyLine struct {
+	text, key, value string
+}
+
+// parseKeys parses buf as lines of "key = value", in the format of sysctl.conf.
+// Blank lines, and comments starting with "#" or ";", are kept as they are.
+func parseKeys(buf []byte) ([]keyLine, error) {
+	var lines []keyLine
+	for i, text := range splitLines(buf) {
+		line := strings.TrimSpace(text)
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			lines = append(lines, keyLine{text: text})
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("line %d: expected key = value", i+1)
+		}
+		lines = append(lines, keyLine{text: text, key: key, value: strings.TrimSpace(value)})
+	}
+	return lines, nil
+}
+
+// mergeKeys returns dest, with the keys set in src set the same way. A key set more
+// than once takes the last value, so that's the one replaced; keys dest doesn't set are
+// added at the end. Anything else in dest is kept as it is.
+func mergeKeys(dest, src []byte) ([]byte, error) {
+	destLines, err := parseKeys(dest)
+	if err != nil {
+		return nil, fmt.Errorf("dest: %w", err)
+	}
+	srcLines, err := parseKeys(src)
+	if err != nil {
+		return nil, fmt.Errorf("src: %w", err)
+	}
+	last := make(map[string]int)
+	for i, l := range destLines {
+		if l.key != "" {
+			last[l.key] = i
+		}
+	}
+	var added []keyLine
+	addedAt := make(map[string]int)
+	for _, l := range srcLines {
+		if l.key == "" {
+			continue
+		}
+		l.text = strings.TrimRight(l.text, "\r\n") + "\n"
+		if i, ok := last[l.key]; ok {
+			if destLines[i].value != l.value {
+				destLines[i] = l
+			}
+		} else if i, ok := addedAt[l.key]; ok {
+			added[i] = l
+		} else {
+			addedAt[l.key] = len(added)
+			added = append(added, l)
+		}
+	}
+	var out bytes.Buffer
+	for _, l := range destLines {
+		out.WriteString(l.text)
+	}
+	if len(added) > 0 && out.Len() > 0 && !bytes.HasSuffix(out.Bytes(), []byte("\n")) {
+		out.WriteByte('\n')
+	}
+	for _, l := range added {
+		out.WriteString(l.text)
+	}
+	return out.Bytes(), nil
+}
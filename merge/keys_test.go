@@ -0,0 +1,70 @@
+package merge
+
+import (
+	"context"
+	"testing"
+)
+
+func TestMergeKeys(t *testing.T) {
+	tests := []struct {
+		dest, src, want string
+	}{
+		{dest: "# defaults\na = 1\nb = 2\n", src: "b = 3\n", want: "# defaults\na = 1\nb = 3\n"},
+		{dest: "a = 1", src: "c = 3\nc = 4\n", want: "a = 1\nc = 4\n"},
+		// The last one is the one that counts.
+		{dest: "a = 1\na = 2\n", src: "a=3\n", want: "a = 1\na=3\n"},
+		{dest: "a = 1\n", src: "a=1\n", want: "a = 1\n"},
+	}
+	for _, tt := range tests {
+		got, err := mergeKeys([]byte(tt.dest), []byte(tt.src))
+		if err != nil || string(got) != tt.want {
+			t.Errorf("mergeKeys(%q, %q) = %q, %v; want %q", tt.dest, tt.src, got, err, tt.want)
+		}
+	}
+	if _, err := mergeKeys([]byte("not a setting\n"), []byte("a = 1\n")); err == nil {
+		t.Errorf("merged into a file that isn't key = value")
+	}
+}
+
+func TestMergeKeysUpdated(t *testing.T) {
+	m, _ := newTestMerger(t, tree{"sysctl.conf": "b = 3\n"},
+		tree{"sysctl.conf": "# defaults\na = 1\nb = 2\n"})
+	m.KeyFiles = []string{"sysctl.conf"}
+	run(t, m)
+	checkTree(t, m.DestDir, tree{
+		"sysctl.conf":                  "# defaults\na = 1\nb = 3\n",
+		"sysctl.conf" + m.BackupSuffix: "# defaults\na = 1\nb = 2\n",
+	})
+	for _, a := range run(t, m) {
+		if a.Kind != ActionOK {
+			t.Errorf("ran again: got %s %s", a.Kind, a.DestRel)
+		}
+	}
+
+	// Changed in the source, although the backup differs.
+	writeTree(t, m.SrcDir, tree{"sysctl.conf": "b = 4\n"})
+	run(t, m)
+	checkTree(t, m.DestDir, tree{
+		"sysctl.conf":                  "# defaults\na = 1\nb = 4\n",
+		"sysctl.conf" + m.BackupSuffix: "# defaults\na = 1\nb = 3\n",
+	})
+
+	// Upgraded in the destination, by whoever else it belongs to.
+	writeTree(t, m.DestDir, tree{"sysctl.conf": "# new defaults\na = 5\nb = 2\nc = 6\n"})
+	run(t, m)
+	checkTree(t, m.DestDir, tree{
+		"sysctl.conf":                  "# new defaults\na = 5\nb = 4\nc = 6\n",
+		"sysctl.conf" + m.BackupSuffix: "# new defaults\na = 5\nb = 2\nc = 6\n",
+	})
+}
+
+func TestMergeKeysReplacedWhole(t *testing.T) {
+	// Replaced whole, it's guarded like any other file.
+	m, _ := newTestMerger(t, tree{"sysctl.conf": "b = 3\n"},
+		tree{"sysctl.conf": "not a setting\n", "sysctl.conf.upmerge~": "older\n"})
+	m.KeyFiles = []string{"sysctl.conf"}
+	if _, err := m.Run(context.Background()); err == nil {
+		t.Errorf("overwrote a differing backup")
+	}
+	checkTree(t, m.DestDir, tree{"sysctl.conf": "not a setting\n", "sysctl.conf.upmerge~": "older\n"})
+}
@@ -0,0 +1,160 @@
+package merge
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// layerFS reads a stack of source directories as one tree: where several of them have
+// the same path, the last one wins. Directories are merged with each other.
+type layerFS struct {
+	dirs []string
+	// top maps every path in any of dirs (as a name in the file system) to the index
+	// of the last one holding it.
+	top map[string]int
+}
+
+// srcDirs returns SrcDir, followed by the Layers on top of it.
+func (m *Merger) srcDirs() []string {
+	return append([]string{m.SrcDir}, m.Layers...)
+}
+
+// loadLayers finds which of the source directories each path is taken from, when
+// there are Layers. A path that's a directory in one of them, but not in another, is an
+// error.
+func (m *Merger) loadLayers() error {
+	m.layers = nil
+	if len(m.Layers) == 0 || m.SrcFS != nil {
+		return nil
+	}
+	l := &layerFS{dirs: m.srcDirs(), top: make(map[string]int)}
+	isDir := make(map[string]bool)
+	for i, dir := range l.dirs {
+		err := fs.WalkDir(os.DirFS(dir), ".", func(name string, d fs.DirEntry, err error) error {
+			if err != nil {
+				// Let the real walk report it.
+				return nil
+			}
+			if _, ok := l.top[name]; ok && isDir[name] != d.IsDir() {
+				path, other := filepath.Join(dir, filepath.FromSlash(name)), l.path(name)
+				if !d.IsDir() {
+					path, other = other, path
+				}
+				return fmt.Errorf("%s is a directory, but %s is not", path, other)
+			}
+			l.top[name] = i
+			isDir[name] = d.IsDir()
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	m.layers = l
+	return nil
+}
+
+// sameStrings returns true if a and b hold the same strings, in the same order.
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// srcPath returns the path of the source file at rel (or its template), in whichever
+// of the source directories it's taken from.
+func (m *Merger) srcPath(rel string) string {
+	rel = m.srcFile(rel)
+	if m.layers != nil {
+		return m.layers.path(srcName(rel))
+	}
+	return filepath.Join(m.SrcDir, rel)
+}
+
+// path returns the path of name in the last directory holding it, or in the first one
+// if none does.
+func (l *layerFS) path(name string) string {
+	return filepath.Join(l.dirs[l.top[name]], filepath.FromSlash(name))
+}
+
+func (l *layerFS) check(op, name string) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return nil
+}
+
+func (l *layerFS) Open(name string) (fs.File, error) {
+	if err := l.check("open", name); err != nil {
+		return nil, err
+	}
+	return os.Open(l.path(name))
+}
+
+func (l *layerFS) Stat(name string) (fs.FileInfo, error) {
+	if err := l.check("stat", name); err != nil {
+		return nil, err
+	}
+	return os.Stat(l.path(name))
+}
+
+func (l *layerFS) Lstat(name string) (fs.FileInfo, error) {
+	if err := l.check("lstat", name); err != nil {
+		return nil, err
+	}
+	return os.Lstat(l.path(name))
+}
+
+func (l *layerFS) ReadLink(name string) (string, error) {
+	if err := l.check("readlink", name); err != nil {
+		return "", err
+	}
+	return os.Readlink(l.path(name))
+}
+
+// ReadDir lists the directory name in every one of dirs that has it, taking each entry
+// from the last one.
+func (l *layerFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if err := l.check("readdir", name); err != nil {
+		return nil, err
+	}
+	byName := make(map[string]fs.DirEntry)
+	found := false
+	var firstErr error
+	for _, dir := range l.dirs {
+		entries, err := os.ReadDir(filepath.Join(dir, filepath.FromSlash(name)))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		found = true
+		for _, e := range entries {
+			byName[e.Name()] = e
+		}
+	}
+	if !found {
+		if firstErr == nil {
+			firstErr = &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+		}
+		return nil, firstErr
+	}
+	entries := make([]fs.DirEntry, 0, len(byName))
+	for _, e := range byName {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, firstErr
+}
@@ -0,0 +1,205 @@
+package merge
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Severities of a Finding.
+const (
+	SeverityError   = "error"   // almost certainly a mistake
+	SeverityWarning = "warning" // worth a look
+)
+
+// Finding is a problem found in the source by Merger.Lint.
+type Finding struct {
+	Severity string
+	Rule     string
+	Path     string // relative to the source root
+	Message  string
+}
+
+// linter holds what's been seen so far by a Lint, for the rules that look at more than
+// a single entry.
+type linter struct {
+	m      *Merger
+	folded foldedPaths
+}
+
+// lintRule checks a single entry of the source (at rel, described by d and st),
+// returning a message if it breaks the rule.
+type lintRule struct {
+	name     string
+	severity string
+	check    func(l *linter, rel string, d fs.DirEntry, st fs.FileInfo) string
+}
+
+// lintRules are the checks made by Lint, in order.
+var lintRules = []lintRule{
+	{"control-character", SeverityError, lintControl},
+	{"case-collision", SeverityError, lintCollision},
+	{"world-writable", SeverityError, lintWorldWritable},
+	{"setuid", SeverityError, lintSetuid},
+	{"broken-symlink", SeverityError, lintBrokenLink},
+	{"backup-file", SeverityWarning, lintBackupFile},
+	{"empty-directory", SeverityWarning, lintEmptyDir},
+}
+
+func lintControl(l *linter, rel string, d fs.DirEntry, st fs.FileInfo) string {
+	if strings.IndexFunc(d.Name(), unicode.IsControl) < 0 {
+		return ""
+	}
+	return fmt.Sprintf("name %q has a control character in it", d.Name())
+}
+
+func lintCollision(l *linter, rel string, d fs.DirEntry, st fs.FileInfo) string {
+	if l.m.CaseSensitiveDest {
+		return ""
+	}
+	name := rel
+	if target, ok := removeTarget(rel); ok {
+		name = target
+	}
+	if other, ok := l.folded.add(name, rel, st.IsDir()); ok {
+		return fmt.Sprintf("same file as %s on a case-insensitive destination", other)
+	}
+	return ""
+}
+
+func lintWorldWritable(l *linter, rel string, d fs.DirEntry, st fs.FileInfo) string {
+	if st.Mode()&fs.ModeSymlink != 0 || st.Mode()&0002 == 0 {
+		return ""
+	}
+	return fmt.Sprintf("writable by anyone (mode %04o)", st.Mode()&modeBits)
+}
+
+func lintSetuid(l *linter, rel string, d fs.DirEntry, st fs.FileInfo) string {
+	switch {
+	case st.IsDir():
+		return ""
+	case st.Mode()&fs.ModeSetuid != 0:
+		return "setuid"
+	case st.Mode()&fs.ModeSetgid != 0:
+		return "setgid"
+	}
+	return ""
+}
+
+func lintBrokenLink(l *linter, rel string, d fs.DirEntry, st fs.FileInfo) string {
+	if st.Mode()&fs.ModeSymlink == 0 {
+		return ""
+	}
+	if _, err := fs.Stat(l.m.src(), srcName(rel)); err == nil {
+		return ""
+	}
+	target, _ := l.m.srcLink(rel)
+	if target == "" {
+		return "points to nothing"
+	}
+	return fmt.Sprintf("points to nothing: %s", target)
+}
+
+func lintBackupFile(l *linter, rel string, d fs.DirEntry, st fs.FileInfo) string {
+	if st.IsDir() || !l.m.isIgnored(rel) {
+		return ""
+	}
+	return "looks like a backup, and is never copied"
+}
+
+func lintEmptyDir(l *linter, rel string, d fs.DirEntry, st fs.FileInfo) string {
+	if !st.IsDir() || rel == "." {
+		return ""
+	}
+	if entries, err := fs.ReadDir(l.m.src(), srcName(rel)); err != nil || len(entries) > 0 {
+		return ""
+	}
+	return fmt.Sprintf("empty, only created in the destination (mode %04o)", l.m.srcMode(st))
+}
+
+// Lint walks the source, and checks every entry that's merged against lintRules,
+// without changing anything. It returns the findings so far, even if it fails part
+// way.
+func (m *Merger) Lint(ctx context.Context) ([]Finding, error) {
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	if err := m.ValidateDirs(true); err != nil {
+		return nil, err
+	}
+	if err := m.loadLayers(); err != nil {
+		return nil, err
+	}
+	if err := m.loadTemplates(); err != nil {
+		return nil, err
+	}
+	m.loadAppends()
+	m.loadOverlays()
+	if err := m.loadIgnore(); err != nil {
+		return nil, err
+	}
+	l := &linter{m: m, folded: make(foldedPaths)}
+	result := m.lintMeta()
+	err := m.walkSrc(func(rel string, d fs.DirEntry, walkErr error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if walkErr != nil {
+			return walkErr
+		}
+		if skip, err := m.skipExcluded(rel, d); skip {
+			return err
+		}
+		if md, ok := d.(metaEntry); ok && md.meta.err != nil {
+			// Already reported by lintMeta.
+			d = md.DirEntry
+		}
+		st, err := d.Info()
+		if err != nil {
+			return wrapErr(OpWalk, rel, err)
+		}
+		for _, r := range lintRules {
+			if msg := r.check(l, rel, d, st); msg != "" {
+				result = append(result, Finding{Severity: r.severity, Rule: r.name, Path: rel, Message: msg})
+			}
+		}
+		return nil
+	})
+	return result, err
+}
+
+// lintMeta loads MetaFile, and checks that it could be, and that every path in it is
+// in the source, with a user and group that exist.
+func (m *Merger) lintMeta() []Finding {
+	var result []Finding
+	add := func(severity, rel, msg string) {
+		result = append(result, Finding{Severity: severity, Rule: "metadata", Path: rel, Message: msg})
+	}
+	warnings, err := m.loadMeta()
+	for _, w := range warnings {
+		add(SeverityWarning, MetaFile, w)
+	}
+	if err != nil {
+		add(SeverityError, MetaFile, err.Error())
+		m.meta = nil
+		return result
+	}
+	names := make([]string, 0, len(m.meta))
+	for name := range m.meta {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return m.meta[names[i]].line < m.meta[names[j]].line })
+	for _, name := range names {
+		fm := m.meta[name]
+		if !m.inSrc(filepath.FromSlash(name)) {
+			add(SeverityError, filepath.FromSlash(name), fmt.Sprintf("%s:%d: not in the source", MetaFile, fm.line))
+		} else if fm.err != nil {
+			add(SeverityError, filepath.FromSlash(name), fmt.Sprintf("%s:%d: %s", MetaFile, fm.line, fm.err))
+		}
+	}
+	return result
+}
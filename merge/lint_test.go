@@ -0,0 +1,75 @@
+package merge
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestLint(t *testing.T) {
+	m, _ := newTestMerger(t, tree{
+		"ok":        "ok\n",
+		"Conf":      "one\n",
+		"conf":      "two\n",
+		"tab\tname": "x\n",
+		"open":      "x\n",
+		"suid":      "x\n",
+		"old~":      "x\n",
+		"empty/":    "",
+		"skipped/":  "",
+		IgnoreFile:  "skipped/\n",
+		MetaFile:    "ok mode=0600 colour=red\nmissing mode=0600\n",
+	}, nil)
+	for name, mode := range map[string]os.FileMode{"open": 0666, "suid": 0755 | os.ModeSetuid} {
+		if err := os.Chmod(filepath.Join(m.SrcDir, name), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("nowhere", filepath.Join(m.SrcDir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	before := readTree(t, m.SrcDir)
+	findings, err := m.Lint(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, f := range findings {
+		got = append(got, f.Severity+" "+f.Rule+" "+filepath.ToSlash(f.Path))
+		if f.Message == "" {
+			t.Errorf("%s %s: no message", f.Rule, f.Path)
+		}
+	}
+	sort.Strings(got)
+	want := []string{
+		"error broken-symlink link",
+		"error case-collision conf",
+		"error control-character tab\tname",
+		"error metadata missing",
+		"error setuid suid",
+		"error world-writable open",
+		"warning backup-file old~",
+		"warning empty-directory empty",
+		"warning metadata " + MetaFile,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	checkTree(t, m.SrcDir, before)
+	checkTree(t, m.DestDir, tree{})
+
+	// On a case-sensitive destination, those are two files.
+	m.CaseSensitiveDest = true
+	findings, err = m.Lint(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range findings {
+		if f.Rule == "case-collision" {
+			t.Errorf("got %s %s", f.Rule, f.Path)
+		}
+	}
+}
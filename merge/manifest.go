@@ -0,0 +1,280 @@
+package merge
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A suggested place to keep the manifest, if it's wanted.
+const DefaultManifestPath = "/var/db/upmerge/manifest"
+
+// manifestEntry records a file installed in the destination: where it came from, the
+// SHA-256 of what was written, and when. A file a fragment is spliced into has no hash,
+// since only the block is upmerge's.
+type manifestEntry struct {
+	Src      string    `json:"src"`
+	Hash     string    `json:"hash,omitempty"`
+	Time     time.Time `json:"time"`
+	Fragment bool      `json:"fragment,omitempty"`
+}
+
+// manifest records the files upmerge installed in the destination, by relative path,
+// and the revision of the source they were last merged from.
+type manifest struct {
+	DestDir  string                   `json:"destDir"`
+	Revision string                   `json:"revision,omitempty"`
+	Files    map[string]manifestEntry `json:"files"`
+
+	mu    sync.Mutex
+	dirty bool
+}
+
+// names returns the paths of the files in the manifest, in the order of a walk.
+func (mf *manifest) names() []string {
+	mf.mu.Lock()
+	names := make([]string, 0, len(mf.Files))
+	for name := range mf.Files {
+		names = append(names, name)
+	}
+	mf.mu.Unlock()
+	sort.Slice(names, func(i, j int) bool {
+		return comparePaths(filepath.FromSlash(names[i]), filepath.FromSlash(names[j])) < 0
+	})
+	return names
+}
+
+// loadManifest reads the manifest from ManifestPath, if set. A missing manifest is
+// started over, but unlike the cache, one that can't be read is an error: the files
+// it records would otherwise be forgotten.
+func (m *Merger) loadManifest() error {
+	m.manifest = nil
+	if m.ManifestPath == "" {
+		return nil
+	}
+	destDir, _ := filepath.Abs(m.DestDir)
+	mf := &manifest{}
+	if buf, err := os.ReadFile(m.ManifestPath); err == nil {
+		if err = json.Unmarshal(buf, mf); err != nil {
+			return fmt.Errorf("reading manifest %s: %w", m.ManifestPath, err)
+		}
+		// One written before the destination was resolved names it the way it was
+		// given, such as /etc for /private/etc.
+		if mf.DestDir != destDir && resolveDir(mf.DestDir) != resolveDir(destDir) {
+			return fmt.Errorf("manifest %s is for %s, not %s", m.ManifestPath, mf.DestDir, destDir)
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("reading manifest: %w", err)
+	}
+	mf.DestDir = destDir
+	if mf.Files == nil {
+		mf.Files = make(map[string]manifestEntry)
+	}
+	m.manifest = mf
+	return nil
+}
+
+// saveManifest writes the manifest back to ManifestPath, if anything changed.
+func (m *Merger) saveManifest() error {
+	mf := m.manifest
+	if mf == nil || !mf.dirty || m.DryRun {
+		return nil
+	}
+	buf, err := json.MarshalIndent(mf, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(m.ManifestPath), 0700); err != nil {
+		return err
+	}
+	// Write it whole, or not at all.
+	tmp := m.ManifestPath + ".tmp"
+	if err = writeFileSync(tmp, buf); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, m.ManifestPath); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	mf.dirty = false
+	return nil
+}
+
+// writeFileSync writes buf to a new file at path, and waits for it to reach the disk.
+func writeFileSync(path string, buf []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(buf); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// remember records in the manifest that step installed its file.
+func (m *Merger) remember(step *Step) error {
+	mf := m.manifest
+	if mf == nil || m.DryRun || m.isOnce(step.Path) || m.isOverlaid(step.Path) {
+		// A file copied once is up to whoever changes it afterwards; a file merged
+		// into was someone else's to begin with.
+		return nil
+	}
+	if m.appends != nil && m.appends.isOrphan(srcName(step.Path)) {
+		// Its block is gone, and so is anything of upmerge's in it.
+		m.forget(step.Path)
+		return nil
+	}
+	hash, err := hashPath(step.Dest)
+	if err != nil {
+		return err
+	}
+	e := manifestEntry{Src: step.Src, Hash: hash, Time: time.Now().UTC()}
+	if m.isAppended(step.Path) {
+		e.Hash, e.Fragment = "", true
+	}
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+	mf.Files[srcName(step.Path)] = e
+	mf.dirty = true
+	step.installed = hash
+	return nil
+}
+
+// forget removes the file at rel from the manifest.
+func (m *Merger) forget(rel string) {
+	mf := m.manifest
+	if mf == nil || m.DryRun {
+		return
+	}
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+	if _, ok := mf.Files[srcName(rel)]; ok {
+		delete(mf.Files, srcName(rel))
+		mf.dirty = true
+	}
+}
+
+// inSrc returns true if there's anything at rel in the source, even a symlink to
+// nowhere.
+func (m *Merger) inSrc(rel string) bool {
+	var err error
+	if m.SrcFS == nil {
+		_, err = os.Lstat(m.srcPath(rel))
+	} else {
+		_, err = fs.Stat(m.src(), srcName(rel))
+	}
+	return err == nil
+}
+
+// drifted returns true if the destination of step was changed since upmerge installed
+// it, going by the manifest. Files it has no hash of never drifted.
+func (m *Merger) drifted(step *Step) (bool, error) {
+	mf := m.manifest
+	if mf == nil {
+		return false, nil
+	}
+	mf.mu.Lock()
+	e, ok := mf.Files[srcName(step.Path)]
+	mf.mu.Unlock()
+	if !ok || e.Hash == "" {
+		return false, nil
+	}
+	hash, err := hashPath(step.Dest)
+	if err != nil {
+		return false, err
+	}
+	return hash != e.Hash, nil
+}
+
+// planPrune calls fn with a StepRemove for every file in the manifest that's no longer
+// in the source, but still in the destination. Files that are gone from both are
+// forgotten. A file whose fragment is gone only has its block taken out, by way of a
+// StepReplace.
+func (m *Merger) planPrune(ctx context.Context, fn func(step *Step) error) error {
+	mf := m.manifest
+	if mf == nil {
+		return nil
+	}
+	for _, name := range mf.names() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel := filepath.FromSlash(name)
+		if m.inSrc(rel) {
+			continue
+		} else if m.orphanFragment(rel) {
+			if err := m.recordErr(rel, m.pruneFragment(rel, fn)); err != nil {
+				return err
+			}
+			continue
+		}
+		step := &Step{
+			Kind:   StepRemove,
+			Path:   rel,
+			Dest:   filepath.Join(m.DestDir, rel),
+			Backup: m.backupPathFor(rel),
+		}
+		if st, err := os.Lstat(step.Dest); os.IsNotExist(err) || err == nil && st.IsDir() {
+			// Whatever took its place isn't upmerge's.
+			m.forget(rel)
+			continue
+		} else if err != nil {
+			return wrapErr(OpRemove, rel, err)
+		}
+		if err := m.recordErr(rel, fn(step)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// orphanFragment returns true if a fragment was spliced into the file at rel, going by
+// the manifest, and it's gone from the source. From then on, its block is taken out.
+func (m *Merger) orphanFragment(rel string) bool {
+	mf := m.manifest
+	if mf == nil || m.appends == nil {
+		return false
+	}
+	mf.mu.Lock()
+	fragment := mf.Files[srcName(rel)].Fragment
+	mf.mu.Unlock()
+	if !fragment || m.inSrc(rel) {
+		return false
+	}
+	m.appends.orphan(srcName(rel))
+	return true
+}
+
+// pruneFragment calls fn with the step that takes the block out of the file at rel,
+// whose fragment is gone (see orphanFragment), if it's still there.
+func (m *Merger) pruneFragment(rel string, fn func(step *Step) error) error {
+	st, err := fs.Stat(m.src(), srcName(rel))
+	if errors.Is(err, fs.ErrNotExist) {
+		m.forget(rel)
+		return nil
+	} else if err != nil {
+		return wrapErr(OpCompare, rel, err)
+	}
+	step, err := m.planEntry(rel, fs.FileInfoToDirEntry(st))
+	if err != nil || step == nil {
+		return err
+	}
+	if step.Kind == StepSkip {
+		// There's no block left to take out.
+		m.forget(rel)
+		return nil
+	}
+	return fn(step)
+}
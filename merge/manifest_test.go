@@ -0,0 +1,174 @@
+package merge
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// manifestFiles returns the paths of the files in the manifest of m.
+func manifestFiles(t *testing.T, m *Merger) []string {
+	t.Helper()
+	buf, err := os.ReadFile(m.ManifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mf manifest
+	if err := json.Unmarshal(buf, &mf); err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for name := range mf.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestManifestPrune(t *testing.T) {
+	m, _ := newTestMerger(t, tree{
+		"a": "a\n", "b": "b\n", "c": "c\n", "d/e": "e\n", "hosts" + AppendSuffix: "10.0.0.1\tgateway\n",
+	}, tree{"hosts": "127.0.0.1\tlocalhost\n"})
+	m.ManifestPath = filepath.Join(t.TempDir(), "manifest")
+	m.Prune = true
+	run(t, m)
+	if got, want := manifestFiles(t, m), []string{"a", "b", "c", "d/e", "hosts"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q in the manifest, want %q", got, want)
+	}
+
+	// Gone from the source, a is removed (with a backup), and its block is taken out of
+	// hosts. Gone from both, b is forgotten, and so is c, which a directory took the
+	// place of.
+	for _, name := range []string{"a", "b", "c", "hosts" + AppendSuffix} {
+		if err := os.Remove(filepath.Join(m.SrcDir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"b", "c"} {
+		if err := os.Remove(filepath.Join(m.DestDir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTree(t, m.DestDir, tree{"c/": ""})
+	run(t, m)
+	checkTree(t, m.DestDir, tree{
+		"a" + m.BackupSuffix:     "a\n",
+		"c/":                     "",
+		"d/":                     "",
+		"d/e":                    "e\n",
+		"hosts":                  "127.0.0.1\tlocalhost\n",
+		"hosts" + m.BackupSuffix: "127.0.0.1\tlocalhost\n" + hostsBlock,
+	})
+	if got, want := manifestFiles(t, m), []string{"d/e"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q in the manifest, want %q", got, want)
+	}
+	for _, a := range run(t, m) {
+		if a.Kind != ActionOK {
+			t.Errorf("ran again: got %s %s", a.Kind, a.DestRel)
+		}
+	}
+}
+
+func TestManifestPruneFragmentGone(t *testing.T) {
+	m, _ := newTestMerger(t, tree{"hosts" + AppendSuffix: "10.0.0.1\tgateway\n"},
+		tree{"hosts": "127.0.0.1\tlocalhost\n"})
+	m.ManifestPath = filepath.Join(t.TempDir(), "manifest")
+	m.Prune = true
+	run(t, m)
+	// With the file it was spliced into gone as well, there's nothing to take out.
+	for _, path := range []string{filepath.Join(m.SrcDir, "hosts"+AppendSuffix), filepath.Join(m.DestDir, "hosts")} {
+		if err := os.Remove(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run(t, m)
+	checkTree(t, m.DestDir, tree{"hosts" + m.BackupSuffix: "127.0.0.1\tlocalhost\n"})
+	if got := manifestFiles(t, m); len(got) != 0 {
+		t.Errorf("got %q in the manifest, want it empty", got)
+	}
+
+	// Nor is there with the block taken out by hand.
+	m, _ = newTestMerger(t, tree{"hosts" + AppendSuffix: "10.0.0.1\tgateway\n"},
+		tree{"hosts": "127.0.0.1\tlocalhost\n"})
+	m.ManifestPath = filepath.Join(t.TempDir(), "manifest")
+	m.Prune = true
+	run(t, m)
+	if err := os.Remove(filepath.Join(m.SrcDir, "hosts"+AppendSuffix)); err != nil {
+		t.Fatal(err)
+	}
+	writeTree(t, m.DestDir, tree{"hosts": "::1\tlocalhost\n"})
+	for _, a := range run(t, m) {
+		if a.Kind != ActionOK {
+			t.Errorf("got %s %s, with no block to take out", a.Kind, a.DestRel)
+		}
+	}
+	if got := readTree(t, m.DestDir)["hosts"]; got != "::1\tlocalhost\n" {
+		t.Errorf("got %q", got)
+	}
+	if got := manifestFiles(t, m); len(got) != 0 {
+		t.Errorf("got %q in the manifest, want it empty", got)
+	}
+}
+
+func TestManifestWithoutPrune(t *testing.T) {
+	m, _ := newTestMerger(t, tree{"a": "a\n"}, nil)
+	m.ManifestPath = filepath.Join(t.TempDir(), "manifest")
+	run(t, m)
+	if err := os.Remove(filepath.Join(m.SrcDir, "a")); err != nil {
+		t.Fatal(err)
+	}
+	run(t, m)
+	checkTree(t, m.DestDir, tree{"a": "a\n"})
+	if got, want := manifestFiles(t, m), []string{"a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q in the manifest, want %q", got, want)
+	}
+
+	// A manifest is for the one destination.
+	other, _ := newTestMerger(t, tree{"a": "a\n"}, nil)
+	other.ManifestPath = m.ManifestPath
+	if _, err := other.Run(context.Background()); err == nil {
+		t.Error("ran with the manifest of another destination")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	m, _ := newTestMerger(t, tree{"same": "same\n", "drifted": "d\n", "deleted": "d\n",
+		"pending": "old\n", "orphan": "o\n"}, nil)
+	if _, err := m.Verify(context.Background()); err == nil {
+		t.Error("verified without a manifest")
+	}
+	m.ManifestPath = filepath.Join(t.TempDir(), "manifest")
+	run(t, m)
+	writeTree(t, m.DestDir, tree{"drifted": "changed\n"})
+	if err := os.Remove(filepath.Join(m.DestDir, "deleted")); err != nil {
+		t.Fatal(err)
+	}
+	writeTree(t, m.SrcDir, tree{"pending": "new\n"})
+	if err := os.Remove(filepath.Join(m.SrcDir, "orphan")); err != nil {
+		t.Fatal(err)
+	}
+	before := readTree(t, m.DestDir)
+	result, err := m.Verify(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	for _, st := range result {
+		got[filepath.Base(st.Dest)] = st.State
+	}
+	want := map[string]string{
+		"same":    StateInSync,
+		"drifted": StateDrifted,
+		"deleted": StateDeleted,
+		"pending": StatePending,
+		"orphan":  StateOrphan,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	checkTree(t, m.DestDir, before)
+}
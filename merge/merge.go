@@ -0,0 +1,1192 @@
+// Package merge implements upmerge: it maintains local overrides to a directory tree
+// such as /etc, by copying files over from a source tree, and backing up whatever they
+// replace.
+package merge
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults used by New.
+const (
+	DefaultSrcDir       = "/usr/local/upmerge/etc"
+	DefaultDestDir      = "/etc"
+	DefaultBackupSuffix = ".upmerge~"
+	DefaultDiffContext  = 3
+	// DefaultMergeToolTimeout leaves some time for merging by hand.
+	DefaultMergeToolTimeout = 10 * time.Minute
+)
+
+// Resolution is the answer to a conflict, as given by Merger.Resolve.
+type Resolution int
+
+const (
+	// ResolveOverwrite replaces the differing backup with the current destination.
+	ResolveOverwrite Resolution = iota
+	// ResolveSkip leaves the file alone.
+	ResolveSkip
+)
+
+// Merger brings the files in SrcDir over to DestDir.
+type Merger struct {
+	SrcDir  string
+	DestDir string
+	// SrcFS, if set, is read as the source instead of SrcDir; SrcDir is then only
+	// used to name source files in actions. Files are created with the modes from
+	// SrcFS, or DefaultFileMode and DefaultDirMode if it doesn't carry any.
+	SrcFS fs.FS
+	// Layers are more source directories, merged on top of SrcDir in order: where
+	// several of them have the same path, the last one wins.
+	Layers []string
+	// Templates renders the source files named with TemplateSuffix as text/templates,
+	// and copies the output without the suffix. Templates are given the Hostname (or
+	// this host's name), OS, Arch, Env (the environment), and Vars.
+	Templates bool
+	Vars      map[string]string
+	Hostname  string
+	// CommentLeaders gives what starts a comment in the files fragments are spliced
+	// into (see AppendSuffix), by file name or, failing that, extension (such as
+	// ".ini"), in place of DefaultCommentLeader. A comment that needs closing is given
+	// with its end after a blank, such as "<!-- -->".
+	CommentLeaders map[string]string
+	// DryRun reports the actions that would be taken, without changing anything.
+	DryRun bool
+
+	// BackupSuffix is appended to the name of a file to name its backup.
+	BackupSuffix string
+	// BackupDir, if set, is where backups are kept instead, at the same relative
+	// paths as in DestDir.
+	BackupDir string
+	// BackupRotate, if positive, is the number of numbered backups to keep of each
+	// file. Differing backups are then shifted out of the way, rather than refused.
+	BackupRotate int
+	// NoBackup replaces files without making a backup first.
+	NoBackup bool
+	// ResolveTypeConflicts decides what's done with a destination entry that's a
+	// directory where the source's isn't, or the other way around: TypeConflictDest (or
+	// "") leaves it alone, TypeConflictSrc backs it up whole, and puts the source's in
+	// its place. Either way, it's reported.
+	ResolveTypeConflicts string
+	// CleanIdenticalBackups removes the backup of a file that's up to date, if it's
+	// identical to the file, as PruneBackups would. Unless set, it's left alone.
+	CleanIdenticalBackups bool
+	// Force overwrites backups that differ from the file being backed up.
+	Force bool
+	// KeepGoing records errors about single files, and carries on with the rest.
+	KeepGoing bool
+	// CachePath, if set, is a file to remember the hashes of source and destination
+	// files in, so that files that haven't changed since needn't be read again.
+	CachePath string
+	// ManifestPath, if set, is a file to record every file installed in DestDir in.
+	ManifestPath string
+	// Merge tries a three-way merge of a source file into its destination, with the
+	// backup as the base, instead of refusing to overwrite the backup (see mergeStep).
+	// Binary files are never merged.
+	Merge bool
+	// MergeTool, if set, is a command to run on the files that Merge can't merge
+	// cleanly, with %base, %mine, %theirs and %out in its arguments replaced by the
+	// paths of the backup, the source, the destination, and the file to write the
+	// merged result to. That's taken if it exits with 0, within MergeToolTimeout.
+	// It's never run in a dry run.
+	MergeTool        []string
+	MergeToolTimeout time.Duration
+	// StrictDrift refuses to replace files that were changed since upmerge installed
+	// them (as recorded in the manifest), unless forced or resolved. Otherwise, they're
+	// only reported as ActionDrift.
+	StrictDrift bool
+	// Prune backs up and removes the files in the manifest that are no longer in the
+	// source. Files that weren't installed by upmerge are never removed.
+	Prune bool
+	// Validators check the new versions of the files they match, before they take the
+	// place of the old ones. They're never run in a dry run.
+	Validators []Validator
+	// Hooks are run after Run (or Apply), once each, if any of the files they match
+	// were changed. They're never run in a dry run.
+	Hooks []Hook
+	// Workers, if more than 1, is the number of files Run compares and copies at the
+	// same time. Directories are still created in order, before their contents.
+	Workers int
+
+	// KeepQuarantine copies the com.apple.quarantine extended attribute along with
+	// the others, which are always copied on macOS.
+	KeepQuarantine bool
+	// NoClone always copies files, rather than cloning them where the file system
+	// can (with clonefile on APFS, or a reflink on Linux).
+	NoClone bool
+	// NoTimes leaves copied files and created directories with the current time,
+	// rather than giving them the access and modification times of their source.
+	NoTimes bool
+	// Exclude lists patterns of files in the source not to copy over, as in
+	// IgnoreFile; they come after the patterns in IgnoreFile.
+	Exclude []string
+	// Paths, if set, limits the merge to these files or directories in SrcDir (and
+	// everything inside). They're relative to SrcDir, unless absolute.
+	Paths []string
+	// Include, if set, limits the merge to files in SrcDir matching these patterns,
+	// in the format of IgnoreFile. Directories are only created to hold them.
+	Include []string
+	// Once lists patterns of files in SrcDir, in the format of IgnoreFile, that are
+	// only copied if they're missing from DestDir. Once there, they're left alone for
+	// good (see ActionSkipOnce), and aren't kept in the manifest.
+	Once []string
+	// ForceFiles lists patterns of files in SrcDir, in the format of IgnoreFile, whose
+	// differing backups are overwritten as if forced (see Force), without asking
+	// Resolve.
+	ForceFiles []string
+	// KeyFiles lists patterns of files in SrcDir, in the format of IgnoreFile, holding
+	// lines of "key = value" (as sysctl.conf does) that are merged into the
+	// destination's, rather than replacing it: the keys set in the source are set the
+	// same way, and everything else is kept. A file that can't be parsed is warned
+	// about, and replaced whole. They aren't kept in the manifest, since the rest of
+	// the file isn't upmerge's.
+	KeyFiles []string
+	// PlistFiles lists patterns of files in SrcDir, in the format of IgnoreFile, that
+	// are property lists whose dictionary is merged into the destination's, which is
+	// written back in its own format (XML or binary). Otherwise, they're like KeyFiles.
+	PlistFiles []string
+	// CreateDest creates DestDir if it doesn't exist. Otherwise, that's an error.
+	CreateDest bool
+	// Strict fails the run (after carrying on with the rest) if the source contains
+	// special files, such as named pipes or sockets, which are never copied. It also
+	// refuses to copy a file that's missing from DestDir next to a backup that differs
+	// from the source, left over from before it went missing.
+	Strict bool
+	// Devices recreates the devices found in the source, when running as root.
+	// Otherwise, they're skipped like other special files.
+	Devices bool
+	// ClearFlags allows replacing files in DestDir that are marked immutable (or
+	// append-only) with chflags: the flags are cleared for the replacement, and set
+	// again on the new file.
+	ClearFlags bool
+	// NoDirPerms leaves the permissions of directories that already exist in DestDir
+	// alone, even if they differ from the source's.
+	NoDirPerms bool
+	// NoOwner leaves copied files owned by whoever is running upmerge. Otherwise, as
+	// root, they're given the owner and group of their source.
+	NoOwner bool
+	// CopyLinks copies the files that symlinks in the source point to, instead of
+	// recreating the symlinks. Symlinks to directories are walked into, as if they were
+	// the directories.
+	CopyLinks bool
+	// Root, if set, is the root of the file system DestDir is in, when that's not the
+	// live one: a staging volume for an image, say. %root in the commands of Validators
+	// and Hooks is replaced by it. With RelativeLinks, absolute symlink targets in the
+	// source are made relative, so that they point at the same place within Root (or
+	// within /, without it).
+	Root          string
+	RelativeLinks bool
+	// UnsafeFollow works on the files in DestDir by their paths, as they are. Otherwise,
+	// they're worked on through a destRoot, so that a symlink swapped in for one of
+	// their directories (say, between checking it, and writing to it) can't lead outside.
+	UnsafeFollow bool
+	// NoSpaceCheck goes ahead without checking that DestDir's file system has got
+	// SpaceMargin times the size of the files to copy free. Otherwise, a run that
+	// doesn't fit fails with a SpaceError, before anything is changed.
+	NoSpaceCheck bool
+	SpaceMargin  float64
+	// Protected is what to do with a file that can't be changed because System
+	// Integrity Protection protects it: ProtectedSkip (or "") or ProtectedFail.
+	Protected string
+	// Retries is how many more times a file is tried after a transient error (such as
+	// a timeout on a network file system), waiting a little longer each time.
+	Retries int
+	// Snapshot, if set (to SnapshotRequired or SnapshotBestEffort), takes a snapshot of
+	// the destination before a run changes anything in it, to go back to if the run goes
+	// wrong. SnapshotDir is where tarballs are kept; DefaultSnapshotDir if "".
+	Snapshot    string
+	SnapshotDir string
+	// JournalDir, if set, is where a run keeps a journal of what it changed (in a
+	// directory of its own, named after the time), to be undone with Undo.
+	JournalDir string
+	// JournalKeep, if positive, is how many journals are kept in JournalDir: once a
+	// run's is saved, the oldest beyond that are removed.
+	JournalKeep int
+	// MaxDepth, if positive, is how many levels of directories below SrcDir are walked
+	// into. Directories with anything deeper are reported as skipped.
+	MaxDepth int
+	// CaseSensitiveDest allows source entries whose names only differ by case (or by
+	// Unicode normalization), which would be the same file on a case-insensitive
+	// destination, such as macOS's by default. Otherwise, the run is refused.
+	CaseSensitiveDest bool
+	// Quick assumes that files with the same size and modification time have the same
+	// contents, rather than comparing them. Such files are reported as Quick.
+	Quick bool
+	// IgnoreLineEndings and IgnoreTrailingSpace let text files match if they only differ
+	// in their line endings (CRLF or CR, rather than LF), or in blanks at the end of
+	// lines. Such files are reported as Loose, and left as they are.
+	IgnoreLineEndings   bool
+	IgnoreTrailingSpace bool
+	// FirstDiff reports where each file that's replaced first differed from its source,
+	// as the DiffInfo of its ActionCopy.
+	FirstDiff bool
+
+	// Diff reports an ActionDiff, with DiffContext lines of context, for every file
+	// that's about to be overwritten.
+	Diff        bool
+	DiffContext int
+
+	// Observer, if set, is told about every action and error as it happens.
+	Observer Observer
+	// Resolve, if set, is called for every file that differs both from its source
+	// and from its backup, instead of refusing to overwrite the backup. An error
+	// stops the run. Even with Workers, it's only called for one file at a time.
+	Resolve func(srcPath, destPath, backupPath string) (Resolution, error)
+
+	// ignore holds the rules loaded from IgnoreFile and Exclude, and include those
+	// from Include.
+	ignore, include []ignoreRule
+	// once holds the rules from Once.
+	once []ignoreRule
+	// forceFiles holds the rules from ForceFiles.
+	forceFiles []ignoreRule
+	// keyFiles and plistFiles hold the rules from KeyFiles and PlistFiles.
+	keyFiles, plistFiles []ignoreRule
+	// layers is where each source file is taken from, when there are Layers.
+	layers *layerFS
+	// templates renders the source's templates, with Templates.
+	templates *templateFS
+	// appends splices the source's fragments into the destination (see AppendSuffix).
+	appends *appendFS
+	// overlays merges the files matching KeyFiles and PlistFiles into the
+	// destination's.
+	overlays *overlayFS
+	// journal records what the current run changes, if it keeps one.
+	journal *journal
+	// undone holds the paths removed by Undo so far (or that would be, in a dry run).
+	undone map[string]bool
+	// meta is what MetaFile gives, by path relative to the source root.
+	meta       map[string]*fileMeta
+	manifest   *manifest
+	validators []validatorRule
+	// mu guards the state below, and serializes calls to the Observer.
+	mu       sync.Mutex
+	actions  []Action
+	failures MultiError
+	cache    *hashCache
+	newDirs  []string
+	// holding is set while actions are held back from the Observer, from heldFrom on.
+	holding  bool
+	heldFrom int
+	progress Progress
+	// copied counts the bytes copied from the source, for the Progress.
+	copied int64
+	// resolveMu serializes calls to Resolve, and dirMu the creation of directories
+	// shared by backups.
+	resolveMu sync.Mutex
+	dirMu     sync.Mutex
+	// dest is DestDir, opened by destRootFor, under destMu.
+	destMu sync.Mutex
+	dest   *destRoot
+}
+
+// New returns a Merger from srcDir to destDir, with the default settings.
+func New(srcDir, destDir string) *Merger {
+	return &Merger{
+		SrcDir:       srcDir,
+		DestDir:      destDir,
+		BackupSuffix: DefaultBackupSuffix,
+		DiffContext:  DefaultDiffContext,
+
+		MergeToolTimeout: DefaultMergeToolTimeout,
+		SpaceMargin:      DefaultSpaceMargin,
+		JournalKeep:      DefaultJournalKeep,
+	}
+}
+
+// Validate checks the settings of m for consistency.
+func (m *Merger) Validate() error {
+	if m.BackupSuffix == "" || strings.ContainsRune(m.BackupSuffix, filepath.Separator) {
+		return fmt.Errorf("invalid backup suffix: %q", m.BackupSuffix)
+	}
+	if m.Quick && m.Diff {
+		return errors.New("can't show diffs of files compared without reading them")
+	}
+	if m.Merge && len(m.MergeTool) > 0 && !strings.Contains(strings.Join(m.MergeTool, " "), "%out") {
+		return errors.New("merge tool doesn't write to %out")
+	}
+	if _, err := parseValidators(m.Validators); err != nil {
+		return err
+	}
+	if _, err := parseHooks(m.Hooks); err != nil {
+		return err
+	}
+	if m.Prune && m.ManifestPath == "" {
+		return errors.New("can't prune without a manifest")
+	}
+	switch m.ResolveTypeConflicts {
+	case "", TypeConflictDest:
+	case TypeConflictSrc:
+		if m.NoBackup {
+			return errors.New("can't replace a directory (or put one in place of a file) without a backup")
+		}
+	default:
+		return fmt.Errorf("invalid way of resolving type conflicts: %q", m.ResolveTypeConflicts)
+	}
+	switch m.Protected {
+	case "", ProtectedSkip, ProtectedFail:
+	default:
+		return fmt.Errorf("invalid way of handling protected files: %q", m.Protected)
+	}
+	switch m.Snapshot {
+	case "", SnapshotRequired, SnapshotBestEffort:
+	default:
+		return fmt.Errorf("invalid way of taking a snapshot: %q", m.Snapshot)
+	}
+	if m.SrcFS != nil && len(m.Layers) > 0 {
+		return errors.New("can't layer directories over a source that isn't a directory")
+	}
+	for _, patterns := range [][]string{m.Exclude, m.Include, m.Once, m.ForceFiles, m.KeyFiles, m.PlistFiles} {
+		for _, pattern := range patterns {
+			if _, _, err := parseIgnoreRule(pattern); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ValidateDirs checks that SrcDir and DestDir are existing directories (unless DestDir
+// is to be created), apart from each other. Without needSrc, SrcDir isn't checked;
+// PruneBackups doesn't look at it.
+func (m *Merger) ValidateDirs(needSrc bool) error {
+	if m.SrcFS == nil && needSrc {
+		for _, dir := range m.srcDirs() {
+			if st, err := os.Stat(dir); os.IsNotExist(err) {
+				return fmt.Errorf("source directory %s doesn't exist", dir)
+			} else if err != nil {
+				return err
+			} else if !st.IsDir() {
+				return fmt.Errorf("source %s is not a directory", dir)
+			}
+		}
+	}
+	if st, err := os.Stat(m.DestDir); os.IsNotExist(err) {
+		if !m.CreateDest {
+			return fmt.Errorf("destination directory %s doesn't exist", m.DestDir)
+		}
+	} else if err != nil {
+		return err
+	} else if !st.IsDir() {
+		return fmt.Errorf("destination %s is not a directory", m.DestDir)
+	}
+	if needSrc {
+		if err := m.checkPaths(); err != nil {
+			return err
+		}
+	}
+	if m.SrcFS != nil || !needSrc {
+		return nil
+	}
+	dest := resolveDir(m.DestDir)
+	for _, dir := range m.srcDirs() {
+		src := resolveDir(dir)
+		switch {
+		case src == dest:
+			return fmt.Errorf("source and destination are the same directory: %s", src)
+		case isInside(src, dest):
+			return fmt.Errorf("destination %s is inside source %s", m.DestDir, dir)
+		case isInside(dest, src) && m.mergedIntoItself(src, dest):
+			return fmt.Errorf("source %s is inside destination %s, and would be merged into itself",
+				dir, m.DestDir)
+		}
+	}
+	return nil
+}
+
+// ResolveDirs resolves any symlinks in SrcDir, Layers and DestDir (such as /etc, which
+// is a symlink to /private/etc on macOS), so that the same directories are always
+// named the same way: in the log, the backups, and the manifest. It fails if DestDir
+// is a symlink to something other than a directory. Directories that don't exist yet
+// are left as they are.
+func (m *Merger) ResolveDirs() error {
+	if st, err := os.Lstat(m.DestDir); err == nil && st.Mode()&fs.ModeSymlink != 0 {
+		target, err := filepath.EvalSymlinks(m.DestDir)
+		if err != nil {
+			return fmt.Errorf("destination %s is a symlink to nothing", m.DestDir)
+		}
+		if st, err := os.Stat(target); err != nil || !st.IsDir() {
+			return fmt.Errorf("destination %s is a symlink to %s, which is not a directory", m.DestDir, target)
+		}
+	}
+	resolve := func(dir *string) {
+		if resolved, err := filepath.EvalSymlinks(*dir); err == nil {
+			*dir = resolved
+		}
+	}
+	resolve(&m.DestDir)
+	if m.Root != "" {
+		resolve(&m.Root)
+	}
+	if m.SrcFS == nil {
+		resolve(&m.SrcDir)
+		for i := range m.Layers {
+			resolve(&m.Layers[i])
+		}
+	}
+	return nil
+}
+
+// resolveDir returns the absolute path of dir, with any symlinks resolved.
+func resolveDir(dir string) string {
+	if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = resolved
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return dir
+	}
+	return abs
+}
+
+// log records a, and passes it on to the Observer (see holdActions).
+func (m *Merger) log(a Action) {
+	a.DryRun = m.DryRun
+	for _, dir := range m.srcDirs() {
+		if a.SrcRel == "" {
+			a.SrcRel = relTo(dir, a.Src)
+		}
+	}
+	a.DestRel = relTo(m.DestDir, a.Dest)
+	if m.BackupDir != "" {
+		a.BackupRel = relTo(m.BackupDir, a.Backup)
+	}
+	if a.BackupRel == "" {
+		a.BackupRel = relTo(m.DestDir, a.Backup)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.actions = append(m.actions, a)
+	if m.Observer != nil && !m.holding {
+		m.Observer.OnAction(a)
+	}
+}
+
+// relTo returns path relative to root, or "" if it's not inside (or it's empty).
+func relTo(root, path string) string {
+	if path == "" || !isInside(root, path) {
+		return ""
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return ""
+	}
+	return rel
+}
+
+// holdActions stops passing actions on to the Observer, until releaseActions: the
+// actions of a parallel run would otherwise be in whatever order they finished.
+func (m *Merger) holdActions() {
+	m.mu.Lock()
+	m.holding, m.heldFrom = true, len(m.actions)
+	m.mu.Unlock()
+}
+
+// releaseActions puts the actions held since holdActions in the order of the walk, by
+// their paths, and passes them on to the Observer.
+func (m *Merger) releaseActions() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	held := m.actions[m.heldFrom:]
+	m.holding = false
+	sort.SliceStable(held, func(i, j int) bool {
+		return comparePaths(held[i].path(), held[j].path()) < 0
+	})
+	if m.Observer != nil {
+		for _, a := range held {
+			m.Observer.OnAction(a)
+		}
+	}
+}
+
+// fail passes an error about the file at rel on to the Observer.
+func (m *Merger) fail(rel string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Observer != nil {
+		m.Observer.OnError(rel, err)
+	}
+}
+
+// start resets the state left over from any previous run, and checks the settings
+// (see ValidateDirs for needSrc).
+func (m *Merger) start(needSrc bool) error {
+	m.actions = nil
+	m.failures = nil
+	m.newDirs = nil
+	if err := m.Validate(); err != nil {
+		return err
+	}
+	if err := m.ValidateDirs(needSrc); err != nil {
+		return err
+	}
+	if needSrc {
+		if err := m.loadLayers(); err != nil {
+			return err
+		}
+		if err := m.loadTemplates(); err != nil {
+			return err
+		}
+		m.loadAppends()
+		m.loadOverlays()
+		if err := m.loadIgnore(); err != nil {
+			return err
+		}
+		warnings, err := m.loadMeta()
+		for _, w := range warnings {
+			m.log(Action{Kind: ActionWarning, Src: m.srcPath(MetaFile), Error: w})
+		}
+		if err != nil {
+			return err
+		}
+		if err := m.loadValidators(); err != nil {
+			return err
+		}
+		if err := m.loadManifest(); err != nil {
+			return err
+		}
+	}
+	if err := m.createDest(); err != nil {
+		return err
+	}
+	m.loadCache()
+	return nil
+}
+
+// createDest creates DestDir if it's missing, and CreateDest is set.
+func (m *Merger) createDest() error {
+	if _, err := os.Stat(m.DestDir); !m.CreateDest || !os.IsNotExist(err) {
+		return nil
+	}
+	if !m.DryRun {
+		mode := DefaultDirMode
+		if st, err := fs.Stat(m.src(), "."); err == nil {
+			mode = m.srcMode(st)
+		}
+		if err := os.MkdirAll(m.DestDir, mode); err != nil {
+			return err
+		}
+	}
+	m.log(Action{Kind: ActionMkdir, Dest: m.DestDir})
+	return nil
+}
+
+// finish returns the actions and errors of the current run.
+func (m *Merger) finish(err error) ([]Action, error) {
+	defer m.closeDest()
+	if timesErr := m.copyDirTimes(); timesErr != nil && err == nil {
+		err = timesErr
+	}
+	if cacheErr := m.saveCache(); cacheErr != nil && err == nil {
+		err = fmt.Errorf("saving cache: %w", cacheErr)
+	}
+	// Even after a failure, the files installed so far are to be remembered.
+	if manifestErr := m.saveManifest(); manifestErr != nil && err == nil {
+		err = fmt.Errorf("saving manifest: %w", manifestErr)
+	}
+	if journalErr := m.closeJournal(); journalErr != nil && err == nil {
+		err = fmt.Errorf("saving journal: %w", journalErr)
+	}
+	if len(m.failures) > 0 {
+		if err != nil {
+			// Whatever stopped the run, keep the errors recorded up to that point.
+			m.failures = append(m.failures, err)
+		}
+		err = m.failures
+	}
+	return m.actions, err
+}
+
+// Run walks SrcDir, and brings every entry over to DestDir. It returns the actions
+// taken, even if it fails part way.
+func (m *Merger) Run(ctx context.Context) ([]Action, error) {
+	if err := m.start(true); err != nil {
+		return nil, err
+	}
+	m.checkSrcRepo(ctx)
+	if err := m.checkCollisions(ctx); err != nil {
+		return m.finish(err)
+	}
+	if err := m.checkSpace(ctx, m.srcSize, m.copySize); err != nil {
+		return m.finish(err)
+	}
+	if err := m.takeSnapshot(ctx, m.snapshotPaths); err != nil {
+		return m.finish(err)
+	}
+	m.startJournal()
+	m.startProgress()
+	var err error
+	if m.Workers > 1 {
+		err = m.runParallel(ctx)
+	} else {
+		err = m.walkSrc(m.keepGoingFunc(func(rel string, d fs.DirEntry, walkErr error) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return m.mergeEntry(ctx, rel, d, walkErr)
+		}))
+	}
+	if err == nil && m.Prune {
+		err = m.planPrune(ctx, func(step *Step) error {
+			return m.applyStep(ctx, step)
+		})
+	}
+	return m.finishChanges(ctx, err)
+}
+
+// copyFile copies named srcPath into destPath, matching permission bits, times, and
+// the owner if running as root. As a precaution, destPath must not exist.
+func copyFile(ctx context.Context, srcPath, destPath string) error {
+	fr, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer fr.Close()
+	st, err := fr.Stat()
+	if err != nil {
+		return err
+	}
+	if err = writeNewFile(ctx, destPath, fr, st.Mode()&modeBits); err != nil {
+		return err
+	}
+	if err = copyTimes(destPath, st); err != nil {
+		return err
+	}
+	return copyOwner(destPath, st)
+}
+
+// writeNewFile creates destPath, copies the contents of r into it, and then gives it
+// exactly the given mode, regardless of umask. As a precaution, destPath must not
+// exist. If the copy fails (or ctx is done before it completes), the partial file is
+// removed. The holes in a sparse file are kept.
+func writeNewFile(ctx context.Context, destPath string, r io.Reader, mode fs.FileMode) error {
+	// Keep it private until it's whole.
+	fw, err := os.OpenFile(destPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if err = fillNewFile(ctx, fw, r, mode); err != nil {
+		os.Remove(destPath)
+	}
+	return err
+}
+
+// fillNewFile copies the contents of r into fw, a new file, gives it the mode, and
+// closes it.
+func fillNewFile(ctx context.Context, fw *os.File, r io.Reader, mode fs.FileMode) error {
+	err := copyContents(ctx, fw, r)
+	if err == nil {
+		err = fw.Chmod(mode)
+	}
+	if err == nil {
+		// Make sure it's all on disk before it's renamed into place.
+		err = fw.Sync()
+	}
+	if closeErr := fw.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// ctxReader fails once its context is done, so that copies stop between chunks.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// isIgnored returns true for files in the source that are never copied over: editor
+// backups, and anything that looks like one of our own backups.
+func (m *Merger) isIgnored(path string) bool {
+	return strings.HasSuffix(path, "~") || strings.HasSuffix(path, m.BackupSuffix)
+}
+
+// mergeEntry is the fs.WalkDirFunc that brings a single entry of the source (at rel,
+// relative to its root) over to DestDir.
+func (m *Merger) mergeEntry(ctx context.Context, rel string, d fs.DirEntry, walkErr error) error {
+	if walkErr != nil {
+		return wrapErr(OpWalk, rel, walkErr)
+	}
+	m.reportProgress(rel)
+	return m.retry(ctx, rel, func() error {
+		step, err := m.planEntry(rel, d)
+		if err != nil || step == nil {
+			return err
+		}
+		return m.applyStep(ctx, step)
+	})
+}
+
+// planEntry decides what needs to be done to bring a single entry of the source over,
+// without changing anything. It returns nil if there's nothing to do.
+func (m *Merger) planEntry(rel string, d fs.DirEntry) (*Step, error) {
+	step := &Step{
+		Path: rel,
+		Src:  m.srcPath(rel),
+		Dest: filepath.Join(m.DestDir, rel),
+	}
+	if m.isExcluded(rel, d.IsDir()) {
+		step.Kind = StepIgnore
+		if d.IsDir() {
+			step.Mode = fs.ModeDir
+		}
+		return step, nil
+	}
+	if d.IsDir() {
+		// Ensure the directory exists in the destination
+		st, err := d.Info()
+		if err != nil {
+			return nil, wrapErr(OpWalk, rel, err)
+		}
+		step.Mode = m.srcMode(st)
+		destSt, err := os.Stat(step.Dest)
+		if err == nil && !destSt.IsDir() {
+			step.Mode |= fs.ModeDir
+			return m.planTypeConflict(step), nil
+		} else if err == nil {
+			m.checkLeftovers(rel)
+			return m.planDirPerms(step, st, destSt), nil
+		} else if !isMissing(err) {
+			return nil, wrapErr(OpMkdir, rel, err)
+		}
+		step.Kind = StepMkdir
+		return step, nil
+	}
+	if m.isIgnored(step.Src) {
+		step.Kind = StepIgnore
+		return step, nil
+	}
+	if _, ok := removeTarget(rel); ok {
+		return m.planRemove(step, d)
+	} else if m.isRemoved(rel) {
+		return nil, m.errRemoved(rel)
+	}
+	var err error
+	stat := os.Stat
+	if d.Type()&fs.ModeSymlink != 0 {
+		if step.Target, err = m.srcLink(rel); err != nil {
+			return nil, wrapErr(OpWalk, rel, err)
+		}
+		if step.Target != "" {
+			// Whatever's in the way of the new symlink needs a backup, even if it's
+			// a symlink to nowhere.
+			stat = os.Lstat
+		}
+	}
+	typ := d.Type()
+	if typ&fs.ModeSymlink != 0 && step.Target == "" {
+		// Copying what the symlink points to, which might be special itself.
+		if st, err := fs.Stat(m.src(), srcName(rel)); err == nil {
+			typ = st.Mode().Type()
+		}
+	}
+	if typ&specialModes != 0 {
+		return m.planSpecial(step, typ)
+	}
+	destSt, err := stat(step.Dest)
+	if isMissing(err) {
+		step.Kind = StepCopy
+		// The destination may have gone (to an uninstaller, say) since it was backed
+		// up, leaving the backup behind.
+		if backup := m.backupPathFor(rel); fileExists(backup) {
+			step.Backup = backup
+		}
+		return step, nil
+	}
+
+	if m.isOnce(rel) {
+		// It's there, and whatever's in it now is up to whoever put it there.
+		step.Kind = StepOnce
+		return step, nil
+	} else if err == nil && destSt.IsDir() {
+		return m.planTypeConflict(step), nil
+	}
+	step.Backup = m.backupPathFor(rel)
+	if m.Quick && step.Target == "" && m.quickMatch(rel, step.Dest) {
+		step.Kind = StepSkip
+		step.Quick = true
+		return m.planMetaPerms(step, d), nil
+	}
+	same, err := m.srcMatches(rel, step.Dest)
+	if err != nil {
+		return nil, wrapErr(OpCompare, rel, err)
+	}
+	if same {
+		step.Kind = StepSkip
+		return m.planMetaPerms(step, d), nil
+	} else if m.looseMatch(rel, step.Dest) {
+		step.Kind = StepSkip
+		step.Loose = true
+		return m.planMetaPerms(step, d), nil
+	}
+	_, err = os.Lstat(step.Backup)
+	backupExists := (err == nil || !os.IsNotExist(err))
+	same, _ = fileContentsAreIdentical(step.Dest, step.Backup)
+	// With rotation, the differing backup is simply shifted out of the way.
+	if backupExists && !same && m.BackupRotate == 0 && !m.keepsDest(rel) {
+		step.Kind = StepConflict
+	} else {
+		step.Kind = StepReplace
+	}
+	return step, nil
+}
+
+// planMetaPerms turns step, a StepSkip for the source file d, into a StepChmod if
+// MetaFile gives d a mode, and the destination has another.
+func (m *Merger) planMetaPerms(step *Step, d fs.DirEntry) *Step {
+	md, ok := d.(metaEntry)
+	if !ok || !md.meta.hasMode || step.Target != "" {
+		return step
+	}
+	// Changing a symlink's mode would change whatever it points to.
+	lst, err := os.Lstat(step.Dest)
+	if err != nil || !lst.Mode().IsRegular() || lst.Mode()&modeBits == md.meta.mode {
+		return step
+	}
+	step.Kind, step.Mode, step.Quick, step.Loose = StepChmod, md.meta.mode, false, false
+	return step
+}
+
+// planDirPerms returns a StepChmod for step, if the existing directory in the
+// destination (described by destSt) has different permissions than the source's
+// (described by st). Otherwise, it returns nil.
+func (m *Merger) planDirPerms(step *Step, st, destSt fs.FileInfo) *Step {
+	// The roots are left alone: a source checked out with a tight umask shouldn't
+	// lock everyone out of /etc.
+	if m.NoDirPerms || step.Path == "." || !m.srcHasPerms(st) || !destSt.IsDir() {
+		return nil
+	}
+	// Changing a symlink's mode would change whatever it points to.
+	if lst, err := os.Lstat(step.Dest); err != nil || lst.Mode()&fs.ModeSymlink != 0 {
+		return nil
+	}
+	if destSt.Mode()&modeBits == step.Mode {
+		return nil
+	}
+	step.Kind = StepChmod
+	return step
+}
+
+// applyStep carries out step, as planned by planEntry.
+func (m *Merger) applyStep(ctx context.Context, step *Step) (err error) {
+	defer func() { err = m.checkProtected(step, err) }()
+	rel := step.Path
+	switch step.Kind {
+	case StepMkdir, StepChmod, StepMknod, StepCopy, StepReplace, StepConflict, StepRemove, StepTypeConflict:
+		// A new symlink replaces whatever is there, rather than writing through it, and
+		// so does a removal, or a backup of the whole entry.
+		leaf := step.Kind != StepMkdir && step.Kind != StepRemove && step.Kind != StepTypeConflict &&
+			step.Target == ""
+		if err := m.checkConfined(rel, leaf); err != nil {
+			return err
+		}
+	}
+	if m.journal != nil && !m.DryRun {
+		done, err := m.journalStep(step)
+		if err != nil {
+			return wrapErr(OpJournal, rel, err)
+		}
+		defer done()
+	}
+	switch step.Kind {
+	case StepMkdir:
+		if m.DryRun {
+			// Don't create anything; files below a missing directory will be
+			// reported as COPY, since stat on them fails the same way.
+			m.log(Action{Kind: ActionMkdir, Dest: step.Dest})
+			return nil
+		}
+		err := m.mkdirDest(step.Dest, step.Mode)
+		if err == nil {
+			// Mkdir applies umask; the mode should be the source's.
+			err = m.chmodDest(step.Dest, step.Mode)
+		}
+		if err == nil {
+			if !m.NoTimes {
+				m.mu.Lock()
+				m.newDirs = append(m.newDirs, rel)
+				m.mu.Unlock()
+			}
+			m.log(Action{Kind: ActionMkdir, Dest: step.Dest})
+			return nil
+		}
+		if os.IsExist(err) {
+			return nil
+		}
+		return wrapErr(OpMkdir, rel, err)
+	case StepChmod:
+		if !m.DryRun {
+			if err := explainImmutable(step.Dest, m.chmodDest(step.Dest, step.Mode)); err != nil {
+				return wrapErr(OpChmod, rel, err)
+			}
+		}
+		m.log(Action{Kind: ActionChmod, Dest: step.Dest, Mode: step.Mode})
+	case StepMknod:
+		return m.makeDevice(step)
+	case StepSpecial:
+		m.skipSpecial(step)
+	case StepIgnore:
+		m.log(Action{Kind: ActionIgnore, Src: step.Src})
+		if step.Mode.IsDir() {
+			return fs.SkipDir
+		}
+	case StepCopy:
+		leftover := m.leftoverBackup(step)
+		if leftover && m.Strict && !m.DryRun {
+			m.log(Action{
+				Kind:   ActionError,
+				Src:    step.Src,
+				Dest:   step.Dest,
+				Backup: step.Backup,
+				Error:  fmt.Sprintf("refusing to copy next to a differing backup: %s", step.Backup),
+			})
+			return wrapErr(OpCopy, rel, ErrRefuse)
+		}
+		if !m.DryRun {
+			if err := m.create(ctx, step); err != nil {
+				return wrapErr(OpCopy, rel, fmt.Errorf("%w; %s not created", err, step.Dest))
+			}
+			if err := m.remember(step); err != nil {
+				return wrapErr(OpCopy, rel, err)
+			}
+		}
+		m.log(m.createAction(step))
+		if leftover {
+			// Copied, but the backup isn't of anything upmerge installed.
+			m.log(Action{Kind: ActionCheck, Dest: step.Dest, Backup: step.Backup})
+		} else if step.Backup != "" && m.CleanIdenticalBackups {
+			return m.cleanBackup(step)
+		}
+	case StepOnce:
+		m.log(Action{Kind: ActionSkipOnce, Src: step.Src, Dest: step.Dest})
+	case StepSkip:
+		m.log(Action{Kind: ActionOK, Src: step.Src, Dest: step.Dest, Quick: step.Quick, Loose: step.Loose})
+		if same, _ := fileContentsAreIdentical(step.Dest, step.Backup); !same && fileExists(step.Backup) && !m.keepsDest(rel) {
+			// destination is up to date with source, but there's still a backup
+			// with contents different from our version.
+			m.log(Action{Kind: ActionCheck, Dest: step.Dest, Backup: step.Backup})
+		} else if same && m.CleanIdenticalBackups {
+			return m.cleanBackup(step)
+		}
+	case StepReplace, StepConflict:
+		return m.replace(ctx, step)
+	case StepTypeConflict:
+		return m.resolveTypeConflict(ctx, step)
+	case StepRemove:
+		return m.remove(step)
+	default:
+		return wrapErr(OpWalk, rel, fmt.Errorf("unknown step: %q", step.Kind))
+	}
+	return nil
+}
+
+// replace backs up the destination of step, and copies the source over it.
+func (m *Merger) replace(ctx context.Context, step *Step) error {
+	rel, srcPath, destPath, backupPath := step.Path, step.Src, step.Dest, step.Backup
+	if m.Diff && step.Target == "" {
+		destBuf, err := os.ReadFile(destPath)
+		if err != nil {
+			return wrapErr(OpCompare, rel, err)
+		}
+		srcBuf, err := m.readSrc(rel)
+		if err != nil {
+			return wrapErr(OpCompare, rel, err)
+		}
+		diff := diffBytes(destPath, srcPath, destBuf, srcBuf, m.DiffContext)
+		m.log(Action{Kind: ActionDiff, Src: srcPath, Dest: destPath, Diff: diff})
+	}
+	var diffInfo *DiffInfo
+	if m.FirstDiff && step.Target == "" {
+		diffInfo = m.srcDiff(rel, destPath)
+	}
+	conflict := step.Kind == StepConflict
+	drifted, err := m.drifted(step)
+	if err != nil {
+		return wrapErr(OpCompare, rel, err)
+	}
+	if drifted {
+		m.log(Action{Kind: ActionDrift, Src: srcPath, Dest: destPath})
+	}
+	var merged []byte
+	if conflict && m.Merge {
+		if merged, err = m.mergeStep(ctx, step); err != nil {
+			return wrapErr(OpMerge, rel, err)
+		}
+		if merged != nil {
+			if buf, err := os.ReadFile(destPath); err == nil && bytes.Equal(buf, merged) {
+				// Merged the last time, and nothing changed since.
+				m.log(Action{Kind: ActionOK, Src: srcPath, Dest: destPath})
+				return nil
+			}
+		}
+	}
+	if merged == nil {
+		if ok, err := m.checkConflict(step, conflict, drifted); !ok {
+			return err
+		}
+	}
+	if !m.DryRun {
+		// Only touch the destination once the new version is safely written.
+		step.merged = merged
+		tmp, err := m.stage(ctx, step)
+		if err != nil {
+			return wrapErr(OpCopy, rel, fmt.Errorf("%w; %s left unchanged", err, destPath))
+		}
+		var cleared uint32
+		if m.ClearFlags {
+			if cleared, err = clearImmutable(destPath); err != nil {
+				m.removeDest(tmp)
+				return wrapErr(OpBackup, rel, err)
+			}
+		}
+		// Without a backup, the new version simply takes the place of the old one. A
+		// merged one keeps the backup it was merged from.
+		if !m.NoBackup && merged == nil {
+			if err = m.makeBackup(rel, destPath, backupPath); err != nil {
+				m.removeDest(tmp)
+				if cleared != 0 {
+					addFileFlags(destPath, cleared)
+				}
+				err = explainImmutable(destPath, err)
+				return wrapErr(OpBackup, rel, fmt.Errorf("%w; %s left unchanged", err, destPath))
+			}
+		}
+		if err = m.install(step, tmp); err != nil {
+			err = explainImmutable(destPath, err)
+			if m.NoBackup || merged != nil {
+				if cleared != 0 {
+					addFileFlags(destPath, cleared)
+				}
+				err = fmt.Errorf("%w; %s left unchanged", err, destPath)
+			} else if restoreErr := m.restoreBackup(destPath, backupPath); restoreErr != nil {
+				err = fmt.Errorf("%w; %s is missing, its previous version is in %s (restoring failed: %v)",
+					err, destPath, backupPath, restoreErr)
+			} else {
+				if cleared != 0 {
+					addFileFlags(destPath, cleared)
+				}
+				err = fmt.Errorf("%w; %s restored from %s", err, destPath, backupPath)
+			}
+			return wrapErr(OpCopy, rel, err)
+		}
+		if cleared != 0 {
+			if err = addFileFlags(destPath, cleared); err != nil {
+				return wrapErr(OpCopy, rel, err)
+			}
+		}
+		if err = m.remember(step); err != nil {
+			return wrapErr(OpCopy, rel, err)
+		}
+		if merged != nil {
+			// Any conflicts from before are resolved.
+			m.removeDest(destPath + ConflictSuffix)
+		}
+	}
+	if merged != nil {
+		m.log(Action{Kind: ActionMerged, Src: srcPath, Dest: destPath, Backup: backupPath})
+		return nil
+	} else if m.NoBackup {
+		backupPath = ""
+	} else if conflict && (m.isForced(rel) || !m.DryRun) {
+		// The previous contents of the backup are gone for good.
+		m.log(Action{Kind: ActionForceMove, Dest: destPath, Backup: backupPath})
+	} else {
+		m.log(Action{Kind: ActionMove, Dest: destPath, Backup: backupPath})
+	}
+	a := m.createAction(step)
+	a.Backup, a.DiffInfo = backupPath, diffInfo
+	m.log(a)
+	return nil
+}
+
+// leftoverBackup returns true if step, a StepCopy, has a backup left behind by a
+// destination that's gone, which differs from the source.
+func (m *Merger) leftoverBackup(step *Step) bool {
+	if step.Backup == "" {
+		return false
+	}
+	same, err := m.srcMatches(step.Path, step.Backup)
+	return err != nil || !same
+}
+
+// cleanBackup removes the backup of step, which is identical to the destination (or, in
+// a dry run, would be once step is taken).
+func (m *Merger) cleanBackup(step *Step) error {
+	if !m.DryRun {
+		// Only what's known to be identical now, to the byte, is worth nothing.
+		same, err := fileContentsAreIdentical(step.Dest, step.Backup)
+		if err != nil || !same {
+			return wrapErr(OpBackup, step.Path, err)
+		}
+		if err := m.removeDest(step.Backup); err != nil {
+			return wrapErr(OpBackup, step.Path, err)
+		}
+	}
+	m.log(Action{Kind: ActionClean, Dest: step.Dest, Backup: step.Backup})
+	return nil
+}
+
+// checkConflict calls resolveConflict for step, if the backup differs (conflict), or
+// if the destination drifted and that's not to be overwritten without asking.
+func (m *Merger) checkConflict(step *Step, conflict, drifted bool) (bool, error) {
+	if conflict {
+		return m.resolveConflict(step, OpBackup, fmt.Sprintf("refusing to overwrite backup: %s", step.Backup))
+	} else if drifted && m.StrictDrift {
+		return m.resolveConflict(step, OpCopy, fmt.Sprintf("refusing to overwrite changed file: %s", step.Dest))
+	}
+	return true, nil
+}
+
+// resolveConflict decides whether to go ahead with step, although its backup differs
+// from the destination (or the destination drifted): only if forced, or if Resolve says
+// so. Otherwise, the refusal is logged, and returned as an error from op. It returns
+// false if the destination is to be left alone.
+func (m *Merger) resolveConflict(step *Step, op, refusal string) (bool, error) {
+	forced := m.isForced(step.Path)
+	if m.Resolve != nil && !m.DryRun && !forced {
+		m.resolveMu.Lock()
+		resolution, err := m.Resolve(step.Src, step.Dest, step.Backup)
+		m.resolveMu.Unlock()
+		if err != nil {
+			return false, err
+		}
+		if resolution == ResolveSkip {
+			m.log(Action{Kind: ActionSkip, Src: step.Src, Dest: step.Dest, Backup: step.Backup})
+			return false, nil
+		}
+	} else if !forced && !m.DryRun {
+		m.log(Action{
+			Kind:   ActionError,
+			Src:    step.Src,
+			Dest:   step.Dest,
+			Backup: step.Backup,
+			Error:  refusal,
+		})
+		return false, wrapErr(op, step.Path, ErrRefuse)
+	}
+	return true, nil
+}
+
+// createAction returns the action that reports create.
+func (m *Merger) createAction(step *Step) Action {
+	if step.Target != "" {
+		return Action{Kind: ActionSymlink, Src: step.Src, Dest: step.Dest, Target: step.Target}
+	}
+	return Action{Kind: ActionCopy, Src: step.Src, Dest: step.Dest, Hash: step.installed}
+}
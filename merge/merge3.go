@@ -0,0 +1,255 @@
+package merge
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// ConflictSuffix is appended to the name of a file that couldn't be merged cleanly, to
+// name the file its conflicting changes are written to, with conflict markers.
+const ConflictSuffix = ".upmerge-conflict"
+
+// hunk is a run of changed lines in a diff: the lines from start to end in the
+// original are replaced with lines.
+type hunk struct {
+	start, end int
+	lines      []string
+}
+
+// editHunks groups the edit script ops into hunks, by lines of the original.
+func editHunks(ops []diffOp) []hunk {
+	var hunks []hunk
+	i := 0
+	for k := 0; k < len(ops); {
+		if ops[k].kind == ' ' {
+			i++
+			k++
+			continue
+		}
+		h := hunk{start: i, end: i}
+		for ; k < len(ops) && ops[k].kind != ' '; k++ {
+			if ops[k].kind == '-' {
+				h.end++
+				i++
+			} else {
+				h.lines = append(h.lines, ops[k].line)
+			}
+		}
+		hunks = append(hunks, h)
+	}
+	return hunks
+}
+
+// applyHunks returns the lines of base from start to end, with hunks applied.
+func applyHunks(base []string, hunks []hunk, start, end int) []string {
+	var out []string
+	p := start
+	for _, h := range hunks {
+		out = append(out, base[p:h.start]...)
+		out = append(out, h.lines...)
+		p = h.end
+	}
+	return append(out, base[p:end]...)
+}
+
+// merge3 merges the changes made from base in ours and in theirs, as diff3 does.
+// Changes that collide are written between conflict markers, labelled with the names
+// given; conflicts is how many there are.
+func merge3(base, ours, theirs []string, baseName, oursName, theirsName string) (
+	out []string, conflicts int) {
+	a := editHunks(diffLines(base, ours))
+	b := editHunks(diffLines(base, theirs))
+	pos := 0
+	for len(a) > 0 || len(b) > 0 {
+		// Start with whichever hunk comes first, then take in every hunk (from either
+		// side) that overlaps or touches the ones taken so far.
+		var ga, gb []hunk
+		var first hunk
+		if len(b) == 0 || len(a) > 0 && a[0].start <= b[0].start {
+			first, a = a[0], a[1:]
+			ga = []hunk{first}
+		} else {
+			first, b = b[0], b[1:]
+			gb = []hunk{first}
+		}
+		start, end := first.start, first.end
+		for {
+			if len(a) > 0 && a[0].start <= end {
+				ga = append(ga, a[0])
+				if a[0].end > end {
+					end = a[0].end
+				}
+				a = a[1:]
+			} else if len(b) > 0 && b[0].start <= end {
+				gb = append(gb, b[0])
+				if b[0].end > end {
+					end = b[0].end
+				}
+				b = b[1:]
+			} else {
+				break
+			}
+		}
+		out = append(out, base[pos:start]...)
+		pos = end
+		x, y := applyHunks(base, ga, start, end), applyHunks(base, gb, start, end)
+		switch {
+		case len(gb) == 0:
+			out = append(out, x...)
+		case len(ga) == 0 || sameStrings(x, y):
+			out = append(out, y...)
+		default:
+			conflicts++
+			out = append(out, "<<<<<<< "+oursName+"\n")
+			out = appendTerminated(out, x)
+			out = append(out, "||||||| "+baseName+"\n")
+			out = appendTerminated(out, base[start:end])
+			out = append(out, "=======\n")
+			out = appendTerminated(out, y)
+			out = append(out, ">>>>>>> "+theirsName+"\n")
+		}
+	}
+	return append(out, base[pos:]...), conflicts
+}
+
+// appendTerminated appends lines to out, making sure the last one ends with a newline.
+func appendTerminated(out, lines []string) []string {
+	out = append(out, lines...)
+	if n := len(out); len(lines) > 0 && !strings.HasSuffix(out[n-1], "\n") {
+		out[n-1] += "\n"
+	}
+	return out
+}
+
+// mergeStep tries merging the changes made to the source of step since its backup was
+// made into the destination, which may have changed since too (such as by an OS
+// upgrade). With a clean merge, it returns the merged file, which is then installed
+// in place of the destination instead of the source; the source is left alone, and so
+// is the backup, as the base to merge from the next time. Otherwise, the conflicts are
+// written next to the destination (with ConflictSuffix), and it returns nil.
+func (m *Merger) mergeStep(ctx context.Context, step *Step) ([]byte, error) {
+	rel := step.Path
+	if m.SrcFS != nil || m.generated(rel) || step.Target != "" {
+		// There's no source file to merge.
+		return nil, nil
+	}
+	for _, path := range []string{step.Src, step.Dest, step.Backup} {
+		if st, err := os.Lstat(path); err != nil || !st.Mode().IsRegular() {
+			return nil, err
+		}
+	}
+	base, err := os.ReadFile(step.Backup)
+	if err != nil {
+		return nil, err
+	}
+	theirs, err := os.ReadFile(step.Dest)
+	if err != nil {
+		return nil, err
+	}
+	ours, err := m.readSrc(rel)
+	if err != nil {
+		return nil, err
+	}
+	if isBinary(base) || isBinary(ours) || isBinary(theirs) {
+		return nil, nil
+	}
+	lines, conflicts := merge3(splitLines(base), splitLines(ours), splitLines(theirs),
+		step.Backup, step.Src, step.Dest)
+	merged := []byte(strings.Join(lines, ""))
+	reason := fmt.Sprintf("%d conflicting changes", conflicts)
+	if conflicts > 0 && len(m.MergeTool) > 0 && !m.DryRun {
+		out, err := m.runMergeTool(ctx, step, merged)
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if err != nil {
+			reason += "; merge tool: " + err.Error()
+		} else {
+			merged, conflicts = out, 0
+		}
+	}
+	if conflicts > 0 {
+		conflictPath := step.Dest + ConflictSuffix
+		if !m.DryRun {
+			// Whatever an earlier run left there is replaced, rather than written
+			// through: a symlink is removed, not followed.
+			if err = m.removeDest(conflictPath); err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+			if err = m.writeNewDest(ctx, conflictPath, bytes.NewReader(merged), 0600); err != nil {
+				return nil, err
+			}
+		}
+		m.log(Action{
+			Kind:  ActionConflict,
+			Src:   step.Src,
+			Dest:  conflictPath,
+			Error: reason,
+		})
+		return nil, nil
+	}
+	return merged, nil
+}
+
+// writeMerged writes step.merged to destPath, which must not exist, with the mode and
+// owner of the source file.
+func (m *Merger) writeMerged(ctx context.Context, step *Step, destPath string) error {
+	st, err := fs.Stat(m.src(), srcName(step.Path))
+	if err == nil {
+		st, err = m.srcInfo(step.Path, st)
+	}
+	if err != nil {
+		return err
+	}
+	if err = m.writeNewDest(ctx, destPath, bytes.NewReader(step.merged), m.srcMode(st)); err != nil {
+		return err
+	}
+	return m.copySrcOwner(destPath, st)
+}
+
+// runMergeTool runs the MergeTool on the conflicting changes to step, and returns the
+// file it merged them into. merged, with conflict markers, is where it starts from.
+func (m *Merger) runMergeTool(ctx context.Context, step *Step, merged []byte) ([]byte, error) {
+	f, err := os.CreateTemp("", "upmerge-merge-*")
+	if err != nil {
+		return nil, err
+	}
+	outPath := f.Name()
+	defer os.Remove(outPath)
+	_, err = f.Write(merged)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	r := strings.NewReplacer("%base", step.Backup, "%mine", step.Src, "%theirs", step.Dest,
+		"%out", outPath)
+	args := make([]string, len(m.MergeTool))
+	for i, arg := range m.MergeTool {
+		args[i] = r.Replace(arg)
+	}
+	if m.MergeToolTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.MergeToolTimeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	// Keep standard output for the actions.
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stderr, os.Stderr
+	m.resolveMu.Lock()
+	err = cmd.Run()
+	m.resolveMu.Unlock()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return nil, fmt.Errorf("timed out after %s", m.MergeToolTimeout)
+	} else if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(outPath)
+}
@@ -0,0 +1,148 @@
+package merge
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMerge3(t *testing.T) {
+	tests := []struct {
+		name               string
+		base, ours, theirs string
+		want               string
+		conflicts          int
+	}{
+		{name: "unchanged", base: "a\nb\n", ours: "a\nb\n", theirs: "a\nb\n", want: "a\nb\n"},
+		{name: "ours", base: "a\nb\nc\n", ours: "A\nb\nc\n", theirs: "a\nb\nc\n", want: "A\nb\nc\n"},
+		{name: "theirs", base: "a\nb\nc\n", ours: "a\nb\nc\n", theirs: "a\nb\nC\n", want: "a\nb\nC\n"},
+		{name: "both", base: "a\nb\nc\n", ours: "A\nb\nc\n", theirs: "a\nb\nC\n", want: "A\nb\nC\n"},
+		{name: "same change", base: "a\nb\n", ours: "A\nb\n", theirs: "A\nb\n", want: "A\nb\n"},
+		{name: "added at either end", base: "b\n", ours: "a\nb\n", theirs: "b\nc\n", want: "a\nb\nc\n"},
+		{
+			name: "conflict", base: "a\nb\n", ours: "A\nb\n", theirs: "X\nb\n",
+			want:      "<<<<<<< ours\nA\n||||||| base\na\n=======\nX\n>>>>>>> theirs\nb\n",
+			conflicts: 1,
+		},
+		{
+			name: "conflict without a newline", base: "a", ours: "A", theirs: "X",
+			want:      "<<<<<<< ours\nA\n||||||| base\na\n=======\nX\n>>>>>>> theirs\n",
+			conflicts: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, conflicts := merge3(splitLines([]byte(tt.base)), splitLines([]byte(tt.ours)),
+				splitLines([]byte(tt.theirs)), "base", "ours", "theirs")
+			if got := strings.Join(out, ""); got != tt.want || conflicts != tt.conflicts {
+				t.Errorf("got %q with %d conflicts, want %q with %d", got, conflicts, tt.want, tt.conflicts)
+			}
+		})
+	}
+}
+
+func TestMergeStep(t *testing.T) {
+	const base = "a\nb\nc\n"
+	tests := []struct {
+		name           string
+		src, dest      string
+		dryRun         bool
+		want           tree
+		kind           string
+		refused        bool
+		conflictMarker bool
+	}{
+		{
+			name: "clean", src: "A\nb\nc\n", dest: "a\nb\nC\n",
+			want: tree{"f": "A\nb\nC\n", "f.upmerge~": base}, kind: ActionMerged,
+		},
+		{
+			name: "clean, dry run", src: "A\nb\nc\n", dest: "a\nb\nC\n", dryRun: true,
+			want: tree{"f": "a\nb\nC\n", "f.upmerge~": base}, kind: ActionMerged,
+		},
+		{
+			name: "already merged", src: "A\nb\nc\n", dest: "A\nb\nC\n",
+			want: tree{"f": "A\nb\nC\n", "f.upmerge~": base}, kind: ActionOK,
+		},
+		{
+			name: "conflict", src: "A\nb\nc\n", dest: "X\nb\nc\n",
+			want: tree{"f": "X\nb\nc\n", "f.upmerge~": base}, kind: ActionConflict,
+			refused: true, conflictMarker: true,
+		},
+		{
+			// Never merged as text, nor written out with conflict markers.
+			name: "binary", src: "A\x00b\nc\n", dest: "a\x00b\nC\n",
+			want: tree{"f": "a\x00b\nC\n", "f.upmerge~": base}, refused: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, rec := newTestMerger(t, tree{"f": tt.src}, tree{"f": tt.dest, "f.upmerge~": base})
+			m.Merge, m.DryRun = true, tt.dryRun
+			_, err := m.Run(context.Background())
+			if refused := errors.Is(err, ErrRefuse); refused != tt.refused || err != nil && !refused {
+				t.Fatalf("run: %v, want refused: %v", err, tt.refused)
+			}
+			if c, ok := readTree(t, m.DestDir)["f"+ConflictSuffix]; ok != tt.conflictMarker {
+				t.Errorf("conflict file: %v, want %v", ok, tt.conflictMarker)
+			} else if ok && !strings.Contains(c, "<<<<<<< ") {
+				t.Errorf("conflict file without markers: %q", c)
+			}
+			want := tree{}
+			for name, contents := range tt.want {
+				want[name] = contents
+			}
+			if tt.conflictMarker {
+				want["f"+ConflictSuffix] = readTree(t, m.DestDir)["f"+ConflictSuffix]
+			}
+			checkTree(t, m.DestDir, want)
+			// The source is never touched.
+			checkTree(t, m.SrcDir, tree{"f": tt.src})
+			found := tt.kind == ""
+			for _, a := range rec.Actions {
+				found = found || a.Kind == tt.kind
+			}
+			if !found {
+				t.Errorf("no %s in %q", tt.kind, kinds(rec.Actions))
+			}
+		})
+	}
+}
+
+func TestMergeStepAgain(t *testing.T) {
+	// Once merged, running again changes nothing, until either side changes.
+	const base = "a\nb\nc\nd\ne\n"
+	m, rec := newTestMerger(t, tree{"f": "A\nb\nc\nd\ne\n"}, tree{"f": "a\nb\nc\nd\nE\n", "f.upmerge~": base})
+	m.Merge = true
+	run(t, m)
+	rec.Actions = nil
+	run(t, m)
+	if got := kinds(rec.Actions); len(got) != 1 || got[0] != ActionOK+" f" {
+		t.Errorf("second run: %q, want only ok f", got)
+	}
+	writeTree(t, m.SrcDir, tree{"f": "A\nb\nC\nd\ne\n"})
+	run(t, m)
+	checkTree(t, m.DestDir, tree{"f": "A\nb\nC\nd\nE\n", "f.upmerge~": base})
+}
+
+func TestMergeConflictSymlink(t *testing.T) {
+	const base = "a\nb\n"
+	m, _ := newTestMerger(t, tree{"f": "A\nb\n"}, tree{"f": "X\nb\n", "f.upmerge~": base})
+	m.Merge = true
+	// Planted where the conflicts are written, leading out of the destination.
+	outside := filepath.Join(filepath.Dir(m.DestDir), "outside")
+	writeTree(t, outside, tree{"f": "outside"})
+	if err := os.Symlink(filepath.Join(outside, "f"), filepath.Join(m.DestDir, "f"+ConflictSuffix)); err != nil {
+		t.Skip(err)
+	}
+	if _, err := m.Run(context.Background()); !errors.Is(err, ErrRefuse) {
+		t.Fatalf("run: %v, want refused", err)
+	}
+	checkTree(t, outside, tree{"f": "outside"})
+	if c := readTree(t, m.DestDir)["f"+ConflictSuffix]; !strings.Contains(c, "<<<<<<< ") {
+		t.Errorf("conflict file: got %q, want it written in place of the symlink", c)
+	}
+}
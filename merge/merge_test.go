@@ -0,0 +1,55 @@
+package merge
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDryRun(t *testing.T) {
+	src := tree{
+		"top":      "top\n",
+		"a/":       "",
+		"a/file":   "file\n",
+		"a/b/":     "",
+		"a/b/deep": "deep\n",
+		"same":     "same\n",
+		"changed":  "new\n",
+	}
+	dest := tree{
+		"same":    "same\n",
+		"changed": "old\n",
+	}
+	m, rec := newTestMerger(t, src, dest)
+	m.DryRun = true
+	run(t, m)
+	checkTree(t, m.DestDir, dest)
+	want := []string{
+		"mkdir a",
+		"mkdir a/b",
+		"copy a/b/deep",
+		"copy a/file",
+		"move changed",
+		"copy changed",
+		"ok same",
+		"copy top",
+	}
+	if got := kinds(rec.Actions); !reflect.DeepEqual(got, want) {
+		t.Errorf("got actions %q, want %q", got, want)
+	}
+	for _, a := range rec.Actions {
+		if !a.DryRun {
+			t.Errorf("%s %s: not marked as a dry run", a.Kind, a.DestRel)
+		}
+	}
+}
+
+func TestDryRunMissingDest(t *testing.T) {
+	m, _ := newTestMerger(t, tree{"a/": "", "a/file": "file\n"}, nil)
+	m.DestDir += "/new"
+	m.CreateDest = true
+	m.DryRun = true
+	run(t, m)
+	if fileExists(m.DestDir) {
+		t.Errorf("%s was created", m.DestDir)
+	}
+}
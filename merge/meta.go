@@ -0,0 +1,264 @@
+package merge
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"os/user"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// MetaFile is the name of the file at the root of the source that gives the owner,
+// group, mode and flags of files in place of their own, for sources (such as git
+// checkouts) that can't carry them. It's never copied over itself.
+//
+// Each line names a path relative to the source root, followed by any of owner=,
+// group=, mode= and flags= (as for chflags, or "none"), separated by blanks:
+//
+//	sudoers.d/admins owner=root group=wheel mode=0440
+//
+// A path with blanks in it is quoted, as in Go. Blank lines and lines starting with
+// "#" are left out.
+const MetaFile = ".upmergemeta"
+
+// fileMeta is what MetaFile gives for a single path.
+type fileMeta struct {
+	line             int
+	mode             fs.FileMode
+	uid, gid         int
+	flags            uint32
+	hasMode, hasUID  bool
+	hasGID, hasFlags bool
+	// err is set if the owner or group doesn't exist, and fails the file.
+	err error
+}
+
+// loadMeta reads MetaFile from the source, if there's one. A line that can't be made
+// sense of is an error; keys that aren't known are returned as warnings, and left out.
+func (m *Merger) loadMeta() ([]string, error) {
+	m.meta = nil
+	f, err := m.src().Open(MetaFile)
+	if err != nil {
+		return nil, nil
+	}
+	defer f.Close()
+	m.meta = make(map[string]*fileMeta)
+	var warnings []string
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, rest, err := cutMetaPath(line)
+		if err != nil {
+			return warnings, fmt.Errorf("%s:%d: %w", MetaFile, n, err)
+		}
+		name = path.Clean(strings.TrimPrefix(name, "/"))
+		if name == "." || name == ".." || strings.HasPrefix(name, "../") {
+			return warnings, fmt.Errorf("%s:%d: path outside the source: %s", MetaFile, n, name)
+		}
+		if m.meta[name] != nil {
+			return warnings, fmt.Errorf("%s:%d: %s was already given on line %d", MetaFile, n, name,
+				m.meta[name].line)
+		}
+		fm := &fileMeta{line: n}
+		for _, field := range strings.Fields(rest) {
+			key, value, ok := strings.Cut(field, "=")
+			if !ok {
+				return warnings, fmt.Errorf("%s:%d: expected key=value: %s", MetaFile, n, field)
+			}
+			if err := fm.set(key, value); err == errUnknownKey {
+				warnings = append(warnings, fmt.Sprintf("%s:%d: unknown key %q", MetaFile, n, key))
+			} else if err != nil {
+				return warnings, fmt.Errorf("%s:%d: %s: %w", MetaFile, n, key, err)
+			}
+		}
+		m.meta[name] = fm
+	}
+	if err := scanner.Err(); err != nil {
+		return warnings, fmt.Errorf("%s: %w", MetaFile, err)
+	}
+	return warnings, nil
+}
+
+// errUnknownKey is returned by fileMeta.set for a key it doesn't know.
+var errUnknownKey = fmt.Errorf("unknown key")
+
+// cutMetaPath splits a line of MetaFile into its path, unquoted, and the rest.
+func cutMetaPath(line string) (string, string, error) {
+	if strings.HasPrefix(line, `"`) {
+		quoted, err := strconv.QuotedPrefix(line)
+		if err != nil {
+			return "", "", fmt.Errorf("bad quoted path: %s", line)
+		}
+		name, _ := strconv.Unquote(quoted)
+		return name, line[len(quoted):], nil
+	}
+	i := strings.IndexAny(line, " \t")
+	if i < 0 {
+		return line, "", nil
+	}
+	return line[:i], line[i:], nil
+}
+
+// set sets key to value. A user or group that doesn't exist isn't an error here, but
+// fails the file it's given for, once it's merged.
+func (fm *fileMeta) set(key, value string) error {
+	switch key {
+	case "mode":
+		bits, err := strconv.ParseUint(value, 8, 32)
+		if err != nil || bits > 07777 {
+			return fmt.Errorf("bad mode: %s", value)
+		}
+		fm.mode = fs.FileMode(bits) & fs.ModePerm
+		for bit, mode := range map[uint64]fs.FileMode{04000: fs.ModeSetuid, 02000: fs.ModeSetgid, 01000: fs.ModeSticky} {
+			if bits&bit != 0 {
+				fm.mode |= mode
+			}
+		}
+		fm.hasMode = true
+	case "owner":
+		id, err := lookupID(value, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+		if err != nil && fm.err == nil {
+			fm.err = fmt.Errorf("no such user: %s", value)
+		}
+		fm.uid, fm.hasUID = id, true
+	case "group":
+		id, err := lookupID(value, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil && fm.err == nil {
+			fm.err = fmt.Errorf("no such group: %s", value)
+		}
+		fm.gid, fm.hasGID = id, true
+	case "flags":
+		flags, err := parseFlags(value)
+		if err != nil {
+			return err
+		}
+		fm.flags, fm.hasFlags = flags, true
+	default:
+		return errUnknownKey
+	}
+	return nil
+}
+
+// lookupID returns the number value stands for: itself, or the ID of the user or
+// group it names, as found by lookup.
+func lookupID(value string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(value); err == nil && id >= 0 {
+		return id, nil
+	}
+	id, err := lookup(value)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(id)
+}
+
+// parseFlags parses a comma-separated list of flags, named as by flagNames, or "none".
+func parseFlags(value string) (uint32, error) {
+	if value == "none" {
+		return 0, nil
+	}
+	var flags uint32
+	for _, name := range strings.Split(value, ",") {
+		flag, ok := flagsByName[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown flag: %s", name)
+		}
+		flags |= flag
+	}
+	return flags, nil
+}
+
+// metaEntry is a source entry with attributes from MetaFile.
+type metaEntry struct {
+	fs.DirEntry
+	meta *fileMeta
+}
+
+func (d metaEntry) Info() (fs.FileInfo, error) {
+	st, err := d.DirEntry.Info()
+	if err != nil {
+		return nil, err
+	}
+	if d.meta.err != nil {
+		return nil, d.meta.err
+	}
+	return metaInfo{st, d.meta}, nil
+}
+
+// metaInfo describes a source file with attributes from MetaFile.
+type metaInfo struct {
+	fs.FileInfo
+	meta *fileMeta
+}
+
+func (st metaInfo) Mode() fs.FileMode {
+	if !st.meta.hasMode {
+		return st.FileInfo.Mode()
+	}
+	return st.FileInfo.Mode().Type() | st.meta.mode
+}
+
+// withMeta returns the source entry d at rel with its attributes from MetaFile, if
+// there are any.
+func (m *Merger) withMeta(rel string, d fs.DirEntry) fs.DirEntry {
+	if fm := m.meta[srcName(rel)]; fm != nil && d != nil {
+		return metaEntry{d, fm}
+	}
+	return d
+}
+
+// srcInfo returns st, describing the source file at rel, with its attributes from
+// MetaFile, if there are any.
+func (m *Merger) srcInfo(rel string, st fs.FileInfo) (fs.FileInfo, error) {
+	fm := m.meta[srcName(rel)]
+	if fm == nil {
+		return st, nil
+	} else if fm.err != nil {
+		return nil, fm.err
+	}
+	return metaInfo{st, fm}, nil
+}
+
+// fileOwner returns the owner and group of the file described by st, if known.
+func fileOwner(st fs.FileInfo) (uid, gid int, ok bool) {
+	mi, isMeta := st.(metaInfo)
+	if !isMeta {
+		return sysOwner(st)
+	}
+	uid, gid, ok = sysOwner(mi.FileInfo)
+	if mi.meta.hasUID {
+		uid = mi.meta.uid
+	}
+	if mi.meta.hasGID {
+		gid = mi.meta.gid
+	}
+	return uid, gid, ok || mi.meta.hasUID && mi.meta.hasGID
+}
+
+// fileFlags returns the file flags of the file described by st.
+func fileFlags(st fs.FileInfo) uint32 {
+	if mi, ok := st.(metaInfo); ok {
+		if mi.meta.hasFlags {
+			return mi.meta.flags
+		}
+		return sysFlags(mi.FileInfo)
+	}
+	return sysFlags(st)
+}
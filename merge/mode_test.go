@@ -0,0 +1,63 @@
+//go:build unix
+
+package merge
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestModesUnderUmask(t *testing.T) {
+	old := syscall.Umask(077)
+	defer syscall.Umask(old)
+
+	modes := map[string]fs.FileMode{
+		"public":        0644,
+		"exec":          0755,
+		"private":       0600,
+		"setuid":        0755 | fs.ModeSetuid,
+		"setgid dir":    0775 | fs.ModeDir | fs.ModeSetgid,
+		"sticky dir":    0777 | fs.ModeDir | fs.ModeSticky,
+		"dir":           0755 | fs.ModeDir,
+		"dir/inside":    0644,
+		"replaced":      0644,
+		"existing dir":  0755 | fs.ModeDir,
+		"existing file": 0644,
+	}
+	m, _ := newTestMerger(t, nil, nil)
+	for _, dir := range []string{m.SrcDir, m.DestDir} {
+		if err := os.Chmod(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTree(t, m.DestDir, tree{"replaced": "old", "existing dir/": ""})
+	// The destination's directory lost its permissions to a tight umask.
+	if err := os.Chmod(filepath.Join(m.DestDir, "existing dir"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"setgid dir", "sticky dir", "dir", "existing dir"} {
+		writeTree(t, m.SrcDir, tree{name + "/": ""})
+	}
+	for name, mode := range modes {
+		path := filepath.Join(m.SrcDir, name)
+		if !mode.IsDir() {
+			writeTree(t, m.SrcDir, tree{name: name})
+		}
+		if err := os.Chmod(path, mode&modeBits); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run(t, m)
+	for name, want := range modes {
+		st, err := os.Lstat(filepath.Join(m.DestDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := st.Mode() & (fs.ModeDir | modeBits); got != want {
+			t.Errorf("%s: mode %v, want %v", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package merge
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
+// Formats written by Merger.Mtree.
+const (
+	MtreeSpec = "mtree" // a specification for mtree(8), with full paths
+	MtreeBOM  = "bom"   // a listing in the format of lsbom(8), for mkbom -i
+)
+
+// mtreeEntry describes a file as it should be in the destination.
+type mtreeEntry struct {
+	rel  string
+	mode fs.FileMode
+	// uid and gid are left out unless hasOwner.
+	uid, gid int
+	hasOwner bool
+	flags    uint32
+	// size, sum and cksum are of the contents of a file, or the target of a link.
+	size   int64
+	sum    string
+	cksum  uint32
+	target string
+}
+
+// Mtree writes a listing of everything merged from the source to w, in format (MtreeSpec
+// or MtreeBOM), as it should be in the destination: templates are rendered, and the
+// modes, owners and flags are those given by MetaFile. The same source always makes the
+// same listing; entries are sorted, and times are left out.
+func (m *Merger) Mtree(ctx context.Context, w io.Writer, format string) error {
+	if format != MtreeSpec && format != MtreeBOM {
+		return fmt.Errorf("unknown format %q", format)
+	}
+	if err := m.Validate(); err != nil {
+		return err
+	}
+	if err := m.loadLayers(); err != nil {
+		return err
+	}
+	if err := m.loadTemplates(); err != nil {
+		return err
+	}
+	m.loadAppends()
+	m.loadOverlays()
+	if err := m.loadIgnore(); err != nil {
+		return err
+	}
+	if _, err := m.loadMeta(); err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	if format == MtreeSpec {
+		fmt.Fprintf(bw, "#mtree\n")
+	}
+	err := m.walkSrc(func(rel string, d fs.DirEntry, walkErr error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if walkErr != nil {
+			return wrapErr(OpWalk, rel, walkErr)
+		}
+		if skip, err := m.skipExcluded(rel, d); skip {
+			return err
+		}
+		if _, ok := removeTarget(rel); ok || !d.IsDir() && m.isIgnored(rel) {
+			// What's removed can't be listed.
+			return nil
+		}
+		e, err := m.mtreeEntry(rel, d)
+		if err != nil || e == nil {
+			return err
+		}
+		if format == MtreeSpec {
+			writeMtree(bw, e)
+		} else {
+			writeBOM(bw, e)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// mtreeEntry describes the source entry at rel (described by d) as it should be in the
+// destination, or returns nil if it's not merged.
+func (m *Merger) mtreeEntry(rel string, d fs.DirEntry) (*mtreeEntry, error) {
+	target, err := m.srcLink(rel)
+	if err != nil {
+		return nil, wrapErr(OpWalk, rel, err)
+	}
+	var st fs.FileInfo
+	if target != "" {
+		st, err = d.Info()
+	} else {
+		// Copying what the symlink points to, if it's one.
+		st, err = fs.Stat(m.src(), srcName(rel))
+		if err == nil {
+			st, err = m.srcInfo(rel, st)
+		}
+	}
+	if err != nil {
+		return nil, wrapErr(OpWalk, rel, err)
+	}
+	if st.Mode()&specialModes != 0 {
+		m.log(Action{Kind: ActionSkip, Src: m.srcPath(rel), Error: specialName(st.Mode())})
+		return nil, nil
+	}
+	e := &mtreeEntry{rel: rel, mode: st.Mode().Type() | m.srcMode(st), target: target}
+	if !m.NoOwner {
+		e.uid, e.gid, e.hasOwner = fileOwner(st)
+	}
+	e.flags = fileFlags(st) & copiedFlags
+	switch {
+	case target != "":
+		e.mode = fs.ModeSymlink | 0755
+		e.size, e.sum, e.cksum, _ = mtreeSums(strings.NewReader(target))
+	case !st.IsDir():
+		f, err := m.src().Open(srcName(rel))
+		if err != nil {
+			return nil, wrapErr(OpCopy, rel, err)
+		}
+		defer f.Close()
+		if e.size, e.sum, e.cksum, err = mtreeSums(f); err != nil {
+			return nil, wrapErr(OpCopy, rel, err)
+		}
+	}
+	return e, nil
+}
+
+// mtreeSums returns the size, SHA-256 and POSIX cksum of what's read from r.
+func mtreeSums(r io.Reader) (int64, string, uint32, error) {
+	h := sha256.New()
+	c := &posixCksum{}
+	n, err := io.Copy(io.MultiWriter(h, c), r)
+	return n, hex.EncodeToString(h.Sum(nil)), c.sum(), err
+}
+
+// writeMtree writes e to w as a line of an mtree(8) specification.
+func writeMtree(w io.Writer, e *mtreeEntry) {
+	fmt.Fprintf(w, "%s", mtreeName(e.rel))
+	switch {
+	case e.mode&fs.ModeSymlink != 0:
+		fmt.Fprintf(w, " type=link link=%s", mtreeEscape(e.target))
+	case e.mode.IsDir():
+		fmt.Fprintf(w, " type=dir mode=%#o", unixMode(e.mode)&07777)
+	default:
+		fmt.Fprintf(w, " type=file mode=%#o", unixMode(e.mode)&07777)
+	}
+	if e.hasOwner {
+		fmt.Fprintf(w, " uid=%d gid=%d", e.uid, e.gid)
+	}
+	if e.flags != 0 {
+		fmt.Fprintf(w, " flags=%s", flagNames(e.flags))
+	}
+	if e.mode.IsRegular() {
+		fmt.Fprintf(w, " size=%d sha256digest=%s", e.size, e.sum)
+	}
+	fmt.Fprintf(w, "\n")
+}
+
+// writeBOM writes e to w as a line of lsbom(8)'s listing: the path, mode, owner, and
+// for files and links, the size and cksum, followed by a link's target.
+func writeBOM(w io.Writer, e *mtreeEntry) {
+	uid, gid := e.uid, e.gid
+	if !e.hasOwner {
+		uid, gid = 0, 0
+	}
+	fmt.Fprintf(w, "%s\t%o\t%d/%d", bomName(e.rel), unixMode(e.mode), uid, gid)
+	if !e.mode.IsDir() {
+		fmt.Fprintf(w, "\t%d\t%d", e.size, e.cksum)
+	}
+	if e.target != "" {
+		fmt.Fprintf(w, "\t%s", e.target)
+	}
+	fmt.Fprintf(w, "\n")
+}
+
+// bomName returns the name of the entry at rel, as given in a BOM.
+func bomName(rel string) string {
+	if rel == "." {
+		return "."
+	}
+	return "./" + filepath.ToSlash(rel)
+}
+
+// mtreeName returns the name of the entry at rel, as given in an mtree specification.
+func mtreeName(rel string) string {
+	return mtreeEscape(bomName(rel))
+}
+
+// mtreeEscape encodes s the way mtree does (as by strsvis(3) with VIS_OCTAL, VIS_WHITE
+// and VIS_GLOB): blanks, what's not printable, and what would be taken for a pattern or
+// comment, are given as \ and three octal digits.
+func mtreeEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte(`\#*?[`, c) >= 0 {
+			fmt.Fprintf(&b, `\%03o`, c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// unixMode returns mode as given in a stat(2) st_mode: the type, and the permissions
+// and setuid, setgid and sticky bits.
+func unixMode(mode fs.FileMode) uint32 {
+	bits := uint32(mode.Perm())
+	for bit, unixBit := range map[fs.FileMode]uint32{fs.ModeSetuid: 04000, fs.ModeSetgid: 02000, fs.ModeSticky: 01000} {
+		if mode&bit != 0 {
+			bits |= unixBit
+		}
+	}
+	switch {
+	case mode&fs.ModeSymlink != 0:
+		bits |= 0120000
+	case mode.IsDir():
+		bits |= 0040000
+	default:
+		bits |= 0100000
+	}
+	return bits
+}
+
+// posixCksum computes the checksum of cksum(1), as recorded in a BOM.
+type posixCksum struct {
+	crc uint32
+	n   uint64
+}
+
+// cksumTable is the table for the CRC of posixCksum, which is CRC-32 with the bits in
+// the other order to hash/crc32's.
+var cksumTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+func (c *posixCksum) Write(p []byte) (int, error) {
+	for _, b := range p {
+		c.crc = c.crc<<8 ^ cksumTable[byte(c.crc>>24)^b]
+	}
+	c.n += uint64(len(p))
+	return len(p), nil
+}
+
+// sum returns the checksum of what's been written, followed by its length.
+func (c *posixCksum) sum() uint32 {
+	crc := c.crc
+	for n := c.n; n != 0; n >>= 8 {
+		crc = crc<<8 ^ cksumTable[byte(crc>>24)^byte(n)]
+	}
+	return ^crc
+}
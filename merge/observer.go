@@ -0,0 +1,107 @@
+package merge
+
+import (
+	"log"
+	"strings"
+)
+
+// Observer is told about everything a Merger does, as it happens.
+type Observer interface {
+	// OnAction is called for every action taken (or, in a dry run, that would be
+	// taken), including ActionError for refusals.
+	OnAction(a Action)
+	// OnError is called for every error about a file (at path, relative to the
+	// roots), whether or not it stops the run.
+	OnError(path string, err error)
+}
+
+// LogObserver prints actions one per line, the way the upmerge command does: error
+// actions (and warnings, such as drift) go to Error, diffs to Diff, and the rest to
+// Info (only the changes, with ChangedOnly). A nil logger discards its share of the
+// output. With Color, the kind of each action is colored with ANSI escapes; the text
+// is the same. With Relative, paths are printed relative to their roots.
+type LogObserver struct {
+	Info        *log.Logger
+	Error       *log.Logger
+	Diff        *log.Logger
+	ChangedOnly bool
+	Color       bool
+	Relative    bool
+}
+
+func (o LogObserver) OnAction(a Action) {
+	l := o.Info
+	switch a.Kind {
+	case ActionError, ActionRefuse, ActionWarning, ActionDrift, ActionConflict,
+		ActionInvalid, ActionProtected, ActionSnapshot:
+		l = o.Error
+	case ActionDiff:
+		l = o.Diff
+	default:
+		if o.ChangedOnly && !a.IsChange() {
+			return
+		}
+	}
+	if l == nil {
+		return
+	}
+	if o.Relative {
+		a = a.Relative()
+	}
+	line := a.String()
+	if o.Color {
+		line = colorize(a.Kind, line)
+	}
+	l.Println(line)
+}
+
+// ANSI escapes for the colors of actions.
+const (
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+	colorRed    = "\x1b[31m"
+	colorDim    = "\x1b[2m"
+	colorReset  = "\x1b[0m"
+)
+
+// colorize colors the keyword at the start of line, the action of the given kind:
+// green for what's created, yellow for what's worth a look, red for failures, and dim
+// for what's left alone.
+func colorize(kind, line string) string {
+	color := ""
+	switch kind {
+	case ActionMkdir, ActionChmod, ActionCopy, ActionSymlink, ActionMknod, ActionMerged,
+		ActionAdopt, ActionRevert, ActionHook:
+		color = colorGreen
+	case ActionCheck, ActionMove, ActionForceMove, ActionRemove, ActionPrune, ActionClean, ActionSkip, ActionCycle,
+		ActionRetry, ActionProtected, ActionSnapshot, ActionWarning, ActionDrift:
+		color = colorYellow
+	case ActionError, ActionRefuse, ActionConflict, ActionTypeConflict, ActionInvalid:
+		color = colorRed
+	case ActionOK, ActionIgnore, ActionSkipOnce:
+		color = colorDim
+	}
+	keyword, rest, found := strings.Cut(line, ":")
+	if color == "" || !found {
+		return line
+	}
+	return color + keyword + ":" + colorReset + rest
+}
+
+// OnError does nothing: the same errors are returned from the run, and upmerge only
+// reports them once it's over.
+func (o LogObserver) OnError(path string, err error) {}
+
+// Recorder is an Observer that keeps everything it's told, in order.
+type Recorder struct {
+	Actions []Action
+	Errors  []error
+}
+
+func (r *Recorder) OnAction(a Action) {
+	r.Actions = append(r.Actions, a)
+}
+
+func (r *Recorder) OnError(path string, err error) {
+	r.Errors = append(r.Errors, err)
+}
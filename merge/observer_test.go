@@ -0,0 +1,104 @@
+package merge
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRecorder(t *testing.T) {
+	tests := []struct {
+		name      string
+		src, dest tree
+		want      []string
+	}{
+		{
+			name: "empty destination",
+			src:  tree{"a": "a", "d/": "", "d/b": "b"},
+			want: []string{"copy a", "mkdir d", "copy d/b"},
+		},
+		{
+			name: "up to date",
+			src:  tree{"a": "a", "d/": "", "d/b": "b"},
+			dest: tree{"a": "a", "d/": "", "d/b": "b"},
+			want: []string{"ok a", "ok d/b"},
+		},
+		{
+			name: "replaced",
+			src:  tree{"a": "new"},
+			dest: tree{"a": "old"},
+			want: []string{"move a", "copy a"},
+		},
+		{
+			name: "backup differs from what's there",
+			src:  tree{"a": "new"},
+			dest: tree{"a": "new", "a.upmerge~": "old"},
+			want: []string{"ok a", "check a"},
+		},
+		{
+			name: "editor backups",
+			src:  tree{"a": "a", "a~": "old", "b.upmerge~": "old"},
+			want: []string{"copy a", "ignore a~", "ignore b.upmerge~"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, rec := newTestMerger(t, tt.src, tt.dest)
+			actions := run(t, m)
+			if got := kinds(rec.Actions); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got actions %q, want %q", got, tt.want)
+			}
+			if !reflect.DeepEqual(actions, rec.Actions) {
+				t.Errorf("Run returned %q, the Observer got %q", kinds(actions), kinds(rec.Actions))
+			}
+		})
+	}
+}
+
+func TestRecorderErrors(t *testing.T) {
+	m, rec := newTestMerger(t, tree{"a": "new", "b": "new"}, tree{"a": "old", "a.upmerge~": "older"})
+	m.KeepGoing = true
+	if _, err := m.Run(context.Background()); err == nil {
+		t.Fatal("a differing backup wasn't refused")
+	}
+	if want := []string{"error a", "copy b"}; !reflect.DeepEqual(kinds(rec.Actions), want) {
+		t.Errorf("got actions %q, want %q", kinds(rec.Actions), want)
+	}
+	if len(rec.Errors) != 1 {
+		t.Errorf("got errors %q, want one", rec.Errors)
+	}
+}
+
+func TestLogObserver(t *testing.T) {
+	m, _ := newTestMerger(t, tree{"a": "new", "b": "b", "c": "c"}, tree{"a": "old", "b": "b", "b.upmerge~": "old"})
+	var info, errs bytes.Buffer
+	m.Observer = LogObserver{Info: log.New(&info, "", 0), Error: log.New(&errs, "", 0)}
+	run(t, m)
+	src, dest := m.SrcDir, m.DestDir
+	want := strings.Join([]string{
+		"MOVE:\t" + filepath.Join(dest, "a.upmerge~") + " <- " + filepath.Join(dest, "a"),
+		"COPY:\t" + filepath.Join(dest, "a") + " <- " + filepath.Join(src, "a"),
+		"OK:\t" + filepath.Join(dest, "b") + " <- " + filepath.Join(src, "b"),
+		"CHECK:\t" + filepath.Join(dest, "b.upmerge~"),
+		"COPY:\t" + filepath.Join(dest, "c") + " <- " + filepath.Join(src, "c"),
+	}, "\n") + "\n"
+	if info.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", info.String(), want)
+	}
+	if errs.Len() != 0 {
+		t.Errorf("got errors:\n%s", errs.String())
+	}
+
+	// Only what changed, relative to the roots.
+	m, _ = newTestMerger(t, tree{"a": "new", "b": "b"}, tree{"b": "b"})
+	info.Reset()
+	m.Observer = LogObserver{Info: log.New(&info, "", 0), ChangedOnly: true, Relative: true}
+	run(t, m)
+	if want := "COPY:\ta <- a\n"; info.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", info.String(), want)
+	}
+}
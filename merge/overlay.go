@@ -0,0 +1,146 @@
+package merge
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+)
+
+// overlayFS shows the files matching KeyFiles or PlistFiles in a source file system as
+// the files in the destination, with the source's merged in.
+type overlayFS struct {
+	fs.FS
+	m *Merger
+
+	mu sync.Mutex
+	// warned are the files that couldn't be merged, and were reported.
+	warned map[string]bool
+}
+
+// loadOverlays sets up merging the files matching KeyFiles or PlistFiles.
+func (m *Merger) loadOverlays() {
+	m.overlays = nil
+	if len(m.KeyFiles) == 0 && len(m.PlistFiles) == 0 {
+		return
+	}
+	m.overlays = &overlayFS{FS: m.src(), m: m, warned: make(map[string]bool)}
+}
+
+// isOverlaid returns true if the source file at rel is merged into the destination's,
+// rather than replacing it.
+func (m *Merger) isOverlaid(rel string) bool {
+	return m.isKeyed(rel) || m.isPlistMerged(rel)
+}
+
+// overlayFunc returns how the source file at rel is merged into the destination's, or
+// nil if it isn't.
+func (m *Merger) overlayFunc(rel string) (func(dest, src []byte) ([]byte, error), string) {
+	switch {
+	case m.isKeyed(rel):
+		return mergeKeys, "keys"
+	case m.isPlistMerged(rel):
+		return mergePlist, "plist"
+	}
+	return nil, ""
+}
+
+// merged returns the file in the destination at name, with the source's merged in, or
+// nil if the source's is copied as it is.
+func (o *overlayFS) merged(name string) ([]byte, fs.FileInfo, error) {
+	merge, what := o.m.overlayFunc(filepath.FromSlash(name))
+	if merge == nil {
+		return nil, nil, nil
+	}
+	st, err := fs.Stat(o.FS, name)
+	if err != nil || !st.Mode().IsRegular() {
+		return nil, nil, nil
+	}
+	destPath := filepath.Join(o.m.DestDir, filepath.FromSlash(name))
+	dest, err := os.ReadFile(destPath)
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	if st, err = os.Stat(destPath); err != nil {
+		return nil, nil, err
+	}
+	src, err := fs.ReadFile(o.FS, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	out, err := merge(dest, src)
+	if err != nil {
+		o.warn(name, destPath, fmt.Errorf("can't merge the %s of %s, replacing it whole: %w", what, destPath, err))
+		return nil, nil, nil
+	}
+	return out, renderedInfo{st, path.Base(name), int64(len(out))}, nil
+}
+
+// warn reports err, once, for the file at name, that's replaced whole.
+func (o *overlayFS) warn(name, destPath string, err error) {
+	o.mu.Lock()
+	warned := o.warned[name]
+	o.warned[name] = true
+	o.mu.Unlock()
+	if !warned {
+		o.m.log(Action{
+			Kind:  ActionWarning,
+			Src:   o.m.srcPath(filepath.FromSlash(name)),
+			Dest:  destPath,
+			Error: err.Error(),
+		})
+	}
+}
+
+// isWarned returns true if the file at name couldn't be merged, and is replaced whole.
+func (o *overlayFS) isWarned(name string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.warned[name]
+}
+
+func (o *overlayFS) Open(name string) (fs.File, error) {
+	out, st, err := o.merged(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	} else if st != nil {
+		return &renderedFile{bytes.NewReader(out), st}, nil
+	}
+	return o.FS.Open(name)
+}
+
+func (o *overlayFS) Stat(name string) (fs.FileInfo, error) {
+	_, st, err := o.merged(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	} else if st != nil {
+		return st, nil
+	}
+	return fs.Stat(o.FS, name)
+}
+
+// ReadDir lists the directory name, describing the merged files as they'll be once
+// merged.
+func (o *overlayFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := fs.ReadDir(o.FS, name)
+	for i, e := range entries {
+		if !e.IsDir() && o.m.isOverlaid(filepath.FromSlash(path.Join(name, e.Name()))) {
+			entries[i] = overlaidEntry{e, o, path.Join(name, e.Name())}
+		}
+	}
+	return entries, err
+}
+
+// overlaidEntry is a merged file, described as it'll be once merged.
+type overlaidEntry struct {
+	fs.DirEntry
+	o    *overlayFS
+	name string
+}
+
+func (e overlaidEntry) Info() (fs.FileInfo, error) { return e.o.Stat(e.name) }
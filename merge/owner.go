@@ -0,0 +1,54 @@
+package merge
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+// chown is os.Chown, unless replaced to see how it's called.
+var chown = os.Chown
+
+// copyOwner gives path the owner and group of the file described by st. This only
+// works as root, so otherwise it does nothing.
+func copyOwner(path string, st fs.FileInfo) error {
+	uid, gid, ok := fileOwner(st)
+	if !ok || os.Geteuid() != 0 {
+		return nil
+	}
+	if err := chown(path, uid, gid); err != nil {
+		return err
+	}
+	// Changing the owner clears setuid and setgid, so put them back.
+	if mode := st.Mode(); mode&(fs.ModeSetuid|fs.ModeSetgid) != 0 {
+		return os.Chmod(path, mode&modeBits)
+	}
+	return nil
+}
+
+// copySrcOwner is copyOwner for destPath, copied from the source file described by st.
+// Unless running as root, a differing owner is warned about instead.
+func (m *Merger) copySrcOwner(destPath string, st fs.FileInfo) error {
+	if m.NoOwner {
+		return nil
+	}
+	if os.Geteuid() == 0 {
+		return copyOwner(destPath, st)
+	}
+	uid, gid, ok := fileOwner(st)
+	if !ok {
+		return nil
+	}
+	destSt, err := os.Stat(destPath)
+	if err != nil {
+		return err
+	}
+	if destUID, destGID, _ := fileOwner(destSt); destUID != uid || destGID != gid {
+		m.log(Action{
+			Kind:  ActionWarning,
+			Dest:  destPath,
+			Error: fmt.Sprintf("can't preserve owner %d:%d, not running as root: %s", uid, gid, destPath),
+		})
+	}
+	return nil
+}
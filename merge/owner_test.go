@@ -0,0 +1,74 @@
+//go:build unix
+
+package merge
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// chownCall is a call made to chown.
+type chownCall struct{ uid, gid int }
+
+// fakeChown replaces chown, for the rest of t, with a function that records its calls
+// in the returned slice, and doesn't change anything.
+func fakeChown(t *testing.T) *[]chownCall {
+	var calls []chownCall
+	orig := chown
+	chown = func(path string, uid, gid int) error {
+		calls = append(calls, chownCall{uid, gid})
+		return nil
+	}
+	t.Cleanup(func() { chown = orig })
+	return &calls
+}
+
+func TestCopyOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("only done as root")
+	}
+	tests := []struct {
+		name    string
+		meta    string
+		noOwner bool
+		want    []chownCall
+	}{
+		{name: "source's owner", want: []chownCall{{4321, 8765}}},
+		{name: "owner from metadata", meta: "f owner=1234 group=5678\n", want: []chownCall{{1234, 5678}}},
+		{name: "no owner", noOwner: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := newTestMerger(t, tree{"f": "f", MetaFile: tt.meta}, nil)
+			if err := os.Chown(filepath.Join(m.SrcDir, "f"), 4321, 8765); err != nil {
+				t.Fatal(err)
+			}
+			m.NoOwner = tt.noOwner
+			calls := fakeChown(t)
+			run(t, m)
+			if len(*calls) != len(tt.want) || len(tt.want) > 0 && (*calls)[0] != tt.want[0] {
+				t.Errorf("chown called with %v, want %v", *calls, tt.want)
+			}
+		})
+	}
+}
+
+func TestCopyOwnerUnprivileged(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("only warned about when not root")
+	}
+	m, rec := newTestMerger(t, tree{"f": "f", MetaFile: "f owner=1234 group=5678\n"}, nil)
+	calls := fakeChown(t)
+	run(t, m)
+	if len(*calls) != 0 {
+		t.Errorf("chown called with %v", *calls)
+	}
+	warned := false
+	for _, a := range rec.Actions {
+		warned = warned || a.Kind == ActionWarning
+	}
+	if !warned {
+		t.Errorf("got actions %q, want a warning about the owner", kinds(rec.Actions))
+	}
+}
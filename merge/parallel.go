@@ -0,0 +1,76 @@
+package merge
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"sync"
+)
+
+// errStopped is returned by the walk in runParallel once a worker has failed.
+var errStopped = errors.New("stopped")
+
+// runParallel is the walk in Run, with files handed over to Workers goroutines. It
+// stops handing out files at the first error that stops the run; files already being
+// worked on are finished. The actions are passed on to the Observer once they're all
+// done, in the same order as a serial run's.
+func (m *Merger) runParallel(ctx context.Context) error {
+	type job struct {
+		rel string
+		d   fs.DirEntry
+	}
+	var (
+		jobs     = make(chan job)
+		done     = make(chan struct{})
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	m.holdActions()
+	defer m.releaseActions()
+	stop := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			close(done)
+		})
+	}
+	for i := 0; i < m.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				if err := m.recordErr(j.rel, m.mergeEntry(ctx, j.rel, j.d, nil)); err != nil {
+					stop(err)
+				}
+			}
+		}()
+	}
+
+	// Directories are created right away, so that they exist before any of the files
+	// inside are handed out.
+	mergeDir := m.keepGoingFunc(func(rel string, d fs.DirEntry, walkErr error) error {
+		return m.mergeEntry(ctx, rel, d, walkErr)
+	})
+	err := m.walkSrc(func(rel string, d fs.DirEntry, walkErr error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if walkErr != nil || d.IsDir() {
+			return mergeDir(rel, d, walkErr)
+		}
+		select {
+		case jobs <- job{rel, d}:
+			return nil
+		case <-done:
+			return errStopped
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	close(jobs)
+	wg.Wait()
+	if err == nil || err == errStopped {
+		err = firstErr
+	}
+	return err
+}
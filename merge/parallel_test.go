@@ -0,0 +1,96 @@
+package merge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestParallel(t *testing.T) {
+	src := genTree(300, 100)
+	dest := tree{}
+	for name, contents := range src {
+		switch {
+		case name[len(name)-1] == '0':
+			dest[name] = "old"
+		case name[len(name)-1] == '1':
+			dest[name] = contents
+		}
+	}
+	serial, serialRec := newTestMerger(t, src, dest)
+	run(t, serial)
+	for _, workers := range []int{2, 8} {
+		t.Run(fmt.Sprintf("%d workers", workers), func(t *testing.T) {
+			m, rec := newTestMerger(t, src, dest)
+			m.Workers = workers
+			run(t, m)
+			checkTree(t, m.DestDir, readTree(t, serial.DestDir))
+			// The actions are in the same order, whichever finished first.
+			if got, want := kinds(rec.Actions), kinds(serialRec.Actions); !reflect.DeepEqual(got, want) {
+				t.Errorf("got actions %q\nwant %q", got, want)
+			}
+		})
+	}
+}
+
+func TestParallelStops(t *testing.T) {
+	src := genTree(300, 100)
+	dest := tree{"d000/f00000": "old", "d000/f00000.upmerge~": "older"}
+	m, _ := newTestMerger(t, src, dest)
+	m.Workers = 4
+	if _, err := m.Run(context.Background()); !errors.Is(err, ErrRefuse) {
+		t.Fatalf("got %v, want a refusal", err)
+	}
+	// The rest aren't handed out after the first failure, though a few may have been.
+	got := readTree(t, m.DestDir)
+	if len(got) >= len(src) {
+		t.Errorf("copied %d files of %d after a failure", len(got), len(src))
+	}
+
+	m, _ = newTestMerger(t, src, dest)
+	m.Workers, m.KeepGoing = 4, true
+	_, err := m.Run(context.Background())
+	var me MultiError
+	if !errors.As(err, &me) || len(me) != 1 {
+		t.Fatalf("got %v, want a single refusal", err)
+	}
+	if got := readTree(t, m.DestDir); len(got) != len(src)+len(dest)+2 {
+		t.Errorf("got %d entries, want every file, and the backup", len(got))
+	}
+}
+
+// BenchmarkRunWorkers merges a generated tree of many small files, serially and in
+// parallel, into an empty destination, and again once it's up to date.
+func BenchmarkRunWorkers(b *testing.B) {
+	src := genTree(2000, 512)
+	for _, workers := range []int{1, 8} {
+		b.Run(fmt.Sprintf("copy/P%d", workers), func(b *testing.B) {
+			m, _ := newTestMerger(b, src, nil)
+			m.Workers = workers
+			m.Observer = nil
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				if err := os.RemoveAll(m.DestDir); err != nil {
+					b.Fatal(err)
+				}
+				if err := os.Mkdir(m.DestDir, 0755); err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+				run(b, m)
+			}
+		})
+		b.Run(fmt.Sprintf("up-to-date/P%d", workers), func(b *testing.B) {
+			m, _ := newTestMerger(b, src, src)
+			m.Workers = workers
+			m.Observer = nil
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				run(b, m)
+			}
+		})
+	}
+}
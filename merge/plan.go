@@ -0,0 +1,294 @@
+package merge
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Kinds of steps in a Plan.
+const (
+	// StepMkdir creates a missing directory.
+	StepMkdir = "mkdir"
+	// StepCopy copies a file that's missing from the destination.
+	StepCopy = "copy"
+	// StepReplace backs up a file that differs from its source, and copies the source
+	// over it.
+	StepReplace = "backup-copy"
+	// StepConflict is like StepReplace, but the backup differs as well: unless forced
+	// or resolved, it's refused.
+	StepConflict = "conflict"
+	// StepSkip leaves alone a file that's already up to date.
+	StepSkip = "skip"
+	// StepChmod gives an existing directory the permissions of its source, or an
+	// existing file the mode given by MetaFile.
+	StepChmod = "chmod"
+	// StepMknod recreates a device that's missing from the destination.
+	StepMknod = "mknod"
+	// StepSpecial leaves alone a special file in the source, such as a named pipe,
+	// that's never copied over.
+	StepSpecial = "special"
+	// StepIgnore leaves alone a file in the source that's never copied over.
+	StepIgnore = "ignore"
+	// StepOnce leaves alone a file that's only copied if it's missing (see
+	// Merger.Once), since it's there.
+	StepOnce = "once"
+	// StepRemove backs up a file that's marked for removal in the source (see
+	// RemoveSuffix), and removes it.
+	StepRemove = "remove"
+	// StepTypeConflict leaves alone (see Merger.ResolveTypeConflicts) a destination
+	// entry that's a directory where the source's isn't, or the other way around.
+	StepTypeConflict = "type-conflict"
+)
+
+// Step is a single operation in a Plan. The hashes record the contents of each file
+// at planning time, or are empty if it didn't exist.
+type Step struct {
+	Kind       string      `json:"step"`
+	Path       string      `json:"path"`
+	Src        string      `json:"src"`
+	Dest       string      `json:"dest"`
+	Backup     string      `json:"backup,omitempty"`
+	Mode       fs.FileMode `json:"mode,omitempty"`
+	SrcHash    string      `json:"srcHash,omitempty"`
+	DestHash   string      `json:"destHash,omitempty"`
+	BackupHash string      `json:"backupHash,omitempty"`
+	// Target is set if the source is a symlink to be recreated, rather than copied.
+	Target string `json:"target,omitempty"`
+	// Quick is set for a StepSkip decided by size and modification time alone.
+	Quick bool `json:"quick,omitempty"`
+	// Loose is set for a StepSkip whose files only match with IgnoreLineEndings or
+	// IgnoreTrailingSpace.
+	Loose bool `json:"loose,omitempty"`
+	// installed is the hash of Dest once the step installed it, if it was hashed.
+	installed string
+	// merged, if set, is what a clean merge made of Dest, to be installed instead of
+	// the source.
+	merged []byte
+}
+
+// Plan is the ordered list of steps that brings SrcDir over to DestDir, as made by
+// Merger.Plan.
+type Plan struct {
+	SrcDir  string   `json:"srcDir"`
+	Layers  []string `json:"layers,omitempty"`
+	DestDir string   `json:"destDir"`
+	Steps   []Step   `json:"steps"`
+}
+
+// Plan walks SrcDir, and works out every step Run would take, without changing
+// anything. The actions are reported as in a dry run.
+func (m *Merger) Plan(ctx context.Context) (*Plan, error) {
+	if err := m.start(true); err != nil {
+		return nil, err
+	}
+	dryRun := m.DryRun
+	m.DryRun = true
+	defer func() { m.DryRun = dryRun }()
+	m.checkSrcRepo(ctx)
+
+	plan := &Plan{SrcDir: m.SrcDir, Layers: m.Layers, DestDir: m.DestDir}
+	if err := m.checkCollisions(ctx); err != nil {
+		_, err = m.finish(err)
+		return plan, err
+	}
+	err := m.walkSrc(m.keepGoingFunc(func(rel string, d fs.DirEntry, walkErr error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if walkErr != nil {
+			return wrapErr(OpWalk, rel, walkErr)
+		}
+		step, err := m.planEntry(rel, d)
+		if err != nil || step == nil {
+			return err
+		}
+		if err = m.hashStep(step); err != nil {
+			return wrapErr(OpCompare, rel, err)
+		}
+		plan.Steps = append(plan.Steps, *step)
+		return m.applyStep(ctx, step)
+	}))
+	if err == nil && m.Prune {
+		err = m.planPrune(ctx, func(step *Step) error {
+			if err := m.hashStep(step); err != nil {
+				return wrapErr(OpCompare, step.Path, err)
+			}
+			plan.Steps = append(plan.Steps, *step)
+			return m.applyStep(ctx, step)
+		})
+	}
+	_, err = m.finish(err)
+	return plan, err
+}
+
+// Apply carries out the steps in plan, which must be for the same SrcDir and DestDir.
+// Any step whose files changed since it was planned is reported and skipped, failing
+// with ErrChanged; the remaining steps are still carried out.
+func (m *Merger) Apply(ctx context.Context, plan *Plan) ([]Action, error) {
+	if err := m.start(true); err != nil {
+		return nil, err
+	}
+	if plan.SrcDir != m.SrcDir || !sameStrings(plan.Layers, m.Layers) || plan.DestDir != m.DestDir {
+		return m.finishChanges(ctx, fmt.Errorf("plan is for %s -> %s", plan.SrcDir, plan.DestDir))
+	}
+	m.checkSrcRepo(ctx)
+	if err := m.checkSpace(ctx, func(context.Context) int64 { return m.planSize(plan) }); err != nil {
+		return m.finishChanges(ctx, err)
+	}
+	err := m.takeSnapshot(ctx, func(context.Context) ([]string, error) { return planPaths(plan), nil })
+	if err != nil {
+		return m.finishChanges(ctx, err)
+	}
+	m.startJournal()
+	for i := range plan.Steps {
+		if err := ctx.Err(); err != nil {
+			return m.finishChanges(ctx, err)
+		}
+		step := plan.Steps[i]
+		rel := filepath.Clean(step.Path)
+		if filepath.IsAbs(rel) || rel == ".." ||
+			strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return m.finishChanges(ctx, fmt.Errorf("%s: not inside %s", step.Path, m.DestDir))
+		}
+		// Don't trust the plan with where to write.
+		step.Path = rel
+		if step.Kind == StepReplace || step.Kind == StepConflict {
+			// Taking out the block of a fragment that's gone, if that's what it is.
+			m.orphanFragment(rel)
+		}
+		step.Src = m.srcPath(rel)
+		if step.Kind == StepRemove {
+			// Either marked for removal, or pruned.
+			step.Src = ""
+			if m.isRemoved(rel) {
+				step.Src = m.srcPath(rel + RemoveSuffix)
+			}
+		}
+		step.Dest = filepath.Join(m.DestDir, rel)
+		if step.Backup != "" {
+			step.Backup = m.backupPathFor(rel)
+		}
+		err := m.retry(ctx, rel, func() error {
+			return m.verifyStep(&step)
+		})
+		if errors.Is(err, ErrChanged) {
+			// Only this step is off; carry on with the rest regardless.
+			m.fail(rel, err)
+			m.mu.Lock()
+			m.failures = append(m.failures, err)
+			m.mu.Unlock()
+			continue
+		}
+		if err == nil {
+			err = m.retry(ctx, rel, func() error {
+				return m.applyStep(ctx, &step)
+			})
+		}
+		if err == fs.SkipDir {
+			// Nothing inside an ignored directory was planned anyway.
+			err = nil
+		}
+		if err = m.recordErr(rel, err); err != nil {
+			return m.finishChanges(ctx, err)
+		}
+	}
+	return m.finishChanges(ctx, nil)
+}
+
+// hashStep records the contents of the files involved in step.
+func (m *Merger) hashStep(step *Step) error {
+	var err error
+	switch step.Kind {
+	case StepMkdir, StepChmod, StepMknod, StepSpecial, StepIgnore, StepOnce, StepTypeConflict:
+		return nil
+	}
+	if step.Target != "" {
+		target, err := m.srcLink(step.Path)
+		if err != nil {
+			return err
+		}
+		step.SrcHash = linkHash(target)
+	} else if step.SrcHash, err = hashOpened(m.src().Open(srcName(step.Path))); err != nil {
+		return err
+	}
+	if step.DestHash, err = hashPath(step.Dest); err != nil {
+		return err
+	}
+	if step.Backup != "" {
+		step.BackupHash, err = hashPath(step.Backup)
+	}
+	return err
+}
+
+// hashPath is like hashOpened for the file at path, except that a symlink isn't
+// followed: its hash is made from the target instead.
+func hashPath(path string) (string, error) {
+	st, err := os.Lstat(path)
+	if err == nil && st.Mode()&fs.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		return linkHash(target), err
+	}
+	return hashOpened(os.Open(path))
+}
+
+// linkHash returns the hash recorded for a symlink to target.
+func linkHash(target string) string {
+	return "-> " + target
+}
+
+// verifyStep checks that the files involved in step are still the same as when it was
+// planned, reporting any that changed.
+func (m *Merger) verifyStep(step *Step) error {
+	planned := *step
+	if err := m.hashStep(step); err != nil {
+		return wrapErr(OpVerify, step.Path, err)
+	}
+	changed := ""
+	switch {
+	case step.SrcHash != planned.SrcHash:
+		changed = step.Src
+	case step.DestHash != planned.DestHash:
+		changed = step.Dest
+	case step.BackupHash != planned.BackupHash:
+		changed = step.Backup
+	default:
+		return nil
+	}
+	m.log(Action{
+		Kind:   ActionError,
+		Src:    step.Src,
+		Dest:   step.Dest,
+		Backup: step.Backup,
+		Error:  fmt.Sprintf("changed since planned: %s", changed),
+	})
+	return wrapErr(OpVerify, step.Path, ErrChanged)
+}
+
+// hashOpened returns the SHA-256 of the contents of f, as returned with err by a call
+// to Open. A file that doesn't exist has an empty hash.
+func hashOpened(f fs.File, err error) (string, error) {
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return hashReader(f)
+}
+
+// hashReader returns the SHA-256 of everything read from r.
+func hashReader(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := copyBuffered(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
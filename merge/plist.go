@@ -0,0 +1,795 @@
+package merge
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// Property lists are compared by what they hold, rather than byte for byte, so that a
+// plist rewritten in another format, or with its keys in another order, is still up
+// to date. Those in PlistFiles have the source's dictionary merged into the
+// destination's. Only what's needed for that is parsed and written: XML and binary
+// plists (bplist00), without the old NeXTSTEP format.
+//
+// Values are held as string, int64, float64, bool, time.Time, []byte, plistUID,
+// []interface{} and *plistDict.
+
+// plistDict is a dictionary in a plist, keeping the order of its keys.
+type plistDict struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+// plistUID is a reference to an object in a keyed archive, only found in binary plists.
+type plistUID uint64
+
+// plistEpoch is when dates in binary plists are counted from.
+var plistEpoch = time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// plistMaxDepth limits how deeply containers are nested, so that a binary plist whose
+// objects refer to themselves can't go on forever.
+const plistMaxDepth = 512
+
+var errNotPlist = errors.New("not a property list")
+
+const bplistMagic = "bplist00"
+
+// isBinaryPlist returns true if buf is a binary plist.
+func isBinaryPlist(buf []byte) bool {
+	return bytes.HasPrefix(buf, []byte(bplistMagic))
+}
+
+// looksLikePlist returns true if buf might be a plist, binary or XML, without parsing
+// all of it.
+func looksLikePlist(buf []byte) bool {
+	if isBinaryPlist(buf) {
+		return true
+	}
+	head := buf
+	if len(head) > 512 {
+		head = head[:512]
+	}
+	return bytes.HasPrefix(bytes.TrimSpace(head), []byte("<?xml")) && bytes.Contains(head, []byte("<plist"))
+}
+
+// parsePlist parses buf as a binary or an XML plist.
+func parsePlist(buf []byte) (interface{}, error) {
+	if isBinaryPlist(buf) {
+		return parseBinaryPlist(buf)
+	}
+	if !looksLikePlist(buf) {
+		return nil, errNotPlist
+	}
+	return parseXMLPlist(buf)
+}
+
+// plistsMatch returns true if a and b are both plists, holding the same.
+func plistsMatch(a, b []byte) bool {
+	if !looksLikePlist(a) || !looksLikePlist(b) {
+		return false
+	}
+	va, err := parsePlist(a)
+	if err != nil {
+		return false
+	}
+	vb, err := parsePlist(b)
+	return err == nil && plistEqual(va, vb)
+}
+
+// plistEqual returns true if a and b hold the same, whatever the order of the keys of
+// their dictionaries.
+func plistEqual(a, b interface{}) bool {
+	switch a := a.(type) {
+	case *plistDict:
+		b, ok := b.(*plistDict)
+		if !ok || len(a.values) != len(b.values) {
+			return false
+		}
+		for k, v := range a.values {
+			w, ok := b.values[k]
+			if !ok || !plistEqual(v, w) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !plistEqual(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case []byte:
+		b, ok := b.([]byte)
+		return ok && bytes.Equal(a, b)
+	case time.Time:
+		b, ok := b.(time.Time)
+		// XML dates only go down to the second.
+		return ok && a.Truncate(time.Second).Equal(b.Truncate(time.Second))
+	case float64:
+		b, ok := b.(float64)
+		return ok && (a == b || math.IsNaN(a) && math.IsNaN(b))
+	default:
+		return a == b
+	}
+}
+
+// isPlistMerged returns true if the source file at rel is a plist merged into the
+// destination's, as given by PlistFiles.
+func (m *Merger) isPlistMerged(rel string) bool {
+	return matchFile(m.plistFiles, rel)
+}
+
+// mergePlist returns dest, with the dictionary in src merged into it: dictionaries in
+// both are merged the same way, and anything else is set to the source's. It's written
+// back in dest's format, unless that changes nothing.
+func mergePlist(dest, src []byte) ([]byte, error) {
+	dv, err := parsePlist(dest)
+	if err != nil {
+		return nil, fmt.Errorf("dest: %w", err)
+	}
+	sv, err := parsePlist(src)
+	if err != nil {
+		return nil, fmt.Errorf("src: %w", err)
+	}
+	dd, ok := dv.(*plistDict)
+	if !ok {
+		return nil, errors.New("dest: not a dictionary")
+	}
+	sd, ok := sv.(*plistDict)
+	if !ok {
+		return nil, errors.New("src: not a dictionary")
+	}
+	merged := mergeDicts(dd, sd)
+	if plistEqual(merged, dd) {
+		return dest, nil
+	}
+	if isBinaryPlist(dest) {
+		return writeBinaryPlist(merged)
+	}
+	return writeXMLPlist(merged), nil
+}
+
+// mergeDicts returns a copy of dest with src merged into it, as by mergePlist.
+func mergeDicts(dest, src *plistDict) *plistDict {
+	out := &plistDict{keys: append([]string{}, dest.keys...), values: make(map[string]interface{})}
+	for k, v := range dest.values {
+		out.values[k] = v
+	}
+	for _, k := range src.keys {
+		sv := src.values[k]
+		dv, ok := out.values[k]
+		if !ok {
+			out.keys = append(out.keys, k)
+		} else if dd, ok := dv.(*plistDict); ok {
+			if sd, ok := sv.(*plistDict); ok {
+				sv = mergeDicts(dd, sd)
+			}
+		}
+		out.values[k] = sv
+	}
+	return out
+}
+
+// xmlPlistParser reads an XML plist, one element at a time.
+type xmlPlistParser struct {
+	d *xml.Decoder
+}
+
+// parseXMLPlist parses buf as an XML plist.
+func parseXMLPlist(buf []byte) (interface{}, error) {
+	p := &xmlPlistParser{xml.NewDecoder(bytes.NewReader(buf))}
+	// Plists say they're UTF-8, which is all the decoder knows.
+	p.d.CharsetReader = func(charset string, r io.Reader) (io.Reader, error) {
+		if !strings.EqualFold(charset, "utf-8") {
+			return nil, fmt.Errorf("unsupported charset: %s", charset)
+		}
+		return r, nil
+	}
+	start, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if start.Name.Local != "plist" {
+		return nil, errNotPlist
+	}
+	el, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	v, err := p.value(el, 0)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = p.next(); err != io.EOF {
+		return nil, errors.New("plist: more than one value")
+	}
+	return v, nil
+}
+
+// next returns the next element to start, or io.EOF once there are none left in the
+// one being read.
+func (p *xmlPlistParser) next() (xml.StartElement, error) {
+	for {
+		tok, err := p.d.Token()
+		if err != nil {
+			return xml.StartElement{}, err
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			return tok, nil
+		case xml.EndElement:
+			return xml.StartElement{}, io.EOF
+		}
+	}
+}
+
+// text returns the text in the element just started, up to its end.
+func (p *xmlPlistParser) text() (string, error) {
+	var b strings.Builder
+	for {
+		tok, err := p.d.Token()
+		if err != nil {
+			return "", err
+		}
+		switch tok := tok.(type) {
+		case xml.CharData:
+			b.Write(tok)
+		case xml.StartElement:
+			return "", fmt.Errorf("plist: unexpected <%s>", tok.Name.Local)
+		case xml.EndElement:
+			return b.String(), nil
+		}
+	}
+}
+
+// value returns the value of el, which was just started, at depth.
+func (p *xmlPlistParser) value(el xml.StartElement, depth int) (interface{}, error) {
+	if depth > plistMaxDepth {
+		return nil, errors.New("plist: nested too deeply")
+	}
+	switch el.Name.Local {
+	case "dict":
+		d := &plistDict{values: make(map[string]interface{})}
+		for {
+			kel, err := p.next()
+			if err == io.EOF {
+				return d, nil
+			} else if err != nil {
+				return nil, err
+			}
+			if kel.Name.Local != "key" {
+				return nil, fmt.Errorf("plist: expected <key>, not <%s>", kel.Name.Local)
+			}
+			key, err := p.text()
+			if err != nil {
+				return nil, err
+			}
+			vel, err := p.next()
+			if err == io.EOF {
+				return nil, fmt.Errorf("plist: no value for %q", key)
+			} else if err != nil {
+				return nil, err
+			}
+			v, err := p.value(vel, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := d.values[key]; !ok {
+				d.keys = append(d.keys, key)
+			}
+			d.values[key] = v
+		}
+	case "array":
+		a := []interface{}{}
+		for {
+			vel, err := p.next()
+			if err == io.EOF {
+				return a, nil
+			} else if err != nil {
+				return nil, err
+			}
+			v, err := p.value(vel, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, v)
+		}
+	case "true", "false":
+		if _, err := p.text(); err != nil {
+			return nil, err
+		}
+		return el.Name.Local == "true", nil
+	}
+	s, err := p.text()
+	if err != nil {
+		return nil, err
+	}
+	switch el.Name.Local {
+	case "string":
+		return s, nil
+	case "integer":
+		s = strings.TrimSpace(s)
+		if n, err := strconv.ParseInt(s, 0, 64); err == nil {
+			return n, nil
+		}
+		// Unsigned integers too big to be signed are kept as their bits.
+		n, err := strconv.ParseUint(s, 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("plist: bad integer: %s", s)
+		}
+		return int64(n), nil
+	case "real":
+		f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil {
+			return nil, fmt.Errorf("plist: bad real: %s", s)
+		}
+		return f, nil
+	case "date":
+		t, err := time.Parse(time.RFC3339, strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("plist: bad date: %s", s)
+		}
+		return t.UTC(), nil
+	case "data":
+		buf, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(s), ""))
+		if err != nil {
+			return nil, fmt.Errorf("plist: bad data: %w", err)
+		}
+		return buf, nil
+	}
+	return nil, fmt.Errorf("plist: unknown element <%s>", el.Name.Local)
+}
+
+// writeXMLPlist returns v as an XML plist, indented the way macOS writes them.
+func writeXMLPlist(v interface{}) []byte {
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	b.WriteString(`<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">` + "\n")
+	b.WriteString(`<plist version="1.0">` + "\n")
+	writeXMLValue(&b, v, 0)
+	b.WriteString("</plist>\n")
+	return b.Bytes()
+}
+
+// writeXMLValue writes v to b, indented by depth tabs.
+func writeXMLValue(b *bytes.Buffer, v interface{}, depth int) {
+	indent := strings.Repeat("\t", depth)
+	element := func(name, text string) {
+		b.WriteString(indent + "<" + name + ">")
+		xml.EscapeText(b, []byte(text))
+		b.WriteString("</" + name + ">\n")
+	}
+	switch v := v.(type) {
+	case *plistDict:
+		if len(v.keys) == 0 {
+			b.WriteString(indent + "<dict/>\n")
+			return
+		}
+		b.WriteString(indent + "<dict>\n")
+		for _, k := range v.keys {
+			b.WriteString(indent + "\t<key>")
+			xml.EscapeText(b, []byte(k))
+			b.WriteString("</key>\n")
+			writeXMLValue(b, v.values[k], depth+1)
+		}
+		b.WriteString(indent + "</dict>\n")
+	case []interface{}:
+		if len(v) == 0 {
+			b.WriteString(indent + "<array/>\n")
+			return
+		}
+		b.WriteString(indent + "<array>\n")
+		for _, e := range v {
+			writeXMLValue(b, e, depth+1)
+		}
+		b.WriteString(indent + "</array>\n")
+	case string:
+		element("string", v)
+	case int64:
+		element("integer", strconv.FormatInt(v, 10))
+	case plistUID:
+		// XML has no UIDs; this is how macOS writes them.
+		d := &plistDict{keys: []string{"CF$UID"}, values: map[string]interface{}{"CF$UID": int64(v)}}
+		writeXMLValue(b, d, depth)
+	case float64:
+		element("real", strconv.FormatFloat(v, 'g', -1, 64))
+	case bool:
+		if v {
+			b.WriteString(indent + "<true/>\n")
+		} else {
+			b.WriteString(indent + "<false/>\n")
+		}
+	case time.Time:
+		element("date", v.UTC().Format("2006-01-02T15:04:05Z"))
+	case []byte:
+		element("data", base64.StdEncoding.EncodeToString(v))
+	}
+}
+
+// binaryPlistParser reads the objects of a binary plist.
+type binaryPlistParser struct {
+	buf     []byte
+	offsets []uint64
+	refSize int
+}
+
+// parseBinaryPlist parses buf as a binary plist.
+func parseBinaryPlist(buf []byte) (interface{}, error) {
+	if len(buf) < len(bplistMagic)+32 {
+		return nil, errors.New("bplist: too short")
+	}
+	trailer := buf[len(buf)-32:]
+	offsetSize, refSize := int(trailer[6]), int(trailer[7])
+	numObjects := binary.BigEndian.Uint64(trailer[8:])
+	top := binary.BigEndian.Uint64(trailer[16:])
+	tableOffset := binary.BigEndian.Uint64(trailer[24:])
+	end := uint64(len(buf) - 32)
+	if offsetSize < 1 || offsetSize > 8 || refSize < 1 || refSize > 8 || top >= numObjects ||
+		tableOffset >= end || numObjects > (end-tableOffset)/uint64(offsetSize) {
+		return nil, errors.New("bplist: bad trailer")
+	}
+	p := &binaryPlistParser{buf: buf, refSize: refSize, offsets: make([]uint64, numObjects)}
+	for i := range p.offsets {
+		at := tableOffset + uint64(i*offsetSize)
+		p.offsets[i] = readUint(buf[at : at+uint64(offsetSize)])
+		if p.offsets[i] < uint64(len(bplistMagic)) || p.offsets[i] >= tableOffset {
+			return nil, errors.New("bplist: bad offset")
+		}
+	}
+	return p.object(top, 0)
+}
+
+// readUint reads a big-endian unsigned integer of up to 8 bytes.
+func readUint(buf []byte) uint64 {
+	var n uint64
+	for _, c := range buf {
+		n = n<<8 | uint64(c)
+	}
+	return n
+}
+
+// bytesAt returns n bytes of the plist at off, checking that they're there.
+func (p *binaryPlistParser) bytesAt(off, n uint64) ([]byte, error) {
+	if off > uint64(len(p.buf)) || n > uint64(len(p.buf))-off {
+		return nil, errors.New("bplist: object runs past the end")
+	}
+	return p.buf[off : off+n], nil
+}
+
+// length returns the count given by the low nibble of marker, found at off, and where
+// whatever it counts starts.
+func (p *binaryPlistParser) length(marker byte, off uint64) (uint64, uint64, error) {
+	if marker&0xf != 0xf {
+		return uint64(marker & 0xf), off + 1, nil
+	}
+	head, err := p.bytesAt(off+1, 1)
+	if err != nil {
+		return 0, 0, err
+	}
+	if head[0]&0xf0 != 0x10 {
+		return 0, 0, errors.New("bplist: bad length")
+	}
+	size := uint64(1) << (head[0] & 0xf)
+	if size > 8 {
+		return 0, 0, errors.New("bplist: bad length")
+	}
+	n, err := p.bytesAt(off+2, size)
+	if err != nil {
+		return 0, 0, err
+	}
+	return readUint(n), off + 2 + size, nil
+}
+
+// refs returns the n object references at off.
+func (p *binaryPlistParser) refs(off, n uint64) ([]uint64, error) {
+	if n > uint64(len(p.buf)) {
+		return nil, errors.New("bplist: object runs past the end")
+	}
+	buf, err := p.bytesAt(off, n*uint64(p.refSize))
+	if err != nil {
+		return nil, err
+	}
+	refs := make([]uint64, n)
+	for i := range refs {
+		refs[i] = readUint(buf[i*p.refSize : (i+1)*p.refSize])
+		if refs[i] >= uint64(len(p.offsets)) {
+			return nil, errors.New("bplist: bad reference")
+		}
+	}
+	return refs, nil
+}
+
+// object returns the object numbered ref, at depth.
+func (p *binaryPlistParser) object(ref uint64, depth int) (interface{}, error) {
+	if depth > plistMaxDepth {
+		return nil, errors.New("bplist: nested too deeply")
+	}
+	off := p.offsets[ref]
+	marker := p.buf[off]
+	switch marker >> 4 {
+	case 0x0:
+		switch marker {
+		case 0x08:
+			return false, nil
+		case 0x09:
+			return true, nil
+		}
+	case 0x1:
+		size := uint64(1) << (marker & 0xf)
+		if size > 16 {
+			break
+		}
+		buf, err := p.bytesAt(off+1, size)
+		if err != nil {
+			return nil, err
+		}
+		// Only 8 bytes are ever significant; 16 bytes hold unsigned 64-bit ones.
+		if size > 8 {
+			buf = buf[size-8:]
+		}
+		return int64(readUint(buf)), nil
+	case 0x2:
+		switch marker & 0xf {
+		case 2:
+			buf, err := p.bytesAt(off+1, 4)
+			if err != nil {
+				return nil, err
+			}
+			return float64(math.Float32frombits(binary.BigEndian.Uint32(buf))), nil
+		case 3:
+			buf, err := p.bytesAt(off+1, 8)
+			if err != nil {
+				return nil, err
+			}
+			return math.Float64frombits(binary.BigEndian.Uint64(buf)), nil
+		}
+	case 0x3:
+		if marker != 0x33 {
+			break
+		}
+		buf, err := p.bytesAt(off+1, 8)
+		if err != nil {
+			return nil, err
+		}
+		secs := math.Float64frombits(binary.BigEndian.Uint64(buf))
+		return plistEpoch.Add(time.Duration(secs * float64(time.Second))), nil
+	case 0x4, 0x5, 0x6:
+		n, start, err := p.length(marker, off)
+		if err != nil {
+			return nil, err
+		}
+		if marker>>4 == 0x6 {
+			if n > uint64(len(p.buf)) {
+				return nil, errors.New("bplist: object runs past the end")
+			}
+			n *= 2
+		}
+		buf, err := p.bytesAt(start, n)
+		if err != nil {
+			return nil, err
+		}
+		switch marker >> 4 {
+		case 0x4:
+			return append([]byte{}, buf...), nil
+		case 0x5:
+			return string(buf), nil
+		}
+		units := make([]uint16, len(buf)/2)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(buf[2*i:])
+		}
+		return string(utf16.Decode(units)), nil
+	case 0x8:
+		buf, err := p.bytesAt(off+1, uint64(marker&0xf)+1)
+		if err != nil {
+			return nil, err
+		}
+		return plistUID(readUint(buf)), nil
+	case 0xa, 0xc:
+		// Sets are read as arrays.
+		n, start, err := p.length(marker, off)
+		if err != nil {
+			return nil, err
+		}
+		refs, err := p.refs(start, n)
+		if err != nil {
+			return nil, err
+		}
+		a := make([]interface{}, n)
+		for i, r := range refs {
+			if a[i], err = p.object(r, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return a, nil
+	case 0xd:
+		n, start, err := p.length(marker, off)
+		if err != nil {
+			return nil, err
+		}
+		refs, err := p.refs(start, 2*n)
+		if err != nil {
+			return nil, err
+		}
+		d := &plistDict{values: make(map[string]interface{})}
+		for i := uint64(0); i < n; i++ {
+			k, err := p.object(refs[i], depth+1)
+			if err != nil {
+				return nil, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, errors.New("bplist: dictionary key isn't a string")
+			}
+			v, err := p.object(refs[n+i], depth+1)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := d.values[key]; !ok {
+				d.keys = append(d.keys, key)
+			}
+			d.values[key] = v
+		}
+		return d, nil
+	}
+	return nil, fmt.Errorf("bplist: unknown object type 0x%02x", marker)
+}
+
+// binaryPlistWriter lays out the objects of a binary plist, each written out once per
+// time it's used.
+type binaryPlistWriter struct {
+	// objects are each object, but for the references to others it ends with, in refs:
+	// those are only written once it's known how big they are.
+	objects [][]byte
+	refs    [][]int
+}
+
+// writeBinaryPlist returns v as a binary plist.
+func writeBinaryPlist(v interface{}) ([]byte, error) {
+	w := &binaryPlistWriter{}
+	w.add(v)
+	refSize := byteSize(uint64(len(w.objects) - 1))
+	var out bytes.Buffer
+	out.WriteString(bplistMagic)
+	offsets := make([]uint64, len(w.objects))
+	for i, obj := range w.objects {
+		offsets[i] = uint64(out.Len())
+		out.Write(obj)
+		for _, r := range w.refs[i] {
+			writeUint(&out, uint64(r), refSize)
+		}
+	}
+	tableOffset := uint64(out.Len())
+	offsetSize := byteSize(tableOffset)
+	for _, off := range offsets {
+		writeUint(&out, off, offsetSize)
+	}
+	trailer := make([]byte, 32)
+	trailer[6], trailer[7] = byte(offsetSize), byte(refSize)
+	binary.BigEndian.PutUint64(trailer[8:], uint64(len(w.objects)))
+	binary.BigEndian.PutUint64(trailer[24:], tableOffset)
+	out.Write(trailer)
+	return out.Bytes(), nil
+}
+
+// byteSize returns how many bytes (1, 2, 4 or 8) it takes to hold n.
+func byteSize(n uint64) int {
+	switch {
+	case n < 1<<8:
+		return 1
+	case n < 1<<16:
+		return 2
+	case n < 1<<32:
+		return 4
+	}
+	return 8
+}
+
+// writeUint writes n to b, big-endian, in size bytes.
+func writeUint(b *bytes.Buffer, n uint64, size int) {
+	for i := size - 1; i >= 0; i-- {
+		b.WriteByte(byte(n >> (8 * i)))
+	}
+}
+
+// marker returns the marker for an object of kind holding n things, with its length if
+// that doesn't fit.
+func marker(kind byte, n int) []byte {
+	if n < 0xf {
+		return []byte{kind<<4 | byte(n)}
+	}
+	return append([]byte{kind<<4 | 0xf}, intObject(int64(n))...)
+}
+
+// intObject returns an integer object holding n.
+func intObject(n int64) []byte {
+	var b bytes.Buffer
+	size := 8
+	if n >= 0 {
+		size = byteSize(uint64(n))
+	}
+	b.WriteByte(0x10 | byte(map[int]int{1: 0, 2: 1, 4: 2, 8: 3}[size]))
+	writeUint(&b, uint64(n), size)
+	return b.Bytes()
+}
+
+// add lays out v as the next object, along with the objects it holds, and returns its
+// number.
+func (w *binaryPlistWriter) add(v interface{}) int {
+	n := len(w.objects)
+	w.objects = append(w.objects, nil)
+	w.refs = append(w.refs, nil)
+	var obj []byte
+	var refs []int
+	switch v := v.(type) {
+	case *plistDict:
+		obj = marker(0xd, len(v.keys))
+		var keyRefs, valueRefs []int
+		for _, k := range v.keys {
+			keyRefs = append(keyRefs, w.add(k))
+		}
+		for _, k := range v.keys {
+			valueRefs = append(valueRefs, w.add(v.values[k]))
+		}
+		refs = append(keyRefs, valueRefs...)
+	case []interface{}:
+		obj = marker(0xa, len(v))
+		for _, e := range v {
+			refs = append(refs, w.add(e))
+		}
+	case string:
+		ascii := true
+		for i := 0; i < len(v); i++ {
+			if v[i] >= 0x80 {
+				ascii = false
+				break
+			}
+		}
+		if ascii {
+			obj = append(marker(0x5, len(v)), v...)
+			break
+		}
+		units := utf16.Encode([]rune(v))
+		obj = marker(0x6, len(units))
+		for _, u := range units {
+			obj = binary.BigEndian.AppendUint16(obj, u)
+		}
+	case int64:
+		obj = intObject(v)
+	case plistUID:
+		size := byteSize(uint64(v))
+		var b bytes.Buffer
+		b.WriteByte(0x80 | byte(size-1))
+		writeUint(&b, uint64(v), size)
+		obj = b.Bytes()
+	case float64:
+		obj = binary.BigEndian.AppendUint64([]byte{0x23}, math.Float64bits(v))
+	case bool:
+		obj = []byte{0x08}
+		if v {
+			obj[0] = 0x09
+		}
+	case time.Time:
+		secs := v.Sub(plistEpoch).Seconds()
+		obj = binary.BigEndian.AppendUint64([]byte{0x33}, math.Float64bits(secs))
+	case []byte:
+		obj = append(marker(0x4, len(v)), v...)
+	}
+	w.objects[n], w.refs[n] = obj, refs
+	return n
+}
@@ -0,0 +1,152 @@
+package merge
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The plists in testdata/plist are written by Python's plistlib, as by macOS, with
+// testdata/plist/gen.py.
+
+// readPlist returns the contents of testdata/plist/name.
+func readPlist(t *testing.T, name string) []byte {
+	t.Helper()
+	buf, err := os.ReadFile(filepath.Join("testdata", "plist", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestPlistsMatch(t *testing.T) {
+	tests := []struct {
+		a, b string
+		same bool
+	}{
+		{"prefs.xml", "prefs.bin", true},
+		{"prefs.bin", "prefs.xml", true},
+		{"prefs.xml", "prefs-sorted.xml", true},
+		{"prefs-sorted.xml", "prefs.bin", true},
+		{"prefs.bin", "prefs-changed.bin", false},
+		{"prefs.xml", "prefs-changed.bin", false},
+		{"prefs.xml", "src.xml", false},
+	}
+	for _, tt := range tests {
+		if same := plistsMatch(readPlist(t, tt.a), readPlist(t, tt.b)); same != tt.same {
+			t.Errorf("plistsMatch(%s, %s) = %v, want %v", tt.a, tt.b, same, tt.same)
+		}
+	}
+	// Anything else is compared byte for byte.
+	prefs := readPlist(t, "prefs.xml")
+	for name, buf := range map[string][]byte{
+		"not a plist": []byte("hello\n"),
+		"truncated":   prefs[:len(prefs)/2],
+		"bad binary":  []byte(bplistMagic + "garbage"),
+	} {
+		if plistsMatch(buf, buf) {
+			t.Errorf("%s: plistsMatch = true, want false", name)
+		}
+	}
+}
+
+func TestPlistRoundTrip(t *testing.T) {
+	for _, name := range []string{"prefs.xml", "prefs.bin", "prefs-changed.bin", "merged.xml"} {
+		t.Run(name, func(t *testing.T) {
+			v, err := parsePlist(readPlist(t, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			bin, err := writeBinaryPlist(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for format, buf := range map[string][]byte{"xml": writeXMLPlist(v), "binary": bin} {
+				if isBinaryPlist(buf) != (format == "binary") {
+					t.Errorf("%s: written in the wrong format", format)
+				}
+				w, err := parsePlist(buf)
+				if err != nil {
+					t.Fatalf("%s: %v", format, err)
+				}
+				if !plistEqual(v, w) {
+					t.Errorf("%s: got %#v, want %#v", format, w, v)
+				}
+			}
+		})
+	}
+}
+
+func TestMergePlist(t *testing.T) {
+	want, err := parsePlist(readPlist(t, "merged.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := readPlist(t, "src.xml")
+	for _, name := range []string{"prefs.xml", "prefs.bin"} {
+		t.Run(name, func(t *testing.T) {
+			dest := readPlist(t, name)
+			out, err := mergePlist(dest, src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if isBinaryPlist(out) != isBinaryPlist(dest) {
+				t.Errorf("not written back in the destination's format")
+			}
+			got, err := parsePlist(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !plistEqual(got, want) {
+				t.Errorf("got %#v, want %#v", got, want)
+			}
+			// Merging it again changes nothing.
+			again, err := mergePlist(out, src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(again, out) {
+				t.Errorf("merging again rewrote it")
+			}
+		})
+	}
+	if _, err := mergePlist([]byte("hello\n"), src); err == nil {
+		t.Errorf("merged into a file that isn't a plist")
+	}
+}
+
+func TestMergePlistUpdated(t *testing.T) {
+	src := readPlist(t, "src.xml")
+	m, _ := newTestMerger(t, tree{"prefs.plist": string(src)},
+		tree{"prefs.plist": string(readPlist(t, "prefs.bin"))})
+	m.PlistFiles = []string{"*.plist"}
+	run(t, m)
+	// check fails t unless the plist in the destination is dest with src merged into
+	// it, and its backup is backup.
+	check := func(dest, src, backup []byte) {
+		t.Helper()
+		want, err := mergePlist(dest, src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkTree(t, m.DestDir, tree{"prefs.plist": string(want), "prefs.plist" + m.BackupSuffix: string(backup)})
+	}
+	check(readPlist(t, "prefs.bin"), src, readPlist(t, "prefs.bin"))
+
+	// Changed in the source, although the backup differs.
+	merged, err := mergePlist(readPlist(t, "prefs.bin"), src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src = bytes.Replace(src, []byte("<integer>43</integer>"), []byte("<integer>44</integer>"), 1)
+	writeTree(t, m.SrcDir, tree{"prefs.plist": string(src)})
+	run(t, m)
+	check(merged, src, merged)
+
+	// Upgraded in the destination, by whoever else it belongs to.
+	upgraded := readPlist(t, "prefs-changed.bin")
+	writeTree(t, m.DestDir, tree{"prefs.plist": string(upgraded)})
+	run(t, m)
+	check(upgraded, src, upgraded)
+}
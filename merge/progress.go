@@ -0,0 +1,70 @@
+package merge
+
+import (
+	"io"
+	"io/fs"
+	"sync/atomic"
+)
+
+// Progress is how far a run has got.
+type Progress struct {
+	// Done is how many entries of the source were looked at, out of Total.
+	Done, Total int
+	// Path is that of the last one, relative to the roots.
+	Path string
+	// Bytes is how much was copied from the source so far.
+	Bytes int64
+}
+
+// ProgressObserver is an Observer that's also told how far a run has got, before
+// every entry of the source is merged. The source is counted first, for the total.
+type ProgressObserver interface {
+	Observer
+	OnProgress(p Progress)
+}
+
+// startProgress counts the entries of the source to merge, if the Observer wants to
+// know how far the run has got.
+func (m *Merger) startProgress() {
+	m.progress = Progress{}
+	atomic.StoreInt64(&m.copied, 0)
+	if _, ok := m.Observer.(ProgressObserver); !ok {
+		return
+	}
+	// Errors are reported by the run itself.
+	m.scanSrc(func(rel string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		// Excluded entries are looked at too, but not what's inside them.
+		m.progress.Total++
+		_, err = m.skipExcluded(rel, d)
+		return err
+	})
+}
+
+// reportProgress tells the Observer that the entry at rel is next.
+func (m *Merger) reportProgress(rel string) {
+	po, ok := m.Observer.(ProgressObserver)
+	if !ok {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.progress.Done++
+	m.progress.Path = rel
+	m.progress.Bytes = atomic.LoadInt64(&m.copied)
+	po.OnProgress(m.progress)
+}
+
+// countingReader counts the bytes read through it in n.
+type countingReader struct {
+	io.Reader
+	n *int64
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	atomic.AddInt64(r.n, int64(n))
+	return n, err
+}
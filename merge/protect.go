@@ -0,0 +1,53 @@
+package merge
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// What to do with a file protected by the system, for Merger.Protected.
+const (
+	// ProtectedSkip reports the file, and carries on with the rest (the default).
+	ProtectedSkip = "skip"
+	// ProtectedFail fails on it, with ErrProtected, like any other error.
+	ProtectedFail = "fail"
+)
+
+// isProtected returns true if path, or a directory it's in, is marked restricted: on
+// macOS, System Integrity Protection keeps even root from changing it.
+func isProtected(path string) bool {
+	if restrictedFlag == 0 {
+		return false
+	}
+	for {
+		if st, err := os.Lstat(path); err == nil && sysFlags(st)&restrictedFlag != 0 {
+			return true
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return false
+		}
+		path = parent
+	}
+}
+
+// checkProtected returns err, from carrying out step, unless it's a missing permission
+// on a file that isProtected. Then, the file is reported as an ActionProtected, and
+// left as it is: nil is returned, or with ProtectedFail, ErrProtected.
+func (m *Merger) checkProtected(step *Step, err error) error {
+	if !errors.Is(err, fs.ErrPermission) || errors.Is(err, ErrProtected) || !isProtected(step.Dest) {
+		return err
+	}
+	m.log(Action{Kind: ActionProtected, Src: step.Src, Dest: step.Dest, Error: err.Error()})
+	if m.Protected == ProtectedFail {
+		return wrapErr(OpCopy, step.Path, fmt.Errorf("%w: %s", ErrProtected, step.Dest))
+	}
+	if step.Kind == StepMkdir {
+		// Nothing can go inside it.
+		return fs.SkipDir
+	}
+	return nil
+}
@@ -0,0 +1,4 @@
+package merge
+
+// restrictedFlag is SF_RESTRICTED, the file flag System Integrity Protection uses.
+const restrictedFlag = 0x00080000
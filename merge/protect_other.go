@@ -0,0 +1,6 @@
+//go:build !darwin
+
+package merge
+
+// restrictedFlag is 0: System Integrity Protection is only on macOS.
+const restrictedFlag = 0
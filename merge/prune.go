@@ -0,0 +1,51 @@
+package merge
+
+import (
+	"context"
+	"io/fs"
+	"path/filepath"
+)
+
+// PruneBackups walks DestDir (or BackupDir, if set) and removes every backup whose
+// contents are identical to the file it was made from. Backups that differ are
+// reported and left alone.
+func (m *Merger) PruneBackups(ctx context.Context) ([]Action, error) {
+	if err := m.start(false); err != nil {
+		return nil, err
+	}
+	root := m.DestDir
+	if m.BackupDir != "" {
+		root = m.BackupDir
+	}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, walkErr error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if walkErr != nil {
+			return walkErr
+		}
+		if d.IsDir() {
+			return nil
+		}
+		destPath, ok := m.backupOrigin(path)
+		if !ok {
+			return nil
+		}
+		same, _ := fileContentsAreIdentical(destPath, path)
+		if !same {
+			m.log(Action{Kind: ActionCheck, Dest: destPath, Backup: path})
+			return nil
+		}
+		if !m.DryRun {
+			if err := m.removeDest(path); err != nil {
+				// WalkDir only gives paths below root.
+				rel, _ := filepath.Rel(root, path)
+				m.fail(rel, err)
+				return err
+			}
+		}
+		m.log(Action{Kind: ActionPrune, Dest: destPath, Backup: path})
+		return nil
+	})
+	return m.finish(err)
+}
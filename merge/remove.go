@@ -0,0 +1,113 @@
+package merge
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// RemoveSuffix marks an empty file in the source, foo.upmerge-remove, saying that foo
+// shouldn't exist in the destination. It's backed up and removed, like a file that's
+// replaced.
+const RemoveSuffix = ".upmerge-remove"
+
+// removeTarget returns the path of the file that the source file at rel marks for
+// removal, if it does.
+func removeTarget(rel string) (string, bool) {
+	if !strings.HasSuffix(rel, RemoveSuffix) || filepath.Base(rel) == RemoveSuffix {
+		return "", false
+	}
+	return strings.TrimSuffix(rel, RemoveSuffix), true
+}
+
+// isRemoved returns true if the source marks the file at rel for removal.
+func (m *Merger) isRemoved(rel string) bool {
+	st, err := fs.Stat(m.src(), srcName(rel+RemoveSuffix))
+	return err == nil && st.Mode().IsRegular()
+}
+
+// errRemoved is the error for a file at rel that's in the source, and is marked for
+// removal as well.
+func (m *Merger) errRemoved(rel string) error {
+	return wrapErr(OpWalk, rel, fmt.Errorf("%s is in the source, but %s removes it",
+		m.srcPath(rel), m.srcPath(rel+RemoveSuffix)))
+}
+
+// planRemove returns a StepRemove for the file marked for removal by the source entry
+// of step, or nil if it's already gone.
+func (m *Merger) planRemove(step *Step, d fs.DirEntry) (*Step, error) {
+	rel, _ := removeTarget(step.Path)
+	st, err := d.Info()
+	if err != nil {
+		return nil, wrapErr(OpWalk, step.Path, err)
+	}
+	if !st.Mode().IsRegular() || st.Size() != 0 {
+		return nil, wrapErr(OpWalk, step.Path, fmt.Errorf("%s should be an empty file", step.Src))
+	}
+	if _, err := fs.Stat(m.src(), srcName(rel)); err == nil {
+		return nil, m.errRemoved(rel)
+	}
+	step.Path = rel
+	step.Dest = filepath.Join(m.DestDir, rel)
+	destSt, err := os.Lstat(step.Dest)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, wrapErr(OpRemove, rel, err)
+	}
+	if destSt.IsDir() {
+		return nil, wrapErr(OpRemove, rel, fmt.Errorf("%s is a directory", step.Dest))
+	}
+	step.Kind = StepRemove
+	step.Backup = m.backupPathFor(rel)
+	return step, nil
+}
+
+// remove backs up the destination of step, and removes it. A backup that differs is
+// refused, as for a replacement.
+func (m *Merger) remove(step *Step) error {
+	rel, destPath, backupPath := step.Path, step.Dest, step.Backup
+	conflict := false
+	if !m.NoBackup && fileExists(backupPath) && m.BackupRotate == 0 {
+		same, _ := fileContentsAreIdentical(destPath, backupPath)
+		conflict = !same
+	}
+	drifted, err := m.drifted(step)
+	if err != nil {
+		return wrapErr(OpCompare, rel, err)
+	}
+	if drifted {
+		m.log(Action{Kind: ActionDrift, Src: step.Src, Dest: destPath})
+	}
+	if ok, err := m.checkConflict(step, conflict, drifted); !ok {
+		return err
+	}
+	if !m.DryRun {
+		if m.ClearFlags {
+			// There's no new file to set the flags on again.
+			if _, err := clearImmutable(destPath); err != nil {
+				return wrapErr(OpRemove, rel, err)
+			}
+		}
+		if m.NoBackup {
+			err = m.removeDest(destPath)
+		} else {
+			err = m.makeBackup(rel, destPath, backupPath)
+		}
+		if err != nil {
+			return wrapErr(OpRemove, rel, explainImmutable(destPath, err))
+		}
+		m.forget(rel)
+	}
+	if m.NoBackup {
+		backupPath = ""
+	} else if conflict && (m.isForced(rel) || !m.DryRun) {
+		m.log(Action{Kind: ActionForceMove, Dest: destPath, Backup: backupPath})
+	} else {
+		m.log(Action{Kind: ActionMove, Dest: destPath, Backup: backupPath})
+	}
+	m.log(Action{Kind: ActionRemove, Src: step.Src, Dest: destPath, Backup: backupPath})
+	return nil
+}
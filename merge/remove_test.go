@@ -0,0 +1,84 @@
+package merge
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestRemove(t *testing.T) {
+	m, _ := newTestMerger(t, tree{"d/old" + RemoveSuffix: "", "gone" + RemoveSuffix: ""},
+		tree{"d/old": "old\n", "d/kept": "kept\n"})
+	actions := run(t, m)
+	checkTree(t, m.DestDir, tree{
+		"d/":                     "",
+		"d/old" + m.BackupSuffix: "old\n",
+		"d/kept":                 "kept\n",
+	})
+	if got := kinds(actions); !contains(got, ActionRemove+" d/old") || contains(got, ActionRemove+" gone") {
+		t.Errorf("got %q, want d/old removed and nothing about gone", got)
+	}
+
+	// Already gone, there's nothing to do, and the backup is left alone.
+	for _, a := range run(t, m) {
+		if a.Kind == ActionRemove || a.Kind == ActionMove {
+			t.Errorf("ran again: got %s %s", a.Kind, a.DestRel)
+		}
+	}
+	checkTree(t, m.DestDir, tree{
+		"d/":                     "",
+		"d/old" + m.BackupSuffix: "old\n",
+		"d/kept":                 "kept\n",
+	})
+
+	if _, err := m.Revert(context.Background(), []string{"d/old"}); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, m.DestDir, tree{"d/": "", "d/old": "old\n", "d/kept": "kept\n"})
+}
+
+func TestRemoveRevertBack(t *testing.T) {
+	m, rec := newTestMerger(t, tree{"f" + RemoveSuffix: ""}, tree{"f": "old\n"})
+	run(t, m)
+	// Put back since, the file isn't upmerge's to replace with the backup.
+	writeTree(t, m.DestDir, tree{"f": "back\n"})
+	_, err := m.Revert(context.Background(), nil)
+	var fe *FileError
+	if !errors.As(err, &fe) || fe.Path != "f" || !errors.Is(err, ErrRefuse) {
+		t.Fatalf("got %v, want reverting f refused", err)
+	}
+	if len(rec.Errors) != 1 {
+		t.Errorf("got %d errors reported, want 1", len(rec.Errors))
+	}
+	checkTree(t, m.DestDir, tree{"f": "back\n", "f" + m.BackupSuffix: "old\n"})
+}
+
+func TestRemoveInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		src  tree
+	}{
+		{"not empty", tree{"f" + RemoveSuffix: "x\n"}},
+		{"in the source", tree{"f": "new\n", "f" + RemoveSuffix: ""}},
+	}
+	for _, tt := range tests {
+		m, _ := newTestMerger(t, tt.src, tree{"f": "old\n"})
+		if _, err := m.Run(context.Background()); err == nil {
+			t.Errorf("%s: got no error", tt.name)
+		}
+		if got := readTree(t, m.DestDir); !reflect.DeepEqual(got, tree{"f": "old\n"}) {
+			t.Errorf("%s: got %q", tt.name, got)
+		}
+	}
+}
+
+// contains returns true if list holds s.
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
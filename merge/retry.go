@@ -0,0 +1,62 @@
+package merge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"time"
+)
+
+// How long to wait before retrying a file after a transient error: retryDelay at
+// first, twice as long each time after that, up to maxRetryDelay. Each wait is cut
+// short by a random amount, up to half, so that workers don't all retry at once.
+const (
+	retryDelay    = 100 * time.Millisecond
+	maxRetryDelay = 10 * time.Second
+)
+
+// isTransient returns true if err may well go away if the same is simply tried again,
+// such as a timeout on a network file system. Refusals, and errors like a missing
+// permission or a full disk, never do.
+func isTransient(err error) bool {
+	if err == nil || isFatal(err) {
+		return false
+	}
+	for _, errno := range transientErrnos {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	var timeout interface{ Timeout() bool }
+	return errors.As(err, &timeout) && timeout.Timeout()
+}
+
+// retry calls fn, which works on the entry at rel, and calls it again (up to Retries
+// times) for as long as it fails with a transient error, waiting longer each time.
+// Each retry is reported as an ActionRetry. If ctx is done while waiting, its error is
+// returned.
+func (m *Merger) retry(ctx context.Context, rel string, fn func() error) error {
+	delay := retryDelay
+	for n := 1; ; n++ {
+		err := fn()
+		if n > m.Retries || !isTransient(err) {
+			return err
+		}
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		m.log(Action{
+			Kind:  ActionRetry,
+			Dest:  filepath.Join(m.DestDir, rel),
+			Error: fmt.Sprintf("%s; retry %d of %d in %s", err, n, m.Retries, wait.Round(time.Millisecond)),
+		})
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		delay = min(delay*2, maxRetryDelay)
+	}
+}
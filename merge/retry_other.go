@@ -0,0 +1,6 @@
+//go:build windows || plan9
+
+package merge
+
+// transientErrnos is empty: only errors that report a timeout are retried here.
+var transientErrnos []error
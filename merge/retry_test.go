@@ -0,0 +1,80 @@
+package merge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"testing"
+)
+
+// timeoutError is a transient error, wherever the tests run.
+type timeoutError struct{}
+
+func (timeoutError) Error() string { return "timed out" }
+func (timeoutError) Timeout() bool { return true }
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{timeoutError{}, true},
+		{wrapErr(OpCopy, "a", &fs.PathError{Op: "write", Path: "/a", Err: timeoutError{}}), true},
+		{fs.ErrPermission, false},
+		{wrapErr(OpCopy, "a", ErrRefuse), false},
+		{context.DeadlineExceeded, false},
+		{fmt.Errorf("walking: %w", context.Canceled), false},
+	}
+	for _, tt := range tests {
+		if got := isTransient(tt.err); got != tt.want {
+			t.Errorf("isTransient(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	m, rec := newTestMerger(t, nil, nil)
+	m.Retries = 3
+	// fails returns a function failing with err the first n times it's called, and
+	// counting each call in calls.
+	calls := 0
+	fails := func(n int, err error) func() error {
+		calls = 0
+		return func() error {
+			calls++
+			if calls <= n {
+				return err
+			}
+			return nil
+		}
+	}
+	if err := m.retry(context.Background(), "a", fails(2, timeoutError{})); err != nil || calls != 3 {
+		t.Errorf("got %v after %d calls, want success after 3", err, calls)
+	}
+	retries := 0
+	for _, a := range rec.Actions {
+		if a.Kind == ActionRetry {
+			retries++
+		}
+	}
+	if retries != 2 {
+		t.Errorf("got %d retries reported, want 2", retries)
+	}
+
+	if err := m.retry(context.Background(), "a", fails(5, fs.ErrPermission)); !errors.Is(err, fs.ErrPermission) || calls != 1 {
+		t.Errorf("got %v after %d calls, want the error after 1", err, calls)
+	}
+	m.Retries = 1
+	if err := m.retry(context.Background(), "a", fails(5, timeoutError{})); !errors.Is(err, timeoutError{}) || calls != 2 {
+		t.Errorf("got %v after %d calls, want the error after 2", err, calls)
+	}
+
+	// Giving up waits no longer.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := m.retry(ctx, "a", fails(5, timeoutError{})); !errors.Is(err, context.Canceled) || calls != 1 {
+		t.Errorf("got %v after %d calls, want it cancelled after 1", err, calls)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !windows && !plan9
+
+package merge
+
+import "syscall"
+
+// transientErrnos are the errors isTransient retries: interrupted or timed out calls,
+// and network file systems losing track of a file or a connection for a moment.
+var transientErrnos = []error{
+	syscall.EAGAIN,
+	syscall.EINTR,
+	syscall.ETIMEDOUT,
+	syscall.ESTALE,
+	syscall.ECONNRESET,
+	syscall.ECONNABORTED,
+	syscall.EHOSTUNREACH,
+}
@@ -0,0 +1,113 @@
+package merge
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// revertFile restores destPath (at rel, relative to DestDir) from its backup. Unless
+// Force is set, destPath must still match srcPath, i.e. it must be upmerge that
+// replaced it; or for a file marked for removal, destPath must still be missing.
+func (m *Merger) revertFile(rel, srcPath, destPath, backupPath string) error {
+	if _, err := os.Lstat(backupPath); err != nil {
+		return wrapErr(OpRevert, rel, err)
+	}
+	if m.isRemoved(rel) {
+		srcPath = m.srcPath(rel + RemoveSuffix)
+		if fileExists(destPath) && !m.Force {
+			m.log(Action{
+				Kind:   ActionError,
+				Src:    srcPath,
+				Dest:   destPath,
+				Backup: backupPath,
+				Error:  fmt.Sprintf("refusing to revert the removal of a file that's back: %s", destPath),
+			})
+			return wrapErr(OpRevert, rel, ErrRefuse)
+		}
+	} else if !m.Force {
+		same, err := m.srcMatches(rel, destPath)
+		if err != nil {
+			return wrapErr(OpCompare, rel, err)
+		}
+		if !same {
+			m.log(Action{
+				Kind:   ActionError,
+				Src:    srcPath,
+				Dest:   destPath,
+				Backup: backupPath,
+				Error:  fmt.Sprintf("refusing to revert locally modified file: %s", destPath),
+			})
+			return wrapErr(OpRevert, rel, ErrRefuse)
+		}
+	}
+	if !m.DryRun {
+		if err := m.moveDest(backupPath, destPath); err != nil {
+			return wrapErr(OpRevert, rel, err)
+		}
+		if m.BackupRotate > 0 {
+			if err := m.unrotateBackups(m.backupBase(rel)); err != nil {
+				return wrapErr(OpRevert, rel, err)
+			}
+		}
+	}
+	m.log(Action{Kind: ActionRevert, Src: srcPath, Dest: destPath, Backup: backupPath})
+	return nil
+}
+
+// Revert restores the named files (or, if none are named, every tracked file that has
+// a backup) from their backups. Paths are relative to DestDir.
+func (m *Merger) Revert(ctx context.Context, paths []string) ([]Action, error) {
+	if err := m.start(true); err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		err := m.walkSrc(func(rel string, d fs.DirEntry, walkErr error) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if walkErr != nil {
+				return walkErr
+			}
+			if skip, err := m.skipExcluded(rel, d); skip {
+				return err
+			}
+			if d.IsDir() || m.isIgnored(rel) {
+				return nil
+			}
+			if target, ok := removeTarget(rel); ok {
+				rel = target
+			}
+			backupPath := m.backupPathFor(rel)
+			if !fileExists(backupPath) {
+				return nil
+			}
+			err := m.revertFile(rel, m.srcPath(rel), filepath.Join(m.DestDir, rel),
+				backupPath)
+			if err != nil {
+				m.fail(rel, err)
+			}
+			return err
+		})
+		return m.finish(err)
+	}
+	for _, path := range paths {
+		if err := ctx.Err(); err != nil {
+			return m.finish(err)
+		}
+		rel, err := relPath(m.DestDir, path)
+		if err != nil {
+			m.fail(path, err)
+			return m.finish(err)
+		}
+		err = m.revertFile(rel, m.srcPath(rel), filepath.Join(m.DestDir, rel),
+			m.backupPathFor(rel))
+		if err != nil {
+			m.fail(rel, err)
+			return m.finish(err)
+		}
+	}
+	return m.finish(nil)
+}
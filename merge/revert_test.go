@@ -0,0 +1,64 @@
+package merge
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestRevert(t *testing.T) {
+	m, _ := newTestMerger(t, tree{"a": "new a\n", "b": "new b\n", "c": "c\n"},
+		tree{"a": "old a\n", "b": "old b\n"})
+	run(t, m)
+	if _, err := m.Revert(context.Background(), []string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, m.DestDir, tree{
+		"a": "old a\n", "b": "new b\n", "b" + m.BackupSuffix: "old b\n", "c": "c\n",
+	})
+
+	// Without any named, everything with a backup is reverted, and what was new is
+	// left alone.
+	run(t, m)
+	if _, err := m.Revert(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, m.DestDir, tree{"a": "old a\n", "b": "old b\n", "c": "c\n"})
+}
+
+func TestRevertModified(t *testing.T) {
+	m, rec := newTestMerger(t, tree{"f": "new\n"}, tree{"f": "old\n"})
+	run(t, m)
+	writeTree(t, m.DestDir, tree{"f": "mine\n"})
+	_, err := m.Revert(context.Background(), []string{"f"})
+	var fe *FileError
+	if !errors.As(err, &fe) || fe.Path != "f" || fe.Op != OpRevert {
+		t.Fatalf("got %v, want a FileError for reverting f", err)
+	}
+	if !errors.Is(err, ErrRefuse) {
+		t.Errorf("got %v, want a refusal", err)
+	}
+	if len(rec.Errors) != 1 {
+		t.Errorf("got %d errors reported, want 1", len(rec.Errors))
+	}
+	checkTree(t, m.DestDir, tree{"f": "mine\n", "f" + m.BackupSuffix: "old\n"})
+
+	m.Force = true
+	if _, err := m.Revert(context.Background(), []string{"f"}); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, m.DestDir, tree{"f": "old\n"})
+}
+
+func TestRevertRotated(t *testing.T) {
+	m, _ := newTestMerger(t, tree{"f": "1\n"}, tree{"f": "0\n"})
+	m.BackupRotate = 3
+	run(t, m)
+	writeTree(t, m.SrcDir, tree{"f": "2\n"})
+	run(t, m)
+	if _, err := m.Revert(context.Background(), []string{"f"}); err != nil {
+		t.Fatal(err)
+	}
+	// The older backup takes the place of the one that was restored.
+	checkTree(t, m.DestDir, tree{"f": "1\n", "f" + m.BackupSuffix + "1": "0\n"})
+}
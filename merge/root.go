@@ -0,0 +1,40 @@
+package merge
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// rootArgs returns args with %root replaced by Root ("" if unset, so that "%root/etc"
+// is simply /etc).
+func (m *Merger) rootArgs(args []string) []string {
+	out := make([]string, len(args))
+	for i, arg := range args {
+		out[i] = strings.ReplaceAll(arg, "%root", m.Root)
+	}
+	return out
+}
+
+// rootLink returns target, that of the source symlink at rel, as it's to be recreated
+// in the destination: with RelativeLinks, an absolute target is made relative to where
+// the symlink goes, so that it points at the same place within Root (or /).
+func (m *Merger) rootLink(rel, target string) string {
+	if !m.RelativeLinks || !filepath.IsAbs(target) {
+		return target
+	}
+	root := m.Root
+	if root == "" {
+		root = string(filepath.Separator)
+	}
+	dir, err := filepath.Rel(root, filepath.Dir(filepath.Join(m.DestDir, rel)))
+	if err != nil || dir == ".." || strings.HasPrefix(dir, ".."+string(filepath.Separator)) {
+		// Not inside the root at all.
+		return target
+	}
+	// Both as they'd be seen from inside the root.
+	relTarget, err := filepath.Rel(filepath.Join(string(filepath.Separator), dir), target)
+	if err != nil {
+		return target
+	}
+	return relTarget
+}
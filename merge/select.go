@@ -0,0 +1,144 @@
+package merge
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+)
+
+// selecting returns true if Paths or Include narrow down which files in the source are
+// merged.
+func (m *Merger) selecting() bool {
+	return len(m.Paths) > 0 || len(m.Include) > 0
+}
+
+// srcPaths returns Paths, cleaned up and relative to SrcDir, as names in the source.
+func (m *Merger) srcPaths() ([]string, error) {
+	var names []string
+	for _, p := range m.Paths {
+		rel, err := relPath(m.SrcDir, p)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, srcName(rel))
+	}
+	return names, nil
+}
+
+// checkPaths checks that every one of Paths is in the source.
+func (m *Merger) checkPaths() error {
+	names, err := m.srcPaths()
+	if err != nil {
+		return err
+	}
+	for i, name := range names {
+		if _, err := fs.Stat(m.src(), name); err != nil {
+			return fmt.Errorf("%s: not in the source %s", m.Paths[i], m.SrcDir)
+		}
+	}
+	return nil
+}
+
+// isIncluded returns true if the file at rel in the source matches Include, or if
+// there's no Include at all. The last pattern that matches decides.
+func (m *Merger) isIncluded(rel string) bool {
+	if len(m.include) == 0 {
+		return true
+	}
+	name := splitRel(rel)
+	included := false
+	for _, r := range m.include {
+		if !r.dirOnly && matchParts(r.parts, name) {
+			included = !r.negate
+		}
+	}
+	return included
+}
+
+// isOnce returns true if the source file at rel is only copied if it's missing, as
+// given by Once.
+func (m *Merger) isOnce(rel string) bool {
+	return matchFile(m.once, rel)
+}
+
+// isForced returns true if a differing backup of the file at rel is to be
+// overwritten: with Force, or as given by ForceFiles.
+func (m *Merger) isForced(rel string) bool {
+	return m.Force || matchFile(m.forceFiles, rel)
+}
+
+// matchFile returns true if the file at rel matches rules. The last rule that matches
+// decides.
+func matchFile(rules []ignoreRule, rel string) bool {
+	name := splitRel(rel)
+	matched := false
+	for _, r := range rules {
+		if !r.dirOnly && matchParts(r.parts, name) {
+			matched = !r.negate
+		}
+	}
+	return matched
+}
+
+// selectSrc walks the parts of the source named by Paths (or all of it), and returns
+// the names of the files selected by Paths and Include, along with the directories
+// needed to hold them. Without Include, every directory in Paths is needed, even if
+// empty.
+func (m *Merger) selectSrc() (files, dirs map[string]bool, err error) {
+	roots := []string{"."}
+	if len(m.Paths) > 0 {
+		if roots, err = m.srcPaths(); err != nil {
+			return nil, nil, err
+		}
+	}
+	files, dirs = make(map[string]bool), make(map[string]bool)
+	need := func(name string) {
+		for ; name != "." && !dirs[name]; name = path.Dir(name) {
+			dirs[name] = true
+		}
+	}
+	for _, root := range roots {
+		err = m.walkDir(m.src(), root, true, func(name string, d fs.DirEntry, err error) error {
+			switch {
+			case err != nil:
+				// Let the real walk report it.
+				if d != nil && d.IsDir() {
+					need(name)
+				}
+			case d.IsDir():
+				if len(m.include) == 0 {
+					need(name)
+				}
+			case m.isIncluded(filepath.FromSlash(name)):
+				files[name] = true
+				need(path.Dir(name))
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return files, dirs, nil
+}
+
+// selectFunc wraps fn, a walk over the whole source, to only see the files (and the
+// directories needed) selected by Paths and Include.
+func (m *Merger) selectFunc(fn fs.WalkDirFunc) (fs.WalkDirFunc, error) {
+	files, dirs, err := m.selectSrc()
+	if err != nil {
+		return nil, err
+	}
+	return func(rel string, d fs.DirEntry, err error) error {
+		name := srcName(rel)
+		switch {
+		case err != nil, name == ".":
+		case d.IsDir() && !dirs[name]:
+			return fs.SkipDir
+		case !d.IsDir() && !files[name]:
+			return nil
+		}
+		return fn(rel, d, err)
+	}, nil
+}
@@ -0,0 +1,125 @@
+package merge
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// SlogObserver logs actions to Logger, each as a record with its kind, paths and error
+// as attributes: failures at slog.LevelError, warnings (such as drift) at
+// slog.LevelWarn, and the rest at slog.LevelDebug (only the changes, with
+// ChangedOnly). Diffs are printed to Diff, if set, instead. The paths relative to
+// their roots are attributes too; with Relative, they're the ones in the message.
+type SlogObserver struct {
+	Logger      *slog.Logger
+	Diff        io.Writer
+	ChangedOnly bool
+	Relative    bool
+}
+
+func (o SlogObserver) OnAction(a Action) {
+	if a.Kind == ActionDiff {
+		if o.Diff != nil {
+			fmt.Fprintln(o.Diff, a)
+		}
+		return
+	}
+	level := actionLevel(a.Kind)
+	if level == slog.LevelDebug && o.ChangedOnly && !a.IsChange() {
+		return
+	}
+	attrs := []slog.Attr{slog.String("action", a.Kind)}
+	for _, attr := range [][2]string{
+		{"src", a.Src}, {"dest", a.Dest}, {"backup", a.Backup}, {"target", a.Target},
+		{"command", a.Command}, {"error", a.Error},
+		{"srcRel", a.SrcRel}, {"destRel", a.DestRel}, {"backupRel", a.BackupRel},
+	} {
+		if attr[1] != "" {
+			attrs = append(attrs, slog.String(attr[0], attr[1]))
+		}
+	}
+	attrs = append(attrs, slog.Bool("dryRun", a.DryRun))
+	msg := a.String()
+	if o.Relative {
+		msg = a.Relative().String()
+	}
+	o.Logger.LogAttrs(context.Background(), level, msg, attrs...)
+}
+
+// OnError does nothing: the same errors are returned from the run.
+func (o SlogObserver) OnError(path string, err error) {}
+
+// actionLevel returns the level to log actions of the given kind at.
+func actionLevel(kind string) slog.Level {
+	switch kind {
+	case ActionError, ActionRefuse, ActionConflict, ActionInvalid:
+		return slog.LevelError
+	case ActionWarning, ActionDrift, ActionProtected:
+		return slog.LevelWarn
+	case ActionSnapshot:
+		return slog.LevelInfo
+	}
+	return slog.LevelDebug
+}
+
+// TextHandlerOptions are the options of a TextHandler.
+type TextHandlerOptions struct {
+	// Level is the lowest level logged; slog.LevelInfo if nil.
+	Level slog.Leveler
+	// Color colors the kind of each action (see LogObserver).
+	Color bool
+	// Time starts each line with the time of the record.
+	Time bool
+}
+
+// TextHandler is a slog.Handler that prints only the message of each record, one per
+// line, the way the upmerge command always has. Attributes are left out.
+type TextHandler struct {
+	w    io.Writer
+	opts TextHandlerOptions
+	mu   *sync.Mutex
+}
+
+// NewTextHandler returns a TextHandler writing to w.
+func NewTextHandler(w io.Writer, opts *TextHandlerOptions) *TextHandler {
+	h := &TextHandler{w: w, mu: &sync.Mutex{}}
+	if opts != nil {
+		h.opts = *opts
+	}
+	return h
+}
+
+func (h *TextHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	min := slog.LevelInfo
+	if h.opts.Level != nil {
+		min = h.opts.Level.Level()
+	}
+	return level >= min
+}
+
+func (h *TextHandler) Handle(ctx context.Context, r slog.Record) error {
+	line := r.Message
+	if h.opts.Color {
+		r.Attrs(func(a slog.Attr) bool {
+			if a.Key == "action" {
+				line = colorize(a.Value.String(), line)
+				return false
+			}
+			return true
+		})
+	}
+	if h.opts.Time && !r.Time.IsZero() {
+		line = r.Time.Format(time.RFC3339) + " " + line
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := fmt.Fprintln(h.w, line)
+	return err
+}
+
+func (h *TextHandler) WithAttrs(attrs []slog.Attr) slog.Handler { return h }
+func (h *TextHandler) WithGroup(name string) slog.Handler       { return h }
@@ -0,0 +1,186 @@
+package merge
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Ways of taking a snapshot of the destination, for Merger.Snapshot.
+const (
+	// SnapshotRequired fails the run, before anything is changed, if the snapshot
+	// can't be taken.
+	SnapshotRequired = "required"
+	// SnapshotBestEffort warns about a snapshot that can't be taken, and carries on.
+	SnapshotBestEffort = "best-effort"
+)
+
+// DefaultSnapshotDir is where the tarballs taken with Merger.Snapshot are kept.
+const DefaultSnapshotDir = "/var/backups/upmerge"
+
+// takeSnapshot takes a snapshot of the destination as it is before a run changes it,
+// and reports it as an ActionSnapshot, if Snapshot is set (and DryRun isn't). That's a
+// local APFS snapshot if there's one to take; otherwise, it's a tarball in SnapshotDir
+// of the existing entries that paths says the run changes, and there's none if it
+// changes none of them.
+func (m *Merger) takeSnapshot(ctx context.Context, paths func(context.Context) ([]string, error)) error {
+	if m.Snapshot == "" || m.DryRun {
+		return nil
+	}
+	id, err := localSnapshot(ctx, m.DestDir)
+	if id == "" && err == nil {
+		var rels []string
+		if rels, err = paths(ctx); err == nil && len(rels) > 0 {
+			id, err = m.snapshotTar(rels)
+		}
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	} else if err != nil && m.Snapshot == SnapshotBestEffort {
+		m.log(Action{Kind: ActionWarning, Dest: m.DestDir, Error: fmt.Sprintf("can't take a snapshot: %s", err)})
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("%w: %s", ErrSnapshot, err)
+	}
+	if id != "" {
+		m.log(Action{Kind: ActionSnapshot, Dest: m.DestDir, Backup: id})
+	}
+	return nil
+}
+
+// snapshotPaths returns the entries in the destination that a run changes, as planned:
+// those it replaces, removes, or gives another mode, and with Prune, those it prunes.
+func (m *Merger) snapshotPaths(ctx context.Context) ([]string, error) {
+	var rels []string
+	err := m.scanSrc(func(rel string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		} else if err := ctx.Err(); err != nil {
+			return err
+		}
+		if skip, err := m.skipExcluded(rel, d); skip {
+			return err
+		}
+		// Errors are reported by the run itself.
+		if step, err := m.planEntry(rel, d); err == nil && step != nil && changesDest(step) {
+			rels = append(rels, step.Path)
+		}
+		return nil
+	})
+	if err != nil || !m.Prune || m.manifest == nil {
+		return rels, err
+	}
+	for _, name := range m.manifest.names() {
+		if rel := filepath.FromSlash(name); !m.inSrc(rel) && fileExists(filepath.Join(m.DestDir, rel)) {
+			rels = append(rels, rel)
+		}
+	}
+	return rels, ctx.Err()
+}
+
+// planPaths returns the entries in the destination that the steps of plan change.
+func planPaths(plan *Plan) []string {
+	var rels []string
+	for i := range plan.Steps {
+		if changesDest(&plan.Steps[i]) {
+			rels = append(rels, filepath.Clean(plan.Steps[i].Path))
+		}
+	}
+	return rels
+}
+
+// changesDest returns true if step changes an entry that's in the destination already.
+func changesDest(step *Step) bool {
+	switch step.Kind {
+	case StepReplace, StepConflict, StepChmod, StepRemove, StepTypeConflict:
+		return true
+	}
+	return false
+}
+
+// snapshotTar writes the entries at rels in the destination (those that exist) to a
+// new gzipped tarball in SnapshotDir, named after the time, and returns its path.
+// Entries are relative to DestDir, and a directory's contents are left out.
+func (m *Merger) snapshotTar(rels []string) (string, error) {
+	dir := m.SnapshotDir
+	if dir == "" {
+		dir = DefaultSnapshotDir
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	name := time.Now().UTC().Format("20060102T150405Z")
+	path := filepath.Join(dir, name+".tar.gz")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	for n := 2; os.IsExist(err); n++ {
+		// Another run (such as for another pair) in the same second.
+		path = filepath.Join(dir, fmt.Sprintf("%s-%d.tar.gz", name, n))
+		f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	}
+	if err != nil {
+		return "", err
+	}
+	zw := gzip.NewWriter(f)
+	tw := tar.NewWriter(zw)
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag:   tar.TypeXGlobalHeader,
+		PAXRecords: map[string]string{"comment": "upmerge snapshot of " + m.DestDir},
+	})
+	for _, rel := range rels {
+		if err != nil {
+			break
+		}
+		err = m.snapshotEntry(tw, rel)
+	}
+	for _, w := range []io.Closer{tw, zw, f} {
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return path, nil
+}
+
+// snapshotEntry writes the entry at rel in the destination to tw, if it exists.
+func (m *Merger) snapshotEntry(tw *tar.Writer, rel string) error {
+	path := filepath.Join(m.DestDir, rel)
+	st, err := os.Lstat(path)
+	if isMissing(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var target string
+	if st.Mode()&fs.ModeSymlink != 0 {
+		if target, err = os.Readlink(path); err != nil {
+			return err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(st, target)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	hdr.Name = "./" + filepath.ToSlash(rel)
+	if st.IsDir() {
+		hdr.Name += "/"
+	}
+	if err = tw.WriteHeader(hdr); err != nil || hdr.Typeflag != tar.TypeReg {
+		return err
+	}
+	fr, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fr.Close()
+	_, err = io.Copy(tw, fr)
+	return err
+}
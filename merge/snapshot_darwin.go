@@ -0,0 +1,49 @@
+package merge
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// systemVolumes are the volumes tmutil takes local snapshots of: the system volume, and
+// the data volume that /etc and the home directories are firmlinked to.
+var systemVolumes = []string{"/", "/System/Volumes/Data"}
+
+// localSnapshot takes a local APFS snapshot with tmutil, and returns its date (as
+// listed by tmutil listlocalsnapshotdates), if dir is on the system volume. Otherwise,
+// it returns "".
+func localSnapshot(ctx context.Context, dir string) (string, error) {
+	st, err := os.Stat(dir)
+	if err != nil {
+		return "", nil
+	}
+	onSystem := false
+	for _, vol := range systemVolumes {
+		if volSt, err := os.Stat(vol); err == nil && fileFS(volSt) == fileFS(st) {
+			onSystem = true
+		}
+	}
+	if !onSystem {
+		return "", nil
+	}
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, "tmutil", "localsnapshot")
+	cmd.Stdout, cmd.Stderr = &out, &out
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(out.String()); msg != "" {
+			return "", fmt.Errorf("tmutil localsnapshot: %s", msg)
+		}
+		return "", fmt.Errorf("tmutil localsnapshot: %w", err)
+	}
+	// As in "Created local snapshot with date: 2006-01-02-150405".
+	for _, line := range strings.Split(out.String(), "\n") {
+		if _, date, found := strings.Cut(line, "date: "); found {
+			return strings.TrimSpace(date), nil
+		}
+	}
+	return "", fmt.Errorf("tmutil localsnapshot: no date in %q", strings.TrimSpace(out.String()))
+}
@@ -0,0 +1,10 @@
+//go:build !darwin
+
+package merge
+
+import "context"
+
+// localSnapshot returns "": local APFS snapshots are only on macOS.
+func localSnapshot(ctx context.Context, dir string) (string, error) {
+	return "", nil
+}
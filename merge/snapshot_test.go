@@ -0,0 +1,103 @@
+package merge
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+// readSnapshot returns the entries of the snapshot tarball at path.
+func readSnapshot(t *testing.T, path string) tree {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(zr)
+	got := tree{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		buf, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[hdr.Name] = string(buf)
+	}
+	return got
+}
+
+func TestSnapshot(t *testing.T) {
+	if runtime.GOOS == "darwin" {
+		t.Skip("snapshots are taken with tmutil")
+	}
+	m, rec := newTestMerger(t, tree{"a": "new a\n", "b": "b\n", "c": "c\n", "d/": ""},
+		tree{"a": "old a\n", "c": "c\n", "d/": ""})
+	m.Snapshot, m.SnapshotDir = SnapshotRequired, filepath.Join(t.TempDir(), "snapshots")
+	run(t, m)
+	var snapshots []string
+	for _, a := range rec.Actions {
+		if a.Kind == ActionSnapshot {
+			snapshots = append(snapshots, a.Backup)
+		}
+	}
+	if len(snapshots) != 1 {
+		t.Fatalf("got snapshots %q, want one", snapshots)
+	}
+	// Only what's changed is in it, as it was.
+	if got, want := readSnapshot(t, snapshots[0]), (tree{"./a": "old a\n"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q in the snapshot, want %q", got, want)
+	}
+
+	// With nothing to change, there's nothing to take.
+	rec.Actions = nil
+	run(t, m)
+	for _, a := range rec.Actions {
+		if a.Kind == ActionSnapshot {
+			t.Errorf("took %s, with nothing changed", a.Backup)
+		}
+	}
+}
+
+func TestSnapshotFailed(t *testing.T) {
+	if runtime.GOOS == "darwin" {
+		t.Skip("snapshots are taken with tmutil")
+	}
+	m, rec := newTestMerger(t, tree{"a": "new\n"}, tree{"a": "old\n"})
+	// There's a file where the directory would be.
+	m.Snapshot, m.SnapshotDir = SnapshotRequired, filepath.Join(m.DestDir, "a")
+	if _, err := m.Run(context.Background()); !errors.Is(err, ErrSnapshot) {
+		t.Fatalf("got %v, want %v", err, ErrSnapshot)
+	}
+	checkTree(t, m.DestDir, tree{"a": "old\n"})
+
+	m.Snapshot = SnapshotBestEffort
+	run(t, m)
+	checkTree(t, m.DestDir, tree{"a": "new\n", "a" + m.BackupSuffix: "old\n"})
+	warned := false
+	for _, a := range rec.Actions {
+		warned = warned || a.Kind == ActionWarning
+	}
+	if !warned {
+		t.Error("no warning about the snapshot")
+	}
+}
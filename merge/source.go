@@ -0,0 +1,380 @@
+package merge
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Modes given to files and directories from a source that doesn't carry permissions,
+// such as an embed.FS.
+const (
+	DefaultFileMode fs.FileMode = 0644
+	DefaultDirMode  fs.FileMode = 0755
+)
+
+// src returns the file system holding the source tree, as it's to be copied.
+func (m *Merger) src() fs.FS {
+	if m.overlays != nil {
+		return m.overlays
+	}
+	if m.appends != nil {
+		return m.appends
+	}
+	if m.templates != nil {
+		return m.templates
+	}
+	return m.rawSrc()
+}
+
+// rawSrc returns the file system holding the source tree, with any templates as they
+// are.
+func (m *Merger) rawSrc() fs.FS {
+	if m.SrcFS != nil {
+		return m.SrcFS
+	}
+	if m.layers != nil {
+		return m.layers
+	}
+	return os.DirFS(m.SrcDir)
+}
+
+// srcName converts rel, a path relative to the source root, into a name for src.
+func srcName(rel string) string {
+	return filepath.ToSlash(rel)
+}
+
+// walkSrc walks the source tree, calling fn for every entry (or only those selected by
+// Paths and Include), with paths relative to its root.
+func (m *Merger) walkSrc(fn fs.WalkDirFunc) error {
+	return m.walkSrcQuiet(false, fn)
+}
+
+// scanSrc is like walkSrc, for a walk made ahead of the real one: cycles and what's
+// too deep are left for that one to report.
+func (m *Merger) scanSrc(fn fs.WalkDirFunc) error {
+	return m.walkSrcQuiet(true, fn)
+}
+
+// walkSrcQuiet is walkSrc, or scanSrc with quiet.
+func (m *Merger) walkSrcQuiet(quiet bool, fn fs.WalkDirFunc) error {
+	if m.SrcFS == nil {
+		// os.DirFS would only say "stat .", which isn't very helpful; report the
+		// root the way filepath.WalkDir would.
+		if _, err := os.Lstat(m.SrcDir); err != nil {
+			return fn(".", nil, err)
+		}
+	}
+	if m.selecting() {
+		var err error
+		if fn, err = m.selectFunc(fn); err != nil {
+			return err
+		}
+	}
+	return m.walkDir(m.src(), ".", quiet, func(path string, d fs.DirEntry, err error) error {
+		return fn(filepath.FromSlash(path), m.withMeta(path, d), err)
+	})
+}
+
+// modeBits are the bits of a file's mode that are copied over.
+const modeBits = fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky
+
+// srcMode returns the mode to create a copy of the source entry described by st
+// with, substituting a default if the source doesn't carry permissions.
+func (m *Merger) srcMode(st fs.FileInfo) fs.FileMode {
+	if !m.srcHasPerms(st) {
+		if st.IsDir() {
+			return DefaultDirMode
+		}
+		return DefaultFileMode
+	}
+	return st.Mode() & modeBits
+}
+
+// srcHasPerms returns false if the source entry described by st doesn't carry any
+// permissions worth copying, as in an embed.FS.
+func (m *Merger) srcHasPerms(st fs.FileInfo) bool {
+	if mi, ok := st.(metaInfo); ok && mi.meta.hasMode {
+		return true
+	}
+	_, isEmbed := m.SrcFS.(embed.FS)
+	return !isEmbed && st.Mode().Perm() != 0
+}
+
+// srcMatches returns true if the source file at rel has the same contents as the file
+// at path. With Quick, it's enough for them to pass quickMatch.
+func (m *Merger) srcMatches(rel, path string) (bool, error) {
+	target, err := m.srcLink(rel)
+	if err != nil {
+		return false, err
+	}
+	if target != "" {
+		return linkMatches(path, target)
+	}
+	if m.Quick && m.quickMatch(rel, path) {
+		return true, nil
+	}
+	f1, err := m.src().Open(srcName(rel))
+	if err != nil {
+		return false, err
+	}
+	defer f1.Close()
+	f2, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f2.Close()
+	var same bool
+	if m.cache != nil {
+		same, err = m.cache.match(rel, f1, f2)
+	} else {
+		same, err = filesAreIdentical(f1, f2)
+	}
+	if err == nil && !same {
+		// Plists holding the same are the same, however they're written.
+		return m.plistMatches(rel, path), nil
+	}
+	return same, err
+}
+
+// looseMatch returns true if the source file at rel and the file at path are both
+// text, and only differ in what IgnoreLineEndings and IgnoreTrailingSpace ignore.
+func (m *Merger) looseMatch(rel, path string) bool {
+	if !m.IgnoreLineEndings && !m.IgnoreTrailingSpace {
+		return false
+	}
+	if target, err := m.srcLink(rel); err != nil || target != "" {
+		return false
+	}
+	dest, err := os.ReadFile(path)
+	if err != nil || isBinary(dest) {
+		return false
+	}
+	src, err := m.readSrc(rel)
+	if err != nil || isBinary(src) {
+		return false
+	}
+	return bytes.Equal(m.normalizeText(src), m.normalizeText(dest))
+}
+
+// normalizeText returns buf with what IgnoreLineEndings and IgnoreTrailingSpace ignore
+// taken out.
+func (m *Merger) normalizeText(buf []byte) []byte {
+	if m.IgnoreLineEndings {
+		buf = bytes.ReplaceAll(buf, []byte("\r\n"), []byte("\n"))
+		buf = bytes.ReplaceAll(buf, []byte("\r"), []byte("\n"))
+	}
+	if !m.IgnoreTrailingSpace {
+		return buf
+	}
+	var out []byte
+	for _, line := range splitLines(buf) {
+		text := strings.TrimRight(line, "\r\n")
+		out = append(out, strings.TrimRight(text, " \t")...)
+		out = append(out, line[len(text):]...)
+	}
+	return out
+}
+
+// srcDiff returns where the source file at rel first differs from the file at path, or
+// nil if it doesn't (or that can't be told).
+func (m *Merger) srcDiff(rel, path string) *DiffInfo {
+	f1, err := m.src().Open(srcName(rel))
+	if err != nil {
+		return nil
+	}
+	defer f1.Close()
+	f2, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f2.Close()
+	s1, err := f1.Stat()
+	if err != nil {
+		return nil
+	}
+	s2, err := f2.Stat()
+	if err != nil || !s2.Mode().IsRegular() {
+		return nil
+	}
+	d, err := diffReaders(f1, f2)
+	if d == nil || err != nil {
+		return nil
+	}
+	d.SrcSize, d.DestSize = s1.Size(), s2.Size()
+	d.Tail = d.Offset == min(d.SrcSize, d.DestSize)
+	return d
+}
+
+// plistMatches returns true if the source file at rel and the file at path are both
+// property lists, holding the same.
+func (m *Merger) plistMatches(rel, path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	f.Close()
+	if !looksLikePlist(head[:n]) {
+		return false
+	}
+	dest, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	src, err := m.readSrc(rel)
+	return err == nil && plistsMatch(src, dest)
+}
+
+// linkFS is implemented by source file systems that can report on symlinks themselves,
+// rather than following them.
+type linkFS interface {
+	fs.FS
+	Lstat(name string) (fs.FileInfo, error)
+	ReadLink(name string) (string, error)
+}
+
+// srcLink returns the target of the source entry at rel, if it's a symlink to be
+// recreated in the destination; otherwise, it returns "".
+func (m *Merger) srcLink(rel string) (string, error) {
+	if m.CopyLinks || m.generated(rel) {
+		// The output of a template is never a symlink.
+		return "", nil
+	}
+	if m.SrcFS == nil {
+		path := m.srcPath(rel)
+		st, err := os.Lstat(path)
+		if err != nil || st.Mode()&fs.ModeSymlink == 0 {
+			return "", err
+		}
+		target, err := os.Readlink(path)
+		return m.rootLink(rel, target), err
+	}
+	lfs, ok := m.SrcFS.(linkFS)
+	if !ok {
+		// Whatever the file system does with symlinks, it does on its own.
+		return "", nil
+	}
+	st, err := lfs.Lstat(srcName(rel))
+	if err != nil || st.Mode()&fs.ModeSymlink == 0 {
+		return "", err
+	}
+	target, err := lfs.ReadLink(srcName(rel))
+	return m.rootLink(rel, target), err
+}
+
+// quickMatch returns true if the source file at rel has the same size and
+// modification time as the file at path, without looking at their contents.
+func (m *Merger) quickMatch(rel, path string) bool {
+	s1, err := fs.Stat(m.src(), srcName(rel))
+	if err != nil || s1.ModTime().IsZero() {
+		return false
+	}
+	s2, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return s1.Size() == s2.Size() && s1.ModTime().Equal(s2.ModTime())
+}
+
+// copyFromSrc copies the source file at rel into destPath, which must not exist,
+// along with its extended attributes, times and owner (unless NoTimes or NoOwner are
+// set).
+func (m *Merger) copyFromSrc(ctx context.Context, rel, destPath string) error {
+	fr, err := m.src().Open(srcName(rel))
+	if err != nil {
+		return err
+	}
+	defer fr.Close()
+	st, err := fr.Stat()
+	if err == nil {
+		st, err = m.srcInfo(rel, st)
+	}
+	if err != nil {
+		return err
+	}
+	if err = m.writeFromSrc(ctx, rel, destPath, fr, st); err != nil {
+		return err
+	}
+	if m.SrcFS == nil {
+		from := m.srcPath(rel)
+		if dest := filepath.Join(m.DestDir, rel); m.keepsDest(rel) && fileExists(dest) {
+			// It's still the file in the destination, but for the block.
+			from = dest
+		}
+		for _, err := range copyXattrs(from, destPath, m.KeepQuarantine) {
+			m.log(Action{Kind: ActionWarning, Dest: destPath, Error: err.Error()})
+		}
+	}
+	if !m.NoTimes {
+		if err = copyTimes(destPath, st); err != nil {
+			return err
+		}
+	}
+	return m.copySrcOwner(destPath, st)
+}
+
+// clone is cloneFile, unless replaced to see how it's called.
+var clone = cloneFile
+
+// writeFromSrc writes the source file at rel (opened as fr, and described by st) to
+// destPath, which must not exist, with the source's mode. Unless NoClone is set, a file
+// in SrcDir is cloned if the file system can, rather than copied. Either way, the
+// extended attributes, times and owner are left to be set.
+func (m *Merger) writeFromSrc(ctx context.Context, rel, destPath string, fr fs.File, st fs.FileInfo) error {
+	if m.NoClone || m.SrcFS != nil || m.generated(rel) || !st.Mode().IsRegular() {
+		return m.writeNewDest(ctx, destPath, countingReader{fr, &m.copied}, m.srcMode(st))
+	}
+	if err := clone(m.srcPath(rel), destPath, m); err != nil {
+		// Not supported, or across file systems: a copy either works, or fails with
+		// a better error.
+		return m.writeNewDest(ctx, destPath, countingReader{fr, &m.copied}, m.srcMode(st))
+	}
+	atomic.AddInt64(&m.copied, st.Size())
+	// A clone may come with the source's times and attributes, which are set (or
+	// not) the same way as for a copy.
+	err := m.chmodDest(destPath, m.srcMode(st))
+	if err == nil && !m.KeepQuarantine {
+		err = dropQuarantine(destPath)
+	}
+	if err == nil && m.NoTimes {
+		now := time.Now()
+		err = os.Chtimes(destPath, now, now)
+	}
+	if err != nil {
+		m.removeDest(destPath)
+	}
+	return err
+}
+
+// generated returns true if the file at rel is made from the source, rather than
+// copied as it is: rendered from a template, spliced into from a fragment, or merged
+// into the destination's.
+func (m *Merger) generated(rel string) bool {
+	return m.srcFile(rel) != rel || m.isOverlaid(rel)
+}
+
+// keepsDest returns true if the file at rel is made from the destination's own, which
+// it keeps all of but the source's part: spliced into from a fragment, or merged into
+// (unless that failed, and it's replaced whole). Its backup is of the destination
+// before the last change, and differs from it for that change alone, so it's replaced
+// without asking, rather than guarded.
+func (m *Merger) keepsDest(rel string) bool {
+	if m.isAppended(rel) {
+		return true
+	}
+	return m.isOverlaid(rel) && m.overlays != nil && !m.overlays.isWarned(srcName(rel))
+}
+
+// readSrc returns the contents of the source file at rel.
+func (m *Merger) readSrc(rel string) ([]byte, error) {
+	return fs.ReadFile(m.src(), srcName(rel))
+}
@@ -0,0 +1,63 @@
+package merge
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func TestSrcFS(t *testing.T) {
+	m, _ := newTestMerger(t, nil, tree{"changed": "old\n", "same": "same\n"})
+	m.SrcFS = fstest.MapFS{
+		"new":         {Data: []byte("new\n")},
+		"changed":     {Data: []byte("changed\n")},
+		"same":        {Data: []byte("same\n")},
+		"dir":         {Mode: fs.ModeDir},
+		"dir/file":    {Data: []byte("file\n")},
+		"private":     {Data: []byte("private\n"), Mode: 0600},
+		"private dir": {Mode: fs.ModeDir | 0700},
+		"link":        {Data: []byte("new"), Mode: fs.ModeSymlink},
+	}
+	run(t, m)
+	checkTree(t, m.DestDir, tree{
+		"new":              "new\n",
+		"changed":          "changed\n",
+		"changed.upmerge~": "old\n",
+		"same":             "same\n",
+		"dir/":             "",
+		"dir/file":         "file\n",
+		"private":          "private\n",
+		"private dir/":     "",
+		"link":             "-> new",
+	})
+	// Without permissions given, files get the defaults.
+	modes := map[string]fs.FileMode{
+		"new":         DefaultFileMode,
+		"dir":         DefaultDirMode,
+		"dir/file":    DefaultFileMode,
+		"private":     0600,
+		"private dir": 0700,
+	}
+	for name, want := range modes {
+		st, err := os.Stat(filepath.Join(m.DestDir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := st.Mode() & fs.ModePerm; got != want {
+			t.Errorf("%s: mode %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestSrcFSDryRun(t *testing.T) {
+	m, rec := newTestMerger(t, nil, nil)
+	m.SrcFS = fstest.MapFS{"dir/file": {Data: []byte("file\n")}}
+	m.DryRun = true
+	run(t, m)
+	checkTree(t, m.DestDir, tree{})
+	if len(rec.Actions) != 2 {
+		t.Errorf("got actions %q, want a mkdir and a copy", kinds(rec.Actions))
+	}
+}
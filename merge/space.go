@@ -0,0 +1,137 @@
+package merge
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"math"
+)
+
+// DefaultSpaceMargin leaves room for what the size of a copy doesn't tell, such as
+// the blocks it takes up, its backup on another file system, or whatever else is
+// writing to the destination at the same time.
+const DefaultSpaceMargin = 2
+
+// SpaceError is returned before anything is changed if the file system holding Dir
+// hasn't got Need bytes free (the size of what's to be copied there, times the
+// SpaceMargin).
+type SpaceError struct {
+	Dir        string
+	Need, Free int64
+}
+
+func (e *SpaceError) Error() string {
+	return fmt.Sprintf("not enough free space in %s: %d bytes needed, %d free", e.Dir, e.Need, e.Free)
+}
+
+// checkSpace fails with a SpaceError if DestDir's file system hasn't got SpaceMargin
+// times the size of the files to copy free, unless NoSpaceCheck (or DryRun) is set.
+// Each of sizes returns that, or more: the first one to fit is enough, as the later
+// ones take longer to tell. If the free space can't be told, the check passes.
+func (m *Merger) checkSpace(ctx context.Context, sizes ...func(context.Context) int64) error {
+	if m.NoSpaceCheck || m.DryRun {
+		return nil
+	}
+	free, ok := freeSpace(m.DestDir)
+	if !ok {
+		return nil
+	}
+	margin := m.SpaceMargin
+	if margin < 1 {
+		margin = 1
+	}
+	var need int64
+	for _, size := range sizes {
+		need = int64(math.Ceil(float64(size(ctx)) * margin))
+		if need <= free {
+			return nil
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		// It's not known what was left out.
+		return err
+	}
+	return &SpaceError{Dir: m.DestDir, Need: need, Free: free}
+}
+
+// srcSize returns the size of every file in the source (as selected and excluded),
+// which is at least what a run copies.
+func (m *Merger) srcSize(ctx context.Context) int64 {
+	var total int64
+	m.scanSrc(func(rel string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		} else if err := ctx.Err(); err != nil {
+			return err
+		}
+		if skip, err := m.skipExcluded(rel, d); skip || d.IsDir() {
+			return err
+		}
+		if st, err := fs.Stat(m.src(), srcName(rel)); err == nil && st.Mode().IsRegular() {
+			total += st.Size()
+		}
+		return nil
+	})
+	return total
+}
+
+// copySize returns the size of the files a run copies, as planned: those missing from
+// the destination, and those that differ. Files are compared for it, as for the run.
+func (m *Merger) copySize(ctx context.Context) int64 {
+	var total int64
+	m.scanSrc(func(rel string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		} else if err := ctx.Err(); err != nil {
+			return err
+		}
+		if skip, err := m.skipExcluded(rel, d); skip || d.IsDir() {
+			return err
+		}
+		// Errors are reported by the run itself.
+		if step, err := m.planEntry(rel, d); err == nil && step != nil {
+			total += m.stepSize(step)
+		}
+		return nil
+	})
+	return total
+}
+
+// planSize returns the size of the files copied by the steps of plan.
+func (m *Merger) planSize(plan *Plan) int64 {
+	var total int64
+	for i := range plan.Steps {
+		total += m.stepSize(&plan.Steps[i])
+	}
+	return total
+}
+
+// stepSize returns the size of the source file that step copies into the destination,
+// or 0 if it doesn't.
+func (m *Merger) stepSize(step *Step) int64 {
+	switch step.Kind {
+	case StepCopy, StepReplace, StepConflict:
+	case StepTypeConflict:
+		if m.ResolveTypeConflicts != TypeConflictSrc || step.Mode.IsDir() {
+			return 0
+		}
+	default:
+		return 0
+	}
+	if step.Target != "" {
+		return 0
+	}
+	st, err := fs.Stat(m.src(), srcName(step.Path))
+	if err != nil || !st.Mode().IsRegular() {
+		return 0
+	}
+	return st.Size()
+}
+
+// clampSize converts n, a number of bytes, to an int64.
+func clampSize(n uint64) int64 {
+	if n > math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return int64(n)
+}
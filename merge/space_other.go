@@ -0,0 +1,8 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux
+
+package merge
+
+// freeSpace returns false: the free space isn't available here.
+func freeSpace(path string) (int64, bool) {
+	return 0, false
+}
@@ -0,0 +1,15 @@
+//go:build darwin || dragonfly || freebsd || linux
+
+package merge
+
+import "syscall"
+
+// freeSpace returns the number of bytes free (to an unprivileged user) on the file
+// system holding path, if known.
+func freeSpace(path string) (int64, bool) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, false
+	}
+	return clampSize(uint64(st.Bavail) * uint64(st.Bsize)), true
+}
@@ -0,0 +1,33 @@
+package merge
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCheckSpace(t *testing.T) {
+	big := strings.Repeat("x", 1024)
+	m, _ := newTestMerger(t, tree{"same": big, "new": "new\n"}, tree{"same": big})
+	free, ok := freeSpace(m.DestDir)
+	if !ok {
+		t.Skip("the free space can't be told here")
+	}
+	// Far more than there is, for the size of the source, but not for what's copied.
+	m.SpaceMargin = float64(free) / 1024 * 2
+	run(t, m)
+	checkTree(t, m.DestDir, tree{"same": big, "new": "new\n"})
+
+	writeTree(t, m.SrcDir, tree{"same": big + "changed"})
+	_, err := m.Run(context.Background())
+	var se *SpaceError
+	if !errors.As(err, &se) || se.Dir != m.DestDir || se.Free <= 0 || se.Need <= se.Free {
+		t.Fatalf("got %v, want a SpaceError", err)
+	}
+	checkTree(t, m.DestDir, tree{"same": big, "new": "new\n"})
+
+	m.NoSpaceCheck = true
+	run(t, m)
+	checkTree(t, m.DestDir, tree{"same": big + "changed", "same" + m.BackupSuffix: big, "new": "new\n"})
+}
@@ -0,0 +1,121 @@
+package merge
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"os"
+)
+
+// zeros is a chunk of a hole, for copyZeros to compare with.
+var zeros [bufSize]byte
+
+// isSparse returns true if the file described by st takes up less space on disk than
+// its size: it has holes in it, which read as zeros.
+func isSparse(st fs.FileInfo) bool {
+	blocks, ok := fileBlocks(st)
+	return ok && st.Mode().IsRegular() && blocks*512 < st.Size()
+}
+
+// copyContents copies everything from r into fw. A file with holes in it (read
+// directly, or through a countingReader) keeps them, by way of copySparse. A file
+// smaller than bufSize is copied through a buffer of its own size, rather than taking
+// one from bufPool.
+func copyContents(ctx context.Context, fw *os.File, r io.Reader) error {
+	src, counted := r, new(int64)
+	if cr, ok := r.(countingReader); ok {
+		src, counted = cr.Reader, cr.n
+	}
+	if f, ok := src.(*os.File); ok {
+		if st, err := f.Stat(); err == nil {
+			switch {
+			case isSparse(st):
+				return copySparse(ctx, fw, f, st.Size(), counted)
+			case st.Size() < bufSize:
+				buf := make([]byte, st.Size()+1)
+				_, err := io.CopyBuffer(struct{ io.Writer }{fw}, ctxReader{ctx, r}, buf)
+				return err
+			}
+		}
+	}
+	_, err := copyBuffered(fw, ctxReader{ctx, r})
+	return err
+}
+
+// copySparse copies src, which is size bytes long, into dest, only writing where src
+// has data: the holes are found with SEEK_DATA and SEEK_HOLE where the system has them,
+// or else by looking for runs of zeros. The bytes read are counted in n.
+func copySparse(ctx context.Context, dest, src *os.File, size int64, n *int64) error {
+	off := int64(0)
+	for canSeekHoles && off < size {
+		data, err := src.Seek(off, seekData)
+		if noMoreData(err) {
+			// Nothing but a hole up to the end.
+			off = size
+			break
+		} else if err != nil {
+			// Not on this file system.
+			break
+		}
+		hole, err := src.Seek(data, seekHole)
+		if err != nil {
+			hole = size
+		}
+		if err = copyRange(ctx, dest, src, data, hole-data, n); err != nil {
+			return err
+		}
+		off = hole
+	}
+	if off < size {
+		if err := copyZeros(ctx, dest, src, off, n); err != nil {
+			return err
+		}
+	}
+	// A hole at the end is only made by the size.
+	return dest.Truncate(size)
+}
+
+// copyRange copies length bytes from src into dest, both at off.
+func copyRange(ctx context.Context, dest, src *os.File, off, length int64, n *int64) error {
+	if _, err := src.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := dest.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := copyBuffered(dest, io.LimitReader(ctxReader{ctx, countingReader{src, n}}, length))
+	return err
+}
+
+// copyZeros copies the rest of src from off into dest, skipping over the chunks that
+// are all zeros instead of writing them.
+func copyZeros(ctx context.Context, dest, src *os.File, off int64, n *int64) error {
+	if _, err := src.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := dest.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	r := ctxReader{ctx, countingReader{src, n}}
+	b := getBuf()
+	defer putBuf(b)
+	buf := *b
+	for {
+		k, readErr := io.ReadFull(r, buf)
+		var err error
+		if bytes.Equal(buf[:k], zeros[:k]) {
+			_, err = dest.Seek(int64(k), io.SeekCurrent)
+		} else {
+			_, err = dest.Write(buf[:k])
+		}
+		switch {
+		case err != nil:
+			return err
+		case readErr == io.EOF || readErr == io.ErrUnexpectedEOF:
+			return nil
+		case readErr != nil:
+			return readErr
+		}
+	}
+}
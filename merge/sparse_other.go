@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !freebsd && !solaris
+
+package merge
+
+// canSeekHoles is false: copySparse has to find the holes itself.
+const (
+	canSeekHoles = false
+	seekData     = 0
+	seekHole     = 0
+)
+
+func noMoreData(err error) bool {
+	return false
+}
@@ -0,0 +1,21 @@
+//go:build linux || darwin || freebsd || solaris
+
+package merge
+
+import (
+	"errors"
+	"syscall"
+)
+
+// Whence for Seek to find the data and holes in a file; from <unistd.h>.
+const (
+	canSeekHoles = true
+	seekData     = 3
+	seekHole     = 4
+)
+
+// noMoreData returns true if err, from seeking to the next data, says there's only a
+// hole left.
+func noMoreData(err error) bool {
+	return errors.Is(err, syscall.ENXIO)
+}
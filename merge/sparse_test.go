@@ -0,0 +1,184 @@
+//go:build unix
+
+package merge
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// extent is data written at off in a sparse file.
+type extent struct {
+	off  int64
+	data string
+}
+
+// writeSparse creates the file at path, size bytes long, with nothing but extents in
+// it; the rest is left as holes where the file system can.
+func writeSparse(t *testing.T, path string, size int64, extents []extent) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err = f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range extents {
+		if _, err = f.WriteAt([]byte(e.data), e.off); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// usage returns the size of the file at path, and the space it takes up on disk.
+func usage(t *testing.T, path string) (size, used int64) {
+	t.Helper()
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks, ok := fileBlocks(st)
+	if !ok {
+		t.Skip("the space taken up by files isn't known here")
+	}
+	return st.Size(), blocks * 512
+}
+
+// supportsHoles returns true if files in dir can have holes.
+func supportsHoles(t *testing.T, dir string) bool {
+	t.Helper()
+	path := filepath.Join(dir, "holes")
+	writeSparse(t, path, 4*mib, nil)
+	defer os.Remove(path)
+	_, used := usage(t, path)
+	return used < 4*mib
+}
+
+const mib = 1 << 20
+
+var sparseTests = []struct {
+	name    string
+	size    int64
+	extents []extent
+}{
+	{name: "hole at the end", size: 4 * mib, extents: []extent{{0, "start"}}},
+	{name: "hole at the start", size: 4 * mib, extents: []extent{{4*mib - 3, "end"}}},
+	{name: "holes around", size: 4 * mib, extents: []extent{{2 * mib, "middle"}}},
+	{name: "holes between", size: 8 * mib, extents: []extent{{0, "start"}, {4 * mib, "middle"}, {8*mib - 3, "end"}}},
+	{name: "all hole", size: 4 * mib},
+}
+
+func TestSparse(t *testing.T) {
+	for _, tt := range sparseTests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := newTestMerger(t, nil, nil)
+			src, dest := filepath.Join(m.SrcDir, "f"), filepath.Join(m.DestDir, "f")
+			if !supportsHoles(t, m.SrcDir) {
+				t.Skip("no holes on this file system")
+			}
+			writeSparse(t, src, tt.size, tt.extents)
+			run(t, m)
+			want, err := os.ReadFile(src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := os.ReadFile(dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("contents differ from the source")
+			}
+			size, used := usage(t, dest)
+			if size != tt.size {
+				t.Errorf("size %d, want %d", size, tt.size)
+			}
+			// Only the data takes up space, give or take a few blocks for each extent.
+			if limit := int64(len(tt.extents)+1) * 64 * 1024; used > limit {
+				t.Errorf("takes up %d bytes, want at most %d", used, limit)
+			}
+			// And compared the same as any other file.
+			if got := kinds(run(t, m)); len(got) != 1 || got[0] != ActionOK+" f" {
+				t.Errorf("second run: %q, want only ok f", got)
+			}
+		})
+	}
+}
+
+func TestSparseCompare(t *testing.T) {
+	dir := t.TempDir()
+	a, b, c := filepath.Join(dir, "a"), filepath.Join(dir, "b"), filepath.Join(dir, "c")
+	writeSparse(t, a, 4*mib, []extent{{mib, "data"}})
+	writeSparse(t, b, 4*mib, []extent{{mib, "data"}})
+	// The same size, but with a byte where the others have a hole.
+	writeSparse(t, c, 4*mib, []extent{{mib, "data"}, {3 * mib, "x"}})
+	for _, tt := range []struct {
+		a, b string
+		same bool
+	}{{a, b, true}, {a, c, false}} {
+		same, err := fileContentsAreIdentical(tt.a, tt.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if same != tt.same {
+			t.Errorf("fileContentsAreIdentical(%s, %s) = %v, want %v",
+				filepath.Base(tt.a), filepath.Base(tt.b), same, tt.same)
+		}
+	}
+}
+
+func TestCopyZeros(t *testing.T) {
+	// Where holes can't be sought, runs of zeros are skipped over instead, even in a
+	// file that has them written out.
+	for _, tt := range sparseTests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			srcPath, destPath := filepath.Join(dir, "src"), filepath.Join(dir, "dest")
+			want := make([]byte, tt.size)
+			for _, e := range tt.extents {
+				copy(want[e.off:], e.data)
+			}
+			if err := os.WriteFile(srcPath, want, 0644); err != nil {
+				t.Fatal(err)
+			}
+			src, err := os.Open(srcPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer src.Close()
+			dest, err := os.Create(destPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dest.Close()
+			var n int64
+			if err = copyZeros(context.Background(), dest, src, 0, &n); err == nil {
+				err = dest.Truncate(tt.size)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != tt.size {
+				t.Errorf("read %d bytes, want %d", n, tt.size)
+			}
+			got, err := os.ReadFile(destPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("contents differ from the source")
+			}
+			if !supportsHoles(t, dir) {
+				return
+			}
+			if _, used := usage(t, destPath); used > int64(len(tt.extents)+1)*64*1024 {
+				t.Errorf("takes up %d bytes, with holes left out", used)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package merge
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+// specialModes are the types of files that can't be copied like regular files.
+const specialModes = fs.ModeNamedPipe | fs.ModeSocket | fs.ModeDevice | fs.ModeCharDevice | fs.ModeIrregular
+
+// specialName describes the type of special file in mode.
+func specialName(mode fs.FileMode) string {
+	switch {
+	case mode&fs.ModeCharDevice != 0:
+		return "character device"
+	case mode&fs.ModeDevice != 0:
+		return "block device"
+	case mode&fs.ModeNamedPipe != 0:
+		return "named pipe"
+	case mode&fs.ModeSocket != 0:
+		return "socket"
+	}
+	return "irregular file"
+}
+
+// planSpecial plans step for a special file of type typ in the source. These are
+// skipped, except for devices that are recreated with Devices. It returns nil if there's
+// nothing to do.
+func (m *Merger) planSpecial(step *Step, typ fs.FileMode) (*Step, error) {
+	step.Kind = StepSpecial
+	step.Mode = typ
+	if !m.Devices || typ&fs.ModeDevice == 0 || os.Geteuid() != 0 {
+		return step, nil
+	}
+	destSt, err := os.Lstat(step.Dest)
+	if os.IsNotExist(err) {
+		step.Kind = StepMknod
+		return step, nil
+	} else if err != nil {
+		return nil, wrapErr(OpCompare, step.Path, err)
+	}
+	st, err := fs.Stat(m.src(), srcName(step.Path))
+	if err != nil {
+		return nil, wrapErr(OpCompare, step.Path, err)
+	}
+	mode, dev, _ := fileDevice(st)
+	if destMode, destDev, ok := fileDevice(destSt); ok && destMode == mode && destDev == dev {
+		return nil, nil
+	}
+	// Something else is in the way; leave it be.
+	return step, nil
+}
+
+// skipSpecial reports a special file that's not copied. With Strict, it's also a
+// failure, though the run carries on.
+func (m *Merger) skipSpecial(step *Step) {
+	m.log(Action{Kind: ActionSkip, Src: step.Src, Dest: step.Dest, Error: specialName(step.Mode)})
+	if !m.Strict {
+		return
+	}
+	err := wrapErr(OpCopy, step.Path, fmt.Errorf("%w: %s", ErrSpecial, specialName(step.Mode)))
+	m.fail(step.Path, err)
+	m.mu.Lock()
+	m.failures = append(m.failures, err)
+	m.mu.Unlock()
+}
+
+// makeDevice recreates the source device of step in the destination, with its
+// permissions, owner and times.
+func (m *Merger) makeDevice(step *Step) error {
+	if !m.DryRun {
+		st, err := fs.Stat(m.src(), srcName(step.Path))
+		if err != nil {
+			return wrapErr(OpCopy, step.Path, err)
+		}
+		mode, dev, ok := fileDevice(st)
+		if !ok {
+			return wrapErr(OpCopy, step.Path, fmt.Errorf("%w: %s", ErrSpecial, specialName(step.Mode)))
+		}
+		if err = mknod(step.Dest, mode, dev); err == nil {
+			err = m.chmodDest(step.Dest, st.Mode()&modeBits)
+		}
+		if err == nil && !m.NoTimes {
+			err = copyTimes(step.Dest, st)
+		}
+		if err == nil {
+			err = copyOwner(step.Dest, st)
+		}
+		if err != nil {
+			return wrapErr(OpCopy, step.Path, err)
+		}
+	}
+	m.log(Action{Kind: ActionMknod, Src: step.Src, Dest: step.Dest})
+	return nil
+}
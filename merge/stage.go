@@ -0,0 +1,84 @@
+package merge
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// tempInfix goes between the name of a destination file and the process ID, to name
+// the temporary file its new version is written to.
+const tempInfix = ".upmerge.tmp."
+
+// tempPath returns the temporary file that the new version of destPath is staged in.
+func tempPath(destPath string) string {
+	return destPath + tempInfix + strconv.Itoa(os.Getpid())
+}
+
+// stage brings the source of step over next to its destination, as a copy or as a new
+// symlink to the same target, and returns the temporary path it's at, once it's passed
+// the validators. Nothing is left behind if it fails.
+func (m *Merger) stage(ctx context.Context, step *Step) (string, error) {
+	tmp := tempPath(step.Dest)
+	// Only a run with the same process ID, which must be over, could have left it.
+	m.removeDest(tmp)
+	var err error
+	if step.Target != "" {
+		err = m.symlinkDest(step.Target, tmp)
+	} else if step.merged != nil {
+		err = m.writeMerged(ctx, step, tmp)
+	} else {
+		err = m.copyFromSrc(ctx, step.Path, tmp)
+	}
+	if err == nil {
+		err = m.validate(ctx, step, tmp)
+	}
+	if err != nil {
+		m.removeDest(tmp)
+		return "", err
+	}
+	return tmp, nil
+}
+
+// install renames tmp, as returned by stage, over the destination of step. The source's
+// file flags are only set then, since they might prevent renaming.
+func (m *Merger) install(step *Step, tmp string) error {
+	if err := m.renameDest(tmp, step.Dest); err != nil {
+		m.removeDest(tmp)
+		return err
+	}
+	if step.Target == "" {
+		if st, err := fs.Stat(m.src(), srcName(step.Path)); err == nil {
+			if st, err = m.srcInfo(step.Path, st); err == nil {
+				m.copySrcFlags(step.Dest, st)
+			}
+		}
+	}
+	return nil
+}
+
+// create brings the source of step over to its destination, by way of stage and
+// install.
+func (m *Merger) create(ctx context.Context, step *Step) error {
+	tmp, err := m.stage(ctx, step)
+	if err != nil {
+		return err
+	}
+	return m.install(step, tmp)
+}
+
+// checkLeftovers warns about temporary files left in the destination directory at
+// rel by an earlier run that was cut short.
+func (m *Merger) checkLeftovers(rel string) {
+	matches, _ := filepath.Glob(filepath.Join(m.DestDir, rel, "*"+tempInfix+"*"))
+	for _, path := range matches {
+		m.log(Action{
+			Kind:  ActionWarning,
+			Dest:  path,
+			Error: fmt.Sprintf("leftover temporary file from an interrupted run: %s", path),
+		})
+	}
+}
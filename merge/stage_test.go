@@ -0,0 +1,102 @@
+package merge
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+var errInjected = errors.New("injected failure")
+
+// failingFS is a file system whose files fail to read past their first n bytes.
+type failingFS struct {
+	fstest.MapFS
+	n int
+}
+
+func (fsys failingFS) Open(name string) (fs.File, error) {
+	f, err := fsys.MapFS.Open(name)
+	if st, statErr := fs.Stat(fsys.MapFS, name); err != nil || statErr != nil || st.IsDir() {
+		return f, err
+	}
+	return &failingFile{File: f, left: fsys.n}, nil
+}
+
+// failingFile fails to read once left bytes have been read.
+type failingFile struct {
+	fs.File
+	left int
+}
+
+func (f *failingFile) Read(p []byte) (int, error) {
+	if f.left <= 0 {
+		return 0, errInjected
+	}
+	if len(p) > f.left {
+		p = p[:f.left]
+	}
+	n, err := f.File.Read(p)
+	f.left -= n
+	return n, err
+}
+
+func TestCopyFailure(t *testing.T) {
+	big := strings.Repeat("x", 3*bufSize)
+	tests := []struct {
+		name string
+		dest tree
+	}{
+		{name: "new file"},
+		{name: "replaced file", dest: tree{"f": "old"}},
+		{name: "replaced file with a backup", dest: tree{"f": "old", "f.upmerge~": "old"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := newTestMerger(t, nil, tt.dest)
+			m.SrcFS = failingFS{fstest.MapFS{"f": {Data: []byte(big), Mode: 0644}}, bufSize + 10}
+			_, err := m.Run(context.Background())
+			if !errors.Is(err, errInjected) {
+				t.Fatalf("got %v, want the injected failure", err)
+			}
+			// What's left is said, and it's what was there before.
+			state := "left unchanged"
+			if tt.dest == nil {
+				state = "not created"
+			}
+			if !strings.Contains(err.Error(), state) {
+				t.Errorf("got %q, want it to say the file was %s", err, state)
+			}
+			want := tt.dest
+			if want == nil {
+				want = tree{}
+			}
+			checkTree(t, m.DestDir, want)
+		})
+	}
+}
+
+func TestWriteNewFileFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "f")
+	r := io.MultiReader(strings.NewReader("partial"), &failingFile{})
+	if err := writeNewFile(context.Background(), path, r, 0644); !errors.Is(err, errInjected) {
+		t.Fatalf("got %v, want the injected failure", err)
+	}
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("partial file left behind: %v", err)
+	}
+}
+
+func TestRestoreBackup(t *testing.T) {
+	m, _ := newTestMerger(t, nil, tree{"f.upmerge~": "old"})
+	dir := m.DestDir
+	if err := m.restoreBackup(filepath.Join(dir, "f"), filepath.Join(dir, "f.upmerge~")); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, dir, tree{"f": "old", "f.upmerge~": "old"})
+}
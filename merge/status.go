@@ -0,0 +1,166 @@
+package merge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// File states reported by Merger.Status.
+const (
+	StateMissing      = "missing"          // not yet in dest
+	StateInSync       = "in-sync"          // dest matches source
+	StateModified     = "modified-in-dest" // source differs, there's no backup
+	StatePending      = "pending-update"   // source differs, backup matches dest
+	StateBlocked      = "blocked"          // source differs, backup differs
+	StateForced       = "forced-update"    // source differs, backup differs, but forced
+	StateStaleBackup  = "stale-backup"     // dest matches source, but the backup lingers
+	StateRemoved      = "removed"          // marked for removal, and not in dest
+	StateRemove       = "pending-remove"   // marked for removal, backup matches dest
+	StateOnce         = "seeded"           // only copied if missing, and it's in dest
+	StateTypeConflict = "type-conflict"    // dest is a directory, source isn't
+)
+
+// FileStatus is the state of a single file tracked in SrcDir.
+type FileStatus struct {
+	State  string
+	Src    string
+	Dest   string
+	Backup string
+}
+
+// fileExists returns true if anything exists at path.
+func fileExists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// isMissing returns true if err, from a stat, says there's nothing there: not even
+// its parent directory, which may be a file.
+func isMissing(err error) bool {
+	return os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR)
+}
+
+// classify determines the state of a single tracked file, at rel.
+func (m *Merger) classify(rel, destPath, backupPath string) (string, error) {
+	if !fileExists(destPath) {
+		return StateMissing, nil
+	} else if m.isOnce(rel) {
+		return StateOnce, nil
+	} else if st, err := os.Stat(destPath); err == nil && st.IsDir() {
+		return StateTypeConflict, nil
+	}
+	same, err := m.srcMatches(rel, destPath)
+	if err != nil {
+		return "", err
+	}
+	same = same || m.looseMatch(rel, destPath)
+	hasBackup := fileExists(backupPath)
+	if same {
+		if hasBackup {
+			return StateStaleBackup, nil
+		}
+		return StateInSync, nil
+	}
+	if !hasBackup {
+		return StateModified, nil
+	}
+	same, err = fileContentsAreIdentical(destPath, backupPath)
+	if err != nil {
+		return "", err
+	}
+	if same || m.keepsDest(rel) {
+		return StatePending, nil
+	} else if m.isForced(rel) {
+		return StateForced, nil
+	}
+	return StateBlocked, nil
+}
+
+// classifyRemoved determines the state of a file marked for removal in the source, at
+// rel.
+func (m *Merger) classifyRemoved(rel, destPath, backupPath string) (string, error) {
+	if !fileExists(destPath) {
+		return StateRemoved, nil
+	}
+	if !fileExists(backupPath) {
+		return StateRemove, nil
+	}
+	same, err := fileContentsAreIdentical(destPath, backupPath)
+	if err != nil {
+		return "", err
+	}
+	if same {
+		return StateRemove, nil
+	} else if m.isForced(rel) {
+		return StateForced, nil
+	}
+	return StateBlocked, nil
+}
+
+// Status walks the source and determines the state of every tracked file, without
+// changing anything. It returns the states determined so far, even if it fails part
+// way.
+func (m *Merger) Status(ctx context.Context) ([]FileStatus, error) {
+	var result []FileStatus
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	if err := m.ValidateDirs(true); err != nil {
+		return nil, err
+	}
+	if err := m.loadLayers(); err != nil {
+		return nil, err
+	}
+	if err := m.loadTemplates(); err != nil {
+		return nil, err
+	}
+	m.loadAppends()
+	m.loadOverlays()
+	if err := m.loadIgnore(); err != nil {
+		return nil, err
+	}
+	m.loadCache()
+	err := m.walkSrc(func(rel string, d fs.DirEntry, walkErr error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if walkErr != nil {
+			return walkErr
+		}
+		if skip, err := m.skipExcluded(rel, d); skip {
+			return err
+		}
+		if d.IsDir() || d.Type()&specialModes != 0 || m.isIgnored(rel) {
+			return nil
+		}
+		srcPath := m.srcPath(rel)
+		classify := m.classify
+		if target, ok := removeTarget(rel); ok {
+			rel = target
+			classify = m.classifyRemoved
+		}
+		destPath := filepath.Join(m.DestDir, rel)
+		backupPath := m.backupPathFor(rel)
+		state, err := classify(rel, destPath, backupPath)
+		if err != nil {
+			m.fail(rel, err)
+			return err
+		}
+		result = append(result, FileStatus{
+			State:  state,
+			Src:    srcPath,
+			Dest:   destPath,
+			Backup: backupPath,
+		})
+		return nil
+	})
+	if cacheErr := m.saveCache(); cacheErr != nil && err == nil {
+		err = fmt.Errorf("saving cache: %w", cacheErr)
+	}
+	return result, err
+}
@@ -0,0 +1,76 @@
+package merge
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStatus(t *testing.T) {
+	m, _ := newTestMerger(t, tree{
+		"missing":               "new\n",
+		"same":                  "same\n",
+		"modified":              "new\n",
+		"pending":               "new\n",
+		"blocked":               "new\n",
+		"stale":                 "same\n",
+		"gone" + RemoveSuffix:   "",
+		"remove" + RemoveSuffix: "",
+		"dir":                   "new\n",
+	}, tree{
+		"same":               "same\n",
+		"modified":           "old\n",
+		"pending":            "old\n",
+		"pending.upmerge~":   "old\n",
+		"blocked":            "old\n",
+		"blocked.upmerge~":   "older\n",
+		"stale":              "same\n",
+		"stale.upmerge~":     "old\n",
+		"remove":             "old\n",
+		"dir/":               "",
+		"dir/f":              "f\n",
+		"untracked":          "mine\n",
+		"untracked.upmerge~": "mine\n",
+	})
+	want := map[string]string{
+		"missing":  StateMissing,
+		"same":     StateInSync,
+		"modified": StateModified,
+		"pending":  StatePending,
+		"blocked":  StateBlocked,
+		"stale":    StateStaleBackup,
+		"gone":     StateRemoved,
+		"remove":   StateRemove,
+		"dir":      StateTypeConflict,
+	}
+	before := readTree(t, m.DestDir)
+	// states returns the state of every file reported, by the path of its destination.
+	states := func() map[string]string {
+		t.Helper()
+		result, err := m.Status(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[string]string)
+		for _, st := range result {
+			rel, _ := filepath.Rel(m.DestDir, st.Dest)
+			got[filepath.ToSlash(rel)] = st.State
+			if st.Backup != m.backupPathFor(rel) {
+				t.Errorf("%s: got backup %s", rel, st.Backup)
+			}
+		}
+		return got
+	}
+	if got := states(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	checkTree(t, m.DestDir, before)
+
+	// Forced, only what's blocked changes.
+	m.Force = true
+	want["blocked"] = StateForced
+	if got := states(); !reflect.DeepEqual(got, want) {
+		t.Errorf("forced: got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,30 @@
+//go:build windows || plan9 || wasip1
+
+package merge
+
+import "io/fs"
+
+// fileInode returns 0: inode numbers aren't available here.
+func fileInode(st fs.FileInfo) uint64 {
+	return 0
+}
+
+// fileFS returns 0: device numbers aren't available here.
+func fileFS(st fs.FileInfo) uint64 {
+	return 0
+}
+
+// sysOwner returns false: owners aren't available here.
+func sysOwner(st fs.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
+
+// fileBlocks returns false: the space taken up on disk isn't available here.
+func fileBlocks(st fs.FileInfo) (int64, bool) {
+	return 0, false
+}
+
+// isCrossDevice returns false: renames onto another device aren't told apart here.
+func isCrossDevice(err error) bool {
+	return false
+}
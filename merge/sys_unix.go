@@ -0,0 +1,47 @@
+//go:build !windows && !plan9 && !wasip1
+
+package merge
+
+import (
+	"errors"
+	"io/fs"
+	"syscall"
+)
+
+// fileInode returns the inode number of the file described by st, or 0 if unknown.
+func fileInode(st fs.FileInfo) uint64 {
+	if sys, ok := st.Sys().(*syscall.Stat_t); ok {
+		return uint64(sys.Ino)
+	}
+	return 0
+}
+
+// fileFS returns the device holding the file described by st, or 0 if unknown.
+func fileFS(st fs.FileInfo) uint64 {
+	if sys, ok := st.Sys().(*syscall.Stat_t); ok {
+		return uint64(sys.Dev)
+	}
+	return 0
+}
+
+// sysOwner returns the owner and group of the file described by st, if known.
+func sysOwner(st fs.FileInfo) (uid, gid int, ok bool) {
+	if sys, ok := st.Sys().(*syscall.Stat_t); ok {
+		return int(sys.Uid), int(sys.Gid), true
+	}
+	return 0, 0, false
+}
+
+// fileBlocks returns the number of 512-byte blocks the file described by st takes up
+// on disk, if known.
+func fileBlocks(st fs.FileInfo) (int64, bool) {
+	if sys, ok := st.Sys().(*syscall.Stat_t); ok {
+		return int64(sys.Blocks), true
+	}
+	return 0, false
+}
+
+// isCrossDevice returns true if err is from renaming a file onto another device.
+func isCrossDevice(err error) bool {
+	return errors.Is(err, syscall.EXDEV)
+}
@@ -0,0 +1,211 @@
+package merge
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// TemplateSuffix marks the source files that, with Templates, are rendered as
+// text/templates, and copied without it.
+const TemplateSuffix = ".tmpl"
+
+// templateFS shows the templates in a source file system as the files they render
+// to. The templates themselves are hidden.
+type templateFS struct {
+	fs.FS
+	data map[string]interface{}
+
+	mu       sync.Mutex
+	rendered map[string][]byte
+}
+
+// loadTemplates sets up rendering the templates in the source, with Templates.
+func (m *Merger) loadTemplates() error {
+	m.templates = nil
+	if !m.Templates {
+		return nil
+	}
+	hostname := m.Hostname
+	if hostname == "" {
+		var err error
+		if hostname, err = os.Hostname(); err != nil {
+			return err
+		}
+	}
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			env[k] = v
+		}
+	}
+	vars := m.Vars
+	if vars == nil {
+		vars = make(map[string]string)
+	}
+	m.templates = &templateFS{
+		FS: m.rawSrc(),
+		data: map[string]interface{}{
+			"Hostname": hostname,
+			"OS":       runtime.GOOS,
+			"Arch":     runtime.GOARCH,
+			"Env":      env,
+			"Vars":     vars,
+		},
+		rendered: make(map[string][]byte),
+	}
+	return nil
+}
+
+// srcFile returns the path of the file in the source that the file at rel is made
+// from: its fragment, if it's spliced into, or its template, if that's what it's
+// rendered from.
+func (m *Merger) srcFile(rel string) string {
+	if m.isAppended(rel) {
+		rel += AppendSuffix
+	}
+	if m.templates != nil && m.templates.isTemplate(srcName(rel)+TemplateSuffix) {
+		return rel + TemplateSuffix
+	}
+	return rel
+}
+
+// isTemplate returns true if name is a regular file, to be rendered.
+func (t *templateFS) isTemplate(name string) bool {
+	st, err := fs.Stat(t.FS, name)
+	return err == nil && st.Mode().IsRegular()
+}
+
+// render returns the output of the template at name.
+func (t *templateFS) render(name string) ([]byte, error) {
+	t.mu.Lock()
+	out, ok := t.rendered[name]
+	t.mu.Unlock()
+	if ok {
+		return out, nil
+	}
+	text, err := fs.ReadFile(t.FS, name)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(string(text))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err = tmpl.Execute(&buf, t.data); err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	t.rendered[name] = buf.Bytes()
+	t.mu.Unlock()
+	return buf.Bytes(), nil
+}
+
+// renderedInfo describes the output of a template, as a file named after it.
+func (t *templateFS) renderedInfo(name string) (fs.FileInfo, error) {
+	st, err := fs.Stat(t.FS, name+TemplateSuffix)
+	if err != nil {
+		return nil, err
+	}
+	out, err := t.render(name + TemplateSuffix)
+	if err != nil {
+		return nil, err
+	}
+	return renderedInfo{st, path.Base(name), int64(len(out))}, nil
+}
+
+func (t *templateFS) Open(name string) (fs.File, error) {
+	if t.isTemplate(name + TemplateSuffix) {
+		st, err := t.renderedInfo(name)
+		if err != nil {
+			return nil, err
+		}
+		out, err := t.render(name + TemplateSuffix)
+		if err != nil {
+			return nil, err
+		}
+		return &renderedFile{bytes.NewReader(out), st}, nil
+	}
+	if strings.HasSuffix(name, TemplateSuffix) && t.isTemplate(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return t.FS.Open(name)
+}
+
+func (t *templateFS) Stat(name string) (fs.FileInfo, error) {
+	if t.isTemplate(name + TemplateSuffix) {
+		return t.renderedInfo(name)
+	}
+	if strings.HasSuffix(name, TemplateSuffix) && t.isTemplate(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return fs.Stat(t.FS, name)
+}
+
+// ReadDir lists the directory name, with each template named after the file it
+// renders to. A template that would replace another file is an error.
+func (t *templateFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := fs.ReadDir(t.FS, name)
+	if err != nil {
+		return entries, err
+	}
+	seen := make(map[string]bool)
+	for _, e := range entries {
+		seen[e.Name()] = true
+	}
+	for i, e := range entries {
+		base := strings.TrimSuffix(e.Name(), TemplateSuffix)
+		if base == e.Name() || base == "" || !t.isTemplate(path.Join(name, e.Name())) {
+			continue
+		}
+		if seen[base] {
+			return nil, fmt.Errorf("%s and %s are both copied to %s", path.Join(name, base),
+				path.Join(name, e.Name()), path.Join(name, base))
+		}
+		entries[i] = renderedEntry{e, t, path.Join(name, base)}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// renderedEntry is a template, listed as the file it renders to.
+type renderedEntry struct {
+	fs.DirEntry
+	t    *templateFS
+	name string
+}
+
+func (e renderedEntry) Name() string               { return path.Base(e.name) }
+func (e renderedEntry) Type() fs.FileMode          { return 0 }
+func (e renderedEntry) IsDir() bool                { return false }
+func (e renderedEntry) Info() (fs.FileInfo, error) { return e.t.renderedInfo(e.name) }
+
+// renderedInfo describes the output of a template. It has no modification time, since
+// what it renders to can change along with the data, rather than the template.
+type renderedInfo struct {
+	fs.FileInfo
+	name string
+	size int64
+}
+
+func (i renderedInfo) Name() string       { return i.name }
+func (i renderedInfo) Size() int64        { return i.size }
+func (i renderedInfo) ModTime() time.Time { return time.Time{} }
+
+// renderedFile is the output of a template, opened for reading.
+type renderedFile struct {
+	*bytes.Reader
+	info fs.FileInfo
+}
+
+func (f *renderedFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *renderedFile) Close() error               { return nil }
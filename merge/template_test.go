@@ -0,0 +1,68 @@
+package merge
+
+import (
+	"context"
+	"runtime"
+	"testing"
+)
+
+func TestTemplates(t *testing.T) {
+	src := tree{
+		"hostname.tmpl": "{{.Hostname}} on {{.OS}}\n",
+		"d/conf.tmpl":   "port = {{.Vars.port}}\n",
+		"plain":         "{{.Hostname}}\n",
+	}
+	m, _ := newTestMerger(t, src, nil)
+	m.Templates, m.Hostname = true, "h"
+	m.Vars = map[string]string{"port": "80"}
+	run(t, m)
+	checkTree(t, m.DestDir, tree{
+		"hostname": "h on " + runtime.GOOS + "\n",
+		"d/":       "",
+		"d/conf":   "port = 80\n",
+		"plain":    "{{.Hostname}}\n",
+	})
+	for _, a := range run(t, m) {
+		if a.Kind != ActionOK {
+			t.Errorf("ran again: got %s %s", a.Kind, a.DestRel)
+		}
+	}
+
+	// What a template renders to changes with the data, although the template doesn't.
+	m.Vars["port"] = "8080"
+	run(t, m)
+	if got := readTree(t, m.DestDir)["d/conf"]; got != "port = 8080\n" {
+		t.Errorf("got %q, want it rendered again", got)
+	}
+
+	// Without Templates, they're copied as they are.
+	m, _ = newTestMerger(t, src, nil)
+	run(t, m)
+	checkTree(t, m.DestDir, tree{
+		"hostname.tmpl": "{{.Hostname}} on {{.OS}}\n",
+		"d/":            "",
+		"d/conf.tmpl":   "port = {{.Vars.port}}\n",
+		"plain":         "{{.Hostname}}\n",
+	})
+}
+
+func TestTemplatesInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		src  tree
+	}{
+		{"missing key", tree{"conf.tmpl": "{{.Vars.nope}}\n"}},
+		{"bad syntax", tree{"conf.tmpl": "{{.Hostname\n"}},
+		{"both", tree{"conf.tmpl": "{{.Hostname}}\n", "conf": "conf\n"}},
+	}
+	for _, tt := range tests {
+		m, _ := newTestMerger(t, tt.src, nil)
+		m.Templates = true
+		if _, err := m.Run(context.Background()); err == nil {
+			t.Errorf("%s: got no error", tt.name)
+		}
+		if got := readTree(t, m.DestDir)["conf"]; got != "" {
+			t.Errorf("%s: copied %q", tt.name, got)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+# Generates the plists here, with Python's plistlib, which writes them the way macOS
+# does: python3 gen.py
+import copy
+import datetime
+import plistlib
+
+prefs = {
+    "Name": "upmerge",
+    "Unicode": "café ☃",
+    "Count": 42,
+    "Negative": -7,
+    "Large": 2**40 + 3,
+    "Ratio": 0.25,
+    "Enabled": True,
+    "Disabled": False,
+    "Updated": datetime.datetime(2024, 5, 6, 7, 8, 9),
+    "Blob": b"\x00\x01\x02upmerge\xff",
+    "List": ["one", 2, 3.5, ["nested"], {"k": "v"}],
+    "Window": {"Width": 800, "Height": 600, "Title": "Main"},
+    "Empty": {},
+}
+
+
+def write(name, value, fmt, sort_keys=False):
+    with open(name, "wb") as f:
+        plistlib.dump(value, f, fmt=fmt, sort_keys=sort_keys)
+
+
+write("prefs.xml", prefs, plistlib.FMT_XML)
+write("prefs.bin", prefs, plistlib.FMT_BINARY)
+# The same, with its keys in another order.
+write("prefs-sorted.xml", prefs, plistlib.FMT_XML, sort_keys=True)
+
+changed = copy.deepcopy(prefs)
+changed["Window"]["Width"] = 1024
+write("prefs-changed.bin", changed, plistlib.FMT_BINARY)
+
+# What --plist-merge makes of src merged into prefs.
+src = {"Window": {"Width": 1024, "Maximized": True}, "Count": 43, "Added": ["new"]}
+write("src.xml", src, plistlib.FMT_XML)
+merged = copy.deepcopy(prefs)
+merged["Window"].update(src["Window"])
+merged["Count"] = 43
+merged["Added"] = ["new"]
+write("merged.xml", merged, plistlib.FMT_XML)
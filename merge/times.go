@@ -0,0 +1,34 @@
+package merge
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// copyTimes gives path the access and modification times of the file described by st,
+// if it has any.
+func copyTimes(path string, st fs.FileInfo) error {
+	if st.ModTime().IsZero() {
+		return nil
+	}
+	return os.Chtimes(path, fileAtime(st), st.ModTime())
+}
+
+// copyDirTimes gives the directories created during the run the times of their
+// sources. This waits until the end, since creating anything inside a directory
+// changes its modification time.
+func (m *Merger) copyDirTimes() error {
+	dirs := m.newDirs
+	m.newDirs = nil
+	for _, rel := range dirs {
+		st, err := fs.Stat(m.src(), srcName(rel))
+		if err != nil {
+			return wrapErr(OpMkdir, rel, err)
+		}
+		if err = copyTimes(filepath.Join(m.DestDir, rel), st); err != nil {
+			return wrapErr(OpMkdir, rel, err)
+		}
+	}
+	return nil
+}
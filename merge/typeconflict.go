@@ -0,0 +1,108 @@
+package merge
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+// Ways of resolving a type conflict, for Merger.ResolveTypeConflicts.
+const (
+	// TypeConflictDest leaves the destination alone (the default).
+	TypeConflictDest = "dest"
+	// TypeConflictSrc backs up the destination whole, and puts the source in its place.
+	TypeConflictSrc = "src"
+)
+
+// typeName describes the type of a file with the given mode.
+func typeName(mode fs.FileMode) string {
+	switch {
+	case mode.IsDir():
+		return "directory"
+	case mode&fs.ModeSymlink != 0:
+		return "symlink"
+	case mode.IsRegular():
+		return "file"
+	}
+	return specialName(mode)
+}
+
+// planTypeConflict turns step into a StepTypeConflict: the source is a directory, where
+// the destination has something else, or the other way around.
+func (m *Merger) planTypeConflict(step *Step) *Step {
+	step.Kind = StepTypeConflict
+	step.Backup = m.backupPathFor(step.Path)
+	return step
+}
+
+// resolveTypeConflict reports the type conflict of step, and leaves the destination
+// alone, unless ResolveTypeConflicts is TypeConflictSrc. Then, the destination is backed
+// up (with everything in it), and the source is put in its place.
+func (m *Merger) resolveTypeConflict(ctx context.Context, step *Step) error {
+	rel := step.Path
+	lst, err := os.Lstat(step.Dest)
+	if err != nil {
+		return wrapErr(OpWalk, rel, err)
+	}
+	srcType := typeName(step.Mode)
+	if step.Target != "" {
+		srcType = "symlink"
+	}
+	a := Action{
+		Kind:     ActionTypeConflict,
+		Src:      step.Src,
+		Dest:     step.Dest,
+		SrcType:  srcType,
+		DestType: typeName(lst.Mode()),
+	}
+	if m.ResolveTypeConflicts == TypeConflictSrc {
+		// Where the destination goes, rather than being left alone.
+		a.Backup = step.Backup
+	}
+	m.log(a)
+	if m.ResolveTypeConflicts != TypeConflictSrc {
+		if step.Mode.IsDir() {
+			// Nothing in it can go anywhere.
+			return fs.SkipDir
+		}
+		return nil
+	}
+	backupExists := fileExists(step.Backup)
+	forced := m.isForced(rel) || m.BackupRotate > 0
+	if backupExists && !forced {
+		if !m.DryRun {
+			m.log(Action{
+				Kind:   ActionError,
+				Src:    step.Src,
+				Dest:   step.Dest,
+				Backup: step.Backup,
+				Error:  fmt.Sprintf("refusing to overwrite backup: %s", step.Backup),
+			})
+			return wrapErr(OpBackup, rel, ErrRefuse)
+		}
+	}
+	if !m.DryRun {
+		if backupExists && m.BackupRotate == 0 {
+			if err := m.removeAllDest(step.Backup); err != nil {
+				return wrapErr(OpBackup, rel, err)
+			}
+		}
+		if err := m.makeBackup(rel, step.Dest, step.Backup); err != nil {
+			return wrapErr(OpBackup, rel, fmt.Errorf("%w; %s left unchanged", err, step.Dest))
+		}
+	}
+	if backupExists && m.BackupRotate == 0 && (m.isForced(rel) || !m.DryRun) {
+		m.log(Action{Kind: ActionForceMove, Dest: step.Dest, Backup: step.Backup})
+	} else {
+		m.log(Action{Kind: ActionMove, Dest: step.Dest, Backup: step.Backup})
+	}
+	// Out of the way, the source goes in as if there had been nothing there.
+	step.Backup = ""
+	if step.Mode.IsDir() {
+		step.Kind, step.Mode = StepMkdir, step.Mode&modeBits
+	} else {
+		step.Kind = StepCopy
+	}
+	return m.applyStep(ctx, step)
+}
@@ -0,0 +1,68 @@
+package merge
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTypeConflict(t *testing.T) {
+	dirOverFile := struct{ src, dest tree }{tree{"x/f": "new"}, tree{"x": "old"}}
+	fileOverDir := struct{ src, dest tree }{tree{"x": "new"}, tree{"x/": "", "x/f": "old"}}
+	tests := []struct {
+		name              string
+		src, dest         tree
+		resolve           string
+		dryRun            bool
+		srcType, destType string
+		kinds             []string
+		want              tree
+	}{
+		// Left alone, by default, and nothing in a directory goes anywhere.
+		{name: "dir over file", src: dirOverFile.src, dest: dirOverFile.dest,
+			srcType: "directory", destType: "file",
+			kinds: []string{"type-conflict x"}, want: dirOverFile.dest},
+		{name: "dir over file, dry run", src: dirOverFile.src, dest: dirOverFile.dest, dryRun: true,
+			srcType: "directory", destType: "file",
+			kinds: []string{"type-conflict x"}, want: dirOverFile.dest},
+		{name: "file over dir", src: fileOverDir.src, dest: fileOverDir.dest,
+			srcType: "file", destType: "directory",
+			kinds: []string{"type-conflict x"}, want: fileOverDir.dest},
+		{name: "file over dir, dry run", src: fileOverDir.src, dest: fileOverDir.dest, dryRun: true,
+			srcType: "file", destType: "directory",
+			kinds: []string{"type-conflict x"}, want: fileOverDir.dest},
+		// The destination is backed up whole, and the source put in its place.
+		{name: "dir over file, src wins", src: dirOverFile.src, dest: dirOverFile.dest, resolve: TypeConflictSrc,
+			srcType: "directory", destType: "file",
+			kinds: []string{"type-conflict x", "move x", "mkdir x", "copy x/f"},
+			want:  tree{"x/": "", "x/f": "new", "x.upmerge~": "old"}},
+		{name: "dir over file, src wins, dry run", src: dirOverFile.src, dest: dirOverFile.dest, resolve: TypeConflictSrc, dryRun: true,
+			srcType: "directory", destType: "file",
+			kinds: []string{"type-conflict x", "move x", "mkdir x", "copy x/f"},
+			want:  dirOverFile.dest},
+		{name: "file over dir, src wins", src: fileOverDir.src, dest: fileOverDir.dest, resolve: TypeConflictSrc,
+			srcType: "file", destType: "directory",
+			kinds: []string{"type-conflict x", "move x", "copy x"},
+			want:  tree{"x": "new", "x.upmerge~/": "", "x.upmerge~/f": "old"}},
+		{name: "file over dir, src wins, dry run", src: fileOverDir.src, dest: fileOverDir.dest, resolve: TypeConflictSrc, dryRun: true,
+			srcType: "file", destType: "directory",
+			kinds: []string{"type-conflict x", "move x", "copy x"},
+			want:  fileOverDir.dest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, rec := newTestMerger(t, tt.src, tt.dest)
+			m.ResolveTypeConflicts = tt.resolve
+			m.DryRun = tt.dryRun
+			run(t, m)
+			if got := kinds(rec.Actions); !reflect.DeepEqual(got, tt.kinds) {
+				t.Errorf("got %q, want %q", got, tt.kinds)
+			}
+			for _, a := range rec.Actions {
+				if a.Kind == ActionTypeConflict && (a.SrcType != tt.srcType || a.DestType != tt.destType) {
+					t.Errorf("conflict between %s and %s, want %s and %s", a.SrcType, a.DestType, tt.srcType, tt.destType)
+				}
+			}
+			checkTree(t, m.DestDir, tt.want)
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package merge
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Validator checks the new versions of the files matching Pattern (in the format of
+// IgnoreFile, relative to DestDir) before they're installed, by running Command with
+// %f in its arguments replaced by the path of the new version (and %root by
+// Merger.Root). The file is only installed if it exits with 0.
+type Validator struct {
+	Pattern string
+	Command []string
+}
+
+// validatorRule is a Validator, with its pattern parsed.
+type validatorRule struct {
+	rule    ignoreRule
+	command []string
+}
+
+// parseValidators parses the patterns of validators.
+func parseValidators(validators []Validator) ([]validatorRule, error) {
+	var rules []validatorRule
+	for _, v := range validators {
+		r, ok, err := parseIgnoreRule(v.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		if !ok || r.negate || len(v.Command) == 0 {
+			return nil, fmt.Errorf("invalid validator: %q", v.Pattern)
+		}
+		rules = append(rules, validatorRule{r, v.Command})
+	}
+	return rules, nil
+}
+
+// loadValidators sets up running the Validators.
+func (m *Merger) loadValidators() error {
+	var err error
+	m.validators, err = parseValidators(m.Validators)
+	return err
+}
+
+// validate runs the validators matching step on tmp, its new version as staged. An
+// error from one that fails wraps ErrInvalid, and it's logged as an ActionInvalid,
+// along with what it printed.
+func (m *Merger) validate(ctx context.Context, step *Step, tmp string) error {
+	if step.Target != "" {
+		return nil
+	}
+	name := splitRel(step.Path)
+	for _, v := range m.validators {
+		if v.rule.dirOnly || !matchParts(v.rule.parts, name) {
+			continue
+		}
+		args := m.rootArgs(v.command)
+		for i, arg := range args {
+			args[i] = strings.ReplaceAll(arg, "%f", tmp)
+		}
+		var stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Stdout, cmd.Stderr = &stderr, &stderr
+		err := cmd.Run()
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		} else if err == nil {
+			continue
+		}
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		m.log(Action{Kind: ActionInvalid, Src: step.Src, Dest: step.Dest, Error: msg})
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			err = fmt.Errorf("%s: %w", args[0], err)
+		}
+		return fmt.Errorf("%w (%v)", ErrInvalid, err)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package merge
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateDirs(t *testing.T) {
+	tests := []struct {
+		name       string
+		src, dest  string
+		createDest bool
+		want       string // in the error, or "" for none
+	}{
+		{name: "fine", src: "src", dest: "dest"},
+		{name: "missing source", src: "nowhere", dest: "dest", want: "source directory"},
+		{name: "source is a file", src: "file", dest: "dest", want: "is not a directory"},
+		{name: "missing destination", src: "src", dest: "nowhere", want: "destination directory"},
+		{name: "missing destination, created", src: "src", dest: "nowhere", createDest: true},
+		{name: "destination is a file", src: "src", dest: "file", want: "is not a directory"},
+		{name: "same directory", src: "src", dest: "src", want: "the same directory"},
+		{name: "same directory through a symlink", src: "src", dest: "link", want: "the same directory"},
+		{name: "destination inside source", src: "src", dest: "src/sub", want: "is inside source"},
+		{name: "source inside destination", src: "dest/src", dest: "dest", want: "merged into itself"},
+		// It's nowhere the merge writes to, as with dotfiles in the home directory.
+		{name: "source inside destination, apart", src: "dest/apart", dest: "dest"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeTree(t, dir, tree{
+				"src/": "", "src/sub/": "", "src/f": "f", "file": "file",
+				"dest/": "", "dest/src/": "", "dest/src/src/": "", "dest/apart/": "", "dest/apart/f": "f",
+			})
+			if err := os.Symlink("src", filepath.Join(dir, "link")); err != nil {
+				t.Skip(err)
+			}
+			m := New(filepath.Join(dir, tt.src), filepath.Join(dir, tt.dest))
+			m.CreateDest = tt.createDest
+			err := m.ValidateDirs(true)
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("got %v", err)
+			case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+				t.Errorf("got %v, want an error about %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		set  func(m *Merger)
+		want string
+	}{
+		{name: "defaults", set: func(m *Merger) {}},
+		{name: "no backup suffix", set: func(m *Merger) { m.BackupSuffix = "" }, want: "backup suffix"},
+		{name: "backup suffix with a slash", set: func(m *Merger) { m.BackupSuffix = "a/b" }, want: "backup suffix"},
+		{name: "quick diffs", set: func(m *Merger) { m.Quick, m.Diff = true, true }, want: "without reading"},
+		{name: "prune without a manifest", set: func(m *Merger) { m.Prune = true }, want: "manifest"},
+		{name: "type conflicts", set: func(m *Merger) { m.ResolveTypeConflicts = "sideways" }, want: "type conflicts"},
+		{name: "snapshot", set: func(m *Merger) { m.Snapshot = "sometimes" }, want: "snapshot"},
+		{name: "merge tool", set: func(m *Merger) { m.Merge, m.MergeTool = true, []string{"vimdiff", "%mine"} }, want: "%out"},
+		// Only run with Merge, so one set in the environment is left alone without.
+		{name: "merge tool without merge", set: func(m *Merger) { m.MergeTool = []string{"vimdiff", "%mine"} }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := New("src", "dest")
+			tt.set(m)
+			err := m.Validate()
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("got %v", err)
+			case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+				t.Errorf("got %v, want an error about %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package merge
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sort"
+)
+
+// File states reported by Merger.Verify, along with StateInSync and StatePending.
+const (
+	StateDrifted = "drifted" // dest no longer has what upmerge installed
+	StateDeleted = "deleted" // dest is gone since upmerge installed it
+	StateOrphan  = "orphan"  // dest was installed from a file no longer in the source
+)
+
+// Verify checks every file in the manifest against what upmerge installed there,
+// without changing anything. Files that were changed (or deleted) since are
+// StateDrifted (or StateDeleted); the others are StateInSync, or StatePending if the
+// source has changed since.
+func (m *Merger) Verify(ctx context.Context) ([]FileStatus, error) {
+	if m.ManifestPath == "" {
+		return nil, errors.New("can't verify without a manifest")
+	}
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	if err := m.ValidateDirs(true); err != nil {
+		return nil, err
+	}
+	if err := m.loadLayers(); err != nil {
+		return nil, err
+	}
+	if err := m.loadTemplates(); err != nil {
+		return nil, err
+	}
+	m.loadAppends()
+	m.loadOverlays()
+	if err := m.loadManifest(); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(m.manifest.Files))
+	for name := range m.manifest.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var result []FileStatus
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		rel := filepath.FromSlash(name)
+		st := FileStatus{
+			Src:    m.srcPath(rel),
+			Dest:   filepath.Join(m.DestDir, rel),
+			Backup: m.backupPathFor(rel),
+		}
+		var err error
+		if st.State, err = m.verifyFile(rel, st.Dest, m.manifest.Files[name]); err != nil {
+			m.fail(rel, err)
+			return result, wrapErr(OpVerify, rel, err)
+		}
+		result = append(result, st)
+	}
+	return result, nil
+}
+
+// verifyFile determines the state of the file at rel, installed as recorded in e.
+func (m *Merger) verifyFile(rel, destPath string, e manifestEntry) (string, error) {
+	if !fileExists(destPath) {
+		return StateDeleted, nil
+	}
+	// Files recorded before the manifest had hashes can't be told apart.
+	if e.Hash != "" {
+		hash, err := hashPath(destPath)
+		if err != nil {
+			return "", err
+		}
+		if hash != e.Hash {
+			return StateDrifted, nil
+		}
+	}
+	if !m.inSrc(rel) {
+		return StateOrphan, nil
+	}
+	same, err := m.srcMatches(rel, destPath)
+	if err != nil {
+		return "", err
+	}
+	if !same {
+		return StatePending, nil
+	}
+	return StateInSync, nil
+}
@@ -0,0 +1,142 @@
+package merge
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// dirID tells directories apart, including those reached through more than one path.
+type dirID struct {
+	dev, ino uint64
+}
+
+// dirWalk is a walk of the source, as made by walkDir.
+type dirWalk struct {
+	m     *Merger
+	fsys  fs.FS
+	quiet bool
+	fn    fs.WalkDirFunc
+	// open are the directories being walked, from the root down, by the path they
+	// were first reached at.
+	open map[dirID]string
+}
+
+// walkDir walks fsys from root like fs.WalkDir, but for what the settings of m change
+// about it: with CopyLinks, symlinks to directories are walked into as if they were
+// directories, and with MaxDepth, it goes no deeper than that. A directory inside
+// itself (through a symlink, or a mount) is reported as a cycle, and left out there.
+// With quiet, nothing is reported, for a walk made ahead of the real one.
+func (m *Merger) walkDir(fsys fs.FS, root string, quiet bool, fn fs.WalkDirFunc) error {
+	st, err := fs.Stat(fsys, root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		w := &dirWalk{m: m, fsys: fsys, quiet: quiet, fn: fn, open: make(map[dirID]string)}
+		err = w.walk(root, fs.FileInfoToDirEntry(st))
+	}
+	if err == fs.SkipDir || err == fs.SkipAll {
+		return nil
+	}
+	return err
+}
+
+// walk calls fn for name (described by d), and everything inside, if it's a directory.
+func (w *dirWalk) walk(name string, d fs.DirEntry) error {
+	if !d.IsDir() {
+		return w.fn(name, d, nil)
+	}
+	id, known := w.dirID(name)
+	if first, ok := w.open[id]; known && ok {
+		w.report(Action{
+			Kind:   ActionCycle,
+			Src:    w.m.srcPath(filepath.FromSlash(name)),
+			Target: w.m.srcPath(filepath.FromSlash(first)),
+		})
+		return nil
+	}
+	if err := w.fn(name, d, nil); err != nil {
+		if err == fs.SkipDir {
+			return nil
+		}
+		return err
+	}
+	if known {
+		w.open[id] = name
+		defer delete(w.open, id)
+	}
+	entries, err := fs.ReadDir(w.fsys, name)
+	if err != nil {
+		// Once more, to report it.
+		if err = w.fn(name, d, err); err != nil {
+			if err == fs.SkipDir {
+				return nil
+			}
+			return err
+		}
+	}
+	if w.m.MaxDepth > 0 && depth(name) >= w.m.MaxDepth {
+		if len(entries) > 0 {
+			w.report(Action{
+				Kind:  ActionSkip,
+				Src:   w.m.srcPath(filepath.FromSlash(name)),
+				Dest:  filepath.Join(w.m.DestDir, filepath.FromSlash(name)),
+				Error: fmt.Sprintf("%d entries deeper than %d levels", len(entries), w.m.MaxDepth),
+			})
+		}
+		return nil
+	}
+	for _, e := range entries {
+		child := path.Join(name, e.Name())
+		if w.m.CopyLinks && e.Type()&fs.ModeSymlink != 0 {
+			if st, err := fs.Stat(w.fsys, child); err == nil && st.IsDir() {
+				e = followedEntry{e, st}
+			}
+		}
+		if err := w.walk(child, e); err != nil {
+			if err == fs.SkipDir {
+				// Only a file skips the rest of its directory.
+				break
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// dirID returns what tells the directory at name apart, if that's known.
+func (w *dirWalk) dirID(name string) (dirID, bool) {
+	st, err := fs.Stat(w.fsys, name)
+	if err != nil {
+		return dirID{}, false
+	}
+	id := dirID{fileFS(st), fileInode(st)}
+	return id, id.ino != 0
+}
+
+// report logs a, unless the walk is quiet.
+func (w *dirWalk) report(a Action) {
+	if !w.quiet {
+		w.m.log(a)
+	}
+}
+
+// depth returns how many levels below the root name is.
+func depth(name string) int {
+	if name == "." {
+		return 0
+	}
+	return strings.Count(name, "/") + 1
+}
+
+// followedEntry is a symlink to a directory, walked into with CopyLinks.
+type followedEntry struct {
+	fs.DirEntry
+	st fs.FileInfo
+}
+
+func (e followedEntry) IsDir() bool                { return true }
+func (e followedEntry) Type() fs.FileMode          { return fs.ModeDir }
+func (e followedEntry) Info() (fs.FileInfo, error) { return e.st, nil }
@@ -0,0 +1,107 @@
+package merge
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// symlink makes a symlink at name under dir, pointing to target, or skips t where
+// there can't be one.
+func symlink(t *testing.T, target, dir, name string) {
+	t.Helper()
+	if err := os.Symlink(target, filepath.Join(dir, filepath.FromSlash(name))); err != nil {
+		t.Skip(err)
+	}
+}
+
+func TestWalkCycle(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("directories can't be told apart here")
+	}
+	tests := []struct {
+		name  string
+		links map[string]string
+		kinds []string
+		want  tree
+	}{
+		{name: "to the root", links: map[string]string{"a/b/up": "../.."},
+			kinds: []string{"mkdir a", "mkdir a/b", "copy a/b/f", "cycle a/b/up", "copy top"},
+			want:  tree{"a/": "", "a/b/": "", "a/b/f": "f", "top": "top"}},
+		{name: "to itself", links: map[string]string{"a/self": "."},
+			kinds: []string{"mkdir a", "mkdir a/b", "copy a/b/f", "cycle a/self", "copy top"},
+			want:  tree{"a/": "", "a/b/": "", "a/b/f": "f", "top": "top"}},
+		// The same directory twice, but neither inside the other.
+		{name: "not a cycle", links: map[string]string{"c": "a/b"},
+			kinds: []string{"mkdir a", "mkdir a/b", "copy a/b/f", "mkdir c", "copy c/f", "copy top"},
+			want:  tree{"a/": "", "a/b/": "", "a/b/f": "f", "c/": "", "c/f": "f", "top": "top"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, rec := newTestMerger(t, tree{"a/b/f": "f", "top": "top"}, nil)
+			for name, target := range tt.links {
+				symlink(t, target, m.SrcDir, name)
+			}
+			m.CopyLinks = true
+			run(t, m)
+			if got := kinds(rec.Actions); !reflect.DeepEqual(got, tt.kinds) {
+				t.Errorf("got %q, want %q", got, tt.kinds)
+			}
+			checkTree(t, m.DestDir, tt.want)
+		})
+	}
+}
+
+func TestWalkCycleLinksCopied(t *testing.T) {
+	// Without CopyLinks, the symlink is copied, rather than walked into.
+	m, rec := newTestMerger(t, tree{"a/f": "f"}, nil)
+	symlink(t, "..", m.SrcDir, "a/up")
+	run(t, m)
+	want := []string{"mkdir a", "copy a/f", "symlink a/up"}
+	if got := kinds(rec.Actions); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if target, err := os.Readlink(filepath.Join(m.DestDir, "a", "up")); err != nil || target != ".." {
+		t.Errorf("got %q, %v; want a symlink to ..", target, err)
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	src := tree{"top": "1", "a/f": "2", "a/b/f": "3", "a/b/c/f": "4", "a/e/": ""}
+	tests := []struct {
+		depth int
+		kinds []string
+		want  tree
+	}{
+		{depth: 0,
+			kinds: []string{"mkdir a", "mkdir a/b", "mkdir a/b/c", "copy a/b/c/f", "copy a/b/f", "mkdir a/e", "copy a/f", "copy top"},
+			want:  tree{"top": "1", "a/": "", "a/f": "2", "a/b/": "", "a/b/f": "3", "a/b/c/": "", "a/b/c/f": "4", "a/e/": ""}},
+		{depth: 1,
+			kinds: []string{"mkdir a", "skip a", "copy top"},
+			want:  tree{"top": "1", "a/": ""}},
+		// An empty directory has nothing deeper to skip.
+		{depth: 2,
+			kinds: []string{"mkdir a", "mkdir a/b", "skip a/b", "mkdir a/e", "copy a/f", "copy top"},
+			want:  tree{"top": "1", "a/": "", "a/f": "2", "a/b/": "", "a/e/": ""}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.depth), func(t *testing.T) {
+			m, rec := newTestMerger(t, src, nil)
+			m.MaxDepth = tt.depth
+			run(t, m)
+			if got := kinds(rec.Actions); !reflect.DeepEqual(got, tt.kinds) {
+				t.Errorf("got %q, want %q", got, tt.kinds)
+			}
+			for _, a := range rec.Actions {
+				if a.Kind == ActionSkip && !strings.Contains(a.Error, fmt.Sprintf("deeper than %d levels", tt.depth)) {
+					t.Errorf("skipped %s: %q, want what's skipped", a.Src, a.Error)
+				}
+			}
+			checkTree(t, m.DestDir, tt.want)
+		})
+	}
+}
@@ -0,0 +1,142 @@
+//go:build darwin
+
+package merge
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Don't follow symlinks; from <sys/xattr.h>.
+const xattrNoFollow = 0x0001
+
+// quarantineXattr marks files downloaded from the internet; it's not worth keeping on
+// files in /etc.
+const quarantineXattr = "com.apple.quarantine"
+
+// copyXattrs copies the extended attributes of srcPath over to destPath, except for
+// the quarantine flag (unless keepQuarantine is set). It carries on past attributes
+// that fail to copy, returning an error for each.
+func copyXattrs(srcPath, destPath string, keepQuarantine bool) []error {
+	names, err := listXattrs(srcPath)
+	if err != nil {
+		return []error{err}
+	}
+	var errs []error
+	for _, name := range names {
+		if name == quarantineXattr && !keepQuarantine {
+			continue
+		}
+		value, err := getXattr(srcPath, name)
+		if err == nil {
+			err = setXattr(destPath, name, value)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// bufPtr returns a pointer to the start of buf, or 0 if it's empty.
+func bufPtr(buf []byte) uintptr {
+	if len(buf) == 0 {
+		return 0
+	}
+	return uintptr(unsafe.Pointer(&buf[0]))
+}
+
+// listXattrs returns the names of the extended attributes of path.
+func listXattrs(path string) ([]string, error) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	var buf []byte
+	for {
+		// Ask for the size first; try again if the list grows in between.
+		n, _, errno := syscall.Syscall6(syscall.SYS_LISTXATTR, uintptr(unsafe.Pointer(p)),
+			bufPtr(buf), uintptr(len(buf)), xattrNoFollow, 0, 0)
+		if errno == syscall.ERANGE {
+			buf = nil
+			continue
+		} else if errno != 0 {
+			return nil, &os.PathError{Op: "listxattr", Path: path, Err: errno}
+		}
+		if n == 0 {
+			return nil, nil
+		}
+		if buf == nil {
+			buf = make([]byte, n)
+			continue
+		}
+		list := strings.TrimSuffix(string(buf[:n]), "\x00")
+		return strings.Split(list, "\x00"), nil
+	}
+}
+
+// getXattr returns the value of the extended attribute name of path.
+func getXattr(path, name string) ([]byte, error) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	np, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+	var buf []byte
+	for {
+		n, _, errno := syscall.Syscall6(syscall.SYS_GETXATTR, uintptr(unsafe.Pointer(p)),
+			uintptr(unsafe.Pointer(np)), bufPtr(buf), uintptr(len(buf)), 0, xattrNoFollow)
+		if errno == syscall.ERANGE {
+			buf = nil
+			continue
+		} else if errno != 0 {
+			return nil, &os.PathError{Op: "getxattr " + name, Path: path, Err: errno}
+		}
+		if buf == nil && n > 0 {
+			buf = make([]byte, n)
+			continue
+		}
+		return buf[:n], nil
+	}
+}
+
+// setXattr sets the extended attribute name of path to value.
+func setXattr(path, name string, value []byte) error {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	np, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_SETXATTR, uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(np)), bufPtr(value), uintptr(len(value)), 0, xattrNoFollow)
+	if errno != 0 {
+		return &os.PathError{Op: "setxattr " + name, Path: path, Err: errno}
+	}
+	return nil
+}
+
+// dropQuarantine removes the quarantine flag from path, if it's there.
+func dropQuarantine(path string) error {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	np, err := syscall.BytePtrFromString(quarantineXattr)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_REMOVEXATTR, uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(np)), xattrNoFollow)
+	if errno != 0 && errno != syscall.ENOATTR {
+		return &os.PathError{Op: "removexattr " + quarantineXattr, Path: path, Err: errno}
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !darwin
+
+package merge
+
+// copyXattrs does nothing: extended attributes are only copied on macOS.
+func copyXattrs(srcPath, destPath string, keepQuarantine bool) []error {
+	return nil
+}
+
+// dropQuarantine does nothing: there's no quarantine flag.
+func dropQuarantine(path string) error {
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rollcat/upmerge/merge"
+)
+
+var metricsPath = ""
+
+// labelEscaper escapes a label value, the only way the text format allows.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metric is a gauge written by --metrics-file.
+type metric struct {
+	name, help string
+	value      float64
+}
+
+// runMetrics returns the gauges for a run that took actions, and ends with code.
+// Their names and labels are kept as they are, for the dashboards and alerts built on
+// them.
+func runMetrics(actions []merge.Action, code int) []metric {
+	var copied, conflicts int
+	// A file that's backed up and replaced is only pending once.
+	pending := make(map[string]bool)
+	for _, a := range actions {
+		switch {
+		case a.Kind == merge.ActionCopy || a.Kind == merge.ActionSymlink || a.Kind == merge.ActionMknod ||
+			a.Kind == merge.ActionMerged:
+			if !a.DryRun {
+				copied++
+			}
+		case a.Kind == merge.ActionCheck, a.Kind == merge.ActionConflict,
+			a.Kind == merge.ActionTypeConflict && a.Backup == "",
+			a.Kind == merge.ActionError && a.Backup != "":
+			// Left for someone to look at.
+			conflicts++
+		}
+		switch {
+		case (a.Kind == merge.ActionError || a.Kind == merge.ActionRefuse || a.Kind == merge.ActionProtected) &&
+			a.Dest != "",
+			a.DryRun && a.IsChange():
+			pending[a.Dest] = true
+		}
+	}
+	success := 0.0
+	if code == exitOK || code == exitPending {
+		success = 1
+	}
+	return []metric{
+		{"upmerge_last_run_timestamp_seconds", "When the last run ended.",
+			float64(time.Now().UnixMilli()) / 1000},
+		{"upmerge_last_run_duration_seconds", "How long the last run took.",
+			time.Since(startTime).Seconds()},
+		{"upmerge_last_run_success", "Whether the last run went fine (1), or failed (0).", success},
+		{"upmerge_last_run_exit_code", "The exit status of the last run.", float64(code)},
+		{"upmerge_files_copied_total", "Files copied (or created) by the last run.", float64(copied)},
+		{"upmerge_files_pending", "Files the last run left out of date: changes of a dry run, or failed.",
+			float64(len(pending))},
+		{"upmerge_backup_conflicts", "Backups the last run found differing from their files.",
+			float64(conflicts)},
+		{"upmerge_errors", "Errors in the last run.", float64(len(runErrors))},
+	}
+}
+
+// writeMetrics writes the gauges for a run ending with code to metricsPath, in the
+// Prometheus text format, for node_exporter's textfile collector. The file is replaced
+// whole, by way of a temporary file the collector ignores. Failing that is reported,
+// but doesn't change how the run went.
+func writeMetrics(code int) {
+	if metricsPath == "" {
+		return
+	}
+	dest, err := filepath.Abs(m.DestDir)
+	if err != nil {
+		dest = m.DestDir
+	}
+	labels := fmt.Sprintf(`{dest="%s"}`, labelEscaper.Replace(dest))
+	var b strings.Builder
+	for _, mt := range runMetrics(runActions, code) {
+		fmt.Fprintf(&b, "# HELP %s %s\n", mt.name, mt.help)
+		fmt.Fprintf(&b, "# TYPE %s gauge\n", mt.name)
+		fmt.Fprintf(&b, "%s%s %s\n", mt.name, labels, strconv.FormatFloat(mt.value, 'f', -1, 64))
+	}
+	tmp := metricsPath + ".tmp"
+	if err = os.WriteFile(tmp, []byte(b.String()), 0644); err == nil {
+		err = os.Rename(tmp, metricsPath)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		logError("%s: can't write the metrics: %s", progName, err)
+	}
+}
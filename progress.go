@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/rollcat/upmerge/merge"
+)
+
+// How often --progress updates the line on a terminal, or prints a new one otherwise.
+const (
+	progressRedraw   = 100 * time.Millisecond
+	progressInterval = 5 * time.Second
+)
+
+// progressObserver shows how far the run has got on stderr, around the output of an
+// Observer: on a terminal, as a single line that's updated (and taken out of the way
+// of anything else printed), and otherwise as a PROGRESS line every so often.
+type progressObserver struct {
+	merge.Observer
+	tty   bool
+	shown bool
+	last  time.Time
+	p     merge.Progress
+}
+
+// newProgressObserver returns a progressObserver around o.
+func newProgressObserver(o merge.Observer) *progressObserver {
+	st, err := os.Stderr.Stat()
+	return &progressObserver{Observer: o, tty: err == nil && st.Mode()&os.ModeCharDevice != 0}
+}
+
+func (o *progressObserver) OnAction(a merge.Action) {
+	o.clear()
+	o.Observer.OnAction(a)
+	if o.tty && o.p.Total > 0 {
+		o.draw()
+	}
+}
+
+func (o *progressObserver) OnProgress(p merge.Progress) {
+	o.p = p
+	interval := progressInterval
+	if o.tty {
+		interval = progressRedraw
+	}
+	if time.Since(o.last) < interval && p.Done < p.Total {
+		return
+	}
+	o.last = time.Now()
+	if o.tty {
+		o.draw()
+	} else if p.Done < p.Total {
+		logInfo("PROGRESS:\t%s", o.status())
+	}
+}
+
+// status describes the progress so far.
+func (o *progressObserver) status() string {
+	return fmt.Sprintf("%d/%d files, %s copied, at %s", o.p.Done, o.p.Total, formatBytes(o.p.Bytes),
+		o.p.Path)
+}
+
+// draw shows the progress so far on the terminal, cut down to fit on one line.
+func (o *progressObserver) draw() {
+	width, err := strconv.Atoi(os.Getenv("COLUMNS"))
+	if err != nil || width <= 0 {
+		width = 80
+	}
+	line := []rune(o.status())
+	if len(line) >= width {
+		line = line[:width-1]
+	}
+	fmt.Fprintf(os.Stderr, "\r\x1b[K%s", string(line))
+	o.shown = true
+}
+
+// clear takes the progress line off the terminal, if it's shown.
+func (o *progressObserver) clear() {
+	if o.shown {
+		fmt.Fprint(os.Stderr, "\r\x1b[K")
+		o.shown = false
+	}
+}
+
+// formatBytes formats n with a binary unit, such as 1.5 MiB.
+func formatBytes(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	value, unit := float64(n)/1024, "KiB"
+	for _, next := range []string{"MiB", "GiB", "TiB"} {
+		if value < 1024 {
+			break
+		}
+		value, unit = value/1024, next
+	}
+	return fmt.Sprintf("%.1f %s", value, unit)
+}
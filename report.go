@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rollcat/upmerge/merge"
+)
+
+var (
+	reportPath     = ""
+	reportRequired = false
+	// report is what's written to reportPath, filled in as the run goes.
+	report *runReport
+	// runActions and runErrors are all the actions and errors of the run, for --report
+	// and --metrics-file.
+	runActions []merge.Action
+	runErrors  []string
+)
+
+// runReport is the record of a run written with --report.
+type runReport struct {
+	Version string    `json:"version"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Args    []string  `json:"args"`
+	// Flags are the settings in effect, from the config files and the command line,
+	// as printed by --print-config.
+	Flags   map[string]string `json:"flags"`
+	Command string            `json:"command,omitempty"`
+	SrcDir  string            `json:"srcDir"`
+	Layers  []string          `json:"layers,omitempty"`
+	DestDir string            `json:"destDir"`
+	// Actions are all the actions of the run, on-change hooks included.
+	Actions []merge.Action `json:"actions"`
+	Summary *summary       `json:"summary,omitempty"`
+	Hooks   []hookReport   `json:"hooks,omitempty"`
+	// Snapshots are those taken with --snapshot: the paths of tarballs, or the dates
+	// of APFS snapshots.
+	Snapshots []string `json:"snapshots,omitempty"`
+	Errors    []string `json:"errors,omitempty"`
+	Exit      int      `json:"exitStatus"`
+}
+
+// hookReport is how a --pre-run or --post-run hook went.
+type hookReport struct {
+	Hook    string `json:"hook"`
+	Command string `json:"command"`
+	Error   string `json:"error,omitempty"`
+}
+
+// startReport starts recording the run for --report, once the flags were applied.
+func startReport(cmd string) {
+	if reportPath == "" {
+		return
+	}
+	var buf bytes.Buffer
+	writeConfig(&buf)
+	flags := make(map[string]string)
+	sc := bufio.NewScanner(&buf)
+	for sc.Scan() {
+		// Settings left unset are commented out.
+		if key, value, ok := strings.Cut(sc.Text(), " = "); ok && !strings.HasPrefix(key, "#") {
+			flags[key] = value
+		}
+	}
+	report = &runReport{
+		Version: buildVersion(),
+		Start:   startTime,
+		Args:    os.Args,
+		Flags:   flags,
+		Command: cmd,
+	}
+}
+
+// reportHook records how a hook went, for --report.
+func reportHook(hook, command string, err error) {
+	if report == nil || command == "" {
+		return
+	}
+	h := hookReport{Hook: hook, Command: command}
+	if err != nil {
+		h.Error = err.Error()
+	}
+	report.Hooks = append(report.Hooks, h)
+}
+
+// writeReport writes the report of a run ending with code to reportPath, whole or not
+// at all. It returns the code to exit with: the same, unless the report couldn't be
+// written, --report-required was given, and the run itself went fine.
+func writeReport(code int) int {
+	r := report
+	if r == nil {
+		return code
+	}
+	report = nil
+	r.End = time.Now()
+	r.Actions, r.Errors = append([]merge.Action{}, runActions...), runErrors
+	for _, a := range r.Actions {
+		if a.Kind == merge.ActionSnapshot {
+			r.Snapshots = append(r.Snapshots, a.Backup)
+		}
+	}
+	// As resolved for the run, and made absolute, for telling where it went.
+	abs := func(dir string) string {
+		if a, err := filepath.Abs(dir); err == nil && !merge.IsArchive(dir) {
+			return a
+		}
+		return dir
+	}
+	r.SrcDir, r.DestDir = abs(m.SrcDir), abs(m.DestDir)
+	for _, dir := range m.Layers {
+		r.Layers = append(r.Layers, abs(dir))
+	}
+	if r.Command == "" || r.Command == "adopt" || r.Command == "revert" || r.Command == "apply" ||
+		r.Command == "undo" {
+		s := summarize(r.Actions, nil)
+		s.Errors = len(r.Errors)
+		r.Summary = &s
+	}
+	r.Exit = code
+	buf, err := json.MarshalIndent(r, "", "\t")
+	if err == nil {
+		tmp := reportPath + ".tmp"
+		if err = os.WriteFile(tmp, append(buf, '\n'), 0644); err == nil {
+			err = os.Rename(tmp, reportPath)
+		}
+		if err != nil {
+			os.Remove(tmp)
+		}
+	}
+	if err != nil {
+		logError("%s: can't write the report: %s", progName, err)
+		if reportRequired && (code == exitOK || code == exitPending) {
+			return exitError
+		}
+	}
+	return code
+}
+
+// recordObserver records every action in runActions, and passes it on.
+type recordObserver struct {
+	merge.Observer
+}
+
+func (o recordObserver) OnAction(a merge.Action) {
+	runActions = append(runActions, a)
+	o.Observer.OnAction(a)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/rollcat/upmerge/merge"
+)
+
+// runHook runs command (split on whitespace, without a shell, and with %root replaced by
+// the --root), with UPMERGE_DRY_RUN in its environment. The post-run hook is also told how many of the actions
+// were changes, the path of a temporary file listing the files they changed, and
+// whether the run failed.
+func runHook(ctx context.Context, command string, post bool, actions []merge.Action, failed bool) error {
+	args := strings.Fields(strings.ReplaceAll(command, "%root", m.Root))
+	if len(args) == 0 {
+		return nil
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), "UPMERGE_DRY_RUN="+strconv.FormatBool(m.DryRun))
+	if post {
+		f, err := os.CreateTemp("", "upmerge-changed-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		seen := make(map[string]bool)
+		changes := 0
+		for _, a := range actions {
+			if !a.IsChange() {
+				continue
+			}
+			changes++
+			if a.Dest != "" && !seen[a.Dest] {
+				seen[a.Dest] = true
+				fmt.Fprintln(f, a.Dest)
+			}
+		}
+		if err = f.Close(); err != nil {
+			return err
+		}
+		cmd.Env = append(cmd.Env,
+			"UPMERGE_CHANGED_COUNT="+strconv.Itoa(changes),
+			"UPMERGE_CHANGED_FILES="+f.Name(),
+			"UPMERGE_FAILED="+strconv.FormatBool(failed))
+	}
+	// Keep standard output for the actions.
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	return cmd.Run()
+}
+
+// runCycle merges paths (or everything, if nil) once, between the run hooks, and
+// reports how it went, for a run that carries on regardless.
+func runCycle(ctx context.Context, paths []string, hooks bool) []merge.Action {
+	if hooks && preRun != "" {
+		err := runHook(ctx, preRun, false, nil, false)
+		reportHook("pre-run", preRun, err)
+		if err != nil {
+			logError("%s: pre-run hook failed: %s", progName, err)
+			return nil
+		}
+	}
+	m.Paths = paths
+	actions, err := m.Run(ctx)
+	if hooks && postRun != "" {
+		hookErr := runHook(context.Background(), postRun, true, actions, err != nil)
+		reportHook("post-run", postRun, hookErr)
+		if hookErr != nil {
+			logError("%s: post-run hook failed: %s", progName, hookErr)
+		}
+	}
+	if err != nil {
+		reportErr(err, countChanges(actions))
+	}
+	return actions
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// sudoEnv are the environment variables kept for the run under sudo, which resets the
+// rest: the ones upmerge itself looks at.
+var sudoEnv = []string{"XDG_CONFIG_HOME", "UPMERGE_MERGETOOL", "SOURCE_DATE_EPOCH", "NO_COLOR", "TERM", "COLUMNS"}
+
+// sudoMarker is set for the run under sudo, so that it never tries again.
+const sudoMarker = "UPMERGE_SUDO"
+
+// askSudo asks whether to run again with sudo, when running interactively.
+func askSudo() bool {
+	fmt.Fprintf(tty, "%s is only writable by root; run with sudo? [y/N] ", m.DestDir)
+	line, err := ttyIn.ReadString('\n')
+	if err != nil {
+		return false
+	}
+	answer := strings.ToLower(strings.TrimSpace(line))
+	return answer == "y" || answer == "yes"
+}
+
+// runSudo runs upmerge again under sudo, with the same arguments, and exits with its
+// status. It only returns if it can't: when there's no terminal to ask for a password
+// on (as when run by cron), or if it's already running under sudo, and still not as
+// root.
+func runSudo() error {
+	if os.Getenv(sudoMarker) != "" {
+		return errors.New("still not running as root under sudo")
+	}
+	if !isTerminal(os.Stdin) {
+		return errors.New("not asking for a sudo password without a terminal")
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	env := append(os.Environ(), sudoMarker+"=1")
+	if os.Getenv("XDG_CONFIG_HOME") == "" {
+		// Root would read its own settings, rather than the user's.
+		if home, err := os.UserHomeDir(); err == nil {
+			env = append(env, "XDG_CONFIG_HOME="+filepath.Join(home, ".config"))
+		}
+	}
+	args := []string{"--preserve-env=" + strings.Join(append(sudoEnv, sudoMarker), ","), "--", self}
+	cmd := exec.Command("sudo", append(args, os.Args[1:]...)...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = env
+	err = cmd.Run()
+	code := exitOK
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if code = exitErr.ExitCode(); code < 0 {
+			// Killed by a signal.
+			code = exitInterrupted
+		}
+	} else if err != nil {
+		return err
+	}
+	// The run under sudo did everything, report and metrics included; these would
+	// only overwrite them.
+	for _, f := range logFiles {
+		f.Close()
+	}
+	os.Exit(code)
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/rollcat/upmerge/merge"
+)
+
+// summary counts what a run did, for the line printed at the end of it (or with -j,
+// the last object).
+type summary struct {
+	Kind      string `json:"action"`
+	Copied    int    `json:"copied"`
+	BackedUp  int    `json:"backedUp"`
+	Removed   int    `json:"removed,omitempty"`
+	Merged    int    `json:"merged,omitempty"`
+	Adopted   int    `json:"adopted,omitempty"`
+	Reverted  int    `json:"reverted,omitempty"`
+	Pruned    int    `json:"pruned,omitempty"`
+	Dirs      int    `json:"mkdir,omitempty"`
+	Chmod     int    `json:"chmod,omitempty"`
+	Unchanged int    `json:"unchanged"`
+	Ignored   int    `json:"ignored"`
+	Skipped   int    `json:"skipped,omitempty"`
+	Checks    int    `json:"check"`
+	Errors    int    `json:"errors"`
+	DryRun    bool   `json:"dryRun"`
+	// Protected lists the files left alone, as System Integrity Protection keeps
+	// them from being changed.
+	Protected []string `json:"protected,omitempty"`
+}
+
+// summarize counts actions, and the errors in err, the outcome of the run that took
+// them.
+func summarize(actions []merge.Action, err error) summary {
+	s := summary{Kind: "summary", Errors: countErrors(err), DryRun: m.DryRun}
+	for _, a := range actions {
+		switch a.Kind {
+		case merge.ActionCopy, merge.ActionSymlink, merge.ActionMknod:
+			s.Copied++
+		case merge.ActionMove, merge.ActionForceMove:
+			s.BackedUp++
+		case merge.ActionRemove:
+			s.Removed++
+		case merge.ActionMerged:
+			s.Merged++
+		case merge.ActionAdopt:
+			s.Adopted++
+		case merge.ActionRevert:
+			s.Reverted++
+		case merge.ActionPrune, merge.ActionClean:
+			s.Pruned++
+		case merge.ActionMkdir:
+			s.Dirs++
+		case merge.ActionChmod:
+			s.Chmod++
+		case merge.ActionOK, merge.ActionSkipOnce:
+			s.Unchanged++
+		case merge.ActionIgnore:
+			s.Ignored++
+		case merge.ActionSkip, merge.ActionCycle:
+			s.Skipped++
+		case merge.ActionCheck:
+			s.Checks++
+		case merge.ActionProtected:
+			if relative {
+				a = a.Relative()
+			}
+			s.Protected = append(s.Protected, a.Dest)
+		case merge.ActionTypeConflict:
+			if a.Backup == "" {
+				s.Skipped++
+			}
+		}
+	}
+	return s
+}
+
+// countErrors returns how many errors there are in err, not counting an interruption
+// or timeout.
+func countErrors(err error) int {
+	if err == nil {
+		return 0
+	}
+	errs := merge.MultiError{err}
+	if me, ok := err.(merge.MultiError); ok {
+		errs = me
+	}
+	n := 0
+	for _, err := range errs {
+		if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+			n++
+		}
+	}
+	return n
+}
+
+// String formats the summary as a single line. The counts that are usually zero are
+// left out when they are.
+func (s summary) String() string {
+	var parts []string
+	add := func(n int, what string, always bool) {
+		if n > 0 || always {
+			parts = append(parts, fmt.Sprintf("%d %s", n, what))
+		}
+	}
+	add(s.Dirs, "mkdir", false)
+	add(s.Copied, "copied", true)
+	add(s.Chmod, "chmod", false)
+	add(s.BackedUp, "backed up", true)
+	add(s.Removed, "removed", false)
+	add(s.Merged, "merged", false)
+	add(s.Adopted, "adopted", false)
+	add(s.Reverted, "reverted", false)
+	add(s.Pruned, "pruned", false)
+	add(s.Unchanged, "unchanged", true)
+	add(s.Ignored, "ignored", true)
+	add(s.Skipped, "skipped", false)
+	add(len(s.Protected), "protected", false)
+	add(s.Checks, "check", true)
+	add(s.Errors, "errors", true)
+	line := strings.Join(parts, ", ")
+	if s.DryRun {
+		line += " (dry run)"
+	}
+	return line
+}
+
+// printSummary reports what the run that took actions did, with err as its outcome
+// (only to the --log-file and --syslog, if told to be quiet).
+func printSummary(actions []merge.Action, err error) {
+	s := summarize(actions, err)
+	if quiet {
+		// It's still recorded in the --log-file and --syslog.
+		if sideLogger != nil {
+			sideLogger.Info(fmt.Sprintf("%s: %s", progName, s))
+		}
+		return
+	}
+	if jsonOut != nil {
+		jsonOut.Encode(s)
+	}
+	logInfo("%s: %s", progName, s)
+	for _, path := range s.Protected {
+		logInfo("%s: protected: %s", progName, path)
+	}
+}
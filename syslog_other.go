@@ -0,0 +1,13 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"errors"
+	"log/slog"
+)
+
+// newSyslogHandler fails: there's no syslog here.
+func newSyslogHandler(level slog.Leveler) (slog.Handler, error) {
+	return nil, errors.New("not supported on this system")
+}
@@ -0,0 +1,45 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"log/syslog"
+)
+
+// syslogHandler is a slog.Handler sending the message of every record to the local
+// syslog daemon, at the matching priority.
+type syslogHandler struct {
+	w     *syslog.Writer
+	level slog.Leveler
+}
+
+// newSyslogHandler connects to the local syslog daemon, logging records at level and
+// above.
+func newSyslogHandler(level slog.Leveler) (slog.Handler, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "upmerge")
+	if err != nil {
+		return nil, err
+	}
+	return syslogHandler{w, level}, nil
+}
+
+func (h syslogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h syslogHandler) Handle(ctx context.Context, r slog.Record) error {
+	switch {
+	case r.Level >= slog.LevelError:
+		return h.w.Err(r.Message)
+	case r.Level >= slog.LevelWarn:
+		return h.w.Warning(r.Message)
+	case r.Level >= slog.LevelInfo:
+		return h.w.Info(r.Message)
+	}
+	return h.w.Debug(r.Message)
+}
+
+func (h syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler { return h }
+func (h syslogHandler) WithGroup(name string) slog.Handler       { return h }
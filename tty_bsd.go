@@ -0,0 +1,8 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import "syscall"
+
+// ioctlGetTermios gets the terminal settings of a file, failing if it's not one.
+const ioctlGetTermios = syscall.TIOCGETA
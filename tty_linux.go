@@ -0,0 +1,6 @@
+package main
+
+import "syscall"
+
+// ioctlGetTermios gets the terminal settings of a file, failing if it's not one.
+const ioctlGetTermios = syscall.TCGETS
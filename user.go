@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rollcat/upmerge/merge"
+)
+
+var (
+	// userMode is set with --user, for managing the home directory.
+	userMode = false
+	// rootDir is the --root everything is written into.
+	rootDir = ""
+	// pairs are the source and destination directories given with --pair, merged one
+	// after the other.
+	pairs [][2]string
+)
+
+// userDefaults switches the settings that are still at their defaults to those for
+// --user: merging ~/.local/share/upmerge into the home directory, with the manifest,
+// the cache and the lock kept in ~/.local/state/upmerge (or wherever XDG_DATA_HOME and
+// XDG_STATE_HOME say). There's no need to be root.
+func userDefaults() {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		logError("%s: %s", progName, err)
+		exit(exitUsage)
+	}
+	data, state := os.Getenv("XDG_DATA_HOME"), os.Getenv("XDG_STATE_HOME")
+	if data == "" {
+		data = filepath.Join(home, ".local", "share")
+	}
+	if state == "" {
+		state = filepath.Join(home, ".local", "state")
+	}
+	state = filepath.Join(state, "upmerge")
+	if m.SrcDir == merge.DefaultSrcDir {
+		m.SrcDir = filepath.Join(data, "upmerge")
+	}
+	if m.DestDir == merge.DefaultDestDir {
+		m.DestDir = home
+	}
+	if m.ManifestPath == "" {
+		m.ManifestPath = filepath.Join(state, "manifest")
+	}
+	if m.CachePath == "" {
+		m.CachePath = filepath.Join(state, "cache")
+	}
+	if lockPath == "" {
+		lockPath = filepath.Join(state, "lock")
+	}
+	if journalDir == "" {
+		journalDir = filepath.Join(state, "journal")
+	}
+	if m.SnapshotDir == "" {
+		m.SnapshotDir = filepath.Join(state, "snapshots")
+	}
+	allowUnpriv = true
+}
+
+// parsePair parses the argument of --pair, "src:dest". A leading ~ in either stands for
+// the home directory.
+func parsePair(arg string) ([2]string, bool) {
+	src, dest, ok := strings.Cut(arg, ":")
+	if !ok || src == "" || dest == "" {
+		return [2]string{}, false
+	}
+	return [2]string{expandHome(src), expandHome(dest)}, true
+}
+
+// expandHome replaces a leading ~ in path with the home directory.
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~"+string(filepath.Separator)) {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[1:])
+}
+
+// runPairs merges each of the pairs in turn, returning the actions of all of them. A
+// pair that fails doesn't stop the rest, unless the run was interrupted; the errors
+// are returned together.
+func runPairs(ctx context.Context) ([]merge.Action, error) {
+	var actions []merge.Action
+	var errs merge.MultiError
+	manifestPath, cachePath := m.ManifestPath, m.CachePath
+	for _, p := range pairs {
+		m.SrcDir, m.DestDir = p[0], p[1]
+		m.ManifestPath, m.CachePath = pairPath(manifestPath, p[1]), pairPath(cachePath, p[1])
+		logDebug("PAIR:\t%s -> %s", m.SrcDir, m.DestDir)
+		a, err := runPair(ctx)
+		actions = append(actions, a...)
+		if me, ok := err.(merge.MultiError); ok {
+			errs = append(errs, me...)
+		} else if err != nil {
+			errs = append(errs, err)
+		}
+		if ctx.Err() != nil || errors.Is(err, merge.ErrQuit) {
+			break
+		}
+	}
+	if len(errs) == 0 {
+		return actions, nil
+	} else if len(errs) == 1 {
+		return actions, errs[0]
+	}
+	return actions, errs
+}
+
+// runPair merges m.SrcDir into m.DestDir, the way main does for a single pair.
+func runPair(ctx context.Context) ([]merge.Action, error) {
+	m.SrcFS = nil
+	if merge.IsArchive(m.SrcDir) {
+		fsys, err := merge.OpenArchive(m.SrcDir)
+		if err != nil {
+			return nil, err
+		}
+		m.SrcFS = fsys
+	}
+	if err := m.ResolveDirs(); err != nil {
+		return nil, err
+	}
+	if err := m.ValidateDirs(true); err != nil {
+		return nil, err
+	}
+	return m.Run(ctx)
+}
+
+// pairPath returns where to keep the manifest or cache at path for the pair merging
+// into dest: the same, if there's only one pair, or named after dest otherwise, since
+// each is only good for the directories it was made for.
+func pairPath(path, dest string) string {
+	if path == "" || len(pairs) < 2 {
+		return path
+	}
+	name, _ := filepath.Abs(dest)
+	if home, err := os.UserHomeDir(); err == nil {
+		if rel, err := filepath.Rel(home, name); err == nil && !strings.HasPrefix(rel, "..") {
+			name = rel
+		}
+	}
+	name = strings.Trim(strings.ReplaceAll(name, string(filepath.Separator), "-"), "-.")
+	if name == "" {
+		name = "home"
+	}
+	return path + "-" + name
+}
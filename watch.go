@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rollcat/upmerge/merge"
+)
+
+// watchInterval is how long the source must stay quiet, once --watch is told it
+// changed, before the changes are merged. Where it can't be told, that's how often the
+// source is looked at instead.
+const watchInterval = time.Second
+
+// srcKey names an entry in one of the source directories (0 for SrcDir, then the
+// Layers).
+type srcKey struct {
+	dir int
+	rel string
+}
+
+// srcEntry is what's compared to tell whether an entry in the source changed.
+type srcEntry struct {
+	mode    fs.FileMode
+	size    int64
+	modTime time.Time
+	target  string
+}
+
+// snapshotSrc returns every entry in the source directories. Version control metadata
+// is left out, since it changes along with anything done in the repository.
+func snapshotSrc() (map[srcKey]srcEntry, error) {
+	snap := make(map[srcKey]srcEntry)
+	for i, dir := range srcDirs() {
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() && d.Name() == ".git" {
+				return fs.SkipDir
+			}
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			st, err := d.Info()
+			if err != nil {
+				return err
+			}
+			e := srcEntry{mode: st.Mode()}
+			switch {
+			case st.IsDir():
+				// Its times change with its contents, which are compared anyway.
+			case st.Mode()&fs.ModeSymlink != 0:
+				if e.target, err = os.Readlink(path); err != nil {
+					return err
+				}
+			default:
+				e.size, e.modTime = st.Size(), st.ModTime()
+			}
+			snap[srcKey{i, rel}] = e
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return snap, nil
+}
+
+// srcDirs returns the source directories: SrcDir, then the Layers.
+func srcDirs() []string {
+	return append([]string{m.SrcDir}, m.Layers...)
+}
+
+// sameSnapshot returns true if nothing changed between the snapshots a and b.
+func sameSnapshot(a, b map[srcKey]srcEntry) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, e := range a {
+		if f, ok := b[k]; !ok || e != f {
+			return false
+		}
+	}
+	return true
+}
+
+// changedPaths compares the snapshots old and cur, and returns the paths to merge
+// (relative to the source) for what changed: none at all if nothing did, or nil for
+// everything. Anything inside a new directory is only merged along with it.
+func changedPaths(old, cur map[srcKey]srcEntry) (paths []string, changed bool) {
+	set := make(map[string]bool)
+	removed := false
+	add := func(k srcKey) {
+		if k.rel == "." || k.rel == merge.IgnoreFile {
+			// Everything is affected.
+			set["."] = true
+			return
+		}
+		set[targetName(k.rel)] = true
+	}
+	for k, e := range cur {
+		if f, ok := old[k]; !ok || e != f {
+			add(k)
+		}
+	}
+	for k := range old {
+		if _, ok := cur[k]; !ok {
+			// Merged if it's still in another layer.
+			removed = true
+			add(k)
+		}
+	}
+	if removed && m.Prune {
+		// Only a run over the whole source knows what's gone.
+		set["."] = true
+	}
+	if set["."] {
+		return nil, true
+	}
+	for rel := range set {
+		if !inSrc(cur, rel) {
+			continue
+		}
+		inside := false
+		for dir := filepath.Dir(rel); dir != "."; dir = filepath.Dir(dir) {
+			if set[dir] && inSrc(cur, dir) {
+				inside = true
+				break
+			}
+		}
+		if !inside {
+			paths = append(paths, rel)
+		}
+	}
+	sort.Strings(paths)
+	return paths, len(paths) > 0
+}
+
+// targetName returns the path in the destination that rel in the source is merged
+// into: a template or a fragment is merged into the file it's named after.
+func targetName(rel string) string {
+	if m.Templates {
+		rel = strings.TrimSuffix(rel, merge.TemplateSuffix)
+	}
+	if filepath.Base(rel) != merge.AppendSuffix {
+		rel = strings.TrimSuffix(rel, merge.AppendSuffix)
+	}
+	return rel
+}
+
+// inSrc returns true if any of the source directories in snap has rel, or its template
+// or fragment.
+func inSrc(snap map[srcKey]srcEntry, rel string) bool {
+	names := []string{rel, rel + merge.AppendSuffix}
+	if m.Templates {
+		names = append(names, rel+merge.TemplateSuffix, rel+merge.AppendSuffix+merge.TemplateSuffix)
+	}
+	for i := 0; i <= len(m.Layers); i++ {
+		for _, name := range names {
+			if _, ok := snap[srcKey{i, name}]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// addWatches has w watch every directory in snap, as the watches aren't recursive.
+func addWatches(w *fsnotify.Watcher, snap map[srcKey]srcEntry) error {
+	dirs := srcDirs()
+	for k, e := range snap {
+		if !e.mode.IsDir() {
+			continue
+		}
+		if err := w.Add(filepath.Join(dirs[k.dir], k.rel)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// watchSrc merges everything, then merges the paths that change in the source until
+// ctx is done, each time it settles down. Errors from single runs are reported, and
+// don't stop it. It's told of changes by the system (inotify, kqueue, and the like),
+// and only looks for them every watchInterval where it can't be.
+func watchSrc(ctx context.Context, hooks bool) error {
+	merged, err := snapshotSrc()
+	if err != nil {
+		return err
+	}
+	logInfo("WATCH:\t%s", m.SrcDir)
+	runCycle(ctx, nil, hooks)
+	w, err := fsnotify.NewWatcher()
+	if err == nil {
+		if err = addWatches(w, merged); err != nil {
+			w.Close()
+		}
+	}
+	if err != nil {
+		// Not supported here, or out of watches (such as inotify's max_user_watches).
+		logDebug("WATCH:\tlooking every %s: %s", watchInterval, err)
+		return pollSrc(ctx, merged, hooks)
+	}
+	defer w.Close()
+	settle := time.NewTimer(watchInterval)
+	wait := func() {
+		// Stopped and drained, so that Reset starts it afresh.
+		if !settle.Stop() {
+			select {
+			case <-settle.C:
+			default:
+			}
+		}
+		settle.Reset(watchInterval)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.Canceled) {
+				// Interrupted, as is the way to stop watching.
+				return nil
+			}
+			return ctx.Err()
+		case ev, ok := <-w.Events:
+			if !ok {
+				return pollSrc(ctx, merged, hooks)
+			}
+			if ev.Has(fsnotify.Create) {
+				// Watched right away, so that what's written into it keeps this waiting.
+				if st, err := os.Lstat(ev.Name); err == nil && st.IsDir() && st.Name() != ".git" {
+					w.Add(ev.Name)
+				}
+			}
+			wait()
+			continue
+		case err, ok := <-w.Errors:
+			if !ok {
+				return pollSrc(ctx, merged, hooks)
+			}
+			// Such as events lost to an overflow: comparing snapshots catches up.
+			logDebug("WATCH:\t%s", err)
+			wait()
+			continue
+		case <-settle.C:
+		}
+		cur, err := snapshotSrc()
+		if err != nil {
+			// Such as while a checkout replaces the source; look again later.
+			wait()
+			continue
+		}
+		// Anything created since (including a source directory put back in place)
+		// is watched from now on.
+		if err = addWatches(w, cur); err != nil {
+			logDebug("WATCH:\t%s", err)
+		}
+		paths, changed := changedPaths(merged, cur)
+		if !changed {
+			continue
+		}
+		merged = cur
+		logInfo("WATCH:\t%s", strings.Join(paths, " "))
+		runCycle(ctx, paths, hooks)
+	}
+}
+
+// pollSrc is watchSrc, once merged (a snapshot of the source) is merged, for where
+// the system can't tell of changes: it looks at the source every watchInterval.
+func pollSrc(ctx context.Context, merged map[srcKey]srcEntry, hooks bool) error {
+	last := merged
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.Canceled) {
+				return nil
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		cur, err := snapshotSrc()
+		if err != nil {
+			continue
+		}
+		if !sameSnapshot(cur, last) {
+			// Wait for it to settle down.
+			last = cur
+			continue
+		}
+		paths, changed := changedPaths(merged, cur)
+		if !changed {
+			continue
+		}
+		merged = cur
+		logInfo("WATCH:\t%s", strings.Join(paths, " "))
+		runCycle(ctx, paths, hooks)
+	}
+}